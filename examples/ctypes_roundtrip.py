@@ -0,0 +1,118 @@
+#!/usr/bin/env python3
+"""Drives the Awesome TLS library from Python through its C ABI (the awesome_tls_* functions).
+
+Build the library first:
+
+    cd src-go/server && go build -buildmode=c-shared -o build/libawesometls.so ./cmd
+
+Then run this script with the path of the library, and optionally a URL to send a request to:
+
+    python3 examples/ctypes_roundtrip.py src-go/server/build/libawesometls.so https://tls.peet.ws/api/all
+
+Without a URL, the request goes to a local HTTP server the script starts, so it works offline.
+It exits with a non-zero status if any step fails.
+"""
+
+import base64
+import ctypes
+import http.server
+import json
+import sys
+import threading
+
+
+class AwesomeTLS:
+    def __init__(self, path):
+        self.lib = ctypes.CDLL(path)
+        # Returned strings are declared as c_void_p rather than c_char_p, so they can be passed back to free_string.
+        for name in ("start_server", "save_settings", "send_request", "build_curl_command"):
+            function = getattr(self.lib, "awesome_tls_" + name)
+            function.argtypes = [ctypes.c_char_p]
+            function.restype = ctypes.c_void_p
+        for name in ("stop_server", "get_fingerprints", "get_version", "healthcheck"):
+            function = getattr(self.lib, "awesome_tls_" + name)
+            function.argtypes = []
+            function.restype = ctypes.c_void_p
+        self.lib.awesome_tls_free_string.argtypes = [ctypes.c_void_p]
+        self.lib.awesome_tls_free_string.restype = None
+
+    def call(self, name, *args):
+        """Calls awesome_tls_<name> with JSON arguments and returns its result, raising on errors."""
+        encoded = [json.dumps(arg).encode("utf-8") for arg in args]
+        pointer = getattr(self.lib, "awesome_tls_" + name)(*encoded)
+        try:
+            response = json.loads(ctypes.string_at(pointer).decode("utf-8"))
+        finally:
+            self.lib.awesome_tls_free_string(pointer)
+
+        if "Error" in response:
+            raise RuntimeError("%s: %s %s" % (name, response["Error"], response.get("SettingsErrors", "")))
+        return response.get("Result")
+
+
+class Handler(http.server.BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        response = json.dumps({"path": self.path, "headers": list(self.headers.keys()), "body": body.decode()}).encode()
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(response)))
+        self.end_headers()
+        self.wfile.write(response)
+
+    def log_message(self, *args):
+        pass
+
+
+def main():
+    if len(sys.argv) < 2:
+        sys.exit("usage: %s <library> [url]" % sys.argv[0])
+
+    tls = AwesomeTLS(sys.argv[1])
+    print("version:", tls.call("get_version"))
+
+    # Port 0 picks a free port. Saving the same address keeps the server on it.
+    address = "127.0.0.1:0"
+    started = tls.call("start_server", {"Address": address})
+    print("spoof server:", started["Address"])
+
+    tls.call("save_settings", {"SpoofProxyAddress": address, "Fingerprint": "chrome_133"})
+
+    if len(sys.argv) > 2:
+        url = sys.argv[2]
+        method, body = "GET", b""
+    else:
+        local = http.server.ThreadingHTTPServer(("127.0.0.1", 0), Handler)
+        threading.Thread(target=local.serve_forever, daemon=True).start()
+        url = "http://127.0.0.1:%d/echo" % local.server_address[1]
+        method, body = "POST", b"hello"
+
+    response = tls.call("send_request", {
+        "Method": method,
+        "Url": url,
+        "Headers": [
+            {"Name": "User-Agent", "Value": "awesome-tls-example"},
+            {"Name": "Accept", "Value": "*/*"},
+            {"Name": "Content-Type", "Value": "text/plain"},
+        ],
+        "Body": base64.b64encode(body).decode(),
+    })
+    content = base64.b64decode(response["Body"]).decode("utf-8", "replace")
+    print("status:", response["StatusCode"])
+    print(content[:1000])
+
+    health = tls.call("healthcheck")
+    tls.call("stop_server")
+
+    if response["StatusCode"] != 200:
+        sys.exit("request failed with status %d" % response["StatusCode"])
+    if len(sys.argv) == 2 and json.loads(content)["body"] != "hello":
+        sys.exit("unexpected response body")
+    if not health["Healthy"]:
+        sys.exit("health check failed: %s" % health["Checks"])
+
+    print("ok")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+const (
+	// defaultMaxClientConnections is the number of client connections served at the same time if
+	// Settings.MaxConcurrentRequests doesn't limit requests.
+	defaultMaxClientConnections = 1024
+
+	// clientConnectionsPerRequest is the number of client connections served per request of
+	// Settings.MaxConcurrentRequests, since clients keep connections open between their requests.
+	clientConnectionsPerRequest = 4
+
+	// minClientConnections is the minimum number of client connections served at the same time.
+	minClientConnections = 64
+)
+
+// clientConnections bounds the connections the spoof server, its listeners and the proxies serve at the same time,
+// and with them the goroutines and the memory that serving them takes, see limitConnections.
+var clientConnections = &connectionLimiter{slots: newSemaphore(defaultMaxClientConnections)}
+
+// connectionLimiter hands out the slots of the client connections. Connections that wait for their next request,
+// or that haven't sent their first one yet, cost a slot but no work: once the slots run out, the one that waited the
+// longest is closed to make room for each Accept waiting, like the idle timeout of a server would. Clients open a new
+// one when they need it.
+type connectionLimiter struct {
+	mutex sync.Mutex
+	slots semaphore
+
+	// idle are the connections of HTTP servers waiting for a request.
+	idle map[net.Conn]idleConn
+
+	// unserved counts the Accept calls waiting for a slot that found no idle connection to close. The next
+	// connections to become idle are closed for them, one each.
+	unserved int
+
+	// waiting counts the Accept calls waiting for a slot, see AdminStatus.QueuedConnections.
+	waiting atomic.Int64
+}
+
+// idleConn is when an idle connection started waiting for a request, and the semaphore its slot belongs to. Only
+// closing the connections whose slots belong to the current semaphore makes room for Accept once configure replaced
+// it.
+type idleConn struct {
+	since time.Time
+	slots semaphore
+}
+
+// connSlots returns the semaphore the slot of conn, a limitedConn or a TLS connection over one, belongs to, or nil if
+// it doesn't hold one.
+func connSlots(conn net.Conn) semaphore {
+	for {
+		switch c := conn.(type) {
+		case *limitedConn:
+			return c.slots
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// maxClientConnections returns the number of client connections to serve at the same time.
+func maxClientConnections(maxConcurrentRequests int) int {
+	if maxConcurrentRequests <= 0 {
+		return defaultMaxClientConnections
+	}
+	return max(maxConcurrentRequests*clientConnectionsPerRequest, minClientConnections)
+}
+
+// configure sizes the slots from Settings.MaxConcurrentRequests. Connections already holding a slot release it to
+// the semaphore they got it from, like requestLimiter.configure.
+func (l *connectionLimiter) configure(maxConcurrentRequests int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if slots := maxClientConnections(maxConcurrentRequests); slots != cap(l.slots) {
+		l.slots = newSemaphore(slots)
+	}
+}
+
+// acquire waits for a slot until done is closed, closing the connection that waited the longest for a request if
+// there's none. It returns the semaphore the slot belongs to, or nil if done was closed.
+func (l *connectionLimiter) acquire(done <-chan struct{}) semaphore {
+	l.mutex.Lock()
+	slots := l.slots
+	l.mutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return slots
+	default:
+	}
+
+	l.waiting.Add(1)
+	defer func() {
+		l.mutex.Lock()
+		l.unserved = min(l.unserved, int(l.waiting.Add(-1)))
+		l.mutex.Unlock()
+	}()
+
+	l.mutex.Lock()
+	oldest := l.takeOldestIdle(slots)
+	if oldest == nil {
+		l.unserved++
+	}
+	l.mutex.Unlock()
+	closeIdle(oldest)
+
+	select {
+	case slots <- struct{}{}:
+		return slots
+	case <-done:
+		return nil
+	}
+}
+
+// takeOldestIdle removes the connection that has waited for a request the longest among those holding a slot of
+// slots from the idle ones, and returns it, or nil if there's none. The mutex must be held.
+func (l *connectionLimiter) takeOldestIdle(slots semaphore) net.Conn {
+	var oldest net.Conn
+	for conn, idle := range l.idle {
+		if idle.slots == slots && (oldest == nil || idle.since.Before(l.idle[oldest].since)) {
+			oldest = conn
+		}
+	}
+	delete(l.idle, oldest)
+	return oldest
+}
+
+// closeIdle closes conn, an idle connection taken by takeOldestIdle, if it isn't nil.
+func closeIdle(conn net.Conn) {
+	if conn != nil {
+		connectionLog.Debug("client connections are at their limit, closing the oldest idle one", "address", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// connState records whether conn waits for a request, see trackConnState. When a connection finishes a request while
+// an Accept that found no idle connection to close waits for a slot, the oldest idle one is closed for it, which
+// gives its slot to a new client. The other connections stay open for their next request.
+func (l *connectionLimiter) connState(conn net.Conn, connState fhttp.ConnState) {
+	switch connState {
+	case fhttp.StateNew, fhttp.StateIdle:
+		l.mutex.Lock()
+		if l.idle == nil {
+			l.idle = make(map[net.Conn]idleConn)
+		}
+		l.idle[conn] = idleConn{since: time.Now(), slots: connSlots(conn)}
+		var oldest net.Conn
+		if connState == fhttp.StateIdle && l.unserved > 0 {
+			if oldest = l.takeOldestIdle(l.slots); oldest != nil {
+				l.unserved--
+			}
+		}
+		l.mutex.Unlock()
+		closeIdle(oldest)
+	default:
+		l.mutex.Lock()
+		delete(l.idle, conn)
+		l.mutex.Unlock()
+	}
+}
+
+// limitConnections returns listener, each of whose connections takes a slot of clientConnections until it's closed.
+// Accept waits for a slot before accepting a connection, so bursts of connections wait in the listen backlog
+// (and time out there if they wait too long) rather than in goroutines.
+func limitConnections(listener net.Listener) net.Listener {
+	return &limitedListener{Listener: listener, done: make(chan struct{})}
+}
+
+type limitedListener struct {
+	net.Listener
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	slots := clientConnections.acquire(l.done)
+	if slots == nil {
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, slots: slots}, nil
+}
+
+func (l *limitedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitedConn releases its slot of clientConnections once it's closed.
+type limitedConn struct {
+	net.Conn
+
+	releaseOnce sync.Once
+	slots       semaphore
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(func() { <-c.slots })
+	return err
+}
+
+func (c *limitedConn) ReadFrom(r io.Reader) (int64, error) {
+	return readFromConn(c.Conn, r)
+}
+
+func (c *limitedConn) WriteTo(w io.Writer) (int64, error) {
+	return writeToConn(c.Conn, w)
+}
+
+func (c *limitedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package server
+
+import (
+	"syscall"
+	"testing"
+)
+
+// skipUnlessFileDescriptors skips t if the process may not open n file descriptors.
+func skipUnlessFileDescriptors(t *testing.T, n uint64) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil || limit.Cur < n {
+		t.Skipf("needs %d file descriptors, the limit is %d", n, limit.Cur)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// closeRecorder is a connection holding a slot of slots that only records that it was closed, which doesn't release
+// the slot.
+type closeRecorder struct {
+	net.Conn
+	slots  semaphore
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) NetConn() net.Conn {
+	return &limitedConn{slots: c.slots}
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (c *closeRecorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestConnStateClosesOnlyTheOldestIdle(t *testing.T) {
+	l := &connectionLimiter{slots: newSemaphore(3)}
+	conns := make([]*closeRecorder, 3)
+	for i := range conns {
+		conns[i] = &closeRecorder{slots: l.acquire(nil)}
+		l.connState(conns[i], fhttp.StateNew)
+		l.connState(conns[i], fhttp.StateActive)
+	}
+
+	// Closing a recorder doesn't release its slot, so the Accept keeps waiting.
+	done := make(chan struct{})
+	acquired := make(chan semaphore)
+	go func() { acquired <- l.acquire(done) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		l.mutex.Lock()
+		unserved := l.unserved
+		l.mutex.Unlock()
+		if unserved == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Accept doesn't wait for a slot")
+		}
+	}
+
+	for _, conn := range conns {
+		l.connState(conn, fhttp.StateIdle)
+	}
+	if !conns[0].closed.Load() {
+		t.Error("the oldest idle connection wasn't closed for the waiting Accept")
+	}
+	for i, conn := range conns[1:] {
+		if conn.closed.Load() {
+			t.Errorf("idle connection %d was closed, though one Accept waits", i+1)
+		}
+	}
+
+	close(done)
+	if slots := <-acquired; slots != nil {
+		t.Error("Accept got a slot, no connection released one")
+	}
+	if l.unserved != 0 {
+		t.Errorf("%d Accept calls are still unserved once none waits", l.unserved)
+	}
+}
+
+func TestAcquireClosesOldestIdle(t *testing.T) {
+	l := &connectionLimiter{slots: newSemaphore(2)}
+	conns := make([]*closeRecorder, 2)
+	for i := range conns {
+		conns[i] = &closeRecorder{slots: l.acquire(nil)}
+		l.connState(conns[i], fhttp.StateNew)
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	l.acquire(done)
+
+	if !conns[0].closed.Load() || conns[1].closed.Load() {
+		t.Errorf("closed %v and %v, want only the first connection closed", conns[0].closed.Load(), conns[1].closed.Load())
+	}
+}
+
+func TestAcquireClosesIdleOfCurrentSlots(t *testing.T) {
+	l := &connectionLimiter{slots: newSemaphore(2)}
+	stale := &closeRecorder{slots: l.acquire(nil)}
+	l.connState(stale, fhttp.StateNew)
+	time.Sleep(time.Millisecond)
+
+	// The semaphore is replaced, as configure does. Closing the connection of the previous one wouldn't give Accept a
+	// slot.
+	l.slots = newSemaphore(1)
+	current := &closeRecorder{slots: l.acquire(nil)}
+	l.connState(current, fhttp.StateNew)
+
+	done := make(chan struct{})
+	close(done)
+	l.acquire(done)
+
+	if stale.closed.Load() || !current.closed.Load() {
+		t.Errorf("closed the stale connection: %v, the current one: %v, want only the current one closed", stale.closed.Load(), current.closed.Load())
+	}
+}
+
+// TestAcceptBurst opens 10k connections to the spoof server at once and checks that they're served with a bounded
+// number of goroutines and memory, while later requests still get through.
+func TestAcceptBurst(t *testing.T) {
+	const burst, dialers, maxConcurrentRequests = 10000, 100, 16
+	if testing.Short() {
+		t.Skip("opens 10k connections")
+	}
+	skipUnlessFileDescriptors(t, burst+1000)
+
+	saveTestSettings(t, fmt.Sprintf(`{"MaxConcurrentRequests":%d}`, maxConcurrentRequests))
+	spoofAddr := startSpoofServer(t)
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {})
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	var peakGoroutines atomic.Int64
+	sampled := make(chan struct{})
+	stopSampling := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if n := int64(runtime.NumGoroutine()); n > peakGoroutines.Load() {
+				peakGoroutines.Store(n)
+			}
+			select {
+			case <-stopSampling:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	// The connections are held open rather than dialed one after another, so they all compete for the slots.
+	var mutex sync.Mutex
+	open := make([]net.Conn, 0, burst)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range dialers {
+		wg.Go(func() {
+			dialer := &net.Dialer{Timeout: 10 * time.Second}
+			for next.Add(1) <= burst {
+				conn, err := dialer.Dial("tcp", spoofAddr)
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				open = append(open, conn)
+				mutex.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	var during runtime.MemStats
+	runtime.ReadMemStats(&during)
+	close(stopSampling)
+	<-sampled
+
+	if len(open) < burst/2 {
+		t.Errorf("only %d of %d connections were dialed", len(open), burst)
+	}
+	slots := int64(maxClientConnections(maxConcurrentRequests))
+	t.Logf("%d connections: goroutines grew by at most %d, the heap by %d KiB", len(open), peakGoroutines.Load()-int64(goroutines), (int64(during.HeapInuse)-int64(before.HeapInuse))>>10)
+	// Each connection being served takes a few goroutines, a few more linger while closed ones finish.
+	if grown, bound := peakGoroutines.Load()-int64(goroutines), 4*slots+dialers+50; grown > bound {
+		t.Errorf("goroutines grew by %d serving %d connections, want at most %d", grown, len(open), bound)
+	}
+	if grown := int64(during.HeapInuse) - int64(before.HeapInuse); grown > 64<<20 {
+		t.Errorf("heap grew by %d MiB serving %d connections, want at most 64 MiB", grown>>20, len(open))
+	}
+
+	for _, conn := range open {
+		conn.Close()
+	}
+	if res, body := spoofGet(t, origin, "/", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("request after the burst: got %d %q", res.StatusCode, body)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); runtime.NumGoroutine() > goroutines+50; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("%d goroutines are left after the burst, there were %d before", runtime.NumGoroutine(), goroutines)
+			break
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package server
+
+import "testing"
+
+// skipUnlessFileDescriptors skips t if the process may not open n file descriptors. Windows has no such limit on
+// sockets, only the memory they take.
+func skipUnlessFileDescriptors(t *testing.T, n uint64) {}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// admin serves the admin API on Settings.AdminAddress.
+// Like the control plane, it's independent of the spoof server, so it runs as soon as the address is set.
+var admin = &adminServer{}
+
+type adminServer struct {
+	mutex  sync.Mutex
+	addr   string
+	server *http.Server
+
+	// token is the token requests must send, see GetAdminToken. generated is the one used while AdminToken is empty.
+	token     atomic.Pointer[string]
+	generated string
+}
+
+// AdminStatus is the response of the /status route of the admin API.
+type AdminStatus struct {
+	Running       bool
+	UptimeSeconds int64
+
+	// ActiveConnections is the number of client connections to the spoof server, its listeners and the proxies.
+	ActiveConnections int64
+
+	// RequestsInFlight is the number of requests being handled, including the QueuedRequests.
+	RequestsInFlight int64
+
+	// QueuedRequests is the number of requests waiting for a slot of MaxConcurrentRequests or
+	// MaxConcurrentRequestsPerHost. If it stays above zero, the limits are what slows requests down.
+	QueuedRequests int64
+
+	// QueuedConnections is the number of listeners waiting for a client connection to close before accepting
+	// another one, see MaxConcurrentRequests. Meanwhile, new connections wait in the listen backlog.
+	QueuedConnections int64
+
+	// CacheEntries is the number of entries of each of the server's caches, by name, see CacheSettings.
+	CacheEntries map[string]int
+
+	// Panics counts the panics recovered since the server started, which failed only the request or connection
+	// that caused them. Their stacks are in the log.
+	Panics uint64
+
+	// CertificateExpiry is when the CA expires, nil if it wasn't created yet.
+	CertificateExpiry *CertificateExpiry
+
+	SpoofProxyAddress       string
+	InterceptProxyAddresses []string
+	ForwardProxyAddress     string
+	SocksProxyAddress       string
+	Listeners               []ListenerStatus
+}
+
+// activeConnections counts the client connections of the data plane, see AdminStatus.ActiveConnections.
+var activeConnections atomic.Int64
+
+// trackConnState is the ConnState hook that counts the connections of a server in activeConnections, and tells
+// clientConnections which ones wait for a request. Hijacked connections stop counting, since they're either closed or
+// handed to another server that counts them.
+func trackConnState(conn net.Conn, connState fhttp.ConnState) {
+	clientConnections.connState(conn, connState)
+	switch connState {
+	case fhttp.StateNew:
+		activeConnections.Add(1)
+	case fhttp.StateHijacked, fhttp.StateClosed:
+		activeConnections.Add(-1)
+	}
+}
+
+// sync moves the admin API to addr, or stops it if addr is empty. Token changes apply without rebinding.
+func (a *adminServer) sync(addr, token string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if addr != a.addr {
+		if err := a.listen(addr); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case addr == "":
+		a.generated = ""
+	case token == "":
+		// The generated token is kept until the admin API is disabled, so clients that read it once keep working.
+		if a.generated == "" {
+			a.generated = newAdminToken()
+			adminLog.Info("AdminToken is empty, using a generated token", "token", a.generated)
+		}
+		token = a.generated
+	}
+	a.token.Store(&token)
+
+	return nil
+}
+
+// listen moves the server to addr, or stops it if addr is empty. The caller must hold the mutex.
+func (a *adminServer) listen(addr string) error {
+	previous := a.server
+
+	a.server = nil
+	if addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			a.server = previous
+			return err
+		}
+		listener = supervise("admin API", addr, listener)
+
+		a.server = &http.Server{
+			Handler:           a.routes(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func(server *http.Server) {
+			defer recoverPanic(adminLog, "serve")
+
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				adminLog.Error("serve failed", "error", err)
+			}
+		}(a.server)
+	}
+	a.addr = addr
+
+	if previous != nil {
+		// Shutting down waits for the request in flight, which may be the one that moved the admin API.
+		go func() {
+			defer recoverPanic(adminLog, "shutdown")
+
+			if err := previous.Shutdown(context.Background()); err != nil {
+				adminLog.Warn("shutdown of the previous listener failed", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+func newAdminToken() string {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// GetAdminToken returns the token that requests to the admin API must send as `Authorization: Bearer <token>`.
+// It's AdminToken, or a random token generated when the admin API started if that's empty.
+// It returns an empty string if the admin API is disabled.
+func GetAdminToken() string {
+	if token := admin.token.Load(); token != nil {
+		return *token
+	}
+	return ""
+}
+
+func (a *adminServer) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		status := AdminStatus{
+			Running:                 spoof.running(),
+			ActiveConnections:       activeConnections.Load(),
+			RequestsInFlight:        requestsInFlight.Load(),
+			QueuedRequests:          limiter.queued.Load(),
+			QueuedConnections:       clientConnections.waiting.Load(),
+			CacheEntries:            cacheSizes(),
+			Panics:                  panicsRecovered.Load(),
+			CertificateExpiry:       getCertificateExpiry(),
+			SpoofProxyAddress:       GetListenAddress(),
+			InterceptProxyAddresses: GetInterceptListenAddresses(),
+			ForwardProxyAddress:     GetForwardProxyAddress(),
+			SocksProxyAddress:       GetSocksProxyAddress(),
+			Listeners:               GetListeners(),
+		}
+		if started := spoof.startTime(); !started.IsZero() {
+			status.UptimeSeconds = int64(time.Since(started).Seconds())
+		}
+		writeAdminJSON(w, http.StatusOK, status)
+	})
+
+	mux.HandleFunc("GET /settings", func(w http.ResponseWriter, req *http.Request) {
+		settings, _ := copySettings(state.Load().settings, false)
+		settings.SchemaVersion = SettingsSchemaVersion
+		writeAdminJSON(w, http.StatusOK, settings)
+	})
+
+	mux.HandleFunc("POST /settings", func(w http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var settingsErrs SettingsErrors
+		switch err = SaveSettings(string(data)); {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.As(err, &settingsErrs):
+			writeAdminJSON(w, http.StatusUnprocessableEntity, settingsErrs)
+		default:
+			writeAdminError(w, http.StatusInternalServerError, err)
+		}
+	})
+
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := reloadSettings(); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /fingerprints", func(w http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(w, http.StatusOK, GetCapturedFingerprints())
+	})
+
+	mux.HandleFunc("DELETE /fingerprints", func(w http.ResponseWriter, req *http.Request) {
+		ClearCapturedFingerprints()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /errors", func(w http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(w, http.StatusOK, GetRecentErrors())
+	})
+
+	mux.HandleFunc("DELETE /errors", func(w http.ResponseWriter, req *http.Request) {
+		ClearRecentErrors()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /logs", func(w http.ResponseWriter, req *http.Request) {
+		after, err := strconv.ParseUint(cmp.Or(req.URL.Query().Get("after"), "0"), 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("after must be the Sequence of a log record: %w", err))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, GetLogs(after))
+	})
+
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(w, http.StatusOK, GetConnectionStats())
+	})
+
+	mux.HandleFunc("GET /wire-captures/{id}", func(w http.ResponseWriter, req *http.Request) {
+		requestId, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("id must be the %s of a captured request: %w", RequestIdHeaderKey, err))
+			return
+		}
+		capture, err := GetWireCapture(requestId)
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, capture)
+	})
+
+	mux.HandleFunc("POST /clear-caches", func(w http.ResponseWriter, req *http.Request) {
+		state.Load().clearClients()
+		sourceAddresses.clear()
+		dnsCache.clear()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return a.authenticate(mux)
+}
+
+// authenticate rejects requests that don't send the admin token.
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		expected := a.token.Load()
+		if !ok || expected == nil || *expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	data, _ := json.Marshal(struct{ Error string }{err.Error()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// reloadSettings reads the environment variables again and reapplies the saved settings on top of them,
+// e.g. after an upstream proxy or a local address changed outside of Awesome TLS.
+func reloadSettings() error {
+	overrides, names, err := readEnvironment()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		settingsLog.Info("using environment variable", "name", name)
+	}
+
+	previous := environment.Swap(overrides)
+
+	sourceAddresses.clear()
+
+	if err = saveSettings(state.Load().saved, false); err != nil {
+		environment.Store(previous)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the caches in AdminStatus.CacheEntries and the cache label of the cache metrics.
+const (
+	cacheDns                     = "dns"
+	cacheInterceptedFingerprints = "intercepted_fingerprints"
+	cacheLeafCertificates        = "leaf_certificates"
+	cacheRequestConfigurations   = "request_configurations"
+	cacheClientHellos            = "client_hellos"
+	cacheWireCaptures            = "wire_captures"
+)
+
+var cacheNames = []string{cacheDns, cacheInterceptedFingerprints, cacheLeafCertificates, cacheRequestConfigurations, cacheClientHellos, cacheWireCaptures}
+
+// Reasons of the reason label of cache_evictions_total.
+const (
+	evictedCapacity = "capacity"
+	evictedExpired  = "expired"
+)
+
+// CacheSettings cap the number of entries of the server's caches, which otherwise grow with the hosts and the
+// configurations of the requests. Zero keeps the defaults. Settings.InterceptedFingerprintMaxEntries caps the
+// intercepted fingerprints, DnsCacheSettings.MaxEntries the addresses of hosts, and WireCaptureSettings.MaxEntries the
+// captured requests.
+type CacheSettings struct {
+	// LeafCertificates is the number of certificates the forward proxy keeps for the hosts it intercepts.
+	// Defaults to [DefaultMaxLeafCertificates].
+	LeafCertificates int
+
+	// RequestConfigurations is the number of request configurations kept parsed, see configCache.
+	// Defaults to [DefaultMaxRequestConfigurations].
+	RequestConfigurations int
+
+	// ClientHellos is the number of HexClientHello values kept compiled, see clientHelloTemplates.
+	// Defaults to [DefaultMaxClientHellos].
+	ClientHellos int
+}
+
+// effective returns the settings with their defaults filled in.
+func (settings CacheSettings) effective() CacheSettings {
+	if settings.LeafCertificates == 0 {
+		settings.LeafCertificates = DefaultMaxLeafCertificates
+	}
+	if settings.RequestConfigurations == 0 {
+		settings.RequestConfigurations = DefaultMaxRequestConfigurations
+	}
+	if settings.ClientHellos == 0 {
+		settings.ClientHellos = DefaultMaxClientHellos
+	}
+	return settings
+}
+
+// boundedCache is a map that keeps at most maxEntries entries, evicting the least recently used one to make room, and
+// forgets entries once their TTL passed. Getting and putting an entry cost the same however full it is.
+// It's safe for concurrent use.
+type boundedCache[K comparable, V any] struct {
+	// evictions are its counters of cache_evictions_total, by reason.
+	evictions map[string]prometheus.Counter
+
+	mutex      sync.Mutex
+	entries    map[K]*list.Element
+	recency    *list.List // front is most recently used, of *cacheEntry[K, V]
+	maxEntries int
+	ttl        time.Duration
+
+	// onEvict, if set, is called with the mutex held for the entries evicted to make room or because they expired.
+	// It must not use the cache.
+	onEvict func(key K, value V, reason string)
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key   K
+	value V
+
+	// expires is when the entry expires, or zero if it doesn't.
+	expires time.Time
+}
+
+// newBoundedCache creates a cache of maxEntries entries, whose entries expire after ttl, or never if it's zero.
+func newBoundedCache[K comparable, V any](name string, maxEntries int, ttl time.Duration) *boundedCache[K, V] {
+	return &boundedCache[K, V]{
+		evictions: map[string]prometheus.Counter{
+			evictedCapacity: cacheEvictions.WithLabelValues(name, evictedCapacity),
+			evictedExpired:  cacheEvictions.WithLabelValues(name, evictedExpired),
+		},
+		entries:    make(map[K]*list.Element),
+		recency:    list.New(),
+		maxEntries: max(maxEntries, 1),
+		ttl:        ttl,
+	}
+}
+
+// resize changes the maximum number of entries, evicting the least recently used ones beyond it.
+func (c *boundedCache[K, V]) resize(maxEntries int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.maxEntries = max(maxEntries, 1)
+	c.evict(c.maxEntries)
+}
+
+// get returns the value of key and marks it as the most recently used, unless it's missing or expired.
+func (c *boundedCache[K, V]) get(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.find(key)
+	if entry == nil {
+		var zero V
+		return zero, false
+	}
+	c.recency.MoveToFront(c.entries[key])
+	return entry.value, true
+}
+
+// peek returns the value of key like get, without marking it as used.
+func (c *boundedCache[K, V]) peek(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry := c.find(key); entry != nil {
+		return entry.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// find returns the entry of key, removing it if it expired. The caller must hold the mutex.
+func (c *boundedCache[K, V]) find(key K) *cacheEntry[K, V] {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry[K, V])
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element, evictedExpired)
+		return nil
+	}
+	return entry
+}
+
+// put stores value under key with the cache's TTL, replacing the previous value, and marks it as the most recently used.
+func (c *boundedCache[K, V]) put(key K, value V) {
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	c.putExpiring(key, value, expires)
+}
+
+// putExpiring is like put, with the entry expiring at expires instead, or never if it's zero.
+func (c *boundedCache[K, V]) putExpiring(key K, value V, expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &cacheEntry[K, V]{key: key, value: value, expires: expires}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.recency.MoveToFront(element)
+		return
+	}
+
+	c.evict(c.maxEntries - 1)
+	c.entries[key] = c.recency.PushFront(entry)
+}
+
+// evict removes the least recently used entries until there are at most n. The caller must hold the mutex.
+func (c *boundedCache[K, V]) evict(n int) {
+	for c.recency.Len() > n {
+		c.remove(c.recency.Back(), evictedCapacity)
+	}
+}
+
+// remove removes the entry of element, evicted for reason. The caller must hold the mutex.
+func (c *boundedCache[K, V]) remove(element *list.Element, reason string) {
+	entry := element.Value.(*cacheEntry[K, V])
+	c.recency.Remove(element)
+	delete(c.entries, entry.key)
+
+	c.evictions[reason].Inc()
+	if c.onEvict != nil {
+		c.onEvict(entry.key, entry.value, reason)
+	}
+}
+
+// delete removes key, and reports whether it was there. Deleted entries don't count as evicted.
+func (c *boundedCache[K, V]) delete(key K) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	c.recency.Remove(element)
+	delete(c.entries, key)
+	return true
+}
+
+// clear removes every entry. Like delete, it doesn't count them as evicted.
+func (c *boundedCache[K, V]) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	clear(c.entries)
+	c.recency.Init()
+}
+
+// len returns the number of entries, including the expired ones that weren't removed yet.
+func (c *boundedCache[K, V]) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.recency.Len()
+}
+
+// each calls f with the entries that haven't expired, from the most recently used, until it returns false.
+// f must not use the cache.
+func (c *boundedCache[K, V]) each(f func(key K, value V) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for element := c.recency.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry[K, V])
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			continue
+		}
+		if !f(entry.key, entry.value) {
+			return
+		}
+	}
+}
+
+// cacheSizes returns the number of entries of each cache, by name, see AdminStatus.CacheEntries.
+func cacheSizes() map[string]int {
+	sizes := map[string]int{
+		cacheDns:                     dnsCache.len(),
+		cacheInterceptedFingerprints: captures.len(),
+		cacheLeafCertificates:        leafCertificateCache.len(),
+		cacheClientHellos:            clientHelloTemplates.entries.len(),
+		cacheWireCaptures:            wireCaptures.entries.len(),
+	}
+	if current := state.Load(); current != nil {
+		sizes[cacheRequestConfigurations] = current.configs.entries.len()
+	}
+	return sizes
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	utls "github.com/bogdanfinn/utls"
+)
+
+func TestBoundedCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newBoundedCache[int, string]("test", 3, 0)
+	var evicted []string
+	c.onEvict = func(key int, value string, reason string) {
+		evicted = append(evicted, fmt.Sprintf("%d=%s %s", key, value, reason))
+	}
+
+	for i := range 3 {
+		c.put(i, strconv.Itoa(i))
+	}
+	c.get(0)
+	c.peek(1)
+	c.put(3, "3")
+
+	if _, ok := c.get(1); ok {
+		t.Error("the least recently used entry wasn't evicted, peek marked it as used")
+	}
+	for _, key := range []int{0, 2, 3} {
+		if value, ok := c.get(key); !ok || value != strconv.Itoa(key) {
+			t.Errorf("get(%d) = %q, %t", key, value, ok)
+		}
+	}
+	if want := []string{"1=1 capacity"}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+
+	c.put(2, "two")
+	c.resize(1)
+	if value, ok := c.get(2); c.len() != 1 || !ok || value != "two" {
+		t.Errorf("after resize(1): %d entries, get(2) = %q, %t", c.len(), value, ok)
+	}
+
+	if !c.delete(2) || c.delete(2) || c.len() != 0 {
+		t.Error("delete didn't remove the entry exactly once")
+	}
+	if len(evicted) != 3 {
+		t.Errorf("evicted %v, deleting shouldn't count", evicted)
+	}
+}
+
+func TestBoundedCacheExpires(t *testing.T) {
+	c := newBoundedCache[string, int]("test", 10, time.Hour)
+	var reasons []string
+	c.onEvict = func(key string, value int, reason string) { reasons = append(reasons, key+" "+reason) }
+
+	c.put("fresh", 1)
+	c.putExpiring("expired", 2, time.Now().Add(-time.Second))
+	c.putExpiring("forever", 3, time.Time{})
+
+	var keys []string
+	c.each(func(key string, value int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if want := []string{"forever", "fresh"}; !slices.Equal(keys, want) {
+		t.Errorf("each visited %v, want %v", keys, want)
+	}
+	if c.len() != 3 {
+		t.Errorf("len() = %d, want 3 until the expired entry is removed", c.len())
+	}
+	if _, ok := c.get("expired"); ok {
+		t.Error("got the expired entry")
+	}
+	if want := []string{"expired expired"}; !slices.Equal(reasons, want) || c.len() != 2 {
+		t.Errorf("evicted %v with %d entries left, want %v with 2", reasons, c.len(), want)
+	}
+
+	c.clear()
+	if c.len() != 0 || len(reasons) != 1 {
+		t.Errorf("clear left %d entries and evicted %v", c.len(), reasons)
+	}
+}
+
+// BenchmarkBoundedCache measures get and put, from concurrent goroutines, in caches filled up to their cap. The cost
+// per operation doesn't grow with the cap, apart from the memory caches missing more in the largest.
+func BenchmarkBoundedCache(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 14, 1 << 18} {
+		c := newBoundedCache[int, int]("benchmark", size, 0)
+		for i := range size {
+			c.put(i, i)
+		}
+
+		b.Run(fmt.Sprintf("get/%d", size), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.get(i % size)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("put/%d", size), func(b *testing.B) {
+			// New keys evict one entry each.
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.put(size+i, i)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("mixed/%d", size), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if i%4 == 0 {
+						c.put(i%(2*size), i)
+					} else {
+						c.get(i % (2 * size))
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestCachesConcurrently uses every cache from concurrent goroutines while the settings change their caps, which the
+// race detector reports if any of them isn't safe for concurrent use, and checks they stay within their caps.
+func TestCachesConcurrently(t *testing.T) {
+	const limitedCaps = `{"InterceptedFingerprintMaxEntries":8,"DnsCache":{"MaxEntries":8},"WireCapture":{"MaxEntries":8},` +
+		`"Caches":{"LeafCertificates":8,"RequestConfigurations":8,"ClientHellos":4}}`
+	saveTestSettings(t, limitedCaps)
+	t.Cleanup(ClearCapturedFingerprints)
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {})
+
+	ca, caKey, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves, err := newLeafCertificates(ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []utls.ClientHelloID{utls.HelloChrome_131, utls.HelloFirefox_120, utls.HelloSafari_16_0}
+	clientHello, err := buildClientHello(ids[0], "cache.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseClientHello(clientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hellos := make([]HexClientHello, 8)
+	for i := range hellos {
+		hellos[i] = testClientHello(t, ids[i%len(ids)], fmt.Sprintf("%d.cache.test", i))
+	}
+
+	const rounds = 200
+	consumers := map[string]func(i int){
+		cacheDns: func(i int) {
+			dnsCache.lookup(context.Background(), "ip4", "localhost")
+			if i%50 == 0 {
+				ClearDnsCache()
+			}
+		},
+		cacheInterceptedFingerprints: func(i int) {
+			captures.put(newCapturedFingerprint(fmt.Sprintf("%d.cache.test", i%16), "443", info, clientHello))
+			captures.lookup(fmt.Sprintf("%d.cache.test", i%16), "8443", wildcardCapture)
+			GetCapturedFingerprints()
+			if i%20 == 0 {
+				DeleteCapturedFingerprint(captureKey(fmt.Sprintf("%d.cache.test", i%16), "443"))
+			}
+		},
+		cacheLeafCertificates: func(i int) {
+			if _, err := leaves.get(fmt.Sprintf("%d.cache.test", i%16)); err != nil {
+				t.Error(err)
+			}
+			getCertificateExpiry()
+		},
+		cacheRequestConfigurations: func(i int) {
+			if _, err := state.Load().configs.parse("", fmt.Sprintf(`{"Host":"%d.cache.test"}`, i%16), TransportConfig{}); err != nil {
+				t.Error(err)
+			}
+		},
+		cacheClientHellos: func(i int) {
+			if _, err := clientHelloTemplates.compile(hellos[i%len(hellos)], ""); err != nil {
+				t.Error(err)
+			}
+		},
+		cacheWireCaptures: func(i int) {
+			res, _ := spoofGet(t, origin, "/", map[string]any{"Capture": true})
+			if requestId, err := strconv.ParseUint(res.Header.Get(RequestIdHeaderKey), 10, 64); err != nil {
+				t.Error("response has no request ID")
+			} else {
+				GetWireCapture(requestId)
+			}
+		},
+	}
+
+	var wg sync.WaitGroup
+	for name, consume := range consumers {
+		wg.Go(func() {
+			for i := range rounds {
+				consume(i)
+				if t.Failed() {
+					t.Logf("%s failed in round %d", name, i)
+					return
+				}
+			}
+		})
+	}
+	stop := make(chan struct{})
+	var resized sync.WaitGroup
+	resized.Go(func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			settings := limitedCaps
+			if i%2 == 1 {
+				settings = testSettings
+			}
+			if err := SaveSettings(settings); err != nil {
+				t.Error(err)
+			}
+			cacheSizes()
+			time.Sleep(time.Millisecond)
+		}
+	})
+	wg.Wait()
+	close(stop)
+	resized.Wait()
+
+	if err := SaveSettings(limitedCaps); err != nil {
+		t.Fatal(err)
+	}
+	caps := map[string]int{
+		cacheDns: 8, cacheInterceptedFingerprints: 8, cacheLeafCertificates: 8,
+		cacheRequestConfigurations: 8, cacheClientHellos: 4, cacheWireCaptures: 8,
+	}
+	sizes := cacheSizes()
+	for _, name := range cacheNames {
+		if size, ok := sizes[name]; !ok || size > caps[name] {
+			t.Errorf("cache %s has %d entries (reported: %t), want at most %d", name, size, ok, caps[name])
+		}
+	}
+}
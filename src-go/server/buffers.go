@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// relayBufferSize is the size of the buffers that tunnels copy data with.
+	relayBufferSize = 32 << 10
+
+	// maxPooledBodyBytes is the capacity up to which body buffers go back to bodyBuffers. Larger ones (from large
+	// responses) are left to the garbage collector, so the pool doesn't pin their memory.
+	maxPooledBodyBytes = 1 << 20
+
+	// maxPooledScratchBytes is the capacity up to which scratch buffers go back to scratchBuffers.
+	maxPooledScratchBytes = 64 << 10
+)
+
+// relayBuffers, bodyBuffers and scratchBuffers save allocating a buffer for each request or tunnel.
+// They hold pointers, so putting a buffer back doesn't allocate either. A buffer must not be used once it's put back,
+// so it's only put back by whoever got it, once nothing refers to its contents anymore.
+var (
+	relayBuffers = sync.Pool{New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	}}
+
+	bodyBuffers = sync.Pool{New: func() any {
+		return new(bytes.Buffer)
+	}}
+
+	scratchBuffers = sync.Pool{New: func() any {
+		buf := make([]byte, 0, 4<<10)
+		return &buf
+	}}
+)
+
+// copyBuffered copies src to dst like io.Copy, with a buffer from relayBuffers. Like io.Copy, it leaves the copy to
+// src's WriteTo or dst's ReadFrom if they have one, which on Linux splice the data between TCP connections in the
+// kernel rather than copying it through the buffer. Wrappers of the connections of tunnels keep that working by
+// forwarding both to the connection they wrap, see readFromConn and writeToConn.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// readFromConn copies r to conn with the ReadFrom of conn if it has one, for the ReadFrom of a wrapper of conn.
+func readFromConn(conn net.Conn, r io.Reader) (int64, error) {
+	if readerFrom, ok := conn.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(r)
+	}
+	return copyBuffered(struct{ io.Writer }{conn}, r)
+}
+
+// writeToConn copies conn to w with the WriteTo of conn if it has one, for the WriteTo of a wrapper of conn.
+func writeToConn(conn net.Conn, w io.Writer) (int64, error) {
+	if writerTo, ok := conn.(io.WriterTo); ok {
+		return writerTo.WriteTo(w)
+	}
+	return copyBuffered(w, struct{ io.Reader }{conn})
+}
+
+// getBodyBuffer returns an empty buffer from bodyBuffers, see putBodyBuffer.
+func getBodyBuffer() *bytes.Buffer {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBodyBuffer puts buf back into bodyBuffers, unless it grew too large.
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBodyBytes {
+		bodyBuffers.Put(buf)
+	}
+}
+
+// withScratch calls fn with a copy of data in a buffer from scratchBuffers, which fn must not keep.
+func withScratch(data string, fn func([]byte) error) error {
+	buf := scratchBuffers.Get().(*[]byte)
+	*buf = append((*buf)[:0], data...)
+	defer func() {
+		if cap(*buf) <= maxPooledScratchBytes {
+			scratchBuffers.Put(buf)
+		}
+	}()
+
+	return fn(*buf)
+}
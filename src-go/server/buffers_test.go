@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// patternBody returns size bytes that repeat the number i, so bodies of different requests tell apart.
+func patternBody(i, size int) string {
+	pattern := fmt.Sprintf("[%d]", i)
+	return strings.Repeat(pattern, size/len(pattern)+1)[:size]
+}
+
+func TestPutBodyBufferDropsLargeBuffers(t *testing.T) {
+	buf := getBodyBuffer()
+	buf.Grow(maxPooledBodyBytes + 1)
+	putBodyBuffer(buf)
+
+	// The pool may drop any buffer, so only a large one coming back is a failure.
+	for range 100 {
+		if got := getBodyBuffer(); got == buf {
+			t.Fatalf("a buffer of %d bytes went back to the pool, the most is %d", buf.Cap(), maxPooledBodyBytes)
+		}
+	}
+}
+
+// TestPooledBuffersAreNotShared sends requests whose responses are read into pooled buffers from concurrent
+// goroutines, while they're recorded, mirrored and captured. The race detector reports a buffer that's reused while
+// something still refers to it, and so does a response, HAR entry or capture that holds another request's body.
+func TestPooledBuffersAreNotShared(t *testing.T) {
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		var i, size int
+		fmt.Sscanf(req.URL.Path, "/%d/%d", &i, &size)
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != patternBody(i, len(body)) {
+			http.Error(w, "mixed up request body", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, patternBody(i, size))
+	})
+	mirrored := t.TempDir()
+	saveTestSettings(t, fmt.Sprintf(`{"Mirror":{"Sink":"directory","Address":%q}}`, mirrored))
+	if err := StartRecording(""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopRecording)
+
+	// Sizes around relayBufferSize and the pooling limits, so buffers are both reused and dropped.
+	sizes := []int{0, 100, relayBufferSize + 1, maxPooledScratchBytes + 1, maxPooledBodyBytes + 1}
+	const requests = 100
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Go(func() {
+			size := sizes[i%len(sizes)]
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://spoof/%d/%d", i, size), strings.NewReader(patternBody(i, 1000+i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res, body := spoofRequest(t, req, origin, map[string]any{"Capture": i%2 == 0})
+			if res.StatusCode != http.StatusOK || body != patternBody(i, size) {
+				t.Errorf("request %d: got %d with %d bytes %.40q, want %d bytes of its own", i, res.StatusCode, len(body), body, size)
+			}
+		})
+	}
+	wg.Wait()
+
+	har, err := ExportHar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log struct {
+		Log struct {
+			Entries []struct {
+				Request  struct{ Url string }
+				Response struct{ Content struct{ Text string } }
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(har), &log); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.Log.Entries) != requests {
+		t.Errorf("recorded %d entries, want %d", len(log.Log.Entries), requests)
+	}
+	for _, entry := range log.Log.Entries {
+		u, err := url.Parse(entry.Request.Url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var i, size int
+		fmt.Sscanf(u.Path, "/%d/%d", &i, &size)
+		if text := entry.Response.Content.Text; text != "" && !strings.HasPrefix(patternBody(i, size), text) {
+			t.Errorf("HAR entry of %s has another response body: %.40q", entry.Request.Url, text)
+		}
+	}
+}
+
+// BenchmarkBuffers reports the allocations of what the pools serve: relaying a tunnel's data, reading a response body
+// and parsing a configuration.
+func BenchmarkBuffers(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 64<<10)
+
+	b.Run("relay", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			// Neither side has ReadFrom or WriteTo, so the data goes through the pooled buffer.
+			copyBuffered(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{bytes.NewReader(body)})
+		}
+	})
+	b.Run("response body", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				buf := getBodyBuffer()
+				buf.ReadFrom(bytes.NewReader(body))
+				putBodyBuffer(buf)
+			}
+		})
+	})
+	b.Run("configuration", func(b *testing.B) {
+		data := `{"Host":"buffers.test:443","Fingerprint":"chrome_131","HeaderOrder":["host","user-agent","accept"]}`
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := ParseTransportConfig(data, TransportConfig{}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	fhttptrace "github.com/bogdanfinn/fhttp/httptrace"
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+// requestDoer sends a request from Burp to its destination, see transportState.clientFor and transportState.bypassClientFor.
+type requestDoer interface {
+	Do(req *fhttp.Request) (*fhttp.Response, error)
+}
+
+// matchBypassHost reports whether host matches one of the patterns of Settings.BypassHosts.
+// Besides the patterns of matchHostPattern, a pattern can be a CIDR range (e.g. `10.0.0.0/8`) that matches IP literals.
+func matchBypassHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(pattern))
+			if ip := net.ParseIP(host); err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassClient sends requests with Go's own HTTP stack and TLS configuration, without a spoofed fingerprint.
+// Requests are sent as they are, so the response body (e.g. its Content-Encoding) is returned untouched as well.
+type bypassClient struct {
+	transport *http.Transport
+	timeout   time.Duration
+}
+
+func newBypassClient(config *TransportConfig) (*bypassClient, error) {
+	var proxyURL *url.URL
+	if config.ExternalProxyUrl != "" {
+		var err error
+		if proxyURL, err = parseUpstreamProxyUrl(config.ExternalProxyUrl); err != nil {
+			return nil, err
+		}
+	}
+
+	return &bypassClient{
+		transport: &http.Transport{
+			// The stageDialer also dials through the upstream proxy, the same way requests with a fingerprint do.
+			DialContext:       (&stageDialer{proxyURL: proxyURL, localAddress: config.LocalAddress, fingerprint: "bypass"}).DialContext,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+			// Like NewClient, see PrewarmSettings.Connections.
+			MaxIdleConnsPerHost: maxPrewarmConnections,
+		},
+		timeout: time.Duration(cmp.Or(config.HttpTimeout, tls_client.DefaultTimeoutSeconds)) * time.Second,
+	}, nil
+}
+
+// Do sends req without following redirects.
+func (c *bypassClient) Do(req *fhttp.Request) (*fhttp.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+
+	body := req.Body
+	if req.ContentLength == 0 {
+		body = http.NoBody
+	}
+
+	// The stages are tracked the same way as for requests with a fingerprint, see withStageTimer.
+	if t := stageTimerFrom(ctx); t != nil {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				t.gotConn(info.Conn, info.Reused)
+			},
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				if info.Err == nil {
+					t.enter(stageResponseHeader)
+				}
+			},
+		})
+	}
+	// The trace of req is one of fhttp, which net/http doesn't know about. Only its GotConn is passed on, see
+	// prewarmBarrier.
+	if trace := fhttptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				trace.GotConn(fhttptrace.GotConnInfo{Conn: info.Conn, Reused: info.Reused, WasIdle: info.WasIdle, IdleTime: info.IdleTime})
+			},
+		})
+	}
+
+	outReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL.String(), body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	outReq.Host = req.Host
+	outReq.ContentLength = req.ContentLength
+	for name, values := range req.Header {
+		if name != fhttp.HeaderOrderKey && name != fhttp.PHeaderOrderKey {
+			outReq.Header[name] = values
+		}
+	}
+
+	res, err := c.transport.RoundTrip(outReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &fhttp.Response{
+		Status:        res.Status,
+		StatusCode:    res.StatusCode,
+		Proto:         res.Proto,
+		ProtoMajor:    res.ProtoMajor,
+		ProtoMinor:    res.ProtoMinor,
+		Header:        fhttp.Header(res.Header),
+		Body:          &cancelOnClose{ReadCloser: res.Body, cancel: cancel},
+		ContentLength: res.ContentLength,
+		Request:       req,
+	}, nil
+}
+
+func (c *bypassClient) CloseIdleConnections() {
+	c.transport.CloseIdleConnections()
+}
+
+// cancelOnClose is a response body that cancels the request's context once it's closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CapturedFingerprintDocumentVersion is the version of the document format used by ExportCapturedFingerprint.
+// It's incremented whenever the format changes in a way older versions can't import.
+const CapturedFingerprintDocumentVersion = 1
+
+// CapturedFingerprintDocument is a self-contained copy of a captured fingerprint,
+// used to move captures between machines (see ExportCapturedFingerprint and ImportCapturedFingerprint).
+type CapturedFingerprintDocument struct {
+	Version int
+
+	Host       string
+	SNI        string
+	Port       string
+	CapturedAt time.Time
+
+	HexClientHello   HexClientHello
+	RetryClientHello HexClientHello
+
+	// HTTP/2 SETTINGS and header order of the client, if they were captured. Requests replaying the fingerprint send
+	// the SETTINGS in their order, and their headers in HeaderOrder, whose pseudo-headers (like ":method") order the
+	// ones of HTTP/2 requests.
+	H2Settings  []H2Setting
+	HeaderOrder []string
+
+	// Informational only, these are recomputed from the ClientHellos on import.
+	JA3     string
+	JA3Hash string
+	JA4     string
+	ALPN    []string
+
+	Opaque bool
+}
+
+// H2Setting is a single setting of an HTTP/2 SETTINGS frame.
+type H2Setting struct {
+	ID    uint16
+	Value uint32
+}
+
+// ExportCapturedFingerprint returns the captured fingerprint for host as a JSON document.
+// host is either a capture key (`name:port`) or a server name, in which case its most recent capture is exported.
+func ExportCapturedFingerprint(host string) (string, error) {
+	fingerprint := captures.get(host)
+	if fingerprint == nil {
+		return "", fmt.Errorf("no captured fingerprint for '%s'", host)
+	}
+
+	data, err := json.Marshal(newCapturedFingerprintDocument(fingerprint))
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func newCapturedFingerprintDocument(fingerprint *capturedFingerprint) CapturedFingerprintDocument {
+	return CapturedFingerprintDocument{
+		Version:          CapturedFingerprintDocumentVersion,
+		Host:             fingerprint.Host,
+		SNI:              fingerprint.SNI,
+		Port:             fingerprint.Port,
+		CapturedAt:       fingerprint.CapturedAt,
+		HexClientHello:   fingerprint.HexClientHello,
+		RetryClientHello: fingerprint.RetryClientHello,
+		H2Settings:       fingerprint.H2Settings,
+		HeaderOrder:      fingerprint.HeaderOrder,
+		JA3:              fingerprint.JA3,
+		JA3Hash:          fingerprint.JA3Hash,
+		JA4:              fingerprint.JA4,
+		ALPN:             fingerprint.ALPN,
+		Opaque:           fingerprint.Opaque,
+	}
+}
+
+// ImportCapturedFingerprint installs a document created by ExportCapturedFingerprint into the fingerprint store,
+// replacing any fingerprint captured under the same key.
+func ImportCapturedFingerprint(document string) error {
+	if strings.TrimSpace(document) == "" {
+		return errors.New("missing captured fingerprint document")
+	}
+
+	var doc CapturedFingerprintDocument
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return err
+	}
+
+	return importCapturedFingerprintDocument(doc)
+}
+
+func importCapturedFingerprintDocument(doc CapturedFingerprintDocument) error {
+	switch {
+	case doc.Version == 0:
+		return errors.New("captured fingerprint document has no version")
+	case doc.Version > CapturedFingerprintDocumentVersion:
+		return fmt.Errorf("unsupported captured fingerprint document version %d (supported up to %d)", doc.Version, CapturedFingerprintDocumentVersion)
+	case doc.Port == "":
+		return errors.New("captured fingerprint document has no port")
+	}
+
+	info, clientHello, err := decodeCapturedClientHello(doc.HexClientHello)
+	if err != nil {
+		return fmt.Errorf("invalid HexClientHello: %w", err)
+	}
+
+	fingerprint := newCapturedFingerprint(doc.Host, doc.Port, info, clientHello)
+	fingerprint.SNI = doc.SNI
+	fingerprint.CapturedAt = doc.CapturedAt
+	fingerprint.H2Settings = doc.H2Settings
+	fingerprint.HeaderOrder = doc.HeaderOrder
+	fingerprint.Opaque = doc.Opaque
+
+	if doc.RetryClientHello != "" {
+		retryInfo, retry, err := decodeCapturedClientHello(doc.RetryClientHello)
+		if err != nil {
+			return fmt.Errorf("invalid RetryClientHello: %w", err)
+		}
+		fingerprint.setRetry(retryInfo, retry)
+	}
+
+	if fingerprint.name() == "" {
+		return errors.New("captured fingerprint document has neither a host nor an SNI")
+	}
+
+	captures.put(fingerprint)
+
+	return nil
+}
+
+// decodeCapturedClientHello validates a ClientHello the same way as when it's used as TransportConfig.HexClientHello.
+func decodeCapturedClientHello(hexClientHello HexClientHello) (*clientHelloInfo, []byte, error) {
+	if _, err := hexClientHello.ToClientHelloSpec(); err != nil {
+		return nil, nil, err
+	}
+
+	clientHello, err := hex.DecodeString(string(hexClientHello))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := parseClientHello(clientHello)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return info, clientHello, nil
+}
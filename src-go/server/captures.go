@@ -0,0 +1,401 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captures holds the fingerprints intercepted by the intercept proxy.
+// It outlives the intercept proxy itself, so captures survive toggling UseInterceptedFingerprint.
+var captures = newFingerprintStore()
+
+const (
+	// DefaultInterceptedFingerprintMaxAge is the default number of seconds after which a captured fingerprint is considered stale.
+	DefaultInterceptedFingerprintMaxAge = 7 * 24 * 60 * 60
+
+	// DefaultInterceptedFingerprintMaxEntries is the default maximum number of captured fingerprints to keep.
+	DefaultInterceptedFingerprintMaxEntries = 1000
+)
+
+// wildcardCapture can be configured as TransportConfig.InterceptedFingerprintDefault to fall back to the most recent capture.
+const wildcardCapture = "*"
+
+// capturedFingerprint is a ClientHello that was intercepted from a real client.
+type capturedFingerprint struct {
+	// Host the client connected to (as specified in its CONNECT request).
+	Host string
+
+	// Server name indication sent by the client.
+	SNI string
+
+	// Destination port the client connected to (as specified in its CONNECT request).
+	Port string
+
+	// Time at which the ClientHello was intercepted.
+	CapturedAt time.Time
+
+	// The intercepted ClientHello record.
+	HexClientHello HexClientHello
+
+	// Fingerprints of the intercepted ClientHello, computed once at capture time.
+	JA3     string
+	JA3Hash string
+	JA4     string
+
+	// ALPN protocols offered in the intercepted ClientHello.
+	ALPN []string
+
+	// The ClientHello the client sent after the server answered with a HelloRetryRequest, if it did.
+	// Outbound connections send one with its extensions if the server they connect to asks for a retry too, with the
+	// key share and cookie that server asked for.
+	RetryClientHello HexClientHello
+	RetryJA3Hash     string
+	RetryJA4         string
+
+	// HTTP/2 SETTINGS and header order of the client. The intercept proxy doesn't observe these, but fingerprints
+	// imported from other machines may have them, and requests replaying those send them too (see useCapture).
+	H2Settings  []H2Setting
+	HeaderOrder []string
+
+	// Whether the client didn't speak HTTP, so the connection was tunneled (or rejected) instead of relayed to Burp.
+	Opaque bool
+
+	// Number of outbound requests that used this fingerprint.
+	uses atomic.Int64
+}
+
+// name returns the server name the fingerprint was captured for.
+// This is the SNI, unless the client didn't send one (e.g. when it connected to an IP literal).
+func (f *capturedFingerprint) name() string {
+	if f.SNI != "" {
+		return f.SNI
+	}
+	return f.Host
+}
+
+// setRetry records the ClientHello sent after a HelloRetryRequest.
+func (f *capturedFingerprint) setRetry(info *clientHelloInfo, clientHello []byte) {
+	f.RetryClientHello = HexClientHello(hex.EncodeToString(clientHello))
+	f.RetryJA3Hash = info.JA3Hash()
+	f.RetryJA4 = info.JA4()
+}
+
+// isStale reports whether the fingerprint was captured longer than maxAge ago.
+// A maxAge of zero or less means fingerprints never go stale.
+func (f *capturedFingerprint) isStale(maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(f.CapturedAt) > maxAge
+}
+
+// key returns the key under which the fingerprint is stored.
+func (f *capturedFingerprint) key() string {
+	return captureKey(f.name(), f.Port)
+}
+
+func captureKey(name, port string) string {
+	return net.JoinHostPort(name, port)
+}
+
+// CapturedFingerprint describes a captured fingerprint as returned by GetCapturedFingerprints.
+type CapturedFingerprint struct {
+	// Key identifies the fingerprint in DeleteCapturedFingerprint (format: `name:port`).
+	Key        string
+	Host       string
+	SNI        string
+	Port       string
+	CapturedAt time.Time
+	JA3        string
+	JA3Hash    string
+	JA4        string
+	ALPN       []string
+
+	// HasH2Settings is always false for fingerprints captured by the intercept proxy,
+	// because it only observes the TLS handshake and not the HTTP/2 connection preface.
+	// It can be true for imported fingerprints (see ImportCapturedFingerprint).
+	HasH2Settings bool
+
+	// HelloRetryRequested is true if the server answered the client's ClientHello with a HelloRetryRequest.
+	// The fingerprints of the second ClientHello are then listed in RetryJA3Hash and RetryJA4.
+	HelloRetryRequested bool
+	RetryJA3Hash        string
+	RetryJA4            string
+
+	// Opaque is true if the client didn't speak HTTP (see OpaqueTrafficTunnel).
+	Opaque bool
+
+	// Stale is true if the fingerprint is older than the configured InterceptedFingerprintMaxAge.
+	Stale bool
+
+	UseCount int64
+}
+
+// fingerprintStore holds captured fingerprints in memory.
+// When it holds more than maxEntries fingerprints, the least recently captured or used ones are evicted.
+type fingerprintStore struct {
+	mutex      sync.RWMutex
+	entries    *boundedCache[string, *capturedFingerprint]
+	maxAge     time.Duration
+	maxEntries int
+
+	// project is the Settings.ProjectId the entries belong to. The entries of other projects are set aside in projects.
+	project  string
+	projects map[string]*boundedCache[string, *capturedFingerprint]
+}
+
+func newFingerprintStore() *fingerprintStore {
+	return &fingerprintStore{
+		entries:    newCaptureEntries(DefaultInterceptedFingerprintMaxEntries),
+		maxAge:     DefaultInterceptedFingerprintMaxAge * time.Second,
+		maxEntries: DefaultInterceptedFingerprintMaxEntries,
+		projects:   make(map[string]*boundedCache[string, *capturedFingerprint]),
+	}
+}
+
+// newCaptureEntries returns the entries of a project, keyed by capturedFingerprint.key.
+func newCaptureEntries(maxEntries int) *boundedCache[string, *capturedFingerprint] {
+	entries := newBoundedCache[string, *capturedFingerprint](cacheInterceptedFingerprints, maxEntries, 0)
+	entries.onEvict = func(key string, _ *capturedFingerprint, _ string) {
+		interceptLog.Debug("evicted an intercepted fingerprint to make room for others, see InterceptedFingerprintMaxEntries", "fingerprint", key)
+	}
+	return entries
+}
+
+// useProject sets the entries of the current project aside and switches to the ones of project.
+func (s *fingerprintStore) useProject(project string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if project == s.project {
+		return
+	}
+
+	s.projects[s.project] = s.entries
+
+	if next, ok := s.projects[project]; ok {
+		delete(s.projects, project)
+		next.resize(s.maxEntries)
+		s.entries = next
+	} else {
+		s.entries = newCaptureEntries(s.maxEntries)
+	}
+
+	s.project = project
+}
+
+// configure updates the max age of fingerprints and the maximum number of fingerprints to keep.
+// Zero values select the defaults.
+func (s *fingerprintStore) configure(maxAge time.Duration, maxEntries int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if maxAge == 0 {
+		maxAge = DefaultInterceptedFingerprintMaxAge * time.Second
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultInterceptedFingerprintMaxEntries
+	}
+
+	s.maxAge = maxAge
+	s.maxEntries = maxEntries
+
+	s.entries.resize(maxEntries)
+}
+
+// put stores the fingerprint, replacing any fingerprint previously captured under the same key.
+func (s *fingerprintStore) put(fingerprint *capturedFingerprint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fingerprint.key()
+	s.entries.put(key, fingerprint)
+
+	capturesTotal.Inc()
+	publishEvent(EventFingerprintCaptured, map[string]string{"key": key})
+}
+
+// lookup returns the fingerprint to use for the given destination, along with the key that matched and whether it's stale.
+// It tries an exact match on `name:port` first, then the most recent capture for name on any port
+// and finally fallback, which is either a key, a name or wildcardCapture to use the most recent capture.
+func (s *fingerprintStore) lookup(name, port, fallback string) (*capturedFingerprint, string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fingerprint, key := s.find(name, port, fallback)
+	if fingerprint == nil {
+		return nil, "", false
+	}
+
+	s.entries.get(fingerprint.key())
+
+	return fingerprint, key, fingerprint.isStale(s.maxAge)
+}
+
+// find implements the matching logic of lookup. The caller must hold the mutex.
+func (s *fingerprintStore) find(name, port, fallback string) (*capturedFingerprint, string) {
+	if fingerprint, ok := s.entries.peek(captureKey(name, port)); ok {
+		return fingerprint, captureKey(name, port)
+	}
+
+	if fingerprint := s.mostRecent(name); fingerprint != nil {
+		return fingerprint, fingerprint.key()
+	}
+
+	switch fallback {
+	case "":
+		return nil, ""
+	case wildcardCapture:
+		if fingerprint := s.mostRecent(""); fingerprint != nil {
+			return fingerprint, fingerprint.key()
+		}
+	default:
+		if fingerprint, ok := s.entries.peek(fallback); ok {
+			return fingerprint, fallback
+		}
+		if fingerprint := s.mostRecent(fallback); fingerprint != nil {
+			return fingerprint, fingerprint.key()
+		}
+	}
+
+	return nil, ""
+}
+
+// mostRecent returns the most recently captured fingerprint for name, or for any name if it's empty.
+// The caller must hold the mutex.
+func (s *fingerprintStore) mostRecent(name string) *capturedFingerprint {
+	var result *capturedFingerprint
+
+	s.entries.each(func(_ string, fingerprint *capturedFingerprint) bool {
+		if name != "" && fingerprint.name() != name {
+			return true
+		}
+		if result == nil || fingerprint.CapturedAt.After(result.CapturedAt) {
+			result = fingerprint
+		}
+		return true
+	})
+
+	return result
+}
+
+// get returns the fingerprint stored under key, or the most recent capture for key if it's a server name instead.
+func (s *fingerprintStore) get(key string) *capturedFingerprint {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if fingerprint, ok := s.entries.peek(key); ok {
+		return fingerprint
+	}
+
+	if key == "" {
+		return nil
+	}
+
+	return s.mostRecent(key)
+}
+
+func (s *fingerprintStore) delete(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.entries.delete(key)
+}
+
+func (s *fingerprintStore) clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries.clear()
+}
+
+// len returns the number of fingerprints of the current project, see AdminStatus.CacheEntries.
+func (s *fingerprintStore) len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.entries.len()
+}
+
+// isStale reports whether the fingerprint is older than the configured max age.
+func (s *fingerprintStore) isStale(fingerprint *capturedFingerprint) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return fingerprint.isStale(s.maxAge)
+}
+
+func (s *fingerprintStore) list() []*capturedFingerprint {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var fingerprints []*capturedFingerprint
+	s.entries.each(func(_ string, fingerprint *capturedFingerprint) bool {
+		fingerprints = append(fingerprints, fingerprint)
+		return true
+	})
+	slices.SortFunc(fingerprints, func(a, b *capturedFingerprint) int {
+		return strings.Compare(a.key(), b.key())
+	})
+
+	return fingerprints
+}
+
+// newCapturedFingerprint creates a captured fingerprint from a ClientHello record.
+func newCapturedFingerprint(host, port string, info *clientHelloInfo, clientHello []byte) *capturedFingerprint {
+	return &capturedFingerprint{
+		Host:           host,
+		SNI:            info.ServerName,
+		Port:           port,
+		CapturedAt:     time.Now(),
+		HexClientHello: HexClientHello(hex.EncodeToString(clientHello)),
+		JA3:            info.JA3(),
+		JA3Hash:        info.JA3Hash(),
+		JA4:            info.JA4(),
+		ALPN:           info.ALPN,
+	}
+}
+
+// GetCapturedFingerprints returns all fingerprints captured by the intercept proxy, sorted by key.
+func GetCapturedFingerprints() []CapturedFingerprint {
+	var result []CapturedFingerprint
+
+	for _, fingerprint := range captures.list() {
+		result = append(result, CapturedFingerprint{
+			Key:                 fingerprint.key(),
+			Host:                fingerprint.Host,
+			SNI:                 fingerprint.SNI,
+			Port:                fingerprint.Port,
+			CapturedAt:          fingerprint.CapturedAt,
+			JA3:                 fingerprint.JA3,
+			JA3Hash:             fingerprint.JA3Hash,
+			JA4:                 fingerprint.JA4,
+			ALPN:                fingerprint.ALPN,
+			HasH2Settings:       len(fingerprint.H2Settings) > 0,
+			HelloRetryRequested: fingerprint.RetryClientHello != "",
+			RetryJA3Hash:        fingerprint.RetryJA3Hash,
+			RetryJA4:            fingerprint.RetryJA4,
+			Opaque:              fingerprint.Opaque,
+			Stale:               captures.isStale(fingerprint),
+			UseCount:            fingerprint.uses.Load(),
+		})
+	}
+
+	return result
+}
+
+// DeleteCapturedFingerprint removes the captured fingerprint with the given key (format: `name:port`).
+func DeleteCapturedFingerprint(key string) error {
+	if !captures.delete(key) {
+		return fmt.Errorf("no captured fingerprint for '%s'", key)
+	}
+	return nil
+}
+
+// ClearCapturedFingerprints removes all captured fingerprints.
+func ClearCapturedFingerprints() {
+	captures.clear()
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	utls "github.com/bogdanfinn/utls"
+)
+
+const (
+	// certificateExpiryCheckInterval is how often watchCertificateExpiry checks the certificates.
+	certificateExpiryCheckInterval = 24 * time.Hour
+
+	// certificateRenewalAction is what a warning of EventCertificateExpiring says to do about it. The CA isn't
+	// regenerated automatically, so clients that trust it have to trust the new one too.
+	certificateRenewalAction = "the CA isn't renewed automatically: import a new CA (or remove ca.der and caKey.der from " +
+		"the project's state directory and restart) and install it on every device again"
+)
+
+// certificateExpiryWarningDays are the days before a certificate expires at which EventCertificateExpiring is
+// published, from the earliest.
+var certificateExpiryWarningDays = []int{30, 7}
+
+// CertificateExpiry is when the certificates the spoof server presents to its clients expire, see HealthReport and
+// AdminStatus. Clients that enforce validity strictly fail the handshakes once they have.
+type CertificateExpiry struct {
+	// NotAfter is when the CA certificate expires, and DaysLeft the whole days until then, negative once it has.
+	NotAfter time.Time
+	DaysLeft int
+
+	// LeafNotAfter is when the first of the cached leaf certificates of the forward proxy expires, and LeafHost the
+	// host it's for. Leaves expire with the CA that issued them.
+	LeafNotAfter time.Time `json:",omitzero"`
+	LeafHost     string    `json:",omitempty"`
+
+	// Warning reports whether the CA or a leaf expires within the first of certificateExpiryWarningDays, and Action
+	// what to do about it then.
+	Warning bool
+	Action  string `json:",omitempty"`
+}
+
+// daysLeft returns the whole days until notAfter at now.
+func daysLeft(notAfter, now time.Time) int {
+	return int(math.Floor(notAfter.Sub(now).Hours() / 24))
+}
+
+// certificateExpiry returns when ca, and the leaves it issued that are cached, expire at now.
+func certificateExpiry(ca *x509.Certificate, now time.Time) CertificateExpiry {
+	expiry := CertificateExpiry{NotAfter: ca.NotAfter, DaysLeft: daysLeft(ca.NotAfter, now)}
+
+	leafCertificateCache.each(func(key leafCertificateKey, cert *utls.Certificate) bool {
+		if cert.Leaf != nil && (expiry.LeafNotAfter.IsZero() || cert.Leaf.NotAfter.Before(expiry.LeafNotAfter)) {
+			expiry.LeafNotAfter, expiry.LeafHost = cert.Leaf.NotAfter, key.host
+		}
+		return true
+	})
+
+	first := certificateExpiryWarningDays[0]
+	expiry.Warning = expiry.DaysLeft <= first || (!expiry.LeafNotAfter.IsZero() && daysLeft(expiry.LeafNotAfter, now) <= first)
+	if expiry.Warning {
+		expiry.Action = certificateRenewalAction
+	}
+	return expiry
+}
+
+// currentCertificateAuthority returns the CA certificate of the running spoof server, or the one on disk. It returns
+// nil if there's none yet.
+func currentCertificateAuthority() *x509.Certificate {
+	spoof.mutex.Lock()
+	tlsConfig := spoof.tlsConfig
+	spoof.mutex.Unlock()
+
+	if tlsConfig != nil && tlsConfig.Certificates[0].Leaf != nil {
+		return tlsConfig.Certificates[0].Leaf
+	}
+	ca, err := readCertFromDisk(caFile)
+	if err != nil {
+		return nil
+	}
+	return ca
+}
+
+// getCertificateExpiry returns when the current CA and its cached leaves expire, or nil if there's no CA yet.
+func getCertificateExpiry() *CertificateExpiry {
+	ca := currentCertificateAuthority()
+	if ca == nil {
+		return nil
+	}
+	expiry := certificateExpiry(ca, time.Now())
+	return &expiry
+}
+
+// expiryWarnings remembers the warnings published for each certificate, so each of certificateExpiryWarningDays is
+// published once per run of the server.
+var expiryWarnings = &expiryWarner{warned: make(map[[sha256.Size]byte]int)}
+
+type expiryWarner struct {
+	mutex sync.Mutex
+	// warned is the last of certificateExpiryWarningDays published for each certificate, by the hash of its DER.
+	warned map[[sha256.Size]byte]int
+}
+
+// warn logs and publishes a warning for cert if it crossed one of certificateExpiryWarningDays since the last
+// one. kind is "ca" or "leaf", and host the host of a leaf.
+func (w *expiryWarner) warn(kind, host string, cert *x509.Certificate, now time.Time) {
+	left := daysLeft(cert.NotAfter, now)
+	threshold := -1
+	for _, days := range certificateExpiryWarningDays {
+		if left <= days {
+			threshold = days
+		}
+	}
+	if threshold < 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	key := sha256.Sum256(cert.Raw)
+	last, warned := w.warned[key]
+	if warned && last <= threshold {
+		w.mutex.Unlock()
+		return
+	}
+	w.warned[key] = threshold
+	w.mutex.Unlock()
+
+	message := "the certificate expires soon"
+	if left < 0 {
+		message = "the certificate expired"
+	}
+	attrs := []any{"certificate", kind, "notAfter", cert.NotAfter, "daysLeft", left, "action", certificateRenewalAction}
+	fields := map[string]string{
+		"certificate": kind,
+		"notAfter":    cert.NotAfter.UTC().Format(time.RFC3339),
+		"daysLeft":    strconv.Itoa(left),
+		"action":      certificateRenewalAction,
+	}
+	if host != "" {
+		attrs = append(attrs, "host", host)
+		fields["host"] = host
+	}
+	certificateLog.Warn(message, attrs...)
+	publishEvent(EventCertificateExpiring, fields)
+}
+
+// checkCertificateExpiry warns about the CA and its cached leaves that expire within certificateExpiryWarningDays.
+// Leaves expire with the CA that issued them, so they're only warned about if they expire before the current CA.
+func checkCertificateExpiry() {
+	ca := currentCertificateAuthority()
+	if ca == nil {
+		return
+	}
+
+	now := time.Now()
+	expiryWarnings.warn("ca", "", ca, now)
+
+	type leaf struct {
+		host string
+		cert *x509.Certificate
+	}
+	var leaves []leaf
+	leafCertificateCache.each(func(key leafCertificateKey, cert *utls.Certificate) bool {
+		if cert.Leaf != nil && cert.Leaf.NotAfter.Before(ca.NotAfter) {
+			leaves = append(leaves, leaf{key.host, cert.Leaf})
+		}
+		return true
+	})
+	for _, leaf := range leaves {
+		expiryWarnings.warn("leaf", leaf.host, leaf.cert, now)
+	}
+}
+
+// watchCertificateExpiry checks when the certificates expire (see checkCertificateExpiry) now and every
+// certificateExpiryCheckInterval, until stopped is closed.
+func watchCertificateExpiry(stopped <-chan struct{}) {
+	defer recoverPanic(certificateLog, "certificate expiry watcher")
+
+	checkCertificateExpiry()
+
+	ticker := time.NewTicker(certificateExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			checkCertificateExpiry()
+		}
+	}
+}
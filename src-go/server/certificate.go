@@ -1,6 +1,8 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -8,12 +10,15 @@ import (
 	"crypto/x509/pkix"
 	"errors"
 	"fmt"
-	"log"
 	"math/big"
+	"net"
 	"os"
 	"path"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	utls "github.com/bogdanfinn/utls"
 )
 
 // Based on: https://github.com/ulixee/hero/blob/main/mitm-socket/go/generate_cert.go
@@ -27,14 +32,15 @@ const (
 // number every time we increment this value.
 var currentSerialNumber = time.Now().Unix()
 
+// getAbsoluteFilePath returns the path of file in the state directory of the current project.
 func getAbsoluteFilePath(file string) string {
-	if userConfigDir, err := os.UserConfigDir(); err == nil {
-		configDir := path.Join(userConfigDir, "burp-awesome-tls")
-		_ = os.Mkdir(configDir, 0o700)
-		return path.Join(configDir, file)
-	}
+	return path.Join(stateDirectory(currentProjectId()), file)
+}
 
-	return file
+// CertificateAuthorityPath returns the path of the DER encoded CA certificate that clients of the spoof server have to trust.
+// The file is created when the spoof server starts.
+func CertificateAuthorityPath() string {
+	return getAbsoluteFilePath(caFile)
 }
 
 func readCertFromDisk(file string) (*x509.Certificate, error) {
@@ -72,14 +78,18 @@ func readPrivateKeyFromDisk(file string) (*rsa.PrivateKey, error) {
 
 // NewCertificateAuthority creates a new CA certificate and associated private key, unless it already exists on disk.
 func NewCertificateAuthority() (*x509.Certificate, *rsa.PrivateKey, error) {
+	if err := copySharedCertificateAuthority(currentProjectId()); err != nil {
+		certificateLog.Error("copying the shared CA into the project failed", "project", currentProjectId(), "error", err)
+	}
+
 	certFromDisk, err := readCertFromDisk(caFile)
 
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Printf("Error reading cert from disk %s %e", caFile, err)
+		certificateLog.Error("reading the CA certificate failed", "file", caFile, "error", err)
 	} else if err == nil {
 		keyFromDisk, err := readPrivateKeyFromDisk(caKeyFile)
 		if err != nil {
-			log.Printf("Error reading private key from disk %s %e", caKeyFile, err)
+			certificateLog.Error("reading the CA private key failed", "file", caKeyFile, "error", err)
 		} else {
 			return certFromDisk, keyFromDisk, nil
 		}
@@ -152,3 +162,136 @@ func NewCertificateAuthority() (*x509.Certificate, *rsa.PrivateKey, error) {
 
 	return x509c, priv, nil
 }
+
+// exportCertificateAuthority returns the DER encoded CA certificate and PKCS #8 private key used by the spoof server:
+// the project's, or the shared one that NewCertificateAuthority copies into the project. It returns nil if there's
+// no CA yet, without creating one.
+func exportCertificateAuthority() ([]byte, []byte, error) {
+	for _, dir := range []string{stateDirectory(currentProjectId()), stateDirectory("")} {
+		cert, err := os.ReadFile(path.Join(dir, caFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		priv, err := os.ReadFile(path.Join(dir, caKeyFile))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return cert, priv, nil
+	}
+
+	return nil, nil, nil
+}
+
+// importCertificateAuthority replaces the CA on disk with the given DER encoded certificate and PKCS #8 private key.
+// The spoof server picks it up the next time it's started.
+func importCertificateAuthority(certBytes, privBytes []byte) error {
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(privBytes)
+	if err != nil {
+		return err
+	}
+
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("Pkcs8 contained non-RSA key. Expected RSA key.")
+	}
+
+	if !priv.PublicKey.Equal(cert.PublicKey) {
+		return errors.New("private key doesn't belong to the certificate")
+	}
+
+	// Each file is replaced atomically, so an interrupted import never leaves a truncated certificate or key behind.
+	if err = writeFileAtomic(getAbsoluteFilePath(caKeyFile), privBytes, 0o600); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(getAbsoluteFilePath(caFile), certBytes, 0o600)
+}
+
+// DefaultMaxLeafCertificates is the default number of leaf certificates leafCertificateCache keeps, see
+// CacheSettings.LeafCertificates.
+const DefaultMaxLeafCertificates = 1024
+
+// leafCertificateCache keeps the certificates of every leafCertificates, so they're capped together.
+var leafCertificateCache = newBoundedCache[leafCertificateKey, *utls.Certificate](cacheLeafCertificates, DefaultMaxLeafCertificates, 0)
+
+type leafCertificateKey struct {
+	issuer *leafCertificates
+	host   string
+}
+
+// leafCertificates issues certificates for the hosts that clients of the forward proxy connect to, signed by the CA.
+// All certificates share one key, which is generated along with them.
+type leafCertificates struct {
+	ca    *x509.Certificate
+	caKey any
+	key   *ecdsa.PrivateKey
+
+	// mutex makes clients connecting to the same host at the same time wait for one certificate.
+	mutex sync.Mutex
+}
+
+func newLeafCertificates(ca *x509.Certificate, caKey any) (*leafCertificates, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &leafCertificates{
+		ca:    ca,
+		caKey: caKey,
+		key:   key,
+	}, nil
+}
+
+// get returns the certificate for host, which is either a host name or an IP address.
+func (c *leafCertificates) get(host string) (*utls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := leafCertificateKey{issuer: c, host: host}
+	if cert, ok := leafCertificateCache.get(key); ok {
+		return cert, nil
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(atomic.AddInt64(&currentSerialNumber, 1)),
+		Subject:      pkix.Name{CommonName: host},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:    time.Now().AddDate(0, 0, -1),
+		NotAfter:     c.ca.NotAfter,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.key.Public(), c.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &utls.Certificate{
+		Certificate: [][]byte{raw, c.ca.Raw},
+		PrivateKey:  c.key,
+		Leaf:        leaf,
+	}
+	leafCertificateCache.put(key, cert)
+
+	return cert, nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ConfigurationModeChannel passes the configuration of each request to RegisterTransportConfig before Burp sends it,
+	// so requests reach the spoof server exactly as Burp shows them. This is the default.
+	ConfigurationModeChannel = "channel"
+
+	// ConfigurationModeHeader passes the configuration of each request in the ConfigurationHeaderKey header.
+	ConfigurationModeHeader = "header"
+)
+
+const (
+	// registeredConfigTTL is how long a registered configuration waits for its request.
+	registeredConfigTTL = time.Minute
+
+	// maxRegisteredConfigs is the maximum number of configurations waiting for their request.
+	maxRegisteredConfigs = 10000
+)
+
+// registeredConfigs holds the configurations passed to RegisterTransportConfig until their request arrives.
+var registeredConfigs = newConfigRegistry()
+
+// configRegistry matches configurations to requests by requestKey.
+// Identical requests registered more than once get their configurations in the order they were registered.
+type configRegistry struct {
+	mutex sync.Mutex
+	// entries holds the elements of order registered for each key, oldest first.
+	entries map[string][]*list.Element
+	// order holds the registeredConfig of every entry, oldest first, so expiring them only looks at the expired ones.
+	order *list.List
+}
+
+type registeredConfig struct {
+	key          string
+	config       string
+	registeredAt time.Time
+}
+
+func newConfigRegistry() *configRegistry {
+	return &configRegistry{entries: make(map[string][]*list.Element), order: list.New()}
+}
+
+// RegisterTransportConfig registers the configuration of a request that Burp is about to send to the spoof server.
+// The request is base64 encoded as Burp will send it, starting with the request line. When the request arrives without
+// a ConfigurationHeaderKey header, config is used as if the header had been sent.
+func RegisterTransportConfig(request, config string) error {
+	raw, err := base64.StdEncoding.DecodeString(request)
+	if err != nil {
+		return err
+	}
+
+	method, target, body, err := splitRequest(raw)
+	if err != nil {
+		return err
+	}
+
+	registeredConfigs.put(requestKey(method, target, body), config)
+
+	return nil
+}
+
+// splitRequest returns the method, request target and body of a raw HTTP/1 request.
+func splitRequest(raw []byte) (string, string, []byte, error) {
+	head, body, ok := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !ok {
+		return "", "", nil, errors.New("request has no end of headers")
+	}
+
+	requestLine, _, _ := bytes.Cut(head, []byte("\r\n"))
+	method, rest, ok := strings.Cut(string(requestLine), " ")
+	if !ok {
+		return "", "", nil, errors.New("malformed request line")
+	}
+	target, _, _ := strings.Cut(rest, " ")
+
+	return method, target, body, nil
+}
+
+// requestKey identifies a request by its method, request target and body.
+func requestKey(method, target string, body []byte) string {
+	hash := requestHash(method, target)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// requestHash returns the hash of requestKey for a request with method and target, whose body is still to be written
+// to it, so a body can be hashed as it's read.
+func requestHash(method, target string) hash.Hash {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + target + "\n"))
+	return hash
+}
+
+func (r *configRegistry) put(key, config string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.expire()
+
+	if r.order.Len() >= maxRegisteredConfigs {
+		spoofLog.Debug("too many transport configurations are waiting for their request, dropping the new one")
+		return
+	}
+
+	element := r.order.PushBack(registeredConfig{key: key, config: config, registeredAt: time.Now()})
+	r.entries[key] = append(r.entries[key], element)
+}
+
+// take removes and returns the oldest configuration registered for key.
+func (r *configRegistry) take(key string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.expire()
+
+	if len(r.entries[key]) == 0 {
+		return "", false
+	}
+
+	return r.remove(key).config, true
+}
+
+// len returns the number of configurations waiting for their request.
+func (r *configRegistry) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.order.Len()
+}
+
+// remove removes and returns the oldest configuration registered for key, which must have one. The caller must hold
+// the mutex.
+func (r *configRegistry) remove(key string) registeredConfig {
+	elements := r.entries[key]
+	if len(elements) == 1 {
+		delete(r.entries, key)
+	} else {
+		r.entries[key] = elements[1:]
+	}
+
+	return r.order.Remove(elements[0]).(registeredConfig)
+}
+
+// expire removes the configurations whose request didn't arrive in time. The caller must hold the mutex.
+// The oldest configuration is also the oldest of its key, so it's the first of its key that's removed.
+func (r *configRegistry) expire() {
+	for front := r.order.Front(); front != nil; front = r.order.Front() {
+		registered := front.Value.(registeredConfig)
+		if time.Since(registered.registeredAt) <= registeredConfigTTL {
+			return
+		}
+		r.remove(registered.key)
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerAged registers config for key in r as if it had been registered age ago.
+func registerAged(r *configRegistry, key, config string, age time.Duration) {
+	r.put(key, config)
+	back := r.order.Back()
+	registered := back.Value.(registeredConfig)
+	registered.registeredAt = time.Now().Add(-age)
+	back.Value = registered
+}
+
+func TestConfigRegistryOrder(t *testing.T) {
+	r := newConfigRegistry()
+	r.put("a", "a1")
+	r.put("b", "b1")
+	r.put("a", "a2")
+
+	for _, want := range []struct{ key, config string }{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}} {
+		if config, ok := r.take(want.key); !ok || config != want.config {
+			t.Errorf("take(%q) = %q, %t, want %q", want.key, config, ok, want.config)
+		}
+	}
+	if config, ok := r.take("a"); ok {
+		t.Errorf("took %q of a key whose configurations were all taken", config)
+	}
+	if r.len() != 0 || len(r.entries) != 0 {
+		t.Errorf("%d configurations and %d keys are left", r.len(), len(r.entries))
+	}
+}
+
+func TestConfigRegistryExpires(t *testing.T) {
+	r := newConfigRegistry()
+	registerAged(r, "a", "a1", 2*registeredConfigTTL)
+	registerAged(r, "b", "b1", 2*registeredConfigTTL)
+	registerAged(r, "a", "a2", registeredConfigTTL/2)
+	r.put("c", "c1")
+
+	if config, ok := r.take("a"); !ok || config != "a2" {
+		t.Errorf("take(a) = %q, %t, want the configuration that didn't expire", config, ok)
+	}
+	if config, ok := r.take("b"); ok {
+		t.Errorf("took the expired configuration %q", config)
+	}
+	if _, ok := r.entries["b"]; ok || r.len() != 1 {
+		t.Errorf("the expired configurations are kept: %d left", r.len())
+	}
+}
+
+// BenchmarkConfigRegistry registers and takes configurations while the registry is nearly full, which costs as much as
+// when it's empty since only expired configurations are looked at.
+func BenchmarkConfigRegistry(b *testing.B) {
+	for _, waiting := range []int{0, maxRegisteredConfigs / 2, maxRegisteredConfigs - 1} {
+		b.Run(fmt.Sprint(waiting), func(b *testing.B) {
+			r := newConfigRegistry()
+			for i := range waiting {
+				r.put(fmt.Sprintf("waiting %d", i), "{}")
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				r.put("key", "{}")
+				if _, ok := r.take("key"); !ok {
+					b.Fatal("the configuration wasn't registered")
+				}
+			}
+		})
+	}
+}
+
+// TestRegisteredRequestBodiesAreSpooled sends a request whose configuration was registered, with a body larger than
+// what's spooled in memory. It's read to identify the request into the spool, which spills the rest of it to a
+// temporary file, rather than into memory, and it's sent to the destination from there.
+func TestRegisteredRequestBodiesAreSpooled(t *testing.T) {
+	saveTestSettings(t, `{"ConfigurationMode":"channel"}`)
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	spilled := func() int64 {
+		var size int64
+		files, _ := filepath.Glob(filepath.Join(spool, "awesometls-body-*"))
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				size += info.Size()
+			}
+		}
+		return size
+	}
+
+	body := make([]byte, 8*maxSpooledMemoryBytes)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	var received [sha256.Size]byte
+	var spilledWhileSent int64
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		spilledWhileSent = spilled()
+		data, _ := io.ReadAll(req.Body)
+		received = sha256.Sum256(data)
+	})
+	host := strings.TrimPrefix(origin.URL, "https://")
+
+	raw := append([]byte(fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: %s\r\n\r\n", host)), body...)
+	if err := RegisterTransportConfig(base64.StdEncoding.EncodeToString(raw), testConfig(origin, map[string]any{"ReportTls": true})); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+startSpoofServer(t)+"/upload", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	res, err := spoofClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get(TlsHeaderKey) == "" {
+		t.Fatalf("got %d without the %s header, want the request sent with its registered configuration", res.StatusCode, TlsHeaderKey)
+	}
+	if received != sha256.Sum256(body) {
+		t.Error("the destination received another body")
+	}
+	if want := int64(len(body) - maxSpooledMemoryBytes); spilledWhileSent != want {
+		t.Errorf("%d bytes of the body were spilled to a file while it was sent, want all but the %d kept in memory (%d)", spilledWhileSent, maxSpooledMemoryBytes, want)
+	}
+	for deadline := time.Now().Add(5 * time.Second); spilled() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the spooled body wasn't removed once the request was done")
+		}
+	}
+}
+
+// TestConfigurationNeverReachesTheDestination sends requests with their configuration in either mode, along the
+// paths that fail or send them more than once, and checks that no internal header or part of the configuration
+// reaches the destination.
+func TestConfigurationNeverReachesTheDestination(t *testing.T) {
+	const marker = "leaked-configuration.test"
+	for name, h2 := range map[string]bool{"HTTP1": false, "HTTP2": true} {
+		t.Run(name, func(t *testing.T) {
+			resetOnce := make(chan struct{}, 1)
+			resetOnce <- struct{}{}
+			origin := newRecordingOrigin(t, h2, func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/reset":
+					select {
+					case <-resetOnce:
+						if hijacker, ok := w.(http.Hijacker); ok {
+							if conn, _, err := hijacker.Hijack(); err == nil {
+								conn.Close()
+								return
+							}
+						}
+						panic(http.ErrAbortHandler)
+					default:
+					}
+				case "/error":
+					http.Error(w, "failed", http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprint(w, "ok")
+			})
+			host := strings.TrimPrefix(origin.URL, "https://")
+			config := fmt.Sprintf(`{"Host":%q,"Scheme":"https","Fingerprint":"chrome_131","InterceptedFingerprintDefault":%q}`, host, marker)
+
+			// send sends a request for path with body, with the configuration in the header if header is true, and
+			// registered beforehand if register is true. mutate changes the request after it's registered.
+			send := func(t *testing.T, path, body string, header, register bool, mutate func(*http.Request)) *http.Response {
+				// The bodies are unique, so no request takes a configuration registered for another.
+				body = t.Name() + body
+				if register {
+					raw := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\n\r\n%s", path, host, body)
+					if err := RegisterTransportConfig(base64.StdEncoding.EncodeToString([]byte(raw)), config); err != nil {
+						t.Fatal(err)
+					}
+				}
+				req, err := http.NewRequest(http.MethodPost, "https://"+startSpoofServer(t)+path, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Host = host
+				if header {
+					req.Header.Set(ConfigurationHeaderKey, config)
+				}
+				req.Header.Set(TraceIdHeaderKey, "leaked-trace-id")
+				if mutate != nil {
+					mutate(req)
+				}
+				res, err := spoofClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				return res
+			}
+
+			tests := []struct {
+				name       string
+				settings   string
+				path, body string
+				header     bool
+				register   bool
+				mutate     func(*http.Request)
+				// http1 is set for requests the HTTP/2 destination can't fail the way they need to.
+				http1      bool
+				wantStatus int
+				// wantLogged is the start of the message of an error the request logs, if any.
+				wantLogged string
+			}{
+				{name: "header", settings: `{"ConfigurationMode":"header"}`, path: "/", header: true, wantStatus: http.StatusOK},
+				{name: "registered", settings: `{"ConfigurationMode":"channel"}`, path: "/", body: "registered", register: true, wantStatus: http.StatusOK},
+				{name: "registered and header", settings: `{"ConfigurationMode":"channel"}`, path: "/", header: true, register: true, wantStatus: http.StatusOK},
+				{
+					name: "changed after it was registered", settings: `{"ConfigurationMode":"channel"}`, path: "/", body: "registered",
+					register: true, mutate: func(req *http.Request) { req.URL.Path = "/changed" }, wantStatus: http.StatusOK,
+					wantLogged: "no transport configuration was registered for the request",
+				},
+				{name: "destination error", settings: `{"ConfigurationMode":"header"}`, path: "/error", header: true, wantStatus: http.StatusInternalServerError},
+				{
+					name: "retried after a reset", settings: `{"ConfigurationMode":"header","RetryPolicy":{"RetryCount":2,"InitialBackoffMs":1,"RetryOn":["reset"]}}`,
+					path: "/reset", body: "retried", header: true, http1: true, wantStatus: http.StatusOK,
+				},
+				{
+					name: "in a trailer", settings: `{"ConfigurationMode":"header"}`, path: "/", header: true, wantStatus: http.StatusOK,
+					mutate: func(req *http.Request) {
+						// The body has no length, so it's chunked and the trailer can follow it.
+						req.Body, req.ContentLength = io.NopCloser(strings.NewReader("trailed")), -1
+						req.Trailer = http.Header{ConfigurationHeaderKey: {config}, TraceIdHeaderKey: {"leaked-trace-id"}}
+					},
+				},
+			}
+
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					if test.http1 && h2 {
+						t.Skip("an HTTP/2 destination can only reset the stream, which isn't retried")
+					}
+					saveTestSettings(t, test.settings)
+					received := origin.requests()
+					var after uint64
+					if logs := GetLogs(0); len(logs) > 0 {
+						after = logs[len(logs)-1].Sequence
+					}
+
+					if res := send(t, test.path, test.body, test.header, test.register, test.mutate); res.StatusCode != test.wantStatus {
+						t.Errorf("got %d, want %d", res.StatusCode, test.wantStatus)
+					}
+					if origin.requests() == received {
+						t.Error("the request didn't reach the destination")
+					}
+					if test.wantLogged != "" && !slices.ContainsFunc(GetLogs(after), func(record LogRecord) bool {
+						return record.Level == "error" && strings.HasPrefix(record.Message, test.wantLogged)
+					}) {
+						t.Errorf("no error was logged starting with %q", test.wantLogged)
+					}
+				})
+			}
+			origin.assertNotReceived(t, marker, "leaked-trace-id", `"Fingerprint"`)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/bogdanfinn/fhttp/http2"
+	utls "github.com/bogdanfinn/utls"
+)
+
+// ClientCertificateDocument is the client certificate that Burp must present to the spoof server
+// when RequireClientCertificate is enabled, as returned by GetClientCertificate.
+type ClientCertificateDocument struct {
+	// DER encoded certificate.
+	Certificate []byte
+
+	// DER encoded PKCS #8 private key.
+	PrivateKey []byte
+}
+
+// clientCertificate is a one-time client certificate, generated each time the spoof server starts.
+type clientCertificate struct {
+	document ClientCertificateDocument
+
+	// tlsConfig is the server's TLS configuration with the certificate required, and http2Config the same offering
+	// HTTP/2, see Settings.SpoofHttp2.
+	tlsConfig   *utls.Config
+	http2Config *utls.Config
+}
+
+// newClientCertificate generates a self-signed client certificate, and derives the TLS configuration of a server that
+// requires it from base. The certificate only lives in memory.
+func newClientCertificate(base *utls.Config) (*clientCertificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "Awesome TLS client",
+			Organization: []string{"Sleeyax"},
+		},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	tlsConfig := base.Clone()
+	tlsConfig.ClientAuth = utls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+
+	return &clientCertificate{
+		document:    ClientCertificateDocument{Certificate: raw, PrivateKey: privBytes},
+		tlsConfig:   tlsConfig,
+		http2Config: offerHTTP2(tlsConfig),
+	}, nil
+}
+
+// offerHTTP2 returns a copy of config that offers HTTP/2 before HTTP/1.1.
+func offerHTTP2(config *utls.Config) *utls.Config {
+	config = config.Clone()
+	config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	return config
+}
+
+// requireClientCertificate and spoofHttp2 are Settings.RequireClientCertificate and Settings.SpoofHttp2 of the
+// settings in effect. They're checked on every handshake, so changing them doesn't restart the spoof server.
+var (
+	requireClientCertificate atomic.Bool
+	spoofHttp2               atomic.Bool
+)
+
+// configForClient returns the TLS configuration for a new connection to the spoof server.
+func (s *spoofServer) configForClient(*utls.ClientHelloInfo) (*utls.Config, error) {
+	h2 := spoofHttp2.Load()
+
+	if !requireClientCertificate.Load() {
+		if h2 {
+			if config := s.http2Config.Load(); config != nil {
+				return config, nil
+			}
+		}
+		// The base configuration is used as-is.
+		return nil, nil
+	}
+
+	clientCert := s.clientCert.Load()
+	if clientCert == nil {
+		return nil, errors.New("no client certificate")
+	}
+
+	if h2 {
+		return clientCert.http2Config, nil
+	}
+	return clientCert.tlsConfig, nil
+}
+
+// GetClientCertificate returns the JSON encoded ClientCertificateDocument that Burp must present to the spoof server
+// when RequireClientCertificate is enabled. A new certificate is generated each time the spoof server starts.
+func GetClientCertificate() (string, error) {
+	clientCert := spoof.clientCert.Load()
+	if clientCert == nil {
+		return "", errors.New("spoof server isn't running")
+	}
+
+	data, err := json.Marshal(clientCert.document)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	utls "github.com/bogdanfinn/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	extensionServerName          uint16 = 0x0000
+	extensionSupportedGroups     uint16 = 0x000a
+	extensionPointFormats        uint16 = 0x000b
+	extensionSignatureAlgorithms uint16 = 0x000d
+	extensionALPN                uint16 = 0x0010
+	extensionSupportedVersions   uint16 = 0x002b
+)
+
+// clientHelloInfo contains the fields of a ClientHello that are relevant for fingerprinting.
+type clientHelloInfo struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ServerName          string
+	ALPN                []string
+}
+
+// parseClientHello parses a ClientHello record (including the 5 byte record header).
+func parseClientHello(raw []byte) (*clientHelloInfo, error) {
+	s := cryptobyte.String(raw)
+
+	var contentType uint8
+	if !s.ReadUint8(&contentType) || !s.Skip(4) {
+		return nil, errors.New("unable to read record header")
+	}
+	if contentType != 0x16 {
+		return nil, errors.New("record is not a handshake")
+	}
+
+	var handshakeType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&handshakeType) || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errors.New("unable to read handshake message")
+	}
+	if handshakeType != 0x01 {
+		return nil, errors.New("handshake message is not a ClientHello")
+	}
+
+	info := &clientHelloInfo{}
+
+	var sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !body.ReadUint16(&info.Version) || !body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errors.New("malformed ClientHello")
+	}
+
+	for !cipherSuites.Empty() {
+		var suite uint16
+		if !cipherSuites.ReadUint16(&suite) {
+			return nil, errors.New("malformed cipher suites")
+		}
+		info.CipherSuites = append(info.CipherSuites, suite)
+	}
+
+	if body.Empty() {
+		// A ClientHello without extensions is valid.
+		return info, nil
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed extensions")
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed extension")
+		}
+
+		info.Extensions = append(info.Extensions, extension)
+
+		if err := info.parseExtension(extension, data); err != nil {
+			return nil, fmt.Errorf("extension %d: %w", extension, err)
+		}
+	}
+
+	return info, nil
+}
+
+func (info *clientHelloInfo) parseExtension(extension uint16, data cryptobyte.String) error {
+	switch extension {
+	case extensionServerName:
+		var names cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&names) {
+			return errors.New("malformed server name list")
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return errors.New("malformed server name")
+			}
+			if nameType == 0 {
+				info.ServerName = string(name)
+			}
+		}
+	case extensionSupportedGroups:
+		var groups cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&groups) {
+			return errors.New("malformed supported groups")
+		}
+		for !groups.Empty() {
+			var group uint16
+			if !groups.ReadUint16(&group) {
+				return errors.New("malformed supported group")
+			}
+			info.SupportedGroups = append(info.SupportedGroups, group)
+		}
+	case extensionPointFormats:
+		var formats cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&formats) {
+			return errors.New("malformed point formats")
+		}
+		info.PointFormats = append(info.PointFormats, formats...)
+	case extensionSignatureAlgorithms:
+		var algorithms cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&algorithms) {
+			return errors.New("malformed signature algorithms")
+		}
+		for !algorithms.Empty() {
+			var algorithm uint16
+			if !algorithms.ReadUint16(&algorithm) {
+				return errors.New("malformed signature algorithm")
+			}
+			info.SignatureAlgorithms = append(info.SignatureAlgorithms, algorithm)
+		}
+	case extensionALPN:
+		var protocols cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&protocols) {
+			return errors.New("malformed ALPN")
+		}
+		for !protocols.Empty() {
+			var protocol cryptobyte.String
+			if !protocols.ReadUint8LengthPrefixed(&protocol) {
+				return errors.New("malformed ALPN protocol")
+			}
+			info.ALPN = append(info.ALPN, string(protocol))
+		}
+	case extensionSupportedVersions:
+		var versions cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&versions) {
+			return errors.New("malformed supported versions")
+		}
+		for !versions.Empty() {
+			var version uint16
+			if !versions.ReadUint16(&version) {
+				return errors.New("malformed supported version")
+			}
+			info.SupportedVersions = append(info.SupportedVersions, version)
+		}
+	}
+
+	return nil
+}
+
+// JA3 returns the JA3 fingerprint string, see https://github.com/salesforce/ja3.
+func (info *clientHelloInfo) JA3() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(info.Version)),
+		joinValues(withoutGrease(info.CipherSuites), "-", strconv.Itoa),
+		joinValues(withoutGrease(info.Extensions), "-", strconv.Itoa),
+		joinValues(withoutGrease(info.SupportedGroups), "-", strconv.Itoa),
+		joinValues(info.PointFormats, "-", strconv.Itoa),
+	}, ",")
+}
+
+// JA3Hash returns the MD5 hash of the JA3 fingerprint string.
+func (info *clientHelloInfo) JA3Hash() string {
+	sum := md5.Sum([]byte(info.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint string, see https://github.com/FoxIO-LLC/ja4.
+func (info *clientHelloInfo) JA4() string {
+	cipherSuites := withoutGrease(info.CipherSuites)
+	extensions := withoutGrease(info.Extensions)
+
+	sni := "i"
+	if info.ServerName != "" {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(info), sni, min(len(cipherSuites), 99), min(len(extensions), 99), ja4ALPN(info.ALPN))
+
+	sortedCipherSuites := slices.Sorted(slices.Values(cipherSuites))
+	b := ja4Hash(joinValues(sortedCipherSuites, ",", hex4))
+
+	var sortedExtensions []uint16
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			sortedExtensions = append(sortedExtensions, extension)
+		}
+	}
+	slices.Sort(sortedExtensions)
+	c := joinValues(sortedExtensions, ",", hex4)
+	if len(info.SignatureAlgorithms) > 0 {
+		c += "_" + joinValues(withoutGrease(info.SignatureAlgorithms), ",", hex4)
+	}
+	if len(sortedExtensions) == 0 {
+		c = ""
+	}
+
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+// buildClientHello returns the ClientHello record utls would send for the given ClientHelloID and server name.
+// Nothing is sent over the network.
+func buildClientHello(id utls.ClientHelloID, serverName string) ([]byte, error) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	uconn := utls.UClient(conn, &utls.Config{ServerName: serverName, InsecureSkipVerify: true}, id, false, false, false)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	hello := uconn.HandshakeState.Hello.Raw
+	record := []byte{0x16, 0x03, 0x01, byte(len(hello) >> 8), byte(len(hello))}
+
+	return append(record, hello...), nil
+}
+
+// logOutboundClientHello logs the fingerprints of the ClientHello that will be sent to serverName.
+func logOutboundClientHello(id utls.ClientHelloID, serverName string) {
+	raw, err := buildClientHello(id, serverName)
+	if err != nil {
+		spoofLog.Warn("building the outbound ClientHello failed", "host", serverName, "error", err)
+		return
+	}
+
+	info, err := parseClientHello(raw)
+	if err != nil {
+		spoofLog.Warn("parsing the outbound ClientHello failed", "host", serverName, "error", err)
+		return
+	}
+
+	spoofLog.Debug("outbound ClientHello", "host", serverName, "clientHello", id.Str(), "ja3", info.JA3(), "ja3Hash", info.JA3Hash(), "ja4", info.JA4(), "alpn", strings.Join(info.ALPN, ","))
+}
+
+func ja4Version(info *clientHelloInfo) string {
+	version := info.Version
+	if versions := withoutGrease(info.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+
+	protocol := protocols[0]
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isGrease reports whether the value is a GREASE value as defined in RFC 8701.
+func isGrease(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	var result []uint16
+	for _, value := range values {
+		if !isGrease(value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func hex4(value int) string {
+	return fmt.Sprintf("%04x", value)
+}
+
+func joinValues[T uint8 | uint16](values []T, sep string, format func(int) string) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = format(int(value))
+	}
+	return strings.Join(parts, sep)
+}
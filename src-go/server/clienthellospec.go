@@ -0,0 +1,345 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	utls "github.com/bogdanfinn/utls"
+)
+
+// DefaultMaxClientHellos is the default number of compiled ClientHellos clientHelloTemplates keeps, see
+// CacheSettings.ClientHellos.
+const DefaultMaxClientHellos = 64
+
+// clientHelloTemplates keeps the ClientHellos of the settings, the listeners and the intercepted fingerprints compiled,
+// so clients sending the same one don't parse it again.
+var clientHelloTemplates = &templateCache{
+	entries: newBoundedCache[templateKey, *clientHelloTemplate](cacheClientHellos, DefaultMaxClientHellos, 0),
+}
+
+type templateCache struct {
+	entries *boundedCache[templateKey, *clientHelloTemplate]
+}
+
+// templateKey identifies a clientHelloTemplate by its ClientHello and the one it sends after a HelloRetryRequest.
+type templateKey struct {
+	hello, retry HexClientHello
+}
+
+// clientHelloTemplate is a ClientHelloSpec compiled from a HexClientHello. It's never changed once compiled: the
+// handshake of every connection fills in the extensions of the spec it's given (its key shares, GREASE values, SNI
+// and session), so each one gets a deep copy of it, see spec.
+type clientHelloTemplate struct {
+	compiled utls.ClientHelloSpec
+
+	// rounds has the helloRound of each extension of compiled, if it was compiled along with the ClientHello sent
+	// after a HelloRetryRequest and they don't have the same extensions.
+	rounds []helloRound
+}
+
+// helloRound tells which of the ClientHellos of a handshake an extension is sent in.
+type helloRound uint8
+
+const (
+	bothHellos helloRound = iota
+	firstHelloOnly
+	retryHelloOnly
+)
+
+// compile returns the template of hexClientHello, compiling it unless it's cached. retry is the ClientHello to send
+// if the server answers with a HelloRetryRequest, or empty to let utls derive it from hexClientHello. Only its
+// extensions are taken: utls fills in the key share the server asked for and its cookie, like a client would.
+func (c *templateCache) compile(hexClientHello, retry HexClientHello) (*clientHelloTemplate, error) {
+	key := templateKey{hello: hexClientHello, retry: retry}
+	if template, ok := c.entries.get(key); ok {
+		return template, nil
+	}
+
+	spec, err := hexClientHello.ToClientHelloSpec()
+	if err != nil {
+		return nil, err
+	}
+	template := &clientHelloTemplate{compiled: spec}
+	if retry != "" {
+		// The first ClientHello is still replayed as it is if the second one can't be.
+		if err := template.addRetry(hexClientHello, retry); err != nil {
+			connectionLog.Warn("the ClientHello sent after a HelloRetryRequest can't be replayed, utls derives it from the first one", "error", err)
+		}
+	}
+	// Extensions that can't be copied would fail every handshake, so they fail the client instead.
+	if _, err := template.spec(); err != nil {
+		return nil, err
+	}
+
+	c.entries.put(key, template)
+
+	return template, nil
+}
+
+// addRetry merges the extensions of retry into the template of hexClientHello, so each ClientHello of a handshake
+// has the extensions of its counterpart. Both must have the extensions they share in the same order.
+func (t *clientHelloTemplate) addRetry(hexClientHello, retry HexClientHello) error {
+	firstIds, err := extensionIds(hexClientHello, len(t.compiled.Extensions))
+	if err != nil {
+		return err
+	}
+	retrySpec, err := retry.ToClientHelloSpec()
+	if err != nil {
+		return err
+	}
+	retryIds, err := extensionIds(retry, len(retrySpec.Extensions))
+	if err != nil {
+		return err
+	}
+
+	var extensions []utls.TLSExtension
+	var rounds []helloRound
+	add := func(extension utls.TLSExtension, id uint16, round helloRound) {
+		switch {
+		case id == utls.ExtensionCookie && round == retryHelloOnly:
+			// utls adds the cookie of the HelloRetryRequest itself.
+			return
+		case id == utls.ExtensionPadding:
+			// utls only pads a ClientHello of the lengths BoringSSL pads, so the padding follows either one.
+			round = bothHellos
+		}
+		extensions = append(extensions, extension)
+		rounds = append(rounds, round)
+	}
+
+	i, j := 0, 0
+	for i < len(firstIds) || j < len(retryIds) {
+		switch {
+		case i < len(firstIds) && j < len(retryIds) && firstIds[i] == retryIds[j]:
+			add(t.compiled.Extensions[i], firstIds[i], bothHellos)
+			i++
+			j++
+		case i < len(firstIds) && !slices.Contains(retryIds, firstIds[i]):
+			add(t.compiled.Extensions[i], firstIds[i], firstHelloOnly)
+			i++
+		case j < len(retryIds) && !slices.Contains(firstIds, retryIds[j]):
+			add(retrySpec.Extensions[j], retryIds[j], retryHelloOnly)
+			j++
+		default:
+			return errors.New("the ClientHellos have their extensions in different orders")
+		}
+	}
+	if !slices.Contains(retryIds, utls.ExtensionKeyShare) || !slices.Contains(firstIds, utls.ExtensionKeyShare) {
+		return errors.New("a ClientHello has no key share")
+	}
+
+	if slices.ContainsFunc(rounds, func(round helloRound) bool { return round != bothHellos }) {
+		t.compiled.Extensions, t.rounds = extensions, rounds
+	}
+
+	return nil
+}
+
+// extensionIds returns the types of the extensions of hexClientHello, with GREASE values as GREASE_PLACEHOLDER.
+// count is the number of extensions of its spec, which must match.
+func extensionIds(hexClientHello HexClientHello, count int) ([]uint16, error) {
+	raw, err := hex.DecodeString(string(hexClientHello))
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseClientHello(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Extensions) != count {
+		return nil, fmt.Errorf("the ClientHello has %d extensions, but its spec %d", len(info.Extensions), count)
+	}
+
+	ids := make([]uint16, len(info.Extensions))
+	for i, id := range info.Extensions {
+		if isGrease(id) {
+			id = utls.GREASE_PLACEHOLDER
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// spec returns a copy of the template for a connection, the SpecFactory of its ClientHelloID. It's called by the TLS
+// handshake on a goroutine of the transport, so it recovers from its panics itself.
+func (t *clientHelloTemplate) spec() (_ utls.ClientHelloSpec, err error) {
+	defer recoverPanicAsError(connectionLog, "client hello", &err)
+
+	spec, err := cloneClientHelloSpec(&t.compiled)
+	if err != nil || t.rounds == nil {
+		return spec, err
+	}
+
+	retry, err := newHelloRetry(spec.Extensions)
+	if err != nil {
+		return utls.ClientHelloSpec{}, err
+	}
+	for i, round := range t.rounds {
+		if round != bothHellos {
+			spec.Extensions[i] = &roundExtension{TLSExtension: spec.Extensions[i], retry: retry, round: round}
+		}
+	}
+	return spec, nil
+}
+
+// helloRetry tells whether the handshake of a spec got a HelloRetryRequest: utls then replaces the key shares of its
+// KeyShareExtension with one of the group the server asked for, which the first ClientHello didn't have a share of.
+type helloRetry struct {
+	keyShare *utls.KeyShareExtension
+	offered  []utls.CurveID
+}
+
+func newHelloRetry(extensions []utls.TLSExtension) (*helloRetry, error) {
+	for _, extension := range extensions {
+		if keyShare, ok := extension.(*utls.KeyShareExtension); ok {
+			retry := &helloRetry{keyShare: keyShare}
+			for _, share := range keyShare.KeyShares {
+				retry.offered = append(retry.offered, share.Group)
+			}
+			return retry, nil
+		}
+	}
+	return nil, errors.New("the client hello has no key share extension")
+}
+
+func (r *helloRetry) happened() bool {
+	return slices.ContainsFunc(r.keyShare.KeyShares, func(share utls.KeyShare) bool {
+		return !isGrease(uint16(share.Group)) && !slices.Contains(r.offered, share.Group)
+	})
+}
+
+// roundExtension is an extension that's only sent in one of the ClientHellos of a handshake. utls leaves out an
+// extension of length zero.
+type roundExtension struct {
+	utls.TLSExtension
+	retry *helloRetry
+	round helloRound
+}
+
+func (e *roundExtension) sent() bool {
+	return e.retry.happened() == (e.round == retryHelloOnly)
+}
+
+func (e *roundExtension) Len() int {
+	if !e.sent() {
+		return 0
+	}
+	return e.TLSExtension.Len()
+}
+
+func (e *roundExtension) Read(p []byte) (int, error) {
+	if !e.sent() {
+		return 0, io.EOF
+	}
+	return e.TLSExtension.Read(p)
+}
+
+// cloneClientHelloSpec returns a deep copy of spec, sharing nothing a handshake changes.
+func cloneClientHelloSpec(spec *utls.ClientHelloSpec) (utls.ClientHelloSpec, error) {
+	clone := *spec
+	clone.CipherSuites = slices.Clone(spec.CipherSuites)
+	clone.CompressionMethods = slices.Clone(spec.CompressionMethods)
+	clone.Extensions = make([]utls.TLSExtension, len(spec.Extensions))
+	for i, extension := range spec.Extensions {
+		cloned := cloneExtension(extension)
+		if cloned == nil {
+			return utls.ClientHelloSpec{}, fmt.Errorf("client hello extension %T can't be copied", extension)
+		}
+		clone.Extensions[i] = cloned
+	}
+	return clone, nil
+}
+
+// cloneExtension returns a deep copy of extension, or nil if it's of a type it doesn't know. The per-connection state
+// of the extensions that keep some (session tickets, ECH and PSK) starts over empty, like in a freshly parsed
+// ClientHello.
+func cloneExtension(extension utls.TLSExtension) utls.TLSExtension {
+	switch e := extension.(type) {
+	case *utls.SNIExtension:
+		c := *e
+		return &c
+	case *utls.StatusRequestExtension:
+		return &utls.StatusRequestExtension{}
+	case *utls.StatusRequestV2Extension:
+		return &utls.StatusRequestV2Extension{}
+	case *utls.SupportedCurvesExtension:
+		return &utls.SupportedCurvesExtension{Curves: slices.Clone(e.Curves)}
+	case *utls.SupportedPointsExtension:
+		return &utls.SupportedPointsExtension{SupportedPoints: slices.Clone(e.SupportedPoints)}
+	case *utls.SignatureAlgorithmsExtension:
+		return &utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: slices.Clone(e.SupportedSignatureAlgorithms)}
+	case *utls.SignatureAlgorithmsCertExtension:
+		return &utls.SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: slices.Clone(e.SupportedSignatureAlgorithms)}
+	case *utls.ALPNExtension:
+		return &utls.ALPNExtension{AlpnProtocols: slices.Clone(e.AlpnProtocols)}
+	case *utls.ApplicationSettingsExtension:
+		c := *e
+		c.SupportedProtocols = slices.Clone(e.SupportedProtocols)
+		return &c
+	case *utls.ApplicationSettingsExtensionNew:
+		c := *e
+		c.SupportedProtocols = slices.Clone(e.SupportedProtocols)
+		return &c
+	case *utls.SCTExtension:
+		return &utls.SCTExtension{}
+	case *utls.GenericExtension:
+		return &utls.GenericExtension{Id: e.Id, Data: slices.Clone(e.Data)}
+	case *utls.ExtendedMasterSecretExtension:
+		return &utls.ExtendedMasterSecretExtension{}
+	case *utls.UtlsGREASEExtension:
+		return &utls.UtlsGREASEExtension{Value: e.Value, Body: slices.Clone(e.Body)}
+	case *utls.UtlsPaddingExtension:
+		c := *e
+		return &c
+	case *utls.UtlsCompressCertExtension:
+		return &utls.UtlsCompressCertExtension{Algorithms: slices.Clone(e.Algorithms)}
+	case *utls.SessionTicketExtension:
+		return &utls.SessionTicketExtension{}
+	case *utls.KeyShareExtension:
+		keyShares := make([]utls.KeyShare, len(e.KeyShares))
+		for i, keyShare := range e.KeyShares {
+			keyShares[i] = utls.KeyShare{Group: keyShare.Group, Data: slices.Clone(keyShare.Data)}
+		}
+		return &utls.KeyShareExtension{KeyShares: keyShares}
+	case *utls.QUICTransportParametersExtension:
+		return &utls.QUICTransportParametersExtension{TransportParameters: slices.Clone(e.TransportParameters)}
+	case *utls.PSKKeyExchangeModesExtension:
+		return &utls.PSKKeyExchangeModesExtension{Modes: slices.Clone(e.Modes)}
+	case *utls.SupportedVersionsExtension:
+		return &utls.SupportedVersionsExtension{Versions: slices.Clone(e.Versions)}
+	case *utls.CookieExtension:
+		return &utls.CookieExtension{Cookie: slices.Clone(e.Cookie)}
+	case *utls.NPNExtension:
+		return &utls.NPNExtension{NextProtos: slices.Clone(e.NextProtos)}
+	case *utls.RenegotiationInfoExtension:
+		return &utls.RenegotiationInfoExtension{Renegotiation: e.Renegotiation, RenegotiatedConnection: slices.Clone(e.RenegotiatedConnection)}
+	case *utls.FakeChannelIDExtension:
+		c := *e
+		return &c
+	case *utls.FakeRecordSizeLimitExtension:
+		c := *e
+		return &c
+	case *utls.FakeTokenBindingExtension:
+		c := *e
+		c.KeyParameters = slices.Clone(e.KeyParameters)
+		return &c
+	case *utls.FakeDelegatedCredentialsExtension:
+		return &utls.FakeDelegatedCredentialsExtension{SupportedSignatureAlgorithms: slices.Clone(e.SupportedSignatureAlgorithms)}
+	case *utls.GREASEEncryptedClientHelloExtension:
+		return &utls.GREASEEncryptedClientHelloExtension{
+			CandidateCipherSuites: slices.Clone(e.CandidateCipherSuites),
+			CandidateConfigIds:    slices.Clone(e.CandidateConfigIds),
+			EncapsulatedKey:       slices.Clone(e.EncapsulatedKey),
+			CandidatePayloadLens:  slices.Clone(e.CandidatePayloadLens),
+		}
+	case *utls.UtlsPreSharedKeyExtension:
+		return &utls.UtlsPreSharedKeyExtension{OmitEmptyPsk: e.OmitEmptyPsk}
+	case *utls.FakePreSharedKeyExtension:
+		return &utls.FakePreSharedKeyExtension{Identities: slices.Clone(e.Identities), Binders: slices.Clone(e.Binders), OmitEmptyPsk: e.OmitEmptyPsk}
+	default:
+		return nil
+	}
+}
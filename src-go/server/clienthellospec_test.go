@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	utls "github.com/bogdanfinn/utls"
+)
+
+// testClientHello returns the ClientHello record that a uTLS client with id sends to serverName, as captured.
+func testClientHello(t *testing.T, id utls.ClientHelloID, serverName string) HexClientHello {
+	t.Helper()
+
+	record, err := buildClientHello(id, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return HexClientHello(hex.EncodeToString(record))
+}
+
+// assertNothingShared fails the test if clone points to any memory that original points to, path being where they
+// are in the specs.
+func assertNothingShared(t *testing.T, path string, original, clone reflect.Value) {
+	t.Helper()
+
+	switch original.Kind() {
+	case reflect.Pointer:
+		// Pointers to values of no size can be equal without sharing anything.
+		if original.IsNil() || clone.IsNil() || original.Type().Elem().Size() == 0 {
+			return
+		}
+		if original.Pointer() == clone.Pointer() {
+			t.Errorf("%s is shared", path)
+			return
+		}
+		assertNothingShared(t, path, original.Elem(), clone.Elem())
+	case reflect.Interface:
+		if !original.IsNil() && !clone.IsNil() {
+			assertNothingShared(t, fmt.Sprintf("%s(%s)", path, original.Elem().Type()), original.Elem(), clone.Elem())
+		}
+	case reflect.Slice:
+		if original.Len() > 0 && clone.Len() > 0 && original.Pointer() == clone.Pointer() {
+			t.Errorf("%s is shared", path)
+			return
+		}
+		for i := range min(original.Len(), clone.Len()) {
+			assertNothingShared(t, fmt.Sprintf("%s[%d]", path, i), original.Index(i), clone.Index(i))
+		}
+	case reflect.Struct:
+		for i := range original.NumField() {
+			assertNothingShared(t, path+"."+original.Type().Field(i).Name, original.Field(i), clone.Field(i))
+		}
+	case reflect.Map:
+		if !original.IsNil() && !clone.IsNil() && original.Pointer() == clone.Pointer() {
+			t.Errorf("%s is shared", path)
+		}
+	}
+}
+
+// dumpValue writes the values v holds to b, unexported fields included, so copies of the same spec write the same.
+// Functions aren't written, since they can't be compared.
+func dumpValue(b *strings.Builder, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Func:
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("nil")
+		} else {
+			dumpValue(b, v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		b.WriteString("[")
+		for i := range v.Len() {
+			dumpValue(b, v.Index(i))
+			b.WriteString(" ")
+		}
+		b.WriteString("]")
+	case reflect.Struct:
+		fmt.Fprintf(b, "%s{", v.Type())
+		for i := range v.NumField() {
+			fmt.Fprintf(b, "%s:", v.Type().Field(i).Name)
+			dumpValue(b, v.Field(i))
+			b.WriteString(" ")
+		}
+		b.WriteString("}")
+	case reflect.Bool:
+		fmt.Fprint(b, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprint(b, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprint(b, v.Uint())
+	case reflect.String:
+		fmt.Fprintf(b, "%q", v.String())
+	case reflect.Map:
+		fmt.Fprintf(b, "map(%d)", v.Len())
+	default:
+		fmt.Fprintf(b, "<%s>", v.Kind())
+	}
+}
+
+// dumpSpec returns what dumpValue writes for spec.
+func dumpSpec(spec *utls.ClientHelloSpec) string {
+	var b strings.Builder
+	dumpValue(&b, reflect.ValueOf(spec))
+	return b.String()
+}
+
+func TestCloneClientHelloSpecSharesNothing(t *testing.T) {
+	ids := []utls.ClientHelloID{utls.HelloChrome_131, utls.HelloChrome_133, utls.HelloFirefox_120, utls.HelloSafari_16_0, utls.HelloIOS_14}
+	for _, id := range ids {
+		t.Run(id.Str(), func(t *testing.T) {
+			templates := map[string]utls.ClientHelloSpec{}
+			if preset, err := utls.UTLSIdToSpec(id); err == nil {
+				templates["preset"] = preset
+			}
+			parsed, err := testClientHello(t, id, "clone.test").ToClientHelloSpec()
+			if err != nil {
+				t.Fatal(err)
+			}
+			templates["parsed"] = parsed
+
+			for name, template := range templates {
+				clone, err := cloneClientHelloSpec(&template)
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				if len(clone.Extensions) != len(template.Extensions) {
+					t.Fatalf("%s: cloned %d extensions of %d", name, len(clone.Extensions), len(template.Extensions))
+				}
+				for i := range template.Extensions {
+					if reflect.TypeOf(clone.Extensions[i]) != reflect.TypeOf(template.Extensions[i]) {
+						t.Errorf("%s: extension %d is a %T, want %T", name, i, clone.Extensions[i], template.Extensions[i])
+					}
+				}
+				assertNothingShared(t, name, reflect.ValueOf(template), reflect.ValueOf(clone))
+			}
+		})
+	}
+}
+
+func TestClientHelloTemplateRejectsUnknownExtensions(t *testing.T) {
+	type unknownExtension struct{ utls.GenericExtension }
+
+	spec := utls.ClientHelloSpec{Extensions: []utls.TLSExtension{&unknownExtension{}}}
+	if _, err := cloneClientHelloSpec(&spec); err == nil {
+		t.Error("cloned a spec with an extension of an unknown type")
+	}
+}
+
+// TestConcurrentHandshakesFromTemplate runs handshakes from one cached template at the same time, which the race
+// detector reports if they change what they share, and checks that the template stays as it was compiled.
+func TestConcurrentHandshakesFromTemplate(t *testing.T) {
+	hexClientHello := testClientHello(t, utls.HelloChrome_131, "template.test")
+	cache := &templateCache{entries: newBoundedCache[templateKey, *clientHelloTemplate](cacheClientHellos, DefaultMaxClientHellos, 0)}
+	template, err := cache.compile(hexClientHello, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := cache.compile(hexClientHello, ""); cached != template {
+		t.Fatal("the template wasn't cached")
+	}
+	compiled := dumpSpec(&template.compiled)
+
+	// The destination accepts TLS 1.2 too, so the handshakes exercise the PSK, session ticket and key share
+	// extensions either way.
+	origin := httptest.NewUnstartedServer(http.NotFoundHandler())
+	origin.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	origin.StartTLS()
+	defer origin.Close()
+
+	const handshakes = 32
+	hellos := make([][]byte, handshakes)
+	var wg sync.WaitGroup
+	for i := range handshakes {
+		wg.Go(func() {
+			conn, err := net.Dial("tcp", origin.Listener.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			id := utls.ClientHelloID{Client: "CustomFromHex", Version: "1", SpecFactory: template.spec}
+			uconn := utls.UClient(conn, &utls.Config{ServerName: "template.test", InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}, id, false, false, false)
+			if err := uconn.Handshake(); err != nil {
+				t.Errorf("handshake %d: %s", i, err)
+				return
+			}
+			hellos[i] = uconn.HandshakeState.Hello.Raw
+		})
+	}
+	wg.Wait()
+
+	seen := map[string]int{}
+	for i, hello := range hellos {
+		if hello == nil {
+			continue
+		}
+		if other, ok := seen[string(hello)]; ok {
+			t.Errorf("handshakes %d and %d sent the same ClientHello, random and key shares included", other, i)
+		}
+		seen[string(hello)] = i
+		if !bytes.Contains(hello, []byte("template.test")) {
+			t.Errorf("handshake %d didn't send its SNI", i)
+		}
+	}
+	if got := dumpSpec(&template.compiled); got != compiled {
+		t.Errorf("the handshakes changed the template:\n%s\nwas\n%s", got, compiled)
+	}
+}
+
+// TestClientHelloTemplateWithUnmergeableRetry compiles a ClientHello along with one sent after a HelloRetryRequest
+// whose extensions are in another order. The first one is still replayed, and utls derives the second from it.
+func TestClientHelloTemplateWithUnmergeableRetry(t *testing.T) {
+	base, err := utls.UTLSIdToSpec(utls.HelloChrome_131)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSpec, err := cloneClientHelloSpec(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retrySpec, err := cloneClientHelloSpec(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(retrySpec.Extensions)
+	first := HexClientHello(hex.EncodeToString(clientHelloOfSpec(t, "template.test", firstSpec)))
+	retry := HexClientHello(hex.EncodeToString(clientHelloOfSpec(t, "template.test", retrySpec)))
+
+	cache := &templateCache{entries: newBoundedCache[templateKey, *clientHelloTemplate](cacheClientHellos, DefaultMaxClientHellos, 0)}
+	template, err := cache.compile(first, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.rounds != nil {
+		t.Error("merged the extensions of ClientHellos that have them in different orders")
+	}
+	if len(template.compiled.Extensions) != len(firstSpec.Extensions) {
+		t.Errorf("the template has %d extensions, want the %d of the first ClientHello", len(template.compiled.Extensions), len(firstSpec.Extensions))
+	}
+}
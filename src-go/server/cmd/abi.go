@@ -0,0 +1,252 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"server"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// The awesome_tls_* exports are the stable C ABI for programs other than Burp, e.g. Python (ctypes) or Node (koffi).
+// Unlike the exports used by the extension, which may change along with it, their names and schemas stay compatible.
+//
+// Every function takes and returns UTF-8 JSON strings. The result is an object with either a "Result" field on
+// success (omitted by functions without a result) or an "Error" field (and, for settings, "SettingsErrors") on
+// failure. Returned strings are allocated by the library and must be released with awesome_tls_free_string.
+// Panics are recovered and returned as errors instead of crashing the host process.
+// See examples/ctypes_roundtrip.py for an example.
+
+// abiResult is the object returned by the awesome_tls_* exports.
+type abiResult struct {
+	Result         any                    `json:",omitempty"`
+	Error          string                 `json:",omitempty"`
+	SettingsErrors []server.SettingsError `json:",omitempty"`
+}
+
+// abiStartTimeout is how long awesome_tls_start_server waits for the spoof server to listen.
+const abiStartTimeout = 10 * time.Second
+
+// abiCall runs fn and returns its result or error as abiResult JSON, recovering from panics.
+func abiCall(fn func() (any, error)) (result *C.char) {
+	// The export calling abiCall names the panic. Its name is only looked up if there's one.
+	var caller [1]uintptr
+	runtime.Callers(2, caller[:])
+	defer func() {
+		if r := recover(); r != nil {
+			function := "C ABI call"
+			if f := runtime.FuncForPC(caller[0]); f != nil {
+				function = strings.TrimPrefix(f.Name(), "main.")
+			}
+			err := server.RecoveredPanic(function, r)
+			result = abiEncode(abiResult{Error: "internal error: " + err.Error()})
+		}
+	}()
+
+	value, err := fn()
+	if err != nil {
+		response := abiResult{Error: err.Error()}
+		var settingsErrs server.SettingsErrors
+		if errors.As(err, &settingsErrs) {
+			response.SettingsErrors = settingsErrs
+		}
+		return abiEncode(response)
+	}
+
+	return abiEncode(abiResult{Result: value})
+}
+
+func abiEncode(response abiResult) *C.char {
+	data, err := json.Marshal(response)
+	if err != nil {
+		data, _ = json.Marshal(abiResult{Error: err.Error()})
+	}
+	return C.CString(string(data))
+}
+
+// abiDecode decodes the JSON argument data into v. An empty or NULL argument leaves v as is.
+func abiDecode(data *C.char, v any) error {
+	if data == nil {
+		return nil
+	}
+	if input := C.GoString(data); input != "" {
+		if err := json.Unmarshal([]byte(input), v); err != nil {
+			return fmt.Errorf("invalid argument: %w", err)
+		}
+	}
+	return nil
+}
+
+// awesome_tls_free_string releases a string returned by any awesome_tls_* function.
+//
+//export awesome_tls_free_string
+func awesome_tls_free_string(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// awesome_tls_start_server starts the spoof server in the background.
+// Argument: {"Address": "[ip:]port or pipe://name"}, the address defaults to the SpoofProxyAddress setting.
+// Result: {"Address": "<address the spoof server listens on>"}.
+//
+//export awesome_tls_start_server
+func awesome_tls_start_server(options *C.char) *C.char {
+	return abiCall(func() (any, error) {
+		var args struct{ Address string }
+		if err := abiDecode(options, &args); err != nil {
+			return nil, err
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					done <- fmt.Errorf("internal error: %w", server.RecoveredPanic("awesome_tls_start_server", r))
+				}
+			}()
+			done <- server.StartServer(args.Address)
+		}()
+
+		deadline := time.After(abiStartTimeout)
+		for {
+			if addr := server.GetListenAddress(); addr != "" {
+				return struct{ Address string }{addr}, nil
+			}
+
+			select {
+			case err := <-done:
+				if err == nil {
+					err = errors.New("spoof server stopped")
+				}
+				return nil, err
+			case <-deadline:
+				return nil, errors.New("timed out waiting for the spoof server to start")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+}
+
+// awesome_tls_stop_server stops the spoof server and its proxies. Result: none.
+//
+//export awesome_tls_stop_server
+func awesome_tls_stop_server() *C.char {
+	return abiCall(func() (any, error) {
+		return nil, server.StopServer()
+	})
+}
+
+// awesome_tls_save_settings applies settings, see server.SaveSettings.
+// Argument: the settings object, in the format of the extension's settings. Result: none.
+// Rejected settings are listed in "SettingsErrors".
+//
+//export awesome_tls_save_settings
+func awesome_tls_save_settings(settings *C.char) *C.char {
+	return abiCall(func() (any, error) {
+		return nil, server.SaveSettings(C.GoString(settings))
+	})
+}
+
+// awesome_tls_send_request sends a request to its destination, see server.SendRequest.
+// Argument: {"Method", "Url", "Headers": [{"Name", "Value"}], "Body": "<base64>", "TransportConfig": "<JSON>"}.
+// Result: {"StatusCode", "Headers": [{"Name", "Value"}], "Body": "<base64>", "Truncated"}.
+//
+//export awesome_tls_send_request
+func awesome_tls_send_request(request *C.char) *C.char {
+	return abiCall(func() (any, error) {
+		return server.SendRequest(C.GoString(request))
+	})
+}
+
+// awesome_tls_get_fingerprints returns the names of the fingerprints that can be spoofed. Result: ["<name>", ...].
+//
+//export awesome_tls_get_fingerprints
+func awesome_tls_get_fingerprints() *C.char {
+	return abiCall(func() (any, error) {
+		return server.GetFingerprints(), nil
+	})
+}
+
+// awesome_tls_get_version returns the build information of the library, see server.VersionInfo.
+//
+//export awesome_tls_get_version
+func awesome_tls_get_version() *C.char {
+	return abiCall(func() (any, error) {
+		return server.GetVersion(), nil
+	})
+}
+
+// awesome_tls_get_connection_stats returns the open connections to destinations, see server.GetConnectionStats.
+// Result: {"Open": ..., "Active": ..., "Idle": ..., "Connections": [...], "Totals": {...}}.
+//
+//export awesome_tls_get_connection_stats
+func awesome_tls_get_connection_stats() *C.char {
+	return abiCall(func() (any, error) {
+		return server.GetConnectionStats(), nil
+	})
+}
+
+// awesome_tls_get_recent_errors returns the last errors, most recent first, see server.GetRecentErrors.
+// Result: [{"Time", "FirstTime", "Count", "Code", "Host", "TraceId", "Message"}, ...].
+//
+//export awesome_tls_get_recent_errors
+func awesome_tls_get_recent_errors() *C.char {
+	return abiCall(func() (any, error) {
+		return server.GetRecentErrors(), nil
+	})
+}
+
+// awesome_tls_clear_recent_errors forgets the errors returned by awesome_tls_get_recent_errors. Result: none.
+//
+//export awesome_tls_clear_recent_errors
+func awesome_tls_clear_recent_errors() *C.char {
+	return abiCall(func() (any, error) {
+		server.ClearRecentErrors()
+		return nil, nil
+	})
+}
+
+// awesome_tls_healthcheck runs the health checks, see server.HealthReport.
+//
+//export awesome_tls_healthcheck
+func awesome_tls_healthcheck() *C.char {
+	return abiCall(func() (any, error) {
+		return server.Healthcheck(), nil
+	})
+}
+
+// awesome_tls_get_logs returns the log records after the one numbered after, see server.GetLogs.
+// Result: [{"Sequence": ..., "Level": ..., "Message": ..., "Fields": {...}}, ...].
+//
+//export awesome_tls_get_logs
+func awesome_tls_get_logs(after C.ulonglong) *C.char {
+	return abiCall(func() (any, error) {
+		return server.GetLogs(uint64(after)), nil
+	})
+}
+
+// awesome_tls_export_wire_capture returns the capture of the request numbered request_id, see server.GetWireCapture.
+// Result: {"RequestId": ..., "Protocol": ..., "Request": {"Bytes": "<base64>", ...}, "Response": {...}, ...}.
+//
+//export awesome_tls_export_wire_capture
+func awesome_tls_export_wire_capture(request_id C.ulonglong) *C.char {
+	return abiCall(func() (any, error) {
+		return server.GetWireCapture(uint64(request_id))
+	})
+}
+
+// awesome_tls_build_curl_command builds a curl command that reproduces a request, see server.BuildCurlCommand.
+//
+//export awesome_tls_build_curl_command
+func awesome_tls_build_curl_command(request *C.char) *C.char {
+	return abiCall(func() (any, error) {
+		return server.BuildCurlCommand(C.GoString(request))
+	})
+}
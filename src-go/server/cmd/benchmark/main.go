@@ -0,0 +1,591 @@
+// Command benchmark measures the throughput of the spoof server against an in-process HTTPS origin, to compare
+// changes that affect performance. It prints its results in the format of Go benchmarks, so runs can be compared
+// with benchstat:
+//
+//	go run ./cmd/benchmark -count 5 > old.txt
+//	go run ./cmd/benchmark -count 5 > new.txt
+//	benchstat old.txt new.txt
+//
+// Run it with -pprof to profile the server while it runs, see Settings.PprofAddress. Benchmarks that check a bound,
+// like ConnectionBurst, fail the run if they exceed it.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"server"
+)
+
+// largeBodyBytes is the size of the body of the large download benchmark.
+const largeBodyBytes = 64 << 20
+
+// tunnelBytes is the number of bytes the tunnel benchmark downloads through the SOCKS proxy.
+const tunnelBytes = 1 << 30
+
+const (
+	// burstConnections is the number of connections the connection burst benchmark opens, burstDialers at a time.
+	// There are twice as many dialers as the server serves connections by default, so the rest wait for a slot.
+	burstConnections = 10000
+	burstDialers     = 2048
+
+	// maxClientConnections is the number of client connections the server serves at the same time by default.
+	maxClientConnections = 1024
+
+	// The bounds of the connection burst benchmark on the goroutines and the heap, beyond the ones before it started
+	// and the dialers' own. Every connection the server serves takes about a goroutine, and a few KB of buffers.
+	maxBurstGoroutines = maxClientConnections + 512
+	maxBurstHeapBytes  = 128 << 20
+)
+
+const (
+	// slowOriginLimit is the MaxConcurrentRequests of the slow origin benchmark, which streams twice as many responses
+	// slowly (each for slowOriginDuration) while it sends its fast requests, slowOriginWorkers at a time.
+	slowOriginLimit    = 16
+	slowOriginStreams  = 2 * slowOriginLimit
+	slowOriginDuration = 2 * time.Second
+	slowOriginRequests = 800
+	slowOriginWorkers  = 8
+
+	// maxSlowOriginP99 bounds the 99th percentile latency of the fast requests. One waiting for a slot held by a slow
+	// response would take about slowOriginDuration.
+	maxSlowOriginP99 = 250 * time.Millisecond
+)
+
+type benchmark struct {
+	name string
+
+	// ops is the number of requests the benchmark sends, and bytes the number of bytes it downloads per request,
+	// to report the throughput.
+	ops   int
+	bytes int64
+
+	run func(*client) error
+}
+
+var benchmarks = []benchmark{
+	{name: "Sequential", ops: 1000, run: sequential(1000)},
+	{name: "SequentialBurpConfig", ops: 1000, run: sequentialBurpConfig(1000)},
+	{name: "ParallelBurst", ops: 100, run: parallel(100)},
+	{name: "LargeBody", ops: 1, bytes: largeBodyBytes, run: largeBody},
+	{name: "Tunnel", ops: 1, bytes: tunnelBytes, run: tunnel},
+	{name: "ConnectionBurst", ops: burstConnections, run: connectionBurst},
+	{name: "SlowOrigin", ops: slowOriginRequests, run: slowOrigin},
+}
+
+func main() {
+	count := flag.Int("count", 1, "number of times to run each benchmark")
+	run := flag.String("run", "", "only run the benchmarks whose name contains this")
+	pprof := flag.String("pprof", "", "serve net/http/pprof on this loopback address while the benchmarks run")
+	verbose := flag.Bool("v", false, "print the server's log")
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	c, stop, err := setup(*pprof)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer stop()
+
+	fmt.Printf("goos: %s\ngoarch: %s\npkg: server/cmd/benchmark\n", runtime.GOOS, runtime.GOARCH)
+	for _, b := range benchmarks {
+		if !strings.Contains(b.name, *run) {
+			continue
+		}
+		for range *count {
+			if err := measure(c, b); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", b.name, err)
+				stop()
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// setup starts the origin and the spoof server, and returns a client that sends requests to the origin through it.
+func setup(pprofAddress string) (*client, func(), error) {
+	stateDir, err := os.MkdirTemp("", "awesometls-benchmark")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := server.SetStateDirectory(stateDir); err != nil {
+		os.RemoveAll(stateDir)
+		return nil, nil, err
+	}
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(serveOrigin))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+
+	source, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		origin.Close()
+		os.RemoveAll(stateDir)
+		return nil, nil, err
+	}
+	go serveSource(source)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.StartServer("127.0.0.1:0")
+	}()
+
+	stop := func() {
+		server.StopServer()
+		origin.Close()
+		source.Close()
+		os.RemoveAll(stateDir)
+	}
+
+	settings := map[string]any{
+		"SpoofProxyAddress": "127.0.0.1:0",
+		"PprofAddress":      pprofAddress,
+		"SocksProxy":        map[string]any{"Enabled": true, "Address": "127.0.0.1:0"},
+	}
+	if err := waitForListener(done); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	if err := saveSettings(settings, nil); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	originURL, _ := url.Parse(origin.URL)
+	config, _ := json.Marshal(map[string]string{"Host": originURL.Host, "Scheme": "https"})
+	// The configuration the extension sends along with a request from a browser.
+	burpConfig, _ := json.Marshal(map[string]any{
+		"Host":   originURL.Host,
+		"Scheme": "https",
+		"HeaderOrder": []string{
+			"Host", "Sec-Ch-Ua", "Sec-Ch-Ua-Mobile", "Sec-Ch-Ua-Platform", "Upgrade-Insecure-Requests", "User-Agent",
+			"Accept", "Sec-Fetch-Site", "Sec-Fetch-Mode", "Sec-Fetch-User", "Sec-Fetch-Dest", "Accept-Encoding",
+			"Accept-Language", "Priority",
+		},
+		"ExternalProxyUrl": "",
+	})
+
+	socks, err := proxy.SOCKS5("tcp", server.GetSocksProxyAddress(), nil, proxy.Direct)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	return &client{
+		address:    server.GetListenAddress(),
+		socks:      socks,
+		source:     source.Addr().String(),
+		spoof:      "https://" + server.GetListenAddress(),
+		config:     string(config),
+		burpConfig: string(burpConfig),
+		settings:   settings,
+		http: &http.Client{Transport: &http.Transport{
+			// The spoof server's certificate is self-signed.
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+			MaxIdleConnsPerHost: 100,
+			DisableCompression:  true,
+		}},
+	}, stop, nil
+}
+
+// saveSettings saves settings, with the ones of extra on top.
+func saveSettings(settings, extra map[string]any) error {
+	settings = maps.Clone(settings)
+	maps.Copy(settings, extra)
+	data, _ := json.Marshal(settings)
+	return server.SaveSettings(string(data))
+}
+
+// waitForListener waits for the spoof server to listen, or for it to fail to start.
+func waitForListener(done <-chan error) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for server.GetListenAddress() == "" {
+		select {
+		case err := <-done:
+			return fmt.Errorf("start server: %w", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("start server: timed out")
+		}
+	}
+	return nil
+}
+
+var largeBodyData = sync.OnceValue(func() []byte {
+	data := make([]byte, largeBodyBytes)
+	rand.Read(data)
+	return data
+})
+
+// slowStreams counts the responses to /slow the origin started.
+var slowStreams atomic.Int64
+
+// serveOrigin responds with a small body, the large one to /large, or one streamed over slowOriginDuration to /slow.
+func serveOrigin(w http.ResponseWriter, req *http.Request) {
+	io.Copy(io.Discard, req.Body)
+
+	switch req.URL.Path {
+	case "/large":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(largeBodyData())
+		return
+	case "/slow":
+		slowStreams.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		for range 10 {
+			io.WriteString(w, "slow\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(slowOriginDuration / 10)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"ok":true}`)
+}
+
+// serveSource sends tunnelBytes to each connection to listener, then closes it.
+func serveSource(listener net.Listener) {
+	data := make([]byte, 1<<20)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for range tunnelBytes / len(data) {
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+type client struct {
+	address string
+	spoof   string
+
+	// socks dials through the SOCKS proxy, which tunnels connections to source opaquely.
+	socks  proxy.Dialer
+	source string
+
+	// config only sets the destination, and burpConfig is like the ones the extension sends.
+	config     string
+	burpConfig string
+
+	http *http.Client
+
+	// settings are the settings the benchmarks start from.
+	settings map[string]any
+}
+
+// get sends a GET request for path to the origin and reads the response, failing unless it's a 200.
+func (c *client) get(path string) (int64, error) {
+	return c.getWith(path, c.config)
+}
+
+// getWith is like get, with the transport configuration config.
+func (c *client) getWith(path, config string) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.spoof+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(server.ConfigurationHeaderKey, config)
+	req.Header.Set("User-Agent", "awesome-tls-benchmark")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	n, err := io.Copy(io.Discard, res.Body)
+	if err != nil {
+		return n, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return n, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return n, nil
+}
+
+func sequential(n int) func(*client) error {
+	return func(c *client) error {
+		for range n {
+			if _, err := c.get("/"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func sequentialBurpConfig(n int) func(*client) error {
+	return func(c *client) error {
+		for range n {
+			if _, err := c.getWith("/", c.burpConfig); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func parallel(n int) func(*client) error {
+	return func(c *client) error {
+		errs := make(chan error, n)
+		for range n {
+			go func() {
+				_, err := c.get("/")
+				errs <- err
+			}()
+		}
+
+		var first error
+		for range n {
+			if err := <-errs; err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+}
+
+func largeBody(c *client) error {
+	n, err := c.get("/large")
+	if err != nil {
+		return err
+	}
+	if n != largeBodyBytes {
+		return fmt.Errorf("downloaded %d bytes instead of %d", n, largeBodyBytes)
+	}
+	return nil
+}
+
+// tunnel downloads tunnelBytes from the source through the SOCKS proxy.
+func tunnel(c *client) error {
+	conn, err := c.socks.Dial("tcp", c.source)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil {
+		return err
+	}
+	if n != tunnelBytes {
+		return fmt.Errorf("downloaded %d bytes instead of %d", n, tunnelBytes)
+	}
+	return nil
+}
+
+// connectionBurst opens burstConnections connections to the spoof server that never send a request, like clients
+// that give up or stall, checking that the goroutines and the heap of the process stay bounded meanwhile, and that
+// requests still succeed afterwards.
+func connectionBurst(c *client) error {
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	done := make(chan struct{})
+	peaks := make(chan [2]uint64, 1)
+	go func() {
+		var peakGoroutines, peakHeap uint64
+		var stats runtime.MemStats
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			peakGoroutines = max(peakGoroutines, uint64(runtime.NumGoroutine()))
+			runtime.ReadMemStats(&stats)
+			peakHeap = max(peakHeap, stats.HeapInuse)
+			select {
+			case <-done:
+				peaks <- [2]uint64{peakGoroutines, peakHeap}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var remaining atomic.Int64
+	remaining.Store(burstConnections)
+	errs := make(chan error, burstDialers)
+	for range burstDialers {
+		go func() {
+			for remaining.Add(-1) >= 0 {
+				if err := holdConnection(c.address); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	var first error
+	for range burstDialers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	close(done)
+	peak := <-peaks
+	if first != nil {
+		return first
+	}
+
+	// The goroutine sampling the peaks is one of them.
+	if grown := int(peak[0]) - goroutines - burstDialers - 1; grown > maxBurstGoroutines {
+		return fmt.Errorf("goroutines grew by %d, more than %d", grown, maxBurstGoroutines)
+	}
+	if grown := int64(peak[1]) - int64(before.HeapInuse); grown > maxBurstHeapBytes {
+		return fmt.Errorf("heap grew by %d bytes, more than %d", grown, maxBurstHeapBytes)
+	}
+
+	_, err := c.get("/")
+	return err
+}
+
+// slowOrigin streams slowOriginStreams slow responses while it sends the fast requests, checking that they don't wait
+// for the slow ones although these are more than MaxConcurrentRequests.
+func slowOrigin(c *client) error {
+	if err := saveSettings(c.settings, map[string]any{"MaxConcurrentRequests": slowOriginLimit}); err != nil {
+		return err
+	}
+	defer saveSettings(c.settings, nil)
+
+	started := slowStreams.Load()
+	streams := make(chan error, slowOriginStreams)
+	for range slowOriginStreams {
+		go func() {
+			_, err := c.get("/slow")
+			streams <- err
+		}()
+	}
+
+	// Until as many streams as the limit have started, the fast requests could still get slots of their own.
+	deadline := time.Now().Add(10 * time.Second)
+	for slowStreams.Load()-started < slowOriginLimit {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("slow responses didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var remaining atomic.Int64
+	remaining.Store(slowOriginRequests)
+	latencies := make(chan []time.Duration, slowOriginWorkers)
+	errs := make(chan error, slowOriginWorkers)
+	for range slowOriginWorkers {
+		go func() {
+			var measured []time.Duration
+			defer func() { latencies <- measured }()
+			for remaining.Add(-1) >= 0 {
+				start := time.Now()
+				if _, err := c.get("/"); err != nil {
+					errs <- err
+					return
+				}
+				measured = append(measured, time.Since(start))
+			}
+			errs <- nil
+		}()
+	}
+
+	var first error
+	var all []time.Duration
+	for range slowOriginWorkers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+		all = append(all, <-latencies...)
+	}
+	for range slowOriginStreams {
+		if err := <-streams; err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return first
+	}
+
+	slices.Sort(all)
+	if p99 := all[len(all)*99/100]; p99 > maxSlowOriginP99 {
+		return fmt.Errorf("99th percentile latency was %s, more than %s", p99, maxSlowOriginP99)
+	}
+	return nil
+}
+
+// holdConnection opens a connection to address and keeps it open without sending anything, until the server closes it
+// or a second passes.
+func holdConnection(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(make([]byte, 1))
+	return nil
+}
+
+// measure runs b once, after a warm-up run that opens the connections, and prints its result.
+// The allocations include the ones of the benchmark's client and the origin, which run in the same process.
+func measure(c *client, b benchmark) error {
+	if err := b.run(c); err != nil {
+		return err
+	}
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	if err := b.run(c); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	ops := uint64(b.ops)
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "Benchmark%s-%d\t%d\t%d ns/op", b.name, runtime.GOMAXPROCS(0), b.ops, elapsed.Nanoseconds()/int64(b.ops))
+	if b.bytes > 0 {
+		fmt.Fprintf(&line, "\t%.2f MB/s", float64(b.bytes)*float64(b.ops)/1e6/elapsed.Seconds())
+	}
+	fmt.Fprintf(&line, "\t%d B/op\t%d allocs/op", (after.TotalAlloc-before.TotalAlloc)/ops, (after.Mallocs-before.Mallocs)/ops)
+	fmt.Println(line.String())
+
+	return nil
+}
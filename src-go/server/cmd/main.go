@@ -3,6 +3,8 @@ package main
 import "C"
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -10,15 +12,28 @@ import (
 	"strings"
 )
 
+// recoverExport recovers from a panic of the exported function named function, which would otherwise abort the
+// process Burp runs in, and returns it as the function's error in *result, if it has one. It must be deferred directly.
+func recoverExport(function string, result **C.char) {
+	if r := recover(); r != nil {
+		err := server.RecoveredPanic(function, r)
+		if result != nil {
+			*result = C.CString("internal error: " + err.Error())
+		}
+	}
+}
+
 func main() {
-	spoofAddr := flag.String("spoof", "", "Spoof proxy address to listen on ([ip:]port)")
+	spoofAddr := flag.String("spoof", "", "Spoof proxy address to listen on ([ip:]port), defaults to $AWESOME_TLS_SPOOF_ADDRESS")
 	flag.Parse()
 
 	log.Fatalln(server.StartServer(*spoofAddr))
 }
 
 //export StartServer
-func StartServer(spoofAddr *C.char) *C.char {
+func StartServer(spoofAddr *C.char) (result *C.char) {
+	defer recoverExport("StartServer", &result)
+
 	if err := server.StartServer(C.GoString(spoofAddr)); err != nil {
 		return C.CString(err.Error())
 	}
@@ -26,19 +41,376 @@ func StartServer(spoofAddr *C.char) *C.char {
 }
 
 //export StopServer
-func StopServer() *C.char {
+func StopServer() (result *C.char) {
+	defer recoverExport("StopServer", &result)
+
 	if err := server.StopServer(); err != nil {
 		return C.CString(err.Error())
 	}
 	return C.CString("")
 }
 
+//export StartListener
+func StartListener(name *C.char) (result *C.char) {
+	defer recoverExport("StartListener", &result)
+
+	if err := server.StartListener(C.GoString(name)); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export StopListener
+func StopListener(name *C.char) (result *C.char) {
+	defer recoverExport("StopListener", &result)
+
+	if err := server.StopListener(C.GoString(name)); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export GetListeners
+func GetListeners() (result *C.char) {
+	defer recoverExport("GetListeners", &result)
+
+	data, err := json.Marshal(server.GetListeners())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export GetListenAddress
+func GetListenAddress() (result *C.char) {
+	defer recoverExport("GetListenAddress", &result)
+
+	return C.CString(server.GetListenAddress())
+}
+
+//export GetForwardProxyAddress
+func GetForwardProxyAddress() (result *C.char) {
+	defer recoverExport("GetForwardProxyAddress", &result)
+
+	return C.CString(server.GetForwardProxyAddress())
+}
+
+//export GetSocksProxyAddress
+func GetSocksProxyAddress() (result *C.char) {
+	defer recoverExport("GetSocksProxyAddress", &result)
+
+	return C.CString(server.GetSocksProxyAddress())
+}
+
+//export GetAdminToken
+func GetAdminToken() (result *C.char) {
+	defer recoverExport("GetAdminToken", &result)
+
+	return C.CString(server.GetAdminToken())
+}
+
+//export GetInterceptListenAddresses
+func GetInterceptListenAddresses() (result *C.char) {
+	defer recoverExport("GetInterceptListenAddresses", &result)
+
+	return C.CString(strings.Join(server.GetInterceptListenAddresses(), ","))
+}
+
+//export GetClientCertificate
+func GetClientCertificate() (result *C.char) {
+	defer recoverExport("GetClientCertificate", &result)
+
+	document, err := server.GetClientCertificate()
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(document)
+}
+
+//export LoadPersistedSettings
+func LoadPersistedSettings(projectId *C.char) (result *C.char) {
+	defer recoverExport("LoadPersistedSettings", &result)
+
+	settings, err := server.LoadPersistedSettings(C.GoString(projectId))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(settings)
+}
+
+//export SaveSettings
+func SaveSettings(settings *C.char) (result *C.char) {
+	defer recoverExport("SaveSettings", &result)
+
+	if err := server.SaveSettings(C.GoString(settings)); err != nil {
+		var settingsErrs server.SettingsErrors
+		if errors.As(err, &settingsErrs) {
+			return C.CString(settingsErrs.JSON())
+		}
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export RegisterTransportConfig
+func RegisterTransportConfig(request, config *C.char) (result *C.char) {
+	defer recoverExport("RegisterTransportConfig", &result)
+
+	if err := server.RegisterTransportConfig(C.GoString(request), C.GoString(config)); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export ExportConfiguration
+func ExportConfiguration(includeSecrets bool) (result *C.char) {
+	defer recoverExport("ExportConfiguration", &result)
+
+	document, err := server.ExportConfiguration(includeSecrets)
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(document)
+}
+
+//export ImportConfiguration
+func ImportConfiguration(document *C.char) (result *C.char) {
+	defer recoverExport("ImportConfiguration", &result)
+
+	results, err := server.ImportConfiguration(C.GoString(document))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
 //export SmokeTest
 func SmokeTest() {
+	defer recoverExport("SmokeTest", nil)
+
 	fmt.Println("smoke test success")
 }
 
 //export GetFingerprints
-func GetFingerprints() *C.char {
+func GetFingerprints() (result *C.char) {
+	defer recoverExport("GetFingerprints", &result)
+
 	return C.CString(strings.Join(server.GetFingerprints(), "\n"))
 }
+
+//export GetRetryPolicy
+func GetRetryPolicy() (result *C.char) {
+	defer recoverExport("GetRetryPolicy", &result)
+
+	data, err := json.Marshal(server.GetRetryPolicy())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export ListProfiles
+func ListProfiles() (result *C.char) {
+	defer recoverExport("ListProfiles", &result)
+
+	data, err := json.Marshal(server.ListProfiles())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export GetCapturedFingerprints
+func GetCapturedFingerprints() (result *C.char) {
+	defer recoverExport("GetCapturedFingerprints", &result)
+
+	data, err := json.Marshal(server.GetCapturedFingerprints())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export DeleteCapturedFingerprint
+func DeleteCapturedFingerprint(key *C.char) (result *C.char) {
+	defer recoverExport("DeleteCapturedFingerprint", &result)
+
+	if err := server.DeleteCapturedFingerprint(C.GoString(key)); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export ExportCapturedFingerprint
+func ExportCapturedFingerprint(host *C.char) (result *C.char) {
+	defer recoverExport("ExportCapturedFingerprint", &result)
+
+	document, err := server.ExportCapturedFingerprint(C.GoString(host))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(document)
+}
+
+//export ImportCapturedFingerprint
+func ImportCapturedFingerprint(document *C.char) (result *C.char) {
+	defer recoverExport("ImportCapturedFingerprint", &result)
+
+	if err := server.ImportCapturedFingerprint(C.GoString(document)); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export ClearCapturedFingerprints
+func ClearCapturedFingerprints() {
+	defer recoverExport("ClearCapturedFingerprints", nil)
+
+	server.ClearCapturedFingerprints()
+}
+
+//export ClearDnsCache
+func ClearDnsCache() {
+	defer recoverExport("ClearDnsCache", nil)
+
+	server.ClearDnsCache()
+}
+
+//export StartRecording
+func StartRecording(options *C.char) (result *C.char) {
+	defer recoverExport("StartRecording", &result)
+
+	if err := server.StartRecording(C.GoString(options)); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export StopRecording
+func StopRecording() {
+	defer recoverExport("StopRecording", nil)
+
+	server.StopRecording()
+}
+
+//export ExportHar
+func ExportHar() (result *C.char) {
+	defer recoverExport("ExportHar", &result)
+
+	har, err := server.ExportHar()
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(har)
+}
+
+//export ExportWireCapture
+func ExportWireCapture(requestId C.longlong) (result *C.char) {
+	defer recoverExport("ExportWireCapture", &result)
+
+	capture, err := server.ExportWireCapture(uint64(requestId))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(capture)
+}
+
+//export GetLogs
+func GetLogs(after C.longlong) (result *C.char) {
+	defer recoverExport("GetLogs", &result)
+
+	data, err := json.Marshal(server.GetLogs(uint64(after)))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export BuildCurlCommand
+func BuildCurlCommand(request *C.char) (result *C.char) {
+	defer recoverExport("BuildCurlCommand", &result)
+
+	command, err := server.BuildCurlCommand(C.GoString(request))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export GetVersion
+func GetVersion() (result *C.char) {
+	defer recoverExport("GetVersion", &result)
+
+	data, err := json.Marshal(server.GetVersion())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export GetConnectionStats
+func GetConnectionStats() (result *C.char) {
+	defer recoverExport("GetConnectionStats", &result)
+
+	data, err := json.Marshal(server.GetConnectionStats())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export GetRecentErrors
+func GetRecentErrors() (result *C.char) {
+	defer recoverExport("GetRecentErrors", &result)
+
+	data, err := json.Marshal(server.GetRecentErrors())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
+
+//export ClearRecentErrors
+func ClearRecentErrors() {
+	defer recoverExport("ClearRecentErrors", nil)
+
+	server.ClearRecentErrors()
+}
+
+//export Healthcheck
+func Healthcheck() (result *C.char) {
+	defer recoverExport("Healthcheck", &result)
+
+	data, err := json.Marshal(server.Healthcheck())
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString(string(data))
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"hash/maphash"
+)
+
+// DefaultMaxRequestConfigurations is the default number of parsed request configurations a configCache keeps, see
+// CacheSettings.RequestConfigurations.
+const DefaultMaxRequestConfigurations = 256
+
+// configCache keeps the configurations that requests sent recently, parsed, since Intruder sends the same one with
+// thousands of requests in a row. Entries are looked up by a hash of the configuration and of the listener whose
+// defaults it was parsed on, and compared in full, so configurations whose hashes collide are only parsed again.
+// Each transportState has its own cache, which starts over empty when the settings change.
+type configCache struct {
+	seed    maphash.Seed
+	entries *boundedCache[uint64, *cachedConfig]
+}
+
+type cachedConfig struct {
+	listener string
+	data     string
+	config   TransportConfig
+}
+
+func newConfigCache(maxEntries int) *configCache {
+	return &configCache{
+		seed:    maphash.MakeSeed(),
+		entries: newBoundedCache[uint64, *cachedConfig](cacheRequestConfigurations, maxEntries, 0),
+	}
+}
+
+// parse returns the configuration data parses to on top of defaults, the defaults of requests to listener, like
+// ParseTransportConfig does. The configuration is a copy the request can change.
+func (c *configCache) parse(listener, data string, defaults TransportConfig) (*TransportConfig, error) {
+	key := c.key(listener, data)
+	if entry, ok := c.entries.get(key); ok && entry.listener == listener && entry.data == data {
+		config := entry.config.clone()
+		return &config, nil
+	}
+
+	config, err := ParseTransportConfig(data, defaults)
+	if err != nil {
+		// Invalid configurations are rare, and not worth keeping.
+		return nil, err
+	}
+
+	// Either another request parsed the same configuration meanwhile, or this one's hash collides with the entry's.
+	// Either way, the entry is replaced.
+	c.entries.put(key, &cachedConfig{listener: listener, data: data, config: config.clone()})
+
+	return config, nil
+}
+
+// key returns the key of the entry of data parsed on the defaults of listener.
+func (c *configCache) key(listener, data string) uint64 {
+	var hash maphash.Hash
+	hash.SetSeed(c.seed)
+	hash.WriteString(listener)
+	hash.WriteByte(0)
+	hash.WriteString(data)
+	return hash.Sum64()
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConfigCacheNeverMixesUpConfigurations(t *testing.T) {
+	cache := newConfigCache(DefaultMaxRequestConfigurations)
+	listenerDefaults := map[string]TransportConfig{
+		"":      {Fingerprint: "chrome_131", HttpTimeout: 30},
+		"other": {Fingerprint: "firefox_120", HttpTimeout: 10},
+	}
+
+	// Configurations that differ in a single byte, or only by the listener they're sent to, parse each to their own.
+	// Twice, so the second round is served from the cache.
+	for round := range 2 {
+		for listener, defaults := range listenerDefaults {
+			for i := range 64 {
+				data := fmt.Sprintf(`{"Host":"host%d.test:443","HttpTimeout":%d}`, i%8, 1+i/8)
+				want, err := ParseTransportConfig(data, defaults)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := cache.parse(listener, data, defaults)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("round %d, listener %q: %s parsed to %+v, want %+v", round, listener, data, got, want)
+				}
+			}
+		}
+	}
+	if got := cache.entries.len(); got != 2*64 {
+		t.Errorf("the cache has %d entries, want one for each of the %d configurations", got, 2*64)
+	}
+}
+
+func TestConfigCacheHashCollision(t *testing.T) {
+	cache := newConfigCache(DefaultMaxRequestConfigurations)
+	defaults := TransportConfig{Fingerprint: "chrome_131"}
+	first, second := `{"Host":"first.test:443"}`, `{"Host":"second.test:443"}`
+
+	// The entry of the first configuration is stored under the key of the second, as if their hashes collided.
+	if _, err := cache.parse("", first, defaults); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := cache.entries.get(cache.key("", first))
+	cache.entries.put(cache.key("", second), entry)
+
+	config, err := cache.parse("", second, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "second.test:443" {
+		t.Errorf("the second configuration parsed to the host %q of the first", config.Host)
+	}
+	if entry, _ := cache.entries.get(cache.key("", second)); entry.data != second {
+		t.Errorf("the colliding entry holds %s, want it replaced by %s", entry.data, second)
+	}
+}
+
+func TestConfigCacheReturnsCopies(t *testing.T) {
+	cache := newConfigCache(DefaultMaxRequestConfigurations)
+	data := `{"Host":"copies.test:443","HeaderOrder":["accept","user-agent"],"MaxResponseBytes":1024}`
+
+	config, err := cache.parse("", data, TransportConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Host = "changed.test:443"
+	config.HeaderOrder[0] = "changed"
+	*config.MaxResponseBytes = 1
+
+	cached, err := cache.parse("", data, TransportConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Host != "copies.test:443" || cached.HeaderOrder[0] != "accept" || *cached.MaxResponseBytes != 1024 {
+		t.Errorf("changing a parsed configuration changed the cached one: %+v", cached)
+	}
+}
+
+// BenchmarkConfigCache compares parsing the configuration Intruder sends with every request against looking it up in
+// the cache, with the cache full of others.
+func BenchmarkConfigCache(b *testing.B) {
+	data := `{"Host":"intruder.test:443","Scheme":"https","Fingerprint":"chrome_131","HttpTimeout":30,` +
+		`"HeaderOrder":["host","user-agent","accept","accept-language","accept-encoding","cookie"],"UseInterceptedFingerprint":true}`
+	defaults := TransportConfig{Fingerprint: "chrome_131", HttpTimeout: 30}
+
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := ParseTransportConfig(data, defaults); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		cache := newConfigCache(DefaultMaxRequestConfigurations)
+		for i := range DefaultMaxRequestConfigurations - 1 {
+			cache.parse("", fmt.Sprintf(`{"Host":"other%d.test:443"}`, i), defaults)
+		}
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := cache.parse("", data, defaults); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
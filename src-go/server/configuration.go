@@ -0,0 +1,239 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ConfigurationDocumentVersion is the version of the document format used by ExportConfiguration.
+const ConfigurationDocumentVersion = 1
+
+// ConfigurationDocument reproduces the effective configuration on another machine,
+// see ExportConfiguration and ImportConfiguration.
+type ConfigurationDocument struct {
+	Version int
+
+	// Secrets lists the fields of the document that contain secrets, e.g. `Settings.ExternalProxyUrl`.
+	// It's empty unless the document was exported with secrets.
+	Secrets []string
+
+	// Settings as passed to SaveSettings. Older schema versions are migrated on import.
+	Settings json.RawMessage
+
+	CapturedFingerprints []CapturedFingerprintDocument
+
+	// CertificateAuthority is nil if the spoof server hasn't created a CA yet.
+	CertificateAuthority *CertificateAuthorityDocument
+}
+
+// CertificateAuthorityDocument contains the CA used by the spoof server.
+type CertificateAuthorityDocument struct {
+	// DER encoded certificate.
+	Certificate []byte
+
+	// PKCS #8 private key. Only included when exporting with secrets.
+	PrivateKey []byte
+}
+
+// Sections of a ConfigurationDocument, as reported by ImportConfiguration.
+const (
+	ConfigurationSectionSettings             = "Settings"
+	ConfigurationSectionCapturedFingerprints = "CapturedFingerprints"
+	ConfigurationSectionCertificateAuthority = "CertificateAuthority"
+)
+
+// ConfigurationImportResult reports whether a section of a ConfigurationDocument was imported.
+type ConfigurationImportResult struct {
+	Section  string
+	Imported bool
+	Error    string
+}
+
+// ExportConfiguration returns the last saved settings, the captured fingerprints and the CA as a JSON document.
+// Secrets (proxy passwords and the CA's private key) are only included if includeSecrets is true.
+func ExportConfiguration(includeSecrets bool) (string, error) {
+	doc := ConfigurationDocument{
+		Version: ConfigurationDocumentVersion,
+	}
+
+	settings, secrets := copySettings(state.Load().settings, includeSecrets)
+	settings.SchemaVersion = SettingsSchemaVersion
+	for _, field := range secrets {
+		doc.Secrets = append(doc.Secrets, ConfigurationSectionSettings+"."+field)
+	}
+
+	var err error
+	if doc.Settings, err = json.Marshal(settings); err != nil {
+		return "", err
+	}
+
+	for _, fingerprint := range captures.list() {
+		doc.CapturedFingerprints = append(doc.CapturedFingerprints, newCapturedFingerprintDocument(fingerprint))
+	}
+
+	cert, priv, err := exportCertificateAuthority()
+	if err != nil {
+		return "", fmt.Errorf("certificate authority: %w", err)
+	}
+
+	if cert != nil {
+		doc.CertificateAuthority = &CertificateAuthorityDocument{Certificate: cert}
+		if includeSecrets {
+			doc.CertificateAuthority.PrivateKey = priv
+			doc.Secrets = append(doc.Secrets, ConfigurationSectionCertificateAuthority+".PrivateKey")
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// ImportConfiguration applies a document created by ExportConfiguration.
+// Each section is imported independently, so an invalid section doesn't prevent the others from being imported.
+// Settings are validated the same way as by SaveSettings.
+// The returned error is only non-nil if the document itself can't be read.
+func ImportConfiguration(document string) ([]ConfigurationImportResult, error) {
+	if strings.TrimSpace(document) == "" {
+		return nil, errors.New("missing configuration document")
+	}
+
+	var doc ConfigurationDocument
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case doc.Version == 0:
+		return nil, errors.New("configuration document has no version")
+	case doc.Version > ConfigurationDocumentVersion:
+		return nil, fmt.Errorf("unsupported configuration document version %d (supported up to %d)", doc.Version, ConfigurationDocumentVersion)
+	}
+
+	var results []ConfigurationImportResult
+
+	if len(doc.Settings) > 0 {
+		results = append(results, newConfigurationImportResult(ConfigurationSectionSettings, SaveSettings(string(doc.Settings))))
+	}
+
+	if len(doc.CapturedFingerprints) > 0 {
+		var errs []error
+		for _, fingerprint := range doc.CapturedFingerprints {
+			if err := importCapturedFingerprintDocument(fingerprint); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", captureKey(cmp.Or(fingerprint.SNI, fingerprint.Host), fingerprint.Port), err))
+			}
+		}
+		results = append(results, newConfigurationImportResult(ConfigurationSectionCapturedFingerprints, errors.Join(errs...)))
+	}
+
+	if ca := doc.CertificateAuthority; ca != nil {
+		var err error
+		if len(ca.PrivateKey) == 0 {
+			err = errors.New("exported without its private key")
+		} else {
+			err = importCertificateAuthority(ca.Certificate, ca.PrivateKey)
+		}
+		results = append(results, newConfigurationImportResult(ConfigurationSectionCertificateAuthority, err))
+	}
+
+	return results, nil
+}
+
+func newConfigurationImportResult(section string, err error) ConfigurationImportResult {
+	if err != nil {
+		return ConfigurationImportResult{Section: section, Error: err.Error()}
+	}
+	return ConfigurationImportResult{Section: section, Imported: true}
+}
+
+// hasPassword reports whether rawURL contains a password.
+// copySettings returns a copy of settings that doesn't share the lists and maps that contain secrets,
+// with the passwords removed from its proxy URLs unless includeSecrets is true.
+// It also returns the fields of the copy that contain secrets, which is only non-empty if includeSecrets is true.
+func copySettings(settings *Settings, includeSecrets bool) (Settings, []string) {
+	result := *settings
+	result.Listeners = slices.Clone(result.Listeners)
+	// Profiles are values, so the ones whose password is removed are replaced in a copy of the map.
+	result.Profiles = maps.Clone(result.Profiles)
+
+	var secrets []string
+
+	fields := map[string]*string{
+		"ExternalProxyUrl":          &result.ExternalProxyUrl,
+		"InterceptUpstreamProxyUrl": &result.InterceptUpstreamProxyUrl,
+	}
+	for i := range result.Listeners {
+		fields[fmt.Sprintf("Listeners[%d].ExternalProxyUrl", i)] = &result.Listeners[i].ExternalProxyUrl
+	}
+
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		value := fields[field]
+		if !hasPassword(*value) {
+			continue
+		}
+		if includeSecrets {
+			secrets = append(secrets, field)
+		} else {
+			*value = withoutPassword(*value)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(result.Profiles)) {
+		profile := result.Profiles[name]
+		if !hasPassword(profile.ExternalProxyUrl) {
+			continue
+		}
+		if includeSecrets {
+			secrets = append(secrets, fmt.Sprintf("Profiles[%s].ExternalProxyUrl", name))
+		} else {
+			profile.ExternalProxyUrl = withoutPassword(profile.ExternalProxyUrl)
+			result.Profiles[name] = profile
+		}
+	}
+
+	if result.SocksProxy.Password != "" {
+		if includeSecrets {
+			secrets = append(secrets, "SocksProxy.Password")
+		} else {
+			result.SocksProxy.Password = ""
+		}
+	}
+
+	if result.AdminToken != "" {
+		if includeSecrets {
+			secrets = append(secrets, "AdminToken")
+		} else {
+			result.AdminToken = ""
+		}
+	}
+
+	return result, secrets
+}
+
+func hasPassword(rawURL string) bool {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.User == nil {
+		return false
+	}
+	_, ok := parsedURL.User.Password()
+	return ok
+}
+
+// withoutPassword removes the password from rawURL, keeping the username.
+func withoutPassword(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.User == nil {
+		return rawURL
+	}
+	parsedURL.User = url.User(parsedURL.User.Username())
+	return parsedURL.String()
+}
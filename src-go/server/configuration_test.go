@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+// TestExportConfigurationWithoutACertificateAuthority exports the configuration before the spoof server created a
+// CA. The document has no CA section, and no CA is created for it.
+func TestExportConfigurationWithoutACertificateAuthority(t *testing.T) {
+	root := stateRoot.Load()
+	if err := SetStateDirectory(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stateRoot.Store(root) })
+
+	data, err := ExportConfiguration(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc ConfigurationDocument
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.CertificateAuthority != nil {
+		t.Error("exported a CA that didn't exist")
+	}
+	for _, file := range []string{caFile, caKeyFile} {
+		if _, err := os.Stat(path.Join(stateDirectory(""), file)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("exporting created %s (%v)", file, err)
+		}
+	}
+}
+
+// TestConfigurationRoundTripsTheCertificateAuthority imports the CA of an exported configuration into a state
+// directory that has none, and checks that the same CA is exported from there, with no temporary file left behind.
+func TestConfigurationRoundTripsTheCertificateAuthority(t *testing.T) {
+	if _, _, err := NewCertificateAuthority(); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ExportConfiguration(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc ConfigurationDocument
+	if err := json.Unmarshal([]byte(exported), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.CertificateAuthority == nil || len(doc.CertificateAuthority.PrivateKey) == 0 {
+		t.Fatal("the CA wasn't exported with its private key")
+	}
+
+	root := stateRoot.Load()
+	dir := t.TempDir()
+	if err := SetStateDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stateRoot.Store(root) })
+
+	if err := importCertificateAuthority(doc.CertificateAuthority.Certificate, doc.CertificateAuthority.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	cert, priv, err := exportCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != string(doc.CertificateAuthority.Certificate) || string(priv) != string(doc.CertificateAuthority.PrivateKey) {
+		t.Error("exported another CA than the imported one")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != caFile && name != caKeyFile {
+			t.Errorf("importing left %s behind", name)
+		}
+	}
+}
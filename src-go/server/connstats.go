@@ -0,0 +1,178 @@
+package server
+
+import (
+	"cmp"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	utls "github.com/bogdanfinn/utls"
+)
+
+// ConnectionStats are the connections to destinations the spoof server has open, see GetConnectionStats.
+type ConnectionStats struct {
+	// Open counts the connections, Active the ones with requests in flight and Idle the others.
+	Open   int
+	Active int
+	Idle   int
+
+	// Connections are the open connections, by address and then from the oldest.
+	Connections []UpstreamConnection
+
+	// Totals count the connections since the server started.
+	Totals ConnectionTotals
+}
+
+// UpstreamConnection is an open connection to a destination (or to it through an upstream proxy).
+type UpstreamConnection struct {
+	// Address is the host and port the connection was dialed to.
+	Address string
+	// Fingerprint is the fingerprint of the client that dialed it (see TransportConfig.Fingerprint), "hex" followed
+	// by the JA4 fingerprint for a HexClientHello or an intercepted fingerprint, or "bypass" for BypassHosts.
+	Fingerprint string
+	// Proxy is the upstream proxy, without its credentials.
+	Proxy        string `json:",omitempty"`
+	LocalAddress string
+
+	// Protocol is the protocol negotiated with ALPN, once the connection was used.
+	Protocol string `json:",omitempty"`
+
+	// Active counts the requests in flight on the connection, which is more than one for multiplexed HTTP/2 requests.
+	Active int
+	// Requests counts the requests sent on the connection, and Reuses those that found it open already.
+	Requests uint64
+	Reuses   uint64
+
+	OpenedAt time.Time
+	AgeMs    int64
+	// IdleMs is how long the connection has been idle for, zero while it's active.
+	IdleMs int64
+}
+
+// ConnectionTotals count the connections to destinations since the server started.
+type ConnectionTotals struct {
+	// Dialed counts the connections made, and Handshakes their TLS handshakes that succeeded.
+	Dialed     uint64
+	Handshakes uint64
+	// Reused counts the requests that were sent on a connection that was open already.
+	Reused uint64
+	// Failed counts the connections that couldn't be dialed, or whose TLS handshake failed.
+	Failed uint64
+}
+
+// upstreamConns are the open connections to destinations.
+var upstreamConns = &connectionRegistry{conns: make(map[*meteredConn]struct{})}
+
+type connectionRegistry struct {
+	mutex sync.Mutex
+	conns map[*meteredConn]struct{}
+
+	dialed     atomic.Uint64
+	handshakes atomic.Uint64
+	reused     atomic.Uint64
+	failed     atomic.Uint64
+}
+
+func (r *connectionRegistry) add(conn *meteredConn) {
+	r.dialed.Add(1)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.conns[conn] = struct{}{}
+}
+
+func (r *connectionRegistry) remove(conn *meteredConn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.conns, conn)
+}
+
+func (r *connectionRegistry) stats() ConnectionStats {
+	r.mutex.Lock()
+	conns := make([]*meteredConn, 0, len(r.conns))
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.mutex.Unlock()
+
+	now := time.Now()
+	stats := ConnectionStats{
+		Open:        len(conns),
+		Connections: make([]UpstreamConnection, 0, len(conns)),
+		Totals:      ConnectionTotals{Dialed: r.dialed.Load(), Handshakes: r.handshakes.Load(), Reused: r.reused.Load(), Failed: r.failed.Load()},
+	}
+	for _, conn := range conns {
+		connection := conn.stats(now)
+		if connection.Active > 0 {
+			stats.Active++
+		}
+		stats.Connections = append(stats.Connections, connection)
+	}
+	stats.Idle = stats.Open - stats.Active
+	slices.SortFunc(stats.Connections, func(a, b UpstreamConnection) int {
+		return cmp.Or(cmp.Compare(a.Address, b.Address), a.OpenedAt.Compare(b.OpenedAt))
+	})
+	return stats
+}
+
+// connectionUse is the use of a connection by a request, see acquireConnection.
+type connectionUse struct {
+	conn *meteredConn
+	once sync.Once
+}
+
+// release ends the use of the connection. It's safe to call more than once.
+func (use *connectionUse) release() {
+	if use == nil {
+		return
+	}
+	use.once.Do(use.conn.release)
+}
+
+// acquireConnection counts a request on conn, the connection a GotConn trace reported, which is a TLS connection wrapping the
+// meteredConn the dialer returned, or the meteredConn itself for plain HTTP. The request uses it until the returned
+// use is released. Connections the spoof server didn't dial are ignored.
+func acquireConnection(conn net.Conn, reused bool) *connectionUse {
+	var protocol string
+	tlsConn := false
+	switch c := conn.(type) {
+	case *utls.UConn:
+		conn, protocol, tlsConn = c.NetConn(), c.ConnectionState().NegotiatedProtocol, true
+	case *tls.Conn:
+		conn, protocol, tlsConn = c.NetConn(), c.ConnectionState().NegotiatedProtocol, true
+	}
+	metered, ok := conn.(*meteredConn)
+	if !ok {
+		return nil
+	}
+
+	metered.acquire(protocol, reused, tlsConn)
+	return &connectionUse{conn: metered}
+}
+
+// connectionFingerprint returns UpstreamConnection.Fingerprint for the connections of clients for config.
+func connectionFingerprint(config *TransportConfig) string {
+	label := fingerprintLabel(config, false, false)
+	if config.HexClientHello == "" {
+		return label
+	}
+	if raw, err := hex.DecodeString(string(config.HexClientHello)); err == nil {
+		if info, err := parseClientHello(raw); err == nil {
+			label += " " + info.JA4()
+		}
+	}
+	return label
+}
+
+// GetConnectionStats returns the connections to destinations that are open, with how many requests they served and
+// whether they're in use, and the totals since the server started. Connections of prewarmed, bypassed and captured
+// requests are included.
+func GetConnectionStats() ConnectionStats {
+	return upstreamConns.stats()
+}
@@ -0,0 +1,231 @@
+package server
+
+//go:generate sh -c "protoc --proto_path=../../src/main/proto --go_out=controlpb --go_opt=paths=source_relative --go-grpc_out=controlpb --go-grpc_opt=paths=source_relative control.proto"
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"server/controlpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// controlSocketPrefix is the prefix of a ControlAddress that names a unix socket.
+const controlSocketPrefix = "unix:"
+
+// controlStopTimeout is how long a previous control plane server is given to finish its calls when it's replaced.
+const controlStopTimeout = 5 * time.Second
+
+// control serves the gRPC control plane on Settings.ControlAddress.
+// It's independent of the spoof server, so it runs as soon as the address is set.
+var control = &controlServer{}
+
+type controlServer struct {
+	mutex  sync.Mutex
+	addr   string
+	server *grpc.Server
+}
+
+// sync moves the control plane to addr, or stops it if addr is empty.
+// The new server is started before the previous one is stopped, which is given controlStopTimeout to finish its calls
+// (e.g. the Configure call that changed the address).
+func (c *controlServer) sync(addr string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if addr == c.addr {
+		return nil
+	}
+
+	previous := c.server
+
+	c.server = nil
+	if addr != "" {
+		listener, err := listenControl(addr)
+		if err != nil {
+			c.server = previous
+			return err
+		}
+
+		c.server = grpc.NewServer(grpc.UnaryInterceptor(recoverUnaryCall), grpc.StreamInterceptor(recoverStreamCall))
+		controlpb.RegisterControlServer(c.server, &controlService{})
+
+		go func(server *grpc.Server) {
+			defer recoverPanic(controlLog, "serve")
+
+			if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				controlLog.Error("serve failed", "error", err)
+			}
+		}(c.server)
+	}
+	c.addr = addr
+
+	if previous != nil {
+		go func() {
+			defer recoverPanic(controlLog, "shutdown")
+
+			timer := time.AfterFunc(controlStopTimeout, previous.Stop)
+			previous.GracefulStop()
+			timer.Stop()
+		}()
+	}
+
+	return nil
+}
+
+// recoverUnaryCall fails calls that panic with codes.Internal, since gRPC doesn't recover the panics of handlers.
+func recoverUnaryCall(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (_ any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = status.Error(codes.Internal, recovered(controlLog, info.FullMethod, r).Error())
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// recoverStreamCall is recoverUnaryCall for streaming calls.
+func recoverStreamCall(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = status.Error(codes.Internal, recovered(controlLog, info.FullMethod, r).Error())
+		}
+	}()
+
+	return handler(srv, stream)
+}
+
+func listenControl(addr string) (net.Listener, error) {
+	if socket, ok := strings.CutPrefix(addr, controlSocketPrefix); ok {
+		// A socket left behind by a previous process would make listening fail.
+		if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", socket)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// controlService implements the Control service of control.proto on top of the exported functions.
+type controlService struct {
+	controlpb.UnimplementedControlServer
+}
+
+func (*controlService) Configure(_ context.Context, req *controlpb.ConfigureRequest) (*controlpb.ConfigureResponse, error) {
+	err := SaveSettings(req.GetSettings())
+
+	var settingsErrs SettingsErrors
+	switch {
+	case err == nil:
+		return &controlpb.ConfigureResponse{}, nil
+	case errors.As(err, &settingsErrs):
+		res := &controlpb.ConfigureResponse{}
+		for _, settingsErr := range settingsErrs {
+			res.Errors = append(res.Errors, &controlpb.SettingsError{
+				Field:  settingsErr.Field,
+				Value:  settingsErr.Value,
+				Reason: settingsErr.Reason,
+				Code:   settingsErr.Code,
+			})
+		}
+		return res, nil
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (*controlService) StartListener(_ context.Context, req *controlpb.ListenerRequest) (*controlpb.ListenerResponse, error) {
+	if err := StartListener(req.GetName()); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &controlpb.ListenerResponse{}, nil
+}
+
+func (*controlService) StopListener(_ context.Context, req *controlpb.ListenerRequest) (*controlpb.ListenerResponse, error) {
+	if err := StopListener(req.GetName()); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &controlpb.ListenerResponse{}, nil
+}
+
+func (*controlService) ListListeners(context.Context, *controlpb.ListListenersRequest) (*controlpb.ListListenersResponse, error) {
+	res := &controlpb.ListListenersResponse{}
+	for _, listener := range GetListeners() {
+		res.Listeners = append(res.Listeners, &controlpb.Listener{
+			Name:    listener.Name,
+			Address: listener.Address,
+			Running: listener.Running,
+		})
+	}
+	return res, nil
+}
+
+func (*controlService) ListFingerprints(context.Context, *controlpb.ListFingerprintsRequest) (*controlpb.ListFingerprintsResponse, error) {
+	return &controlpb.ListFingerprintsResponse{Fingerprints: GetFingerprints()}, nil
+}
+
+func (*controlService) GetCapturedFingerprints(context.Context, *controlpb.GetCapturedFingerprintsRequest) (*controlpb.GetCapturedFingerprintsResponse, error) {
+	res := &controlpb.GetCapturedFingerprintsResponse{}
+	for _, fingerprint := range GetCapturedFingerprints() {
+		res.Fingerprints = append(res.Fingerprints, &controlpb.CapturedFingerprint{
+			Key:                 fingerprint.Key,
+			Host:                fingerprint.Host,
+			Sni:                 fingerprint.SNI,
+			Port:                fingerprint.Port,
+			CapturedAt:          fingerprint.CapturedAt.UnixMilli(),
+			Ja3:                 fingerprint.JA3,
+			Ja3Hash:             fingerprint.JA3Hash,
+			Ja4:                 fingerprint.JA4,
+			Alpn:                fingerprint.ALPN,
+			HasH2Settings:       fingerprint.HasH2Settings,
+			HelloRetryRequested: fingerprint.HelloRetryRequested,
+			RetryJa3Hash:        fingerprint.RetryJA3Hash,
+			RetryJa4:            fingerprint.RetryJA4,
+			Opaque:              fingerprint.Opaque,
+			Stale:               fingerprint.Stale,
+			UseCount:            fingerprint.UseCount,
+		})
+	}
+	return res, nil
+}
+
+func (*controlService) Logs(_ *controlpb.LogsRequest, stream grpc.ServerStreamingServer[controlpb.LogEntry]) error {
+	entries, unsubscribe := logs.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case entry := <-entries:
+			if err := stream.Send(&controlpb.LogEntry{Time: entry.time.UnixMilli(), Message: entry.message}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (*controlService) Events(_ *controlpb.EventsRequest, stream grpc.ServerStreamingServer[controlpb.Event]) error {
+	events, unsubscribe := events.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case event := <-events:
+			if err := stream.Send(&controlpb.Event{Time: event.time.UnixMilli(), Type: event.kind, Fields: event.fields}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,1073 @@
+// Control plane of the Go server, an alternative to the functions the shared library exports.
+// It's served when the ControlAddress setting is set, see src-go/server/control.go.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: control.proto
+
+package controlpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ConfigureRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Settings JSON, in the format SaveSettings takes.
+	Settings      string `protobuf:"bytes,1,opt,name=settings,proto3" json:"settings,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConfigureRequest) Reset() {
+	*x = ConfigureRequest{}
+	mi := &file_control_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConfigureRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigureRequest) ProtoMessage() {}
+
+func (x *ConfigureRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigureRequest.ProtoReflect.Descriptor instead.
+func (*ConfigureRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ConfigureRequest) GetSettings() string {
+	if x != nil {
+		return x.Settings
+	}
+	return ""
+}
+
+type ConfigureResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Errors        []*SettingsError       `protobuf:"bytes,1,rep,name=errors,proto3" json:"errors,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConfigureResponse) Reset() {
+	*x = ConfigureResponse{}
+	mi := &file_control_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConfigureResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigureResponse) ProtoMessage() {}
+
+func (x *ConfigureResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigureResponse.ProtoReflect.Descriptor instead.
+func (*ConfigureResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ConfigureResponse) GetErrors() []*SettingsError {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+type SettingsError struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Field         string                 `protobuf:"bytes,1,opt,name=field,proto3" json:"field,omitempty"`
+	Value         string                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Reason        string                 `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	Code          string                 `protobuf:"bytes,4,opt,name=code,proto3" json:"code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SettingsError) Reset() {
+	*x = SettingsError{}
+	mi := &file_control_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SettingsError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SettingsError) ProtoMessage() {}
+
+func (x *SettingsError) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SettingsError.ProtoReflect.Descriptor instead.
+func (*SettingsError) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SettingsError) GetField() string {
+	if x != nil {
+		return x.Field
+	}
+	return ""
+}
+
+func (x *SettingsError) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func (x *SettingsError) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *SettingsError) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+type ListenerRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListenerRequest) Reset() {
+	*x = ListenerRequest{}
+	mi := &file_control_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListenerRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListenerRequest) ProtoMessage() {}
+
+func (x *ListenerRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListenerRequest.ProtoReflect.Descriptor instead.
+func (*ListenerRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListenerRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type ListenerResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListenerResponse) Reset() {
+	*x = ListenerResponse{}
+	mi := &file_control_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListenerResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListenerResponse) ProtoMessage() {}
+
+func (x *ListenerResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListenerResponse.ProtoReflect.Descriptor instead.
+func (*ListenerResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{4}
+}
+
+type ListListenersRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListListenersRequest) Reset() {
+	*x = ListListenersRequest{}
+	mi := &file_control_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListListenersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListListenersRequest) ProtoMessage() {}
+
+func (x *ListListenersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListListenersRequest.ProtoReflect.Descriptor instead.
+func (*ListListenersRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{5}
+}
+
+type ListListenersResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Listeners     []*Listener            `protobuf:"bytes,1,rep,name=listeners,proto3" json:"listeners,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListListenersResponse) Reset() {
+	*x = ListListenersResponse{}
+	mi := &file_control_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListListenersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListListenersResponse) ProtoMessage() {}
+
+func (x *ListListenersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListListenersResponse.ProtoReflect.Descriptor instead.
+func (*ListListenersResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ListListenersResponse) GetListeners() []*Listener {
+	if x != nil {
+		return x.Listeners
+	}
+	return nil
+}
+
+type Listener struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Address       string                 `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
+	Running       bool                   `protobuf:"varint,3,opt,name=running,proto3" json:"running,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Listener) Reset() {
+	*x = Listener{}
+	mi := &file_control_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Listener) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Listener) ProtoMessage() {}
+
+func (x *Listener) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Listener.ProtoReflect.Descriptor instead.
+func (*Listener) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Listener) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Listener) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *Listener) GetRunning() bool {
+	if x != nil {
+		return x.Running
+	}
+	return false
+}
+
+type ListFingerprintsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListFingerprintsRequest) Reset() {
+	*x = ListFingerprintsRequest{}
+	mi := &file_control_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListFingerprintsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListFingerprintsRequest) ProtoMessage() {}
+
+func (x *ListFingerprintsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListFingerprintsRequest.ProtoReflect.Descriptor instead.
+func (*ListFingerprintsRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{8}
+}
+
+type ListFingerprintsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Fingerprints  []string               `protobuf:"bytes,1,rep,name=fingerprints,proto3" json:"fingerprints,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListFingerprintsResponse) Reset() {
+	*x = ListFingerprintsResponse{}
+	mi := &file_control_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListFingerprintsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListFingerprintsResponse) ProtoMessage() {}
+
+func (x *ListFingerprintsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListFingerprintsResponse.ProtoReflect.Descriptor instead.
+func (*ListFingerprintsResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ListFingerprintsResponse) GetFingerprints() []string {
+	if x != nil {
+		return x.Fingerprints
+	}
+	return nil
+}
+
+type GetCapturedFingerprintsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCapturedFingerprintsRequest) Reset() {
+	*x = GetCapturedFingerprintsRequest{}
+	mi := &file_control_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCapturedFingerprintsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCapturedFingerprintsRequest) ProtoMessage() {}
+
+func (x *GetCapturedFingerprintsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCapturedFingerprintsRequest.ProtoReflect.Descriptor instead.
+func (*GetCapturedFingerprintsRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{10}
+}
+
+type GetCapturedFingerprintsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Fingerprints  []*CapturedFingerprint `protobuf:"bytes,1,rep,name=fingerprints,proto3" json:"fingerprints,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCapturedFingerprintsResponse) Reset() {
+	*x = GetCapturedFingerprintsResponse{}
+	mi := &file_control_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCapturedFingerprintsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCapturedFingerprintsResponse) ProtoMessage() {}
+
+func (x *GetCapturedFingerprintsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCapturedFingerprintsResponse.ProtoReflect.Descriptor instead.
+func (*GetCapturedFingerprintsResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GetCapturedFingerprintsResponse) GetFingerprints() []*CapturedFingerprint {
+	if x != nil {
+		return x.Fingerprints
+	}
+	return nil
+}
+
+type CapturedFingerprint struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Key   string                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Host  string                 `protobuf:"bytes,2,opt,name=host,proto3" json:"host,omitempty"`
+	Sni   string                 `protobuf:"bytes,3,opt,name=sni,proto3" json:"sni,omitempty"`
+	Port  string                 `protobuf:"bytes,4,opt,name=port,proto3" json:"port,omitempty"`
+	// Unix time in milliseconds.
+	CapturedAt          int64    `protobuf:"varint,5,opt,name=captured_at,json=capturedAt,proto3" json:"captured_at,omitempty"`
+	Ja3                 string   `protobuf:"bytes,6,opt,name=ja3,proto3" json:"ja3,omitempty"`
+	Ja3Hash             string   `protobuf:"bytes,7,opt,name=ja3_hash,json=ja3Hash,proto3" json:"ja3_hash,omitempty"`
+	Ja4                 string   `protobuf:"bytes,8,opt,name=ja4,proto3" json:"ja4,omitempty"`
+	Alpn                []string `protobuf:"bytes,9,rep,name=alpn,proto3" json:"alpn,omitempty"`
+	HasH2Settings       bool     `protobuf:"varint,10,opt,name=has_h2_settings,json=hasH2Settings,proto3" json:"has_h2_settings,omitempty"`
+	HelloRetryRequested bool     `protobuf:"varint,11,opt,name=hello_retry_requested,json=helloRetryRequested,proto3" json:"hello_retry_requested,omitempty"`
+	RetryJa3Hash        string   `protobuf:"bytes,12,opt,name=retry_ja3_hash,json=retryJa3Hash,proto3" json:"retry_ja3_hash,omitempty"`
+	RetryJa4            string   `protobuf:"bytes,13,opt,name=retry_ja4,json=retryJa4,proto3" json:"retry_ja4,omitempty"`
+	Opaque              bool     `protobuf:"varint,14,opt,name=opaque,proto3" json:"opaque,omitempty"`
+	Stale               bool     `protobuf:"varint,15,opt,name=stale,proto3" json:"stale,omitempty"`
+	UseCount            int64    `protobuf:"varint,16,opt,name=use_count,json=useCount,proto3" json:"use_count,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *CapturedFingerprint) Reset() {
+	*x = CapturedFingerprint{}
+	mi := &file_control_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CapturedFingerprint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CapturedFingerprint) ProtoMessage() {}
+
+func (x *CapturedFingerprint) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CapturedFingerprint.ProtoReflect.Descriptor instead.
+func (*CapturedFingerprint) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *CapturedFingerprint) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetSni() string {
+	if x != nil {
+		return x.Sni
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetPort() string {
+	if x != nil {
+		return x.Port
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetCapturedAt() int64 {
+	if x != nil {
+		return x.CapturedAt
+	}
+	return 0
+}
+
+func (x *CapturedFingerprint) GetJa3() string {
+	if x != nil {
+		return x.Ja3
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetJa3Hash() string {
+	if x != nil {
+		return x.Ja3Hash
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetJa4() string {
+	if x != nil {
+		return x.Ja4
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetAlpn() []string {
+	if x != nil {
+		return x.Alpn
+	}
+	return nil
+}
+
+func (x *CapturedFingerprint) GetHasH2Settings() bool {
+	if x != nil {
+		return x.HasH2Settings
+	}
+	return false
+}
+
+func (x *CapturedFingerprint) GetHelloRetryRequested() bool {
+	if x != nil {
+		return x.HelloRetryRequested
+	}
+	return false
+}
+
+func (x *CapturedFingerprint) GetRetryJa3Hash() string {
+	if x != nil {
+		return x.RetryJa3Hash
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetRetryJa4() string {
+	if x != nil {
+		return x.RetryJa4
+	}
+	return ""
+}
+
+func (x *CapturedFingerprint) GetOpaque() bool {
+	if x != nil {
+		return x.Opaque
+	}
+	return false
+}
+
+func (x *CapturedFingerprint) GetStale() bool {
+	if x != nil {
+		return x.Stale
+	}
+	return false
+}
+
+func (x *CapturedFingerprint) GetUseCount() int64 {
+	if x != nil {
+		return x.UseCount
+	}
+	return 0
+}
+
+type LogsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogsRequest) Reset() {
+	*x = LogsRequest{}
+	mi := &file_control_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogsRequest) ProtoMessage() {}
+
+func (x *LogsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogsRequest.ProtoReflect.Descriptor instead.
+func (*LogsRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{13}
+}
+
+type LogEntry struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Unix time in milliseconds.
+	Time          int64  `protobuf:"varint,1,opt,name=time,proto3" json:"time,omitempty"`
+	Message       string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogEntry) Reset() {
+	*x = LogEntry{}
+	mi := &file_control_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogEntry) ProtoMessage() {}
+
+func (x *LogEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogEntry.ProtoReflect.Descriptor instead.
+func (*LogEntry) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *LogEntry) GetTime() int64 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *LogEntry) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type EventsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EventsRequest) Reset() {
+	*x = EventsRequest{}
+	mi := &file_control_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EventsRequest) ProtoMessage() {}
+
+func (x *EventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EventsRequest.ProtoReflect.Descriptor instead.
+func (*EventsRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{15}
+}
+
+type Event struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Unix time in milliseconds.
+	Time int64 `protobuf:"varint,1,opt,name=time,proto3" json:"time,omitempty"`
+	// One of "settings_applied", "fingerprint_captured", "listener_started", "listener_stopped",
+	// "listener_down", "listener_restarted", "listener_gave_up" and "resumed".
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	// Details of the event, e.g. the "key" of a captured fingerprint or the "name" of a listener.
+	Fields        map[string]string `protobuf:"bytes,3,rep,name=fields,proto3" json:"fields,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_control_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *Event) GetTime() int64 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *Event) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Event) GetFields() map[string]string {
+	if x != nil {
+		return x.Fields
+	}
+	return nil
+}
+
+var File_control_proto protoreflect.FileDescriptor
+
+const file_control_proto_rawDesc = "" +
+	"\n" +
+	"\rcontrol.proto\x12\rawesometls.v1\".\n" +
+	"\x10ConfigureRequest\x12\x1a\n" +
+	"\bsettings\x18\x01 \x01(\tR\bsettings\"I\n" +
+	"\x11ConfigureResponse\x124\n" +
+	"\x06errors\x18\x01 \x03(\v2\x1c.awesometls.v1.SettingsErrorR\x06errors\"g\n" +
+	"\rSettingsError\x12\x14\n" +
+	"\x05field\x18\x01 \x01(\tR\x05field\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\x12\x12\n" +
+	"\x04code\x18\x04 \x01(\tR\x04code\"%\n" +
+	"\x0fListenerRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"\x12\n" +
+	"\x10ListenerResponse\"\x16\n" +
+	"\x14ListListenersRequest\"N\n" +
+	"\x15ListListenersResponse\x125\n" +
+	"\tlisteners\x18\x01 \x03(\v2\x17.awesometls.v1.ListenerR\tlisteners\"R\n" +
+	"\bListener\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
+	"\aaddress\x18\x02 \x01(\tR\aaddress\x12\x18\n" +
+	"\arunning\x18\x03 \x01(\bR\arunning\"\x19\n" +
+	"\x17ListFingerprintsRequest\">\n" +
+	"\x18ListFingerprintsResponse\x12\"\n" +
+	"\ffingerprints\x18\x01 \x03(\tR\ffingerprints\" \n" +
+	"\x1eGetCapturedFingerprintsRequest\"i\n" +
+	"\x1fGetCapturedFingerprintsResponse\x12F\n" +
+	"\ffingerprints\x18\x01 \x03(\v2\".awesometls.v1.CapturedFingerprintR\ffingerprints\"\xbf\x03\n" +
+	"\x13CapturedFingerprint\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x12\n" +
+	"\x04host\x18\x02 \x01(\tR\x04host\x12\x10\n" +
+	"\x03sni\x18\x03 \x01(\tR\x03sni\x12\x12\n" +
+	"\x04port\x18\x04 \x01(\tR\x04port\x12\x1f\n" +
+	"\vcaptured_at\x18\x05 \x01(\x03R\n" +
+	"capturedAt\x12\x10\n" +
+	"\x03ja3\x18\x06 \x01(\tR\x03ja3\x12\x19\n" +
+	"\bja3_hash\x18\a \x01(\tR\aja3Hash\x12\x10\n" +
+	"\x03ja4\x18\b \x01(\tR\x03ja4\x12\x12\n" +
+	"\x04alpn\x18\t \x03(\tR\x04alpn\x12&\n" +
+	"\x0fhas_h2_settings\x18\n" +
+	" \x01(\bR\rhasH2Settings\x122\n" +
+	"\x15hello_retry_requested\x18\v \x01(\bR\x13helloRetryRequested\x12$\n" +
+	"\x0eretry_ja3_hash\x18\f \x01(\tR\fretryJa3Hash\x12\x1b\n" +
+	"\tretry_ja4\x18\r \x01(\tR\bretryJa4\x12\x16\n" +
+	"\x06opaque\x18\x0e \x01(\bR\x06opaque\x12\x14\n" +
+	"\x05stale\x18\x0f \x01(\bR\x05stale\x12\x1b\n" +
+	"\tuse_count\x18\x10 \x01(\x03R\buseCount\"\r\n" +
+	"\vLogsRequest\"8\n" +
+	"\bLogEntry\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\x03R\x04time\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"\x0f\n" +
+	"\rEventsRequest\"\xa4\x01\n" +
+	"\x05Event\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\x03R\x04time\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x128\n" +
+	"\x06fields\x18\x03 \x03(\v2 .awesometls.v1.Event.FieldsEntryR\x06fields\x1a9\n" +
+	"\vFieldsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012\xb6\x05\n" +
+	"\aControl\x12N\n" +
+	"\tConfigure\x12\x1f.awesometls.v1.ConfigureRequest\x1a .awesometls.v1.ConfigureResponse\x12P\n" +
+	"\rStartListener\x12\x1e.awesometls.v1.ListenerRequest\x1a\x1f.awesometls.v1.ListenerResponse\x12O\n" +
+	"\fStopListener\x12\x1e.awesometls.v1.ListenerRequest\x1a\x1f.awesometls.v1.ListenerResponse\x12Z\n" +
+	"\rListListeners\x12#.awesometls.v1.ListListenersRequest\x1a$.awesometls.v1.ListListenersResponse\x12c\n" +
+	"\x10ListFingerprints\x12&.awesometls.v1.ListFingerprintsRequest\x1a'.awesometls.v1.ListFingerprintsResponse\x12x\n" +
+	"\x17GetCapturedFingerprints\x12-.awesometls.v1.GetCapturedFingerprintsRequest\x1a..awesometls.v1.GetCapturedFingerprintsResponse\x12=\n" +
+	"\x04Logs\x12\x1a.awesometls.v1.LogsRequest\x1a\x17.awesometls.v1.LogEntry0\x01\x12>\n" +
+	"\x06Events\x12\x1c.awesometls.v1.EventsRequest\x1a\x14.awesometls.v1.Event0\x01B\"\n" +
+	"\fburp.controlP\x01Z\x10server/controlpbb\x06proto3"
+
+var (
+	file_control_proto_rawDescOnce sync.Once
+	file_control_proto_rawDescData []byte
+)
+
+func file_control_proto_rawDescGZIP() []byte {
+	file_control_proto_rawDescOnce.Do(func() {
+		file_control_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)))
+	})
+	return file_control_proto_rawDescData
+}
+
+var file_control_proto_msgTypes = make([]protoimpl.MessageInfo, 18)
+var file_control_proto_goTypes = []any{
+	(*ConfigureRequest)(nil),                // 0: awesometls.v1.ConfigureRequest
+	(*ConfigureResponse)(nil),               // 1: awesometls.v1.ConfigureResponse
+	(*SettingsError)(nil),                   // 2: awesometls.v1.SettingsError
+	(*ListenerRequest)(nil),                 // 3: awesometls.v1.ListenerRequest
+	(*ListenerResponse)(nil),                // 4: awesometls.v1.ListenerResponse
+	(*ListListenersRequest)(nil),            // 5: awesometls.v1.ListListenersRequest
+	(*ListListenersResponse)(nil),           // 6: awesometls.v1.ListListenersResponse
+	(*Listener)(nil),                        // 7: awesometls.v1.Listener
+	(*ListFingerprintsRequest)(nil),         // 8: awesometls.v1.ListFingerprintsRequest
+	(*ListFingerprintsResponse)(nil),        // 9: awesometls.v1.ListFingerprintsResponse
+	(*GetCapturedFingerprintsRequest)(nil),  // 10: awesometls.v1.GetCapturedFingerprintsRequest
+	(*GetCapturedFingerprintsResponse)(nil), // 11: awesometls.v1.GetCapturedFingerprintsResponse
+	(*CapturedFingerprint)(nil),             // 12: awesometls.v1.CapturedFingerprint
+	(*LogsRequest)(nil),                     // 13: awesometls.v1.LogsRequest
+	(*LogEntry)(nil),                        // 14: awesometls.v1.LogEntry
+	(*EventsRequest)(nil),                   // 15: awesometls.v1.EventsRequest
+	(*Event)(nil),                           // 16: awesometls.v1.Event
+	nil,                                     // 17: awesometls.v1.Event.FieldsEntry
+}
+var file_control_proto_depIdxs = []int32{
+	2,  // 0: awesometls.v1.ConfigureResponse.errors:type_name -> awesometls.v1.SettingsError
+	7,  // 1: awesometls.v1.ListListenersResponse.listeners:type_name -> awesometls.v1.Listener
+	12, // 2: awesometls.v1.GetCapturedFingerprintsResponse.fingerprints:type_name -> awesometls.v1.CapturedFingerprint
+	17, // 3: awesometls.v1.Event.fields:type_name -> awesometls.v1.Event.FieldsEntry
+	0,  // 4: awesometls.v1.Control.Configure:input_type -> awesometls.v1.ConfigureRequest
+	3,  // 5: awesometls.v1.Control.StartListener:input_type -> awesometls.v1.ListenerRequest
+	3,  // 6: awesometls.v1.Control.StopListener:input_type -> awesometls.v1.ListenerRequest
+	5,  // 7: awesometls.v1.Control.ListListeners:input_type -> awesometls.v1.ListListenersRequest
+	8,  // 8: awesometls.v1.Control.ListFingerprints:input_type -> awesometls.v1.ListFingerprintsRequest
+	10, // 9: awesometls.v1.Control.GetCapturedFingerprints:input_type -> awesometls.v1.GetCapturedFingerprintsRequest
+	13, // 10: awesometls.v1.Control.Logs:input_type -> awesometls.v1.LogsRequest
+	15, // 11: awesometls.v1.Control.Events:input_type -> awesometls.v1.EventsRequest
+	1,  // 12: awesometls.v1.Control.Configure:output_type -> awesometls.v1.ConfigureResponse
+	4,  // 13: awesometls.v1.Control.StartListener:output_type -> awesometls.v1.ListenerResponse
+	4,  // 14: awesometls.v1.Control.StopListener:output_type -> awesometls.v1.ListenerResponse
+	6,  // 15: awesometls.v1.Control.ListListeners:output_type -> awesometls.v1.ListListenersResponse
+	9,  // 16: awesometls.v1.Control.ListFingerprints:output_type -> awesometls.v1.ListFingerprintsResponse
+	11, // 17: awesometls.v1.Control.GetCapturedFingerprints:output_type -> awesometls.v1.GetCapturedFingerprintsResponse
+	14, // 18: awesometls.v1.Control.Logs:output_type -> awesometls.v1.LogEntry
+	16, // 19: awesometls.v1.Control.Events:output_type -> awesometls.v1.Event
+	12, // [12:20] is the sub-list for method output_type
+	4,  // [4:12] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_control_proto_init() }
+func file_control_proto_init() {
+	if File_control_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   18,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_control_proto_goTypes,
+		DependencyIndexes: file_control_proto_depIdxs,
+		MessageInfos:      file_control_proto_msgTypes,
+	}.Build()
+	File_control_proto = out.File
+	file_control_proto_goTypes = nil
+	file_control_proto_depIdxs = nil
+}
@@ -0,0 +1,407 @@
+// Control plane of the Go server, an alternative to the functions the shared library exports.
+// It's served when the ControlAddress setting is set, see src-go/server/control.go.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: control.proto
+
+package controlpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Control_Configure_FullMethodName               = "/awesometls.v1.Control/Configure"
+	Control_StartListener_FullMethodName           = "/awesometls.v1.Control/StartListener"
+	Control_StopListener_FullMethodName            = "/awesometls.v1.Control/StopListener"
+	Control_ListListeners_FullMethodName           = "/awesometls.v1.Control/ListListeners"
+	Control_ListFingerprints_FullMethodName        = "/awesometls.v1.Control/ListFingerprints"
+	Control_GetCapturedFingerprints_FullMethodName = "/awesometls.v1.Control/GetCapturedFingerprints"
+	Control_Logs_FullMethodName                    = "/awesometls.v1.Control/Logs"
+	Control_Events_FullMethodName                  = "/awesometls.v1.Control/Events"
+)
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	// Configure applies settings like SaveSettings. Rejected settings are returned as errors, none are applied then.
+	Configure(ctx context.Context, in *ConfigureRequest, opts ...grpc.CallOption) (*ConfigureResponse, error)
+	// StartListener and StopListener start and stop a listener of the Listeners setting.
+	StartListener(ctx context.Context, in *ListenerRequest, opts ...grpc.CallOption) (*ListenerResponse, error)
+	StopListener(ctx context.Context, in *ListenerRequest, opts ...grpc.CallOption) (*ListenerResponse, error)
+	ListListeners(ctx context.Context, in *ListListenersRequest, opts ...grpc.CallOption) (*ListListenersResponse, error)
+	// ListFingerprints returns the names of the built-in fingerprints.
+	ListFingerprints(ctx context.Context, in *ListFingerprintsRequest, opts ...grpc.CallOption) (*ListFingerprintsResponse, error)
+	GetCapturedFingerprints(ctx context.Context, in *GetCapturedFingerprintsRequest, opts ...grpc.CallOption) (*GetCapturedFingerprintsResponse, error)
+	// Logs streams the log messages of the Go server from the time of the call.
+	Logs(ctx context.Context, in *LogsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LogEntry], error)
+	// Events streams what happens in the Go server from the time of the call, see Event.
+	Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) Configure(ctx context.Context, in *ConfigureRequest, opts ...grpc.CallOption) (*ConfigureResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ConfigureResponse)
+	err := c.cc.Invoke(ctx, Control_Configure_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) StartListener(ctx context.Context, in *ListenerRequest, opts ...grpc.CallOption) (*ListenerResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListenerResponse)
+	err := c.cc.Invoke(ctx, Control_StartListener_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) StopListener(ctx context.Context, in *ListenerRequest, opts ...grpc.CallOption) (*ListenerResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListenerResponse)
+	err := c.cc.Invoke(ctx, Control_StopListener_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ListListeners(ctx context.Context, in *ListListenersRequest, opts ...grpc.CallOption) (*ListListenersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListListenersResponse)
+	err := c.cc.Invoke(ctx, Control_ListListeners_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ListFingerprints(ctx context.Context, in *ListFingerprintsRequest, opts ...grpc.CallOption) (*ListFingerprintsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListFingerprintsResponse)
+	err := c.cc.Invoke(ctx, Control_ListFingerprints_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) GetCapturedFingerprints(ctx context.Context, in *GetCapturedFingerprintsRequest, opts ...grpc.CallOption) (*GetCapturedFingerprintsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetCapturedFingerprintsResponse)
+	err := c.cc.Invoke(ctx, Control_GetCapturedFingerprints_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Logs(ctx context.Context, in *LogsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LogEntry], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[0], Control_Logs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[LogsRequest, LogEntry]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Control_LogsClient = grpc.ServerStreamingClient[LogEntry]
+
+func (c *controlClient) Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[1], Control_Events_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Control_EventsClient = grpc.ServerStreamingClient[Event]
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility.
+type ControlServer interface {
+	// Configure applies settings like SaveSettings. Rejected settings are returned as errors, none are applied then.
+	Configure(context.Context, *ConfigureRequest) (*ConfigureResponse, error)
+	// StartListener and StopListener start and stop a listener of the Listeners setting.
+	StartListener(context.Context, *ListenerRequest) (*ListenerResponse, error)
+	StopListener(context.Context, *ListenerRequest) (*ListenerResponse, error)
+	ListListeners(context.Context, *ListListenersRequest) (*ListListenersResponse, error)
+	// ListFingerprints returns the names of the built-in fingerprints.
+	ListFingerprints(context.Context, *ListFingerprintsRequest) (*ListFingerprintsResponse, error)
+	GetCapturedFingerprints(context.Context, *GetCapturedFingerprintsRequest) (*GetCapturedFingerprintsResponse, error)
+	// Logs streams the log messages of the Go server from the time of the call.
+	Logs(*LogsRequest, grpc.ServerStreamingServer[LogEntry]) error
+	// Events streams what happens in the Go server from the time of the call, see Event.
+	Events(*EventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedControlServer struct{}
+
+func (UnimplementedControlServer) Configure(context.Context, *ConfigureRequest) (*ConfigureResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Configure not implemented")
+}
+func (UnimplementedControlServer) StartListener(context.Context, *ListenerRequest) (*ListenerResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method StartListener not implemented")
+}
+func (UnimplementedControlServer) StopListener(context.Context, *ListenerRequest) (*ListenerResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method StopListener not implemented")
+}
+func (UnimplementedControlServer) ListListeners(context.Context, *ListListenersRequest) (*ListListenersResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListListeners not implemented")
+}
+func (UnimplementedControlServer) ListFingerprints(context.Context, *ListFingerprintsRequest) (*ListFingerprintsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListFingerprints not implemented")
+}
+func (UnimplementedControlServer) GetCapturedFingerprints(context.Context, *GetCapturedFingerprintsRequest) (*GetCapturedFingerprintsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetCapturedFingerprints not implemented")
+}
+func (UnimplementedControlServer) Logs(*LogsRequest, grpc.ServerStreamingServer[LogEntry]) error {
+	return status.Error(codes.Unimplemented, "method Logs not implemented")
+}
+func (UnimplementedControlServer) Events(*EventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Error(codes.Unimplemented, "method Events not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+func (UnimplementedControlServer) testEmbeddedByValue()                 {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	// If the following call panics, it indicates UnimplementedControlServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_Configure_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Configure(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_Configure_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Configure(ctx, req.(*ConfigureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_StartListener_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListenerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).StartListener(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_StartListener_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).StartListener(ctx, req.(*ListenerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_StopListener_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListenerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).StopListener(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_StopListener_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).StopListener(ctx, req.(*ListenerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ListListeners_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListListenersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ListListeners(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_ListListeners_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ListListeners(ctx, req.(*ListListenersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ListFingerprints_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFingerprintsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ListFingerprints(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_ListFingerprints_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ListFingerprints(ctx, req.(*ListFingerprintsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_GetCapturedFingerprints_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCapturedFingerprintsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetCapturedFingerprints(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_GetCapturedFingerprints_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetCapturedFingerprints(ctx, req.(*GetCapturedFingerprintsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Logs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(LogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).Logs(m, &grpc.GenericServerStream[LogsRequest, LogEntry]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Control_LogsServer = grpc.ServerStreamingServer[LogEntry]
+
+func _Control_Events_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(EventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).Events(m, &grpc.GenericServerStream[EventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Control_EventsServer = grpc.ServerStreamingServer[Event]
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "awesometls.v1.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Configure",
+			Handler:    _Control_Configure_Handler,
+		},
+		{
+			MethodName: "StartListener",
+			Handler:    _Control_StartListener_Handler,
+		},
+		{
+			MethodName: "StopListener",
+			Handler:    _Control_StopListener_Handler,
+		},
+		{
+			MethodName: "ListListeners",
+			Handler:    _Control_ListListeners_Handler,
+		},
+		{
+			MethodName: "ListFingerprints",
+			Handler:    _Control_ListFingerprints_Handler,
+		},
+		{
+			MethodName: "GetCapturedFingerprints",
+			Handler:    _Control_GetCapturedFingerprints_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Logs",
+			Handler:       _Control_Logs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Events",
+			Handler:       _Control_Events_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
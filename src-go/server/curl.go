@@ -0,0 +1,537 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bogdanfinn/tls-client/profiles"
+)
+
+// defaultCurlBodyFile is the file binary bodies are read from if CurlRequest.BodyFile is empty.
+const defaultCurlBodyFile = "body.bin"
+
+// CurlRequest is a request to build a command for, see BuildCurlCommand.
+type CurlRequest struct {
+	Method  string
+	Url     string
+	Headers []HeaderField
+	Body    []byte
+
+	// TransportConfig is the configuration of the request, as sent in the ConfigurationHeaderKey header.
+	// Leave empty to use the saved settings. Either way, the profile for the destination is applied on top.
+	TransportConfig string
+
+	// Plain builds a command for plain curl, even if curl-impersonate has a target for the fingerprint.
+	Plain bool
+
+	// IncludeSecrets keeps the password of the upstream proxy in the command.
+	IncludeSecrets bool
+
+	// BodyFile is the file the command reads binary bodies from, see defaultCurlBodyFile.
+	BodyFile string
+}
+
+// CurlCommand is the command built by BuildCurlCommand.
+type CurlCommand struct {
+	// Command is the shell command (POSIX sh), split over several lines.
+	Command string
+
+	// Target is the curl-impersonate target the command runs, or empty if it runs plain curl.
+	Target string
+
+	// BodyFile is the file the command reads the body from, which the body must be written to before running it.
+	// It's empty if the body is part of the command.
+	BodyFile string
+
+	// Warnings describe where the command may behave differently from the spoof server.
+	Warnings []string
+}
+
+// curlImpersonateTarget is a browser curl-impersonate can impersonate, run with the `curl_<Name>` wrapper.
+type curlImpersonateTarget struct {
+	Name    string
+	Version []int
+}
+
+// curlImpersonateTargets are the targets of curl-impersonate by the family of the fingerprints they match.
+var curlImpersonateTargets = map[string][]curlImpersonateTarget{
+	"chrome": {
+		{"chrome99", []int{99}},
+		{"chrome100", []int{100}},
+		{"chrome101", []int{101}},
+		{"chrome104", []int{104}},
+		{"chrome107", []int{107}},
+		{"chrome110", []int{110}},
+		{"chrome116", []int{116}},
+		{"chrome119", []int{119}},
+		{"chrome120", []int{120}},
+		{"chrome123", []int{123}},
+		{"chrome124", []int{124}},
+		{"chrome131", []int{131}},
+		{"chrome133a", []int{133}},
+		{"chrome136", []int{136}},
+	},
+	"firefox": {
+		{"firefox133", []int{133}},
+		{"firefox135", []int{135}},
+	},
+	"safari": {
+		{"safari153", []int{15, 3}},
+		{"safari155", []int{15, 5}},
+		{"safari170", []int{17, 0}},
+		{"safari180", []int{18, 0}},
+		{"safari184", []int{18, 4}},
+		{"safari260", []int{26, 0}},
+	},
+	"safari_ios": {
+		{"safari172_ios", []int{17, 2}},
+		{"safari180_ios", []int{18, 0}},
+		{"safari184_ios", []int{18, 4}},
+		{"safari260_ios", []int{26, 0}},
+	},
+}
+
+// fingerprintVersionPattern splits the name of a fingerprint of profiles.MappedTLSClients into its family and version,
+// e.g. `safari_ios_18_0` into `safari_ios` and `18_0`.
+var fingerprintVersionPattern = regexp.MustCompile(`^(chrome|firefox|safari_ios|safari)_(\d+(?:_\d+)*)`)
+
+// BuildCurlCommand returns a curl command that sends the request described by data (a JSON encoded CurlRequest)
+// like the spoof server would, with the fingerprint of its transport configuration.
+// The command runs curl-impersonate if it has a target that matches the fingerprint, or plain curl otherwise,
+// which only approximates the fingerprint with its TLS options.
+func BuildCurlCommand(data string) (*CurlCommand, error) {
+	var request CurlRequest
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	target, err := url.Parse(request.Url)
+	if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, fmt.Errorf("invalid request: URL '%s' must be an absolute http or https URL", request.Url)
+	}
+
+	current := state.Load()
+	config := current.defaultsFor("")
+	if request.TransportConfig != "" {
+		parsed, err := ParseTransportConfig(request.TransportConfig, config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transport configuration: %w", err)
+		}
+		config = *parsed
+	}
+
+	name := target.Hostname()
+	port := target.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[target.Scheme]
+	}
+
+	if err = current.settings.applyProfile(&config, name); err != nil {
+		return nil, err
+	}
+
+	b := &curlCommandBuilder{command: &CurlCommand{}}
+
+	bypass := matchBypassHost(current.settings.BypassHosts, name)
+	switch {
+	case bypass:
+		b.warn("%s matches BypassHosts, so the spoof server sends its requests without a spoofed fingerprint", name)
+	case config.useInterceptedFingerprint(name):
+		if captured, key, _ := captures.lookup(name, port, config.InterceptedFingerprintDefault); captured != nil {
+			config.HexClientHello = captured.HexClientHello
+			b.warn("using the intercepted fingerprint '%s'", key)
+		}
+	}
+
+	program := "curl"
+	if target.Scheme == "https" && !bypass {
+		program = b.fingerprintOptions(&config, name, request.Plain)
+	}
+
+	b.requestOptions(&request, &config)
+	b.transportOptions(&config, request.IncludeSecrets)
+
+	// Certificates aren't verified by the spoof server either.
+	if target.Scheme == "https" {
+		b.option("--insecure")
+	}
+
+	b.option(target.String())
+
+	lines := []string{program}
+	for _, arguments := range b.arguments {
+		quoted := make([]string, len(arguments))
+		for i, argument := range arguments {
+			quoted[i] = shellQuote(argument)
+		}
+		lines = append(lines, strings.Join(quoted, " "))
+	}
+	b.command.Command = strings.Join(lines, " \\\n  ")
+
+	return b.command, nil
+}
+
+// curlCommandBuilder collects the options of a CurlCommand, each with its arguments.
+type curlCommandBuilder struct {
+	command   *CurlCommand
+	arguments [][]string
+}
+
+func (b *curlCommandBuilder) option(arguments ...string) {
+	b.arguments = append(b.arguments, arguments)
+}
+
+func (b *curlCommandBuilder) warn(format string, a ...any) {
+	b.command.Warnings = append(b.command.Warnings, fmt.Sprintf(format, a...))
+}
+
+// fingerprintOptions returns the program that sends the request with the fingerprint of config,
+// adding the TLS options that approximate it if that's plain curl.
+func (b *curlCommandBuilder) fingerprintOptions(config *TransportConfig, serverName string, plain bool) string {
+	if config.HexClientHello == "" {
+		fingerprint := config.Fingerprint
+		if fingerprint == "" || strings.EqualFold(fingerprint, "default") {
+			fingerprint = defaultFingerprintName()
+		}
+
+		if !plain {
+			if target, exact := curlImpersonateTargetFor(fingerprint); target != "" {
+				if !exact {
+					b.warn("curl-impersonate has no target for '%s', using the closest one '%s'", fingerprint, target)
+				}
+				b.command.Target = target
+				return "curl_" + target
+			}
+			b.warn("curl-impersonate has no target for '%s', using plain curl", fingerprint)
+		}
+
+		profile, ok := profiles.MappedTLSClients[fingerprint]
+		if !ok {
+			b.warn("unrecognized fingerprint '%s', using curl's own", fingerprint)
+			return "curl"
+		}
+
+		raw, err := buildClientHello(profile.GetClientHelloId(), serverName)
+		if err != nil {
+			b.warn("failed to build the ClientHello of '%s', using curl's own: %s", fingerprint, err)
+			return "curl"
+		}
+		b.tlsOptions(raw)
+
+		return "curl"
+	}
+
+	raw, err := hex.DecodeString(string(config.HexClientHello))
+	if err != nil {
+		b.warn("invalid HexClientHello, using curl's own fingerprint: %s", err)
+		return "curl"
+	}
+	if len(raw) > 0 && raw[0] != recordTypeHandshake {
+		raw = append([]byte{recordTypeHandshake, 0x03, 0x01, byte(len(raw) >> 8), byte(len(raw))}, raw...)
+	}
+	b.tlsOptions(raw)
+
+	return "curl"
+}
+
+// tlsOptions adds the options of plain curl that come closest to the ClientHello record raw.
+func (b *curlCommandBuilder) tlsOptions(raw []byte) {
+	info, err := parseClientHello(raw)
+	if err != nil {
+		b.warn("failed to parse the ClientHello, using curl's own fingerprint: %s", err)
+		return
+	}
+
+	b.warn("plain curl only approximates the fingerprint: the extensions, their order, GREASE and the HTTP/2 settings differ from the spoof server's")
+
+	versions := withoutGrease(info.SupportedVersions)
+	if len(versions) == 0 {
+		versions = []uint16{info.Version}
+	}
+	if name, ok := curlTLSVersions[slices.Min(versions)]; ok {
+		b.option("--tlsv" + name)
+	}
+	if name, ok := curlTLSVersions[slices.Max(versions)]; ok {
+		b.option("--tls-max", name)
+	}
+
+	var ciphers, tls13Ciphers, unknown []string
+	for _, suite := range withoutGrease(info.CipherSuites) {
+		switch name, ok := curlCipherSuites[suite]; {
+		case suite == 0x00ff:
+			// The renegotiation SCSV is sent by OpenSSL on its own.
+		case !ok:
+			unknown = append(unknown, hex4(int(suite)))
+		case strings.HasPrefix(name, "TLS_"):
+			tls13Ciphers = append(tls13Ciphers, name)
+		default:
+			ciphers = append(ciphers, name)
+		}
+	}
+	if len(ciphers) > 0 {
+		b.option("--ciphers", strings.Join(ciphers, ":"))
+	}
+	if len(tls13Ciphers) > 0 {
+		b.option("--tls13-ciphers", strings.Join(tls13Ciphers, ":"))
+	}
+	if len(unknown) > 0 {
+		b.warn("cipher suites %s have no OpenSSL name and were left out", strings.Join(unknown, ", "))
+	}
+
+	var curves []string
+	unknown = nil
+	for _, group := range withoutGrease(info.SupportedGroups) {
+		if name, ok := curlCurves[group]; ok {
+			curves = append(curves, name)
+		} else {
+			unknown = append(unknown, hex4(int(group)))
+		}
+	}
+	if len(curves) > 0 {
+		b.option("--curves", strings.Join(curves, ":"))
+	}
+	if len(unknown) > 0 {
+		b.warn("supported groups %s have no OpenSSL name and were left out", strings.Join(unknown, ", "))
+	}
+
+	if slices.Contains(info.ALPN, "h2") {
+		b.option("--http2")
+	} else {
+		b.option("--http1.1")
+	}
+}
+
+// requestOptions adds the method, the headers and the body of request.
+func (b *curlCommandBuilder) requestOptions(request *CurlRequest, config *TransportConfig) {
+	method := strings.ToUpper(cmp.Or(request.Method, "GET"))
+	hasBody := len(request.Body) > 0
+
+	// Without options, curl sends GET requests, or POST requests if they have a body.
+	switch {
+	case method == "HEAD" && !hasBody:
+		b.option("--head")
+	case method == "GET" && !hasBody, method == "POST" && hasBody:
+	default:
+		b.option("--request", method)
+	}
+
+	// Headers in the configured order come first, the others keep their order from the request.
+	headers := slices.Clone(request.Headers)
+	order := map[string]int{}
+	for i, name := range config.HeaderOrder {
+		order[strings.ToLower(name)] = i
+	}
+	slices.SortStableFunc(headers, func(a, c HeaderField) int {
+		i, iok := order[strings.ToLower(a.Name)]
+		j, jok := order[strings.ToLower(c.Name)]
+		switch {
+		case iok && jok:
+			return i - j
+		case iok:
+			return -1
+		case jok:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if len(config.HeaderOrder) > 0 && len(headers) > 0 {
+		b.warn("curl sends its own headers (like Host) first, so the HeaderOrder is only followed for the others")
+	}
+
+	compressed := false
+	for _, header := range headers {
+		switch {
+		case strings.EqualFold(header.Name, "Content-Length"), strings.EqualFold(header.Name, "Transfer-Encoding"):
+			// curl frames the body itself.
+			continue
+		case strings.EqualFold(header.Name, "Accept-Encoding"):
+			compressed = true
+		}
+
+		if header.Value == "" {
+			// curl removes headers passed as `Name:`, and sends them empty only as `Name;`.
+			b.option("--header", header.Name+";")
+		} else {
+			b.option("--header", header.Name+": "+header.Value)
+		}
+	}
+	if compressed {
+		// The spoof server decompresses responses, so curl does as well.
+		b.option("--compressed")
+	}
+
+	if !hasBody {
+		return
+	}
+
+	// Shell arguments can't contain NUL bytes, and other binary data is easily mangled by terminals.
+	if utf8.Valid(request.Body) && !bytes.ContainsFunc(request.Body, isBinaryRune) {
+		b.option("--data-raw", string(request.Body))
+		return
+	}
+
+	b.command.BodyFile = cmp.Or(request.BodyFile, defaultCurlBodyFile)
+	b.option("--data-binary", "@"+b.command.BodyFile)
+}
+
+// transportOptions adds the upstream proxy, the local address and the timeouts of config.
+func (b *curlCommandBuilder) transportOptions(config *TransportConfig, includeSecrets bool) {
+	if config.ExternalProxyUrl != "" {
+		proxyURL := config.ExternalProxyUrl
+		if !includeSecrets && hasPassword(proxyURL) {
+			proxyURL = withoutPassword(proxyURL)
+			b.warn("the password of the upstream proxy was removed")
+		}
+		// Like the spoof server, curl lets the proxy resolve host names with socks5h.
+		if rest, ok := strings.CutPrefix(proxyURL, "socks5://"); ok {
+			proxyURL = "socks5h://" + rest
+		}
+		b.option("--proxy", proxyURL)
+	}
+
+	if config.LocalAddress != "" {
+		b.option("--interface", config.LocalAddress)
+	}
+
+	if config.DialTimeout > 0 {
+		b.option("--connect-timeout", strconv.Itoa(config.DialTimeout))
+	}
+	if config.HttpTimeout > 0 {
+		b.option("--max-time", strconv.Itoa(config.HttpTimeout))
+	}
+}
+
+// curlImpersonateTargetFor returns the curl-impersonate target for fingerprint, and whether it's for the same version.
+// Otherwise it's the closest target of the same browser, preferring older versions.
+func curlImpersonateTargetFor(fingerprint string) (string, bool) {
+	match := fingerprintVersionPattern.FindStringSubmatch(strings.ToLower(fingerprint))
+	if match == nil {
+		return "", false
+	}
+
+	var version []int
+	for _, part := range strings.Split(match[2], "_") {
+		n, _ := strconv.Atoi(part)
+		version = append(version, n)
+	}
+
+	targets := curlImpersonateTargets[match[1]]
+	if len(targets) == 0 {
+		return "", false
+	}
+
+	// The targets are sorted by version, so the last one that isn't newer is the closest older one.
+	closest := targets[0]
+	for _, target := range targets {
+		switch c := slices.Compare(padVersion(target.Version, version), padVersion(version, target.Version)); {
+		case c == 0:
+			return target.Name, true
+		case c < 0:
+			closest = target
+		}
+	}
+
+	return closest.Name, false
+}
+
+// padVersion returns version with trailing zeros to make it as long as other.
+func padVersion(version, other []int) []int {
+	for len(version) < len(other) {
+		version = append(slices.Clip(version), 0)
+	}
+	return version
+}
+
+// defaultFingerprintName returns the name of the fingerprint the "default" fingerprint stands for.
+func defaultFingerprintName() string {
+	id := profiles.DefaultClientProfile.GetClientHelloStr()
+	for _, name := range slices.Sorted(maps.Keys(profiles.MappedTLSClients)) {
+		if profiles.MappedTLSClients[name].GetClientHelloStr() == id {
+			return name
+		}
+	}
+	return "default"
+}
+
+// shellQuote quotes s for a POSIX shell. Single quotes keep everything literal, including newlines.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./-_", r))
+	}) {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isBinaryRune reports whether r is a control character other than whitespace.
+func isBinaryRune(r rune) bool {
+	return r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0x7f
+}
+
+// curlTLSVersions are the names of TLS versions in curl's options.
+var curlTLSVersions = map[uint16]string{
+	0x0301: "1.0",
+	0x0302: "1.1",
+	0x0303: "1.2",
+	0x0304: "1.3",
+}
+
+// curlCipherSuites are the OpenSSL names (as used by --ciphers) of the cipher suites browsers offer.
+// TLS 1.3 suites keep their IANA names, as used by --tls13-ciphers.
+var curlCipherSuites = map[uint16]string{
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+	0xc02b: "ECDHE-ECDSA-AES128-GCM-SHA256",
+	0xc02f: "ECDHE-RSA-AES128-GCM-SHA256",
+	0xc02c: "ECDHE-ECDSA-AES256-GCM-SHA384",
+	0xc030: "ECDHE-RSA-AES256-GCM-SHA384",
+	0xcca9: "ECDHE-ECDSA-CHACHA20-POLY1305",
+	0xcca8: "ECDHE-RSA-CHACHA20-POLY1305",
+	0xc023: "ECDHE-ECDSA-AES128-SHA256",
+	0xc027: "ECDHE-RSA-AES128-SHA256",
+	0xc024: "ECDHE-ECDSA-AES256-SHA384",
+	0xc028: "ECDHE-RSA-AES256-SHA384",
+	0xc009: "ECDHE-ECDSA-AES128-SHA",
+	0xc013: "ECDHE-RSA-AES128-SHA",
+	0xc00a: "ECDHE-ECDSA-AES256-SHA",
+	0xc014: "ECDHE-RSA-AES256-SHA",
+	0xc008: "ECDHE-ECDSA-DES-CBC3-SHA",
+	0xc012: "ECDHE-RSA-DES-CBC3-SHA",
+	0x009e: "DHE-RSA-AES128-GCM-SHA256",
+	0x009f: "DHE-RSA-AES256-GCM-SHA384",
+	0xccaa: "DHE-RSA-CHACHA20-POLY1305",
+	0x0033: "DHE-RSA-AES128-SHA",
+	0x0039: "DHE-RSA-AES256-SHA",
+	0x009c: "AES128-GCM-SHA256",
+	0x009d: "AES256-GCM-SHA384",
+	0x003c: "AES128-SHA256",
+	0x003d: "AES256-SHA256",
+	0x002f: "AES128-SHA",
+	0x0035: "AES256-SHA",
+	0x000a: "DES-CBC3-SHA",
+}
+
+// curlCurves are the OpenSSL names (as used by --curves) of the supported groups browsers offer.
+var curlCurves = map[uint16]string{
+	0x001d: "X25519",
+	0x001e: "X448",
+	0x0017: "P-256",
+	0x0018: "P-384",
+	0x0019: "P-521",
+	0x11ec: "X25519MLKEM768",
+	0x0100: "ffdhe2048",
+	0x0101: "ffdhe3072",
+}
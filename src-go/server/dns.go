@@ -0,0 +1,377 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Defaults of DnsCacheSettings.
+const (
+	DefaultDnsMaxTtlSeconds      = 300
+	DefaultDnsNegativeTtlSeconds = 5
+	DefaultDnsMaxDialFailures    = 3
+	DefaultDnsMaxEntries         = 10000
+)
+
+// DnsCacheSettings configure the cache of the addresses that destinations and upstream proxies resolve to, which saves
+// connections from waiting for a lookup each. Addresses are kept for the TTL of their DNS records, within
+// MinTtlSeconds and MaxTtlSeconds, and hosts that don't exist for NegativeTtlSeconds. The cache is enabled by default.
+type DnsCacheSettings struct {
+	// Disabled looks up the host of every connection again.
+	Disabled bool
+
+	// MinTtlSeconds is the minimum number of seconds to keep addresses, even if their records have a shorter TTL.
+	// It's also how long addresses without a TTL, like the ones of the hosts file, are kept. Defaults to 0.
+	MinTtlSeconds int
+
+	// MaxTtlSeconds is the maximum number of seconds to keep addresses. Defaults to [DefaultDnsMaxTtlSeconds].
+	MaxTtlSeconds int
+
+	// NegativeTtlSeconds is the number of seconds to remember that a host doesn't exist (NXDOMAIN).
+	// Defaults to [DefaultDnsNegativeTtlSeconds], -1 disables it.
+	NegativeTtlSeconds int
+
+	// MaxDialFailures is the number of consecutive failed connections to the addresses of a host after which they're
+	// looked up again, e.g. because the destination moved. Defaults to [DefaultDnsMaxDialFailures].
+	MaxDialFailures int
+
+	// MaxEntries is the number of hosts to keep the addresses of. Beyond it, the least recently used host is
+	// forgotten. Defaults to [DefaultDnsMaxEntries].
+	MaxEntries int
+}
+
+// effective returns the settings with their defaults filled in.
+func (settings DnsCacheSettings) effective() DnsCacheSettings {
+	if settings.MaxTtlSeconds == 0 {
+		settings.MaxTtlSeconds = max(DefaultDnsMaxTtlSeconds, settings.MinTtlSeconds)
+	}
+	if settings.NegativeTtlSeconds == 0 {
+		settings.NegativeTtlSeconds = DefaultDnsNegativeTtlSeconds
+	}
+	if settings.MaxDialFailures == 0 {
+		settings.MaxDialFailures = DefaultDnsMaxDialFailures
+	}
+	if settings.MaxEntries == 0 {
+		settings.MaxEntries = DefaultDnsMaxEntries
+	}
+	return settings
+}
+
+// ttl returns how long to keep addresses whose records have the given TTL, if it's known.
+func (settings *DnsCacheSettings) ttl(seconds uint32, known bool) time.Duration {
+	if !known {
+		return time.Duration(settings.MinTtlSeconds) * time.Second
+	}
+	return time.Duration(min(max(int64(seconds), int64(settings.MinTtlSeconds)), int64(settings.MaxTtlSeconds))) * time.Second
+}
+
+// dnsCache caches the addresses socketDialer connects to, see DnsCacheSettings.
+var dnsCache = &hostCache{
+	settings: DnsCacheSettings{}.effective(),
+	entries:  newBoundedCache[dnsKey, *dnsEntry](cacheDns, DefaultDnsMaxEntries, 0),
+}
+
+// hostCache keeps the entries of hosts until their TTL passes. Entries whose lookup is in progress don't expire.
+type hostCache struct {
+	mutex    sync.Mutex
+	settings DnsCacheSettings
+	entries  *boundedCache[dnsKey, *dnsEntry]
+}
+
+// dnsKey identifies the addresses of a host of a family, the network of net.Resolver.LookupNetIP ("ip", "ip4" or "ip6").
+type dnsKey struct {
+	host    string
+	network string
+}
+
+type dnsEntry struct {
+	// ready is closed once the lookup is done. Until then, connections to the host wait for it instead of looking up
+	// the host as well.
+	ready chan struct{}
+
+	addrs    []netip.Addr
+	err      error
+	failures int
+}
+
+// configure applies settings, clearing the cache if they changed.
+func (c *hostCache) configure(settings DnsCacheSettings) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	settings = settings.effective()
+	if settings != c.settings {
+		c.settings = settings
+		c.entries.clear()
+		c.entries.resize(settings.MaxEntries)
+	}
+}
+
+// enabled reports whether addresses are cached.
+func (c *hostCache) enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return !c.settings.Disabled
+}
+
+// clear removes all entries, see ClearDnsCache.
+func (c *hostCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries.clear()
+}
+
+// len returns the number of hosts in the cache, see AdminStatus.CacheEntries.
+func (c *hostCache) len() int {
+	return c.entries.len()
+}
+
+// lookup returns the addresses of host for network, from the cache if they haven't expired.
+func (c *hostCache) lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	key := dnsKey{host: host, network: network}
+
+	for {
+		c.mutex.Lock()
+		entry, ok := c.entries.get(key)
+		if !ok {
+			break
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+
+		// The lookup of another connection may have been canceled along with its request, which doesn't say
+		// anything about the host.
+		if !isContextError(entry.err) {
+			dnsLookups.WithLabelValues(dnsLookupResult(entry.err, "hit")).Inc()
+			return entry.addrs, entry.err
+		}
+		c.mutex.Lock()
+		if current, _ := c.entries.peek(key); current == entry {
+			c.entries.delete(key)
+		}
+		c.mutex.Unlock()
+	}
+
+	entry := &dnsEntry{ready: make(chan struct{})}
+	c.entries.put(key, entry)
+	settings := c.settings
+	c.mutex.Unlock()
+
+	addrs, ttl, err := resolve(ctx, network, host, &settings)
+	dnsLookups.WithLabelValues(dnsLookupResult(err, "miss")).Inc()
+
+	c.mutex.Lock()
+	entry.addrs, entry.err = addrs, err
+	if current, _ := c.entries.peek(key); current == entry {
+		if ttl <= 0 {
+			c.entries.delete(key)
+		} else {
+			c.entries.putExpiring(key, entry, time.Now().Add(ttl))
+		}
+	}
+	c.mutex.Unlock()
+	close(entry.ready)
+
+	return addrs, err
+}
+
+func (entry *dnsEntry) done() bool {
+	select {
+	case <-entry.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialed records whether a connection to one of the addresses of host for network succeeded. After
+// MaxDialFailures consecutive failures, the addresses are removed so the next connection looks them up again.
+func (c *hostCache) dialed(network, host string, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := dnsKey{host: host, network: network}
+	entry, _ := c.entries.peek(key)
+	if entry == nil || !entry.done() {
+		return
+	}
+
+	if ok {
+		entry.failures = 0
+		return
+	}
+
+	if entry.failures++; entry.failures >= c.settings.MaxDialFailures {
+		dnsLog.Debug("connecting to the cached addresses failed, looking them up again", "host", host, "failures", entry.failures)
+		c.entries.delete(key)
+	}
+}
+
+// resolve looks up host with the system's DNS configuration, and returns how long to cache the result.
+// Errors other than the host not existing aren't cached.
+func resolve(ctx context.Context, network, host string, settings *DnsCacheSettings) ([]netip.Addr, time.Duration, error) {
+	answer := &dnsAnswer{}
+	addrs, err := ttlResolver.LookupNetIP(context.WithValue(ctx, dnsAnswerKey{}, answer), network, host)
+	if err != nil && !isContextError(err) {
+		// The system's resolver may know better, e.g. with the split DNS of a VPN on macOS. Its addresses don't
+		// come with a TTL.
+		systemAddrs, systemErr := net.DefaultResolver.LookupNetIP(ctx, network, host)
+		if systemErr == nil {
+			return systemAddrs, settings.ttl(0, false), nil
+		}
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		seconds, known := answer.ttl()
+		return addrs, settings.ttl(seconds, known), nil
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound && settings.NegativeTtlSeconds > 0:
+		return nil, time.Duration(settings.NegativeTtlSeconds) * time.Second, withCode(ErrorDnsFailure, err)
+	case isContextError(err):
+		return nil, 0, err
+	default:
+		return nil, 0, withCode(ErrorDnsFailure, err)
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// dnsLookupResult returns the result label of dns_lookups_total for a lookup that failed with err, if it did.
+func dnsLookupResult(err error, result string) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return result
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return "negative_" + result
+	default:
+		return "error"
+	}
+}
+
+// ClearDnsCache forgets the addresses of every host, e.g. when a destination moved to other addresses.
+func ClearDnsCache() {
+	dnsCache.clear()
+}
+
+// ttlResolver is Go's own resolver, which reads the system's DNS configuration, talking to the DNS servers over
+// connections that record the TTL of the answers of the lookup they're for (see dnsAnswer).
+var ttlResolver = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		answer, _ := ctx.Value(dnsAnswerKey{}).(*dnsAnswer)
+		if answer == nil {
+			return conn, nil
+		}
+		// The resolver tells datagrams from streams by whether the connection is a net.PacketConn.
+		if udpConn, ok := conn.(*net.UDPConn); ok {
+			return &dnsPacketConn{UDPConn: udpConn, answer: answer}, nil
+		}
+		return &dnsStreamConn{Conn: conn, answer: answer}, nil
+	},
+}
+
+// dnsAnswerKey is the context key of the dnsAnswer of a lookup.
+type dnsAnswerKey struct{}
+
+// dnsAnswer records the lowest TTL of the address records (and the CNAME records leading to them) of a lookup.
+type dnsAnswer struct {
+	mutex   sync.Mutex
+	seconds uint32
+	known   bool
+}
+
+func (a *dnsAnswer) ttl() (uint32, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.seconds, a.known
+}
+
+// parse records the TTLs of the answers of the DNS message msg.
+func (a *dnsAnswer) parse(msg []byte) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(msg); err != nil {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for {
+		header, err := parser.AnswerHeader()
+		if err != nil {
+			return
+		}
+		switch header.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+			if !a.known || header.TTL < a.seconds {
+				a.seconds, a.known = header.TTL, true
+			}
+		}
+		if err := parser.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// dnsPacketConn records the answers of the DNS messages it reads, one per datagram.
+type dnsPacketConn struct {
+	*net.UDPConn
+	answer *dnsAnswer
+}
+
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.answer.parse(b[:n])
+	}
+	return n, err
+}
+
+// dnsStreamConn records the answers of the DNS messages it reads, each prefixed with its length.
+type dnsStreamConn struct {
+	net.Conn
+	answer *dnsAnswer
+	buf    []byte
+}
+
+func (c *dnsStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		length := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+length {
+			break
+		}
+		c.answer.parse(c.buf[2 : 2+length])
+		c.buf = c.buf[2+length:]
+	}
+	return n, err
+}
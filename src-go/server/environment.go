@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// settingsEnvironmentVariables maps the environment variables that override settings to the fields they set.
+// Every field except SchemaVersion has one.
+var settingsEnvironmentVariables = []struct {
+	name  string
+	field string
+}{
+	{"AWESOME_TLS_PROJECT_ID", "ProjectId"},
+	{"AWESOME_TLS_CONFIGURATION_MODE", "ConfigurationMode"},
+	{"AWESOME_TLS_SPOOF_ADDRESS", "SpoofProxyAddress"},
+	{"AWESOME_TLS_REQUIRE_CLIENT_CERTIFICATE", "RequireClientCertificate"},
+	{"AWESOME_TLS_SPOOF_HTTP2", "SpoofHttp2"},
+	{"AWESOME_TLS_INTERCEPT_ADDRESS", "InterceptProxyAddress"},
+	{"AWESOME_TLS_BURP_ADDRESS", "BurpProxyAddress"},
+	{"AWESOME_TLS_INTERCEPT_OPAQUE_TRAFFIC", "InterceptOpaqueTraffic"},
+	{"AWESOME_TLS_INTERCEPT_UPSTREAM_PROXY_URL", "InterceptUpstreamProxyUrl"},
+	{"AWESOME_TLS_FINGERPRINT", "Fingerprint"},
+	{"AWESOME_TLS_HEX_CLIENT_HELLO", "HexClientHello"},
+	{"AWESOME_TLS_HTTP_TIMEOUT", "HttpTimeout"},
+	{"AWESOME_TLS_DIAL_TIMEOUT", "DialTimeout"},
+	{"AWESOME_TLS_TLS_HANDSHAKE_TIMEOUT", "TlsHandshakeTimeout"},
+	{"AWESOME_TLS_RESPONSE_HEADER_TIMEOUT", "ResponseHeaderTimeout"},
+	{"AWESOME_TLS_IDLE_READ_TIMEOUT", "IdleReadTimeout"},
+	{"AWESOME_TLS_MAX_RESPONSE_BYTES", "MaxResponseBytes"},
+	{"AWESOME_TLS_USE_INTERCEPTED_FINGERPRINT", "UseInterceptedFingerprint"},
+	{"AWESOME_TLS_INTERCEPTED_FINGERPRINT_HOSTS", "InterceptedFingerprintHosts"},
+	{"AWESOME_TLS_INTERCEPTED_FINGERPRINT_MAX_AGE", "InterceptedFingerprintMaxAge"},
+	{"AWESOME_TLS_INTERCEPTED_FINGERPRINT_MAX_ENTRIES", "InterceptedFingerprintMaxEntries"},
+	{"AWESOME_TLS_INTERCEPTED_FINGERPRINT_DEFAULT", "InterceptedFingerprintDefault"},
+	{"AWESOME_TLS_EXTERNAL_PROXY_URL", "ExternalProxyUrl"},
+	{"AWESOME_TLS_LOCAL_ADDRESS", "LocalAddress"},
+	{"AWESOME_TLS_REPORT_TIMINGS", "ReportTimings"},
+	{"AWESOME_TLS_REPORT_TLS", "ReportTls"},
+	{"AWESOME_TLS_RETRY_POLICY", "RetryPolicy"},
+	{"AWESOME_TLS_MAX_CONCURRENT_REQUESTS", "MaxConcurrentRequests"},
+	{"AWESOME_TLS_MAX_CONCURRENT_REQUESTS_PER_HOST", "MaxConcurrentRequestsPerHost"},
+	{"AWESOME_TLS_SOCKET_OPTIONS", "SocketOptions"},
+	{"AWESOME_TLS_DNS_CACHE", "DnsCache"},
+	{"AWESOME_TLS_CACHES", "Caches"},
+	{"AWESOME_TLS_PREWARM", "Prewarm"},
+	{"AWESOME_TLS_WIRE_CAPTURE", "WireCapture"},
+	{"AWESOME_TLS_RECENT_ERRORS", "RecentErrors"},
+	{"AWESOME_TLS_REDACTION", "Redaction"},
+	{"AWESOME_TLS_BYPASS_HOSTS", "BypassHosts"},
+	{"AWESOME_TLS_HOOKS", "Hooks"},
+	{"AWESOME_TLS_SCRIPT", "Script"},
+	{"AWESOME_TLS_MIRROR", "Mirror"},
+	{"AWESOME_TLS_PROFILES", "Profiles"},
+	{"AWESOME_TLS_PROFILE_HOSTS", "ProfileHosts"},
+	{"AWESOME_TLS_DEFAULT_PROFILE", "DefaultProfile"},
+	{"AWESOME_TLS_LISTENERS", "Listeners"},
+	{"AWESOME_TLS_FORWARD_PROXY_ADDRESS", "ForwardProxyAddress"},
+	{"AWESOME_TLS_SOCKS_PROXY", "SocksProxy"},
+	{"AWESOME_TLS_CONTROL_ADDRESS", "ControlAddress"},
+	{"AWESOME_TLS_ADMIN_ADDRESS", "AdminAddress"},
+	{"AWESOME_TLS_ADMIN_TOKEN", "AdminToken"},
+	{"AWESOME_TLS_METRICS_ADDRESS", "MetricsAddress"},
+	{"AWESOME_TLS_METRICS_HOST_BUCKETS", "MetricsHostBuckets"},
+	{"AWESOME_TLS_PPROF_ADDRESS", "PprofAddress"},
+	{"AWESOME_TLS_PERSIST_SECRETS", "PersistSecrets"},
+	{"AWESOME_TLS_LOG_LEVEL", "LogLevel"},
+	{"AWESOME_TLS_LOG_FORMAT", "LogFormat"},
+	{"AWESOME_TLS_LOG_FILE", "LogFile"},
+	{"AWESOME_TLS_LOG_MAX_SIZE_MB", "LogMaxSizeMB"},
+	{"AWESOME_TLS_LOG_MAX_BACKUPS", "LogMaxBackups"},
+	{"AWESOME_TLS_DEBUG", "Debug"},
+}
+
+func init() {
+	fields := reflect.VisibleFields(reflect.TypeFor[Settings]())
+	for _, field := range fields {
+		if field.Name != "SchemaVersion" && !slices.ContainsFunc(settingsEnvironmentVariables, func(variable struct{ name, field string }) bool {
+			return variable.field == field.Name
+		}) {
+			panic(fmt.Sprintf("no environment variable for setting %s", field.Name))
+		}
+	}
+}
+
+// environment holds the settings read from environment variables by StartServer.
+// SaveSettings decodes its settings on top of them, so fields it's passed take precedence.
+var environment atomic.Pointer[Settings]
+
+// environmentSettings returns a copy of the settings read from environment variables.
+func environmentSettings() *Settings {
+	settings := &Settings{}
+	if overrides := environment.Load(); overrides != nil {
+		*settings = *overrides
+		settings.InterceptedFingerprintHosts = slices.Clone(overrides.InterceptedFingerprintHosts)
+		settings.RetryPolicy = overrides.RetryPolicy.clone()
+		settings.BypassHosts = slices.Clone(overrides.BypassHosts)
+		settings.Profiles = maps.Clone(overrides.Profiles)
+		settings.ProfileHosts = slices.Clone(overrides.ProfileHosts)
+		settings.Listeners = slices.Clone(overrides.Listeners)
+		settings.Mirror = overrides.Mirror.clone()
+		settings.SocketOptions = overrides.SocketOptions.clone()
+		settings.Prewarm = overrides.Prewarm.clone()
+		if overrides.MaxResponseBytes != nil {
+			maxResponseBytes := *overrides.MaxResponseBytes
+			settings.MaxResponseBytes = &maxResponseBytes
+		}
+	}
+	return settings
+}
+
+// readEnvironment reads the settings from the AWESOME_TLS_* environment variables that are set,
+// and returns them along with the names of those variables.
+func readEnvironment() (*Settings, []string, error) {
+	settings := &Settings{}
+	value := reflect.ValueOf(settings).Elem()
+
+	var names []string
+	for _, variable := range settingsEnvironmentVariables {
+		raw, ok := os.LookupEnv(variable.name)
+		if !ok {
+			continue
+		}
+
+		field := value.FieldByName(variable.field)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, nil, fmt.Errorf("environment variable %s: '%s' is not an integer", variable.name, raw)
+			}
+			field.SetInt(int64(n))
+		case reflect.Pointer:
+			// Optional numbers, like MaxResponseBytes.
+			n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, field.Type().Elem().Bits())
+			if err != nil {
+				return nil, nil, fmt.Errorf("environment variable %s: '%s' is not an integer", variable.name, raw)
+			}
+			field.Set(reflect.New(field.Type().Elem()))
+			field.Elem().SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, nil, fmt.Errorf("environment variable %s: '%s' is not a boolean", variable.name, raw)
+			}
+			field.SetBool(b)
+		case reflect.Map, reflect.Struct:
+			// Maps and objects, like Profiles and RetryPolicy, are JSON objects.
+			if err := json.Unmarshal([]byte(raw), field.Addr().Interface()); err != nil {
+				return nil, nil, fmt.Errorf("environment variable %s: %w", variable.name, err)
+			}
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				// Lists of objects, like Listeners, are JSON arrays.
+				if err := json.Unmarshal([]byte(raw), field.Addr().Interface()); err != nil {
+					return nil, nil, fmt.Errorf("environment variable %s: %w", variable.name, err)
+				}
+				break
+			}
+			// Lists are comma-separated, like InterceptedFingerprintHosts.
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			panic(fmt.Sprintf("unsupported type %s of setting %s", field.Type(), variable.field))
+		}
+
+		names = append(names, variable.name)
+	}
+
+	return settings, names, nil
+}
+
+// applyEnvironment reads the settings from environment variables and applies them below the ones passed to SaveSettings.
+func applyEnvironment() error {
+	overrides, names, err := readEnvironment()
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 && environment.Load() == nil {
+		return nil
+	}
+
+	for _, name := range names {
+		settingsLog.Info("using environment variable", "name", name)
+	}
+
+	previous := environment.Swap(overrides)
+
+	// The settings passed to SaveSettings didn't change, so there's nothing new to persist.
+	if err = saveSettings(state.Load().saved, false); err != nil {
+		environment.Store(previous)
+		return fmt.Errorf("settings from environment variables: %w", err)
+	}
+
+	return nil
+}
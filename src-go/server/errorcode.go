@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	utls "github.com/bogdanfinn/utls"
+)
+
+// ErrorCodeHeaderKey is the response header naming the code of the error the spoof server responded with, see
+// RequestError. Responses truncated to MaxResponseBytes carry ErrorBodyTooLarge in it as well.
+const ErrorCodeHeaderKey = "X-Awesometls-Error-Code"
+
+// Codes of the errors of requests, see RequestError.
+const (
+	// ErrorDnsFailure is a failed lookup of the destination's address.
+	ErrorDnsFailure = "DNS_FAILURE"
+	// ErrorDialTimeout is a connection to the destination (or to the upstream proxy) that timed out.
+	ErrorDialTimeout = "DIAL_TIMEOUT"
+	// ErrorDialFailed is a connection to the destination that was refused or couldn't be routed.
+	ErrorDialFailed = "DIAL_FAILED"
+	// ErrorTlsHandshakeRejected is a TLS handshake the destination aborted, e.g. because it rejected the fingerprint.
+	ErrorTlsHandshakeRejected = "TLS_HANDSHAKE_REJECTED"
+	// ErrorTlsCertInvalid is a certificate that failed verification. The spoof server leaves verifying the certificates
+	// of destinations to Burp, so it's the one of an https upstream proxy.
+	ErrorTlsCertInvalid = "TLS_CERT_INVALID"
+	// ErrorProxyConnectFailed is an upstream proxy that couldn't be reached, or refused to connect to the destination.
+	ErrorProxyConnectFailed = "PROXY_CONNECT_FAILED"
+	// ErrorProxyAuthRequired is an upstream proxy that rejected the credentials of ExternalProxyUrl, or needs some.
+	ErrorProxyAuthRequired = "PROXY_AUTH_REQUIRED"
+	// ErrorConfigInvalid is a transport configuration or profile that can't be used.
+	ErrorConfigInvalid = "CONFIG_INVALID"
+	// ErrorBodyTooLarge is a response body larger than MaxResponseBytes, which was truncated.
+	ErrorBodyTooLarge = "BODY_TOO_LARGE"
+	// ErrorTimeout is a timeout after the connection was made: of the TLS handshake, the response or HttpTimeout.
+	ErrorTimeout = "TIMEOUT"
+	// ErrorConnectionFailed is a connection the destination closed or reset while the request was sent.
+	ErrorConnectionFailed = "CONNECTION_FAILED"
+	// ErrorHookFailed is a hook or script that failed a request.
+	ErrorHookFailed = "HOOK_FAILED"
+	// ErrorCanceled is a request Burp gave up on.
+	ErrorCanceled = "CANCELED"
+	// ErrorInternal is any other error.
+	ErrorInternal = "INTERNAL"
+)
+
+// RequestError is the error of a failed request, with the code classifying it.
+type RequestError struct {
+	Code string
+	Err  error
+}
+
+func (err *RequestError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *RequestError) Unwrap() error {
+	return err.Err
+}
+
+// withCode returns err with code, or nil if err is nil. Errors that already have a code, and those of canceled
+// requests, keep theirs.
+func withCode(code string, err error) error {
+	var requestErr *RequestError
+	if err == nil || errors.Is(err, context.Canceled) || errors.As(err, &requestErr) {
+		return err
+	}
+	return &RequestError{Code: code, Err: err}
+}
+
+// errorCode returns the code of err. Timeouts of the stages of a request take precedence, since whatever failed
+// ran out of time; then comes the code err was wrapped with, and else the one its cause maps to.
+func errorCode(err error) string {
+	var timeoutErr *stageTimeoutError
+	var requestErr *RequestError
+	switch {
+	case errors.As(err, &timeoutErr):
+		if timeoutErr.stage == stageDial {
+			return ErrorDialTimeout
+		}
+		return ErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.As(err, &requestErr):
+		return requestErr.Code
+	}
+	return stageErrorCode(err, "")
+}
+
+// stageErrorCode returns the code of err, which happened in stage of a request (or outside of one if it's empty).
+func stageErrorCode(err error, stage string) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.As(err, &dnsErr):
+		return ErrorDnsFailure
+	case isCertificateError(err):
+		return ErrorTlsCertInvalid
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		if stage == stageDial {
+			return ErrorDialTimeout
+		}
+		return ErrorTimeout
+	}
+
+	switch stage {
+	case stageDial:
+		return ErrorDialFailed
+	case stageTLSHandshake:
+		return ErrorTlsHandshakeRejected
+	case stageWriteRequest, stageResponseHeader, stageIdleRead:
+		return ErrorConnectionFailed
+	}
+	return ErrorInternal
+}
+
+// isCertificateError reports whether err is the failed verification of a certificate, by either TLS stack.
+func isCertificateError(err error) bool {
+	var utlsErr *utls.CertificateVerificationError
+	var tlsErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &utlsErr) || errors.As(err, &tlsErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// proxyError returns err of connecting through an upstream proxy with its code.
+func proxyError(err error) error {
+	var statusErr *proxyStatusError
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return err
+	case isCertificateError(err):
+		return withCode(ErrorTlsCertInvalid, err)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == fhttp.StatusProxyAuthRequired:
+		return withCode(ErrorProxyAuthRequired, err)
+	// SOCKS proxies refusing the credentials only say so in the message.
+	case strings.Contains(err.Error(), "authentication"):
+		return withCode(ErrorProxyAuthRequired, err)
+	default:
+		return withCode(ErrorProxyConnectFailed, err)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestListener accepts TCP connections for the rest of the test, which serve handles until it returns, and returns
+// its address. done is closed when the test ends.
+func newTestListener(t *testing.T, serve func(conn net.Conn, done <-chan struct{})) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn, done)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connectReplying returns a proxy serving function that answers CONNECT requests with status.
+func connectReplying(status string) func(conn net.Conn, done <-chan struct{}) {
+	return func(conn net.Conn, done <-chan struct{}) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			fmt.Fprintf(conn, "HTTP/1.1 %s\r\nContent-Length: 0\r\n\r\n", status)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", 100))
+	})
+
+	tests := []struct {
+		name string
+		// setup returns the destination and the fields of the transport configuration of the request.
+		setup      func(t *testing.T) (*httptest.Server, map[string]any)
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name: "DNS failure",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				return &httptest.Server{URL: "https://no-such-host.invalid:443"}, nil
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorDnsFailure,
+		},
+		{
+			name: "dial refused",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				listener.Close()
+				return &httptest.Server{URL: "https://" + listener.Addr().String()}, nil
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorDialFailed,
+		},
+		{
+			// The proxy accepts the connection but never answers the CONNECT request, which is part of the dial.
+			name: "dial timeout",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				proxy := newTestListener(t, func(conn net.Conn, done <-chan struct{}) { <-done })
+				return origin, map[string]any{"ExternalProxyUrl": "http://" + proxy, "DialTimeout": 1}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorDialTimeout,
+		},
+		{
+			name: "handshake rejected",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				destination := newTestListener(t, func(conn net.Conn, done <-chan struct{}) {
+					// A handshake_failure alert, in reply to the ClientHello.
+					bufio.NewReader(conn).Peek(1)
+					conn.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28})
+				})
+				return &httptest.Server{URL: "https://" + destination}, nil
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorTlsHandshakeRejected,
+		},
+		{
+			// The certificate of the test server isn't signed by a CA the system trusts.
+			name: "invalid certificate of the upstream proxy",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				proxy := httptest.NewTLSServer(http.NotFoundHandler())
+				t.Cleanup(proxy.Close)
+				return origin, map[string]any{"ExternalProxyUrl": proxy.URL}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorTlsCertInvalid,
+		},
+		{
+			name: "upstream proxy refuses to connect",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				proxy := newTestListener(t, connectReplying("502 Bad Gateway"))
+				return origin, map[string]any{"ExternalProxyUrl": "http://" + proxy}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorProxyConnectFailed,
+		},
+		{
+			name: "upstream proxy needs credentials",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				proxy := newTestListener(t, connectReplying("407 Proxy Authentication Required"))
+				return origin, map[string]any{"ExternalProxyUrl": "http://alice:wrong@" + proxy}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorProxyAuthRequired,
+		},
+		{
+			name: "malformed configuration",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				return origin, map[string]any{"DialTimeout": "soon"}
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrorConfigInvalid,
+		},
+		{
+			// The configuration parses, but the client it describes can't be made.
+			name: "unusable configuration",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				return origin, map[string]any{"Fingerprint": "no_such_fingerprint"}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorConfigInvalid,
+		},
+		{
+			// The response is truncated rather than failed.
+			name: "body too large",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				return origin, map[string]any{"MaxResponseBytes": 10}
+			},
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorBodyTooLarge,
+		},
+		{
+			name: "internal",
+			setup: func(t *testing.T) (*httptest.Server, map[string]any) {
+				transport := &panickingTransport{}
+				transport.panics.Store(1)
+				previous := hookClient
+				hookClient = &http.Client{Transport: transport}
+				t.Cleanup(func() { hookClient = previous })
+				saveTestSettings(t, `{"Hooks":{"RequestUrl":"http://hook.test/request"}}`)
+				return origin, nil
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorInternal,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination, more := test.setup(t)
+			res, body := spoofGet(t, destination, "/", more)
+			if got := res.Header.Get(ErrorCodeHeaderKey); res.StatusCode != test.wantStatus || got != test.wantCode {
+				t.Errorf("got %d (%s) %.200q, want %d (%s)", res.StatusCode, got, body, test.wantStatus, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Err: context.DeadlineExceeded}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"dial stage timeout", &stageTimeoutError{stage: stageDial, err: timeout}, ErrorDialTimeout},
+		{"later stage timeout", &stageTimeoutError{stage: stageResponseHeader, err: timeout}, ErrorTimeout},
+		{"stage timeout over a code", withCode(ErrorProxyConnectFailed, &stageTimeoutError{stage: stageDial, err: timeout}), ErrorDialTimeout},
+		{"canceled", fmt.Errorf("round trip: %w", context.Canceled), ErrorCanceled},
+		{"code kept when wrapped", fmt.Errorf("hook: %w", withCode(ErrorHookFailed, errors.New("exit 1"))), ErrorHookFailed},
+		{"first code wins", withCode(ErrorInternal, withCode(ErrorConfigInvalid, errors.New("bad"))), ErrorConfigInvalid},
+		{"DNS error", &net.DNSError{Err: "no such host", Name: "a.invalid", IsNotFound: true}, ErrorDnsFailure},
+		{"deadline", context.DeadlineExceeded, ErrorTimeout},
+		{"proxy 407", proxyError(&proxyStatusError{Status: "407 Proxy Authentication Required", StatusCode: http.StatusProxyAuthRequired}), ErrorProxyAuthRequired},
+		{"proxy 502", proxyError(&proxyStatusError{Status: "502 Bad Gateway", StatusCode: http.StatusBadGateway}), ErrorProxyConnectFailed},
+		{"SOCKS credentials", proxyError(errors.New("socks connect tcp: username/password authentication failed")), ErrorProxyAuthRequired},
+		{"anything else", io.ErrUnexpectedEOF, ErrorInternal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorCode(test.err); got != test.want {
+				t.Errorf("errorCode(%v) = %s, want %s", test.err, got, test.want)
+			}
+		})
+	}
+}
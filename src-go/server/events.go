@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the events streamed by the Events call of the control plane.
+const (
+	// EventSettingsApplied is published when SaveSettings applied new settings.
+	EventSettingsApplied = "settings_applied"
+	// EventFingerprintCaptured is published when the intercept proxy captured a fingerprint (field "key").
+	EventFingerprintCaptured = "fingerprint_captured"
+	// EventListenerStarted is published when a listener started (fields "name" and "address").
+	EventListenerStarted = "listener_started"
+	// EventListenerStopped is published when a listener stopped (field "name").
+	EventListenerStopped = "listener_stopped"
+	// EventListenerDown is published when accepting connections failed unexpectedly and a supervised listener
+	// (see supervisedListener) starts rebinding (fields "listener", "address" and "error").
+	EventListenerDown = "listener_down"
+	// EventListenerRestarted is published when a supervised listener rebound (fields "listener", "address" and "attempts").
+	EventListenerRestarted = "listener_restarted"
+	// EventListenerGaveUp is published when a supervised listener stopped trying to rebind (fields "listener", "address" and "error").
+	EventListenerGaveUp = "listener_gave_up"
+	// EventResumed is published when the connection pools were reset after the machine slept (field "gap").
+	EventResumed = "resumed"
+	// EventRequestFailed is published when the spoof server responded with an error (fields "code", see RequestError,
+	// and "error", and "requestId" and "host" once the destination is known).
+	EventRequestFailed = "request_failed"
+	// EventCertificateExpiring is published when the CA or a cached leaf certificate gets within 30 and then 7 days
+	// of expiring, see CertificateExpiry (fields "certificate", "ca" or "leaf", "host" for leaves, "notAfter",
+	// "daysLeft" and "action").
+	EventCertificateExpiring = "certificate_expiring"
+)
+
+// subscriberBuffer is the number of items buffered for each subscriber.
+// Items published while a subscriber's buffer is full are dropped for it, so a slow client never blocks the server.
+const subscriberBuffer = 256
+
+// broadcaster delivers published items to every current subscriber.
+type broadcaster[T any] struct {
+	mutex       sync.Mutex
+	subscribers map[chan T]struct{}
+}
+
+// subscribe returns a channel receiving the items published from now on, and a function that ends the subscription.
+func (b *broadcaster[T]) subscribe() (<-chan T, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := make(chan T, subscriberBuffer)
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan T]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		delete(b.subscribers, ch)
+	}
+}
+
+func (b *broadcaster[T]) publish(item T) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- item:
+		default:
+		}
+	}
+}
+
+type event struct {
+	time   time.Time
+	kind   string
+	fields map[string]string
+}
+
+// logEntry is a record of the log as streamed by the Logs call of the control plane, see logHandler.
+type logEntry struct {
+	time    time.Time
+	message string
+}
+
+var (
+	events = &broadcaster[event]{}
+	logs   = &broadcaster[logEntry]{}
+)
+
+// publishEvent notifies the subscribers of the Events call of the control plane.
+func publishEvent(kind string, fields map[string]string) {
+	events.publish(event{time: time.Now(), kind: kind, fields: fields})
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	utls "github.com/bogdanfinn/utls"
+)
+
+// forward is the forward proxy of Settings.ForwardProxyAddress.
+// It runs along with the spoof server and issues its certificates with the same CA.
+var forward = &forwardProxy{}
+
+type forwardProxy struct {
+	mutex    sync.Mutex
+	addr     string
+	listener *forwardListener
+}
+
+// forwardListener serves the forward proxy on one address.
+// Plain HTTP proxy requests and CONNECT requests arrive at server. The TLS connections that clients open through their
+// CONNECT tunnels are handed to mitm.
+type forwardListener struct {
+	addr      string
+	boundAddr net.Addr
+	server    *fhttp.Server
+	mitm      *mitmServer
+}
+
+// sync applies ForwardProxyAddress: the proxy moves to addr, or stops if it's empty.
+// If the spoof server isn't running, the proxy starts along with it instead (see start).
+func (p *forwardProxy) sync(addr string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.addr = addr
+
+	if p.listener != nil && p.listener.addr == addr {
+		return nil
+	}
+	if p.listener == nil && (addr == "" || !spoof.running()) {
+		return nil
+	}
+
+	previous := p.listener
+
+	p.listener = nil
+	if addr != "" {
+		listener, err := newForwardListener(addr)
+		if err != nil {
+			p.listener = previous
+			return err
+		}
+		p.listener = listener
+	}
+
+	if previous != nil {
+		go func() {
+			defer recoverPanic(forwardLog, "shutdown")
+
+			if err := previous.shutdown(); err != nil {
+				forwardLog.Warn("shutdown of the previous listener failed", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// start starts the proxy on ForwardProxyAddress, if it's set and the proxy isn't running yet.
+func (p *forwardProxy) start() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener != nil || p.addr == "" {
+		return nil
+	}
+
+	listener, err := newForwardListener(p.addr)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+
+	return nil
+}
+
+func (p *forwardProxy) stop() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener == nil {
+		return nil
+	}
+
+	err := p.listener.shutdown()
+	p.listener = nil
+
+	return err
+}
+
+// listenAddr returns the dialable address the proxy listens on, or an empty string if it isn't running.
+func (p *forwardProxy) listenAddr() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener == nil {
+		return ""
+	}
+
+	return dialableAddr(p.listener.boundAddr)
+}
+
+// GetForwardProxyAddress returns the address the forward proxy listens on, or an empty string if it isn't running.
+// Like GetListenAddress, a port 0 in ForwardProxyAddress is replaced with the port that was chosen.
+func GetForwardProxyAddress() string {
+	return forward.listenAddr()
+}
+
+func newForwardListener(addr string) (*forwardListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen, err: %w", err)
+	}
+	listener = limitConnections(supervise("forward proxy", addr, listener))
+
+	mitm, err := newMITMServer(listener.Addr())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	l := &forwardListener{
+		addr:      addr,
+		boundAddr: listener.Addr(),
+		mitm:      mitm,
+	}
+
+	l.server = &fhttp.Server{
+		Addr:      addr,
+		Handler:   fhttp.HandlerFunc(l.handle),
+		ConnState: trackConnState,
+	}
+
+	go func() {
+		defer recoverPanic(forwardLog, "serve")
+
+		if err := l.server.Serve(listener); err != nil && !errors.Is(err, fhttp.ErrServerClosed) {
+			forwardLog.Error("serve failed", "error", err)
+		}
+	}()
+
+	return l, nil
+}
+
+// shutdown stops accepting requests and waits for the ones in flight to finish.
+func (l *forwardListener) shutdown() error {
+	return errors.Join(l.server.Shutdown(context.Background()), l.mitm.shutdown())
+}
+
+// handle serves proxy requests: CONNECT requests open a tunnel, other requests (e.g. `GET http://host/path`)
+// are sent to the host of their URL.
+func (l *forwardListener) handle(w fhttp.ResponseWriter, req *fhttp.Request) {
+	defer recoverHandler(w, forwardLog)
+
+	if req.Method == fhttp.MethodConnect {
+		l.tunnel(w, req)
+		return
+	}
+
+	if req.URL.Host == "" {
+		fhttp.Error(w, "Awesome TLS error: not a proxy request, the request target must be an absolute URL", fhttp.StatusBadRequest)
+		return
+	}
+
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	sendProxied(w, req, scheme, req.URL.Host)
+}
+
+// tunnel accepts a CONNECT request and hands the TLS connection the client opens through it to the MITM server.
+func (l *forwardListener) tunnel(w fhttp.ResponseWriter, req *fhttp.Request) {
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		fhttp.Error(w, "Awesome TLS error: CONNECT target must be of the form host:port", fhttp.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(fhttp.Hijacker)
+	if !ok {
+		writeError(w, forwardLog, nil, withCode(ErrorInternal, errors.New("connection can't be hijacked")))
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, forwardLog, nil, withCode(ErrorInternal, err))
+		return
+	}
+
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+
+	// Whatever the client sent after the CONNECT request (usually its ClientHello) may already be buffered.
+	l.mitm.serve(&tunnelConn{Conn: conn, reader: buffered.Reader, authority: req.Host})
+}
+
+// mitmServer terminates TLS connections tunneled through a proxy with certificates for their destination, signed by
+// the spoof server's CA, and sends the requests they carry to that destination.
+type mitmServer struct {
+	server    *fhttp.Server
+	tunnels   *tunnelListener
+	tlsConfig *utls.Config
+}
+
+// newMITMServer creates a MITM server for the proxy listening on addr. The spoof server must be running.
+func newMITMServer(addr net.Addr) (*mitmServer, error) {
+	spoof.mutex.Lock()
+	tlsConfig := spoof.tlsConfig
+	spoof.mutex.Unlock()
+
+	if tlsConfig == nil {
+		return nil, errors.New("spoof server isn't running")
+	}
+
+	ca := tlsConfig.Certificates[0]
+	leaves, err := newLeafCertificates(ca.Leaf, ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("leaf certificates: %w", err)
+	}
+
+	m := &mitmServer{
+		tunnels: newTunnelListener(addr),
+	}
+
+	m.tlsConfig = &utls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *utls.ClientHelloInfo) (*utls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				// Clients don't send a server name for IP addresses, so the certificate is for the host of the tunnel.
+				if tunnel, ok := hello.Conn.(*tunnelConn); ok {
+					host, _, _ = net.SplitHostPort(tunnel.authority)
+				}
+			}
+			return leaves.get(host)
+		},
+	}
+
+	m.server = &fhttp.Server{
+		Handler:   fhttp.HandlerFunc(m.handle),
+		ConnState: trackConnState,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if tlsConn, ok := conn.(*utls.Conn); ok {
+				if tunnel, ok := tlsConn.NetConn().(*tunnelConn); ok {
+					ctx = context.WithValue(ctx, tunnelAuthorityKey{}, tunnel.authority)
+				}
+			}
+			return ctx
+		},
+	}
+
+	go func() {
+		defer recoverPanic(forwardLog, "serve")
+
+		if err := m.server.Serve(m.tunnels); err != nil && !errors.Is(err, fhttp.ErrServerClosed) {
+			forwardLog.Error("MITM server: serve failed", "error", err)
+		}
+	}()
+
+	return m, nil
+}
+
+// serve terminates the TLS connection of tunnel and serves the requests it carries, closing it if the server is shut down.
+func (m *mitmServer) serve(tunnel *tunnelConn) {
+	if !m.tunnels.push(utls.Server(tunnel, m.tlsConfig)) {
+		tunnel.Close()
+	}
+}
+
+func (m *mitmServer) shutdown() error {
+	return m.server.Shutdown(context.Background())
+}
+
+// tunnelAuthorityKey is the context key of the authority (host:port) of the tunnel that requests arrived through.
+type tunnelAuthorityKey struct{}
+
+// handle sends requests that arrived through a tunnel to the host of the tunnel.
+func (m *mitmServer) handle(w fhttp.ResponseWriter, req *fhttp.Request) {
+	defer recoverHandler(w, forwardLog)
+
+	authority, _ := req.Context().Value(tunnelAuthorityKey{}).(string)
+	sendProxied(w, req, "https", authority)
+}
+
+// sendProxied sends a request that arrived at a proxy to authority (host[:port]) with the saved settings,
+// like the spoof server does for requests without a transport configuration.
+func sendProxied(w fhttp.ResponseWriter, req *fhttp.Request, scheme, authority string) {
+	current := state.Load()
+	defaults := current.defaultsFor("")
+
+	removeInternalHeaders(req.Header)
+	removeInternalTrailers(req)
+	req.Header.Del("Proxy-Authorization")
+
+	if localAddr, ok := req.Context().Value(fhttp.LocalAddrContextKey).(net.Addr); ok && authority == localAddr.String() {
+		writeError(w, forwardLog, nil, withCode(ErrorConfigInvalid, errors.New("request to the proxy itself")))
+		return
+	}
+
+	config := defaults
+	config.Scheme = scheme
+	config.Host = authority
+
+	current.send(w, req, defaults, &config)
+}
+
+// tunnelConn is a connection tunneled to authority through a proxy, e.g. hijacked from a CONNECT request.
+// Data the proxy already read from the connection is buffered in reader.
+type tunnelConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	authority string
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// tunnelListener hands the connections of tunnels to a server.
+type tunnelListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newTunnelListener(addr net.Addr) *tunnelListener {
+	return &tunnelListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push hands conn to the server. It returns false if the listener is closed.
+func (l *tunnelListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	recordTypeChangeCipherSpec = 0x14
+	recordTypeAlert            = 0x15
+	recordTypeHandshake        = 0x16
+	recordTypeApplicationData  = 0x17
+
+	handshakeTypeClientHello = 0x01
+	handshakeTypeServerHello = 0x02
+
+	// maxClientHelloLength is the maximum size of a (reassembled) ClientHello we accept.
+	// Post-quantum key shares and ECH make hellos larger than a single record, but never anywhere close to this.
+	maxClientHelloLength = 1 << 18
+
+	// maxRecordLength is the maximum length of the payload of a plaintext TLS record, see RFC 8446, Section 5.1.
+	maxRecordLength = 1 << 14
+)
+
+// helloRetryRequestRandom is the Random value of a ServerHello that is actually a HelloRetryRequest.
+// See RFC 8446, Section 4.1.3.
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// readClientHello reads a ClientHello from r, reassembling it when it's fragmented across multiple TLS records.
+// It returns the raw bytes consumed from r, so they can be forwarded as-is,
+// and the ClientHello as a single record that can be used as a HexClientHello.
+// Both are nil if r doesn't start with a TLS handshake record, in which case nothing is consumed.
+func readClientHello(r *bufio.Reader) ([]byte, []byte, error) {
+	contentType, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if contentType[0] != recordTypeHandshake {
+		return nil, nil, nil
+	}
+
+	var raw, message []byte
+	var version []byte
+
+	for {
+		record, err := readRecord(r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if record[0] != recordTypeHandshake {
+			return nil, nil, fmt.Errorf("ClientHello interrupted by record of type %d", record[0])
+		}
+
+		if version == nil {
+			version = record[1:3]
+		}
+
+		raw = append(raw, record...)
+		message = append(message, record[5:]...)
+
+		if len(message) < 4 {
+			continue
+		}
+
+		if message[0] != handshakeTypeClientHello {
+			return nil, nil, errors.New("handshake message is not a ClientHello")
+		}
+
+		length := 4 + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+		if length > maxClientHelloLength {
+			return nil, nil, fmt.Errorf("ClientHello of %d bytes is too large", length)
+		}
+
+		if len(message) >= length {
+			// The record length field is capped, but it's ignored when the record is parsed anyway.
+			clientHello := []byte{recordTypeHandshake, version[0], version[1], 0, 0}
+			binary.BigEndian.PutUint16(clientHello[3:], uint16(min(length, 0xffff)))
+			return raw, append(clientHello, message[:length]...), nil
+		}
+	}
+}
+
+// readRecord reads a single TLS record, including its header.
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[3:])
+
+	record := make([]byte, 5+int(length))
+	copy(record, header)
+	if _, err := io.ReadFull(r, record[5:]); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// serverHelloReader passes the server's data through unchanged,
+// while reporting on result whether its first handshake message is a HelloRetryRequest.
+type serverHelloReader struct {
+	r      io.Reader
+	seen   []byte
+	done   bool
+	result chan bool
+}
+
+func newServerHelloReader(r io.Reader) *serverHelloReader {
+	return &serverHelloReader{
+		r:      r,
+		result: make(chan bool, 1),
+	}
+}
+
+func (r *serverHelloReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	if !r.done {
+		r.inspect(p[:n], err)
+	}
+
+	return n, err
+}
+
+// WriteTo copies the server's data to w, reading it through Read until the ServerHello is known, and leaving the rest to
+// the reader it wraps, which can splice it between the connections (see copyBuffered).
+func (r *serverHelloReader) WriteTo(w io.Writer) (int64, error) {
+	buf := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(buf)
+
+	var written int64
+	for !r.done {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			m, writeErr := w.Write((*buf)[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if m < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	n, err := io.Copy(w, r.r)
+	return written + n, err
+}
+
+// inspect accumulates the server's data until the Random value of its ServerHello is known.
+func (r *serverHelloReader) inspect(data []byte, err error) {
+	// Record header (5) + handshake header (4) + version (2) + random (32).
+	const randomEnd = 5 + 4 + 2 + 32
+
+	r.seen = append(r.seen, data...)
+
+	switch {
+	case len(r.seen) > 0 && r.seen[0] != recordTypeHandshake, len(r.seen) > 5 && r.seen[5] != handshakeTypeServerHello:
+		r.report(false)
+	case len(r.seen) >= randomEnd:
+		r.report(bytes.Equal(r.seen[randomEnd-32:randomEnd], helloRetryRequestRandom))
+	case err != nil:
+		r.report(false)
+	}
+}
+
+func (r *serverHelloReader) report(helloRetryRequest bool) {
+	r.done = true
+	r.seen = nil
+	r.result <- helloRetryRequest
+}
@@ -0,0 +1,501 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	utls "github.com/bogdanfinn/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	handshakeTypeCertificate = 0x0b
+
+	extensionCookie   uint16 = 0x002c
+	extensionKeyShare uint16 = 0x0033
+
+	// maxHandshakeRecording is the number of bytes of each direction of a handshake a handshakeRecorder keeps, which
+	// is plenty for the hellos and the certificates of TLS 1.2.
+	maxHandshakeRecording = 64 << 10
+)
+
+// The steps of a TLS handshake, in the order they happen, see HandshakeDiagnostics.Progress.
+var handshakeSteps = []string{
+	"connected",
+	"ClientHello sent",
+	"HelloRetryRequest received",
+	"ServerHello received",
+	// TLS 1.2 sends the certificate in the clear, TLS 1.3 encrypts the rest of the server's handshake.
+	"certificate received",
+	"encrypted handshake received",
+	"client Finished sent",
+	"server Finished received",
+}
+
+const (
+	stepConnected = iota
+	stepClientHelloSent
+	stepHelloRetryRequestReceived
+	stepServerHelloReceived
+	stepCertificateReceived
+	stepEncryptedHandshakeReceived
+	stepClientFinishedSent
+	stepServerFinishedReceived
+)
+
+// HandshakeError is the error of a TLS handshake with a destination that failed, with what the handshake got to.
+type HandshakeError struct {
+	Err         error
+	Diagnostics HandshakeDiagnostics
+}
+
+func (err *HandshakeError) Error() string {
+	return fmt.Sprintf("%s (%s)", err.Err, err.Diagnostics)
+}
+
+func (err *HandshakeError) Unwrap() error {
+	return err.Err
+}
+
+// HandshakeDiagnostics is what a failed TLS handshake got to, read from the records it sent and received, to tell
+// which part of the fingerprint the destination disliked.
+type HandshakeDiagnostics struct {
+	// Progress is the last step of the handshake that happened, e.g. "ServerHello received".
+	Progress string
+
+	// AlertReceived is the alert the destination aborted the handshake with, and AlertSent the one the client did.
+	AlertReceived *TLSAlert `json:",omitempty"`
+	AlertSent     *TLSAlert `json:",omitempty"`
+
+	// ClientHelloLength is the length of the first ClientHello, and KeyShares the groups it sent key shares for.
+	ClientHelloLength int
+	KeyShares         []string
+
+	// HelloRetryRequest is what the destination asked the client to send its ClientHello again with, if it did.
+	HelloRetryRequest *HelloRetryRequest `json:",omitempty"`
+
+	// Version, CipherSuite and KeyShare are the ones the ServerHello chose. ALPN is the protocol it chose in TLS 1.2,
+	// since TLS 1.3 encrypts it. CertificateCount is the length of the certificate chain in TLS 1.2.
+	Version          string `json:",omitempty"`
+	CipherSuite      string `json:",omitempty"`
+	KeyShare         string `json:",omitempty"`
+	ALPN             string `json:",omitempty"`
+	CertificateCount int    `json:",omitempty"`
+}
+
+// TLSAlert is a TLS alert, see RFC 8446, Section 6.
+type TLSAlert struct {
+	// Level is "warning" or "fatal".
+	Level       string
+	Code        uint8
+	Description string
+	// Encrypted is set for alerts sent after the handshake was encrypted, whose level isn't known and is taken to be
+	// fatal, since they aborted the handshake.
+	Encrypted bool `json:",omitempty"`
+}
+
+func (alert *TLSAlert) String() string {
+	return fmt.Sprintf("%s (%d, %s)", alert.Description, alert.Code, alert.Level)
+}
+
+// HelloRetryRequest is the request of a TLS 1.3 destination to send the ClientHello again, see RFC 8446, Section 4.1.4.
+type HelloRetryRequest struct {
+	// KeyShare is the group the destination asked for a key share of, if any.
+	KeyShare    string `json:",omitempty"`
+	CipherSuite string
+	// Cookie is set if the destination sent a cookie to send back.
+	Cookie bool
+}
+
+func (d HandshakeDiagnostics) String() string {
+	parts := []string{"handshake got to " + d.Progress}
+	if d.AlertReceived != nil {
+		parts = append(parts, "destination sent alert "+d.AlertReceived.String())
+	}
+	if d.AlertSent != nil {
+		parts = append(parts, "client sent alert "+d.AlertSent.String())
+	}
+	if hrr := d.HelloRetryRequest; hrr != nil {
+		retry := "HelloRetryRequest"
+		if hrr.KeyShare != "" {
+			retry += " asked for a key share of " + hrr.KeyShare
+		}
+		if hrr.Cookie {
+			retry += " with a cookie"
+		}
+		parts = append(parts, retry)
+	}
+	if d.Version != "" {
+		negotiated := fmt.Sprintf("negotiated %s, %s", d.Version, d.CipherSuite)
+		if d.KeyShare != "" {
+			negotiated += ", key share " + d.KeyShare
+		}
+		if d.ALPN != "" {
+			negotiated += ", ALPN " + d.ALPN
+		}
+		parts = append(parts, negotiated)
+	} else if d.ClientHelloLength > 0 {
+		parts = append(parts, fmt.Sprintf("offered key shares %s in a ClientHello of %d bytes", strings.Join(d.KeyShares, ", "), d.ClientHelloLength))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// LogValue logs the diagnostics as a group, leaving out what the handshake didn't get to.
+func (d HandshakeDiagnostics) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("progress", d.Progress)}
+	if d.AlertReceived != nil {
+		attrs = append(attrs, slog.String("alertReceived", d.AlertReceived.String()))
+	}
+	if d.AlertSent != nil {
+		attrs = append(attrs, slog.String("alertSent", d.AlertSent.String()))
+	}
+	if d.ClientHelloLength > 0 {
+		attrs = append(attrs, slog.Int("clientHelloLength", d.ClientHelloLength), slog.String("keyShares", strings.Join(d.KeyShares, ",")))
+	}
+	if hrr := d.HelloRetryRequest; hrr != nil {
+		attrs = append(attrs, slog.Group("helloRetryRequest", "keyShare", hrr.KeyShare, "cipherSuite", hrr.CipherSuite, "cookie", hrr.Cookie))
+	}
+	for _, field := range []struct{ key, value string }{
+		{"version", d.Version},
+		{"cipherSuite", d.CipherSuite},
+		{"keyShare", d.KeyShare},
+		{"alpn", d.ALPN},
+	} {
+		if field.value != "" {
+			attrs = append(attrs, slog.String(field.key, field.value))
+		}
+	}
+	if d.CertificateCount > 0 {
+		attrs = append(attrs, slog.Int("certificateCount", d.CertificateCount))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// handshakeRecorder records the first maxHandshakeRecording bytes written to and read from a connection to an HTTPS
+// destination until it's stopped once the handshake is done, to diagnose the handshake if it fails.
+type handshakeRecorder struct {
+	net.Conn
+	stopped atomic.Bool
+
+	mutex    sync.Mutex
+	sent     []byte
+	received []byte
+}
+
+func (r *handshakeRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.record(&r.received, p[:n])
+	return n, err
+}
+
+func (r *handshakeRecorder) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.record(&r.sent, p[:n])
+	return n, err
+}
+
+func (r *handshakeRecorder) record(data *[]byte, p []byte) {
+	if r.stopped.Load() {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopped.Load() {
+		return
+	}
+	*data = append(*data, p[:min(len(p), max(maxHandshakeRecording-len(*data), 0))]...)
+}
+
+// stop stops recording, and drops what was recorded.
+func (r *handshakeRecorder) stop() {
+	r.stopped.Store(true)
+
+	r.mutex.Lock()
+	r.sent, r.received = nil, nil
+	r.mutex.Unlock()
+}
+
+// diagnostics returns what the handshake got to before it failed with err.
+func (r *handshakeRecorder) diagnostics(err error) HandshakeDiagnostics {
+	r.mutex.Lock()
+	sent, received := splitRecords(r.sent), splitRecords(r.received)
+	r.mutex.Unlock()
+
+	var d HandshakeDiagnostics
+	progress := stepConnected
+	reach := func(step int) {
+		progress = max(progress, step)
+	}
+
+	// TLS 1.3 sends change cipher spec records for compatibility only, after which the hellos still come in the clear.
+	server := readHandshakeFlight(received, true)
+	version := negotiatedVersion(server.messages)
+	tls13 := version == tls.VersionTLS13
+	if !tls13 {
+		server = readHandshakeFlight(received, false)
+	}
+	client := readHandshakeFlight(sent, tls13)
+
+	for _, message := range server.messages {
+		switch message.messageType {
+		case handshakeTypeServerHello:
+			hello, ok := parseServerHello(message.body)
+			if !ok {
+				continue
+			}
+			if hello.helloRetryRequest {
+				d.HelloRetryRequest = &HelloRetryRequest{KeyShare: groupName(hello.keyShare), CipherSuite: tls.CipherSuiteName(hello.cipherSuite), Cookie: hello.cookie}
+				reach(stepHelloRetryRequestReceived)
+				continue
+			}
+			d.Version, d.CipherSuite, d.KeyShare, d.ALPN = tls.VersionName(hello.version), tls.CipherSuiteName(hello.cipherSuite), groupName(hello.keyShare), hello.alpn
+			reach(stepServerHelloReceived)
+		case handshakeTypeCertificate:
+			d.CertificateCount = certificateCount(message.body)
+			reach(stepCertificateReceived)
+		}
+	}
+
+	for i, message := range client.messages {
+		if message.messageType != handshakeTypeClientHello {
+			continue
+		}
+		if i == 0 {
+			d.ClientHelloLength = 4 + len(message.body)
+			d.KeyShares = offeredKeyShares(message.body)
+		}
+		reach(stepClientHelloSent)
+	}
+
+	if progress >= stepServerHelloReceived {
+		if server.encrypted && tls13 {
+			reach(stepEncryptedHandshakeReceived)
+		}
+		if client.encrypted {
+			reach(stepClientFinishedSent)
+		}
+		if server.encrypted && !tls13 {
+			reach(stepServerFinishedReceived)
+		}
+	}
+	d.Progress = handshakeSteps[progress]
+
+	d.AlertReceived, d.AlertSent = server.alert, client.alert
+	// Encrypted alerts are only known from the error the TLS stack returned for them.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if code, ok := alertCodes()[opErr.Err.Error()]; ok {
+			alert := &TLSAlert{Level: "fatal", Code: code, Description: alertDescription(code), Encrypted: true}
+			switch {
+			case opErr.Op == "remote error" && d.AlertReceived == nil:
+				d.AlertReceived = alert
+			case opErr.Op == "local error" && d.AlertSent == nil:
+				d.AlertSent = alert
+			}
+		}
+	}
+
+	return d
+}
+
+// handshakeFlight is what one side of a connection sent during the handshake.
+type handshakeFlight struct {
+	// messages are the handshake messages sent in the clear.
+	messages []handshakeMessage
+	// alert is the alert sent in the clear, if any.
+	alert *TLSAlert
+	// encrypted is set once records were sent encrypted: after the ServerHello in TLS 1.3, for the Finished message
+	// in TLS 1.2.
+	encrypted bool
+}
+
+type handshakeMessage struct {
+	messageType uint8
+	body        []byte
+}
+
+// readHandshakeFlight reads the records one side of a connection sent. Handshake records after a change cipher spec
+// record are encrypted, unless it's ignored.
+func readHandshakeFlight(records [][]byte, ignoreChangeCipherSpec bool) handshakeFlight {
+	var flight handshakeFlight
+	var buffered []byte
+	changedCipherSpec := false
+	for _, record := range records {
+		payload := record[recordHeaderLength:]
+		switch record[0] {
+		case recordTypeChangeCipherSpec:
+			changedCipherSpec = !ignoreChangeCipherSpec
+		case recordTypeApplicationData:
+			flight.encrypted = true
+		case recordTypeAlert:
+			if len(payload) != 2 || flight.encrypted {
+				flight.encrypted = true
+				continue
+			}
+			level := "fatal"
+			if payload[0] == 1 {
+				level = "warning"
+			}
+			flight.alert = &TLSAlert{Level: level, Code: payload[1], Description: alertDescription(payload[1])}
+		case recordTypeHandshake:
+			if changedCipherSpec {
+				flight.encrypted = true
+				continue
+			}
+			buffered = append(buffered, payload...)
+			for len(buffered) >= 4 {
+				length := 4 + (int(buffered[1])<<16 | int(buffered[2])<<8 | int(buffered[3]))
+				if len(buffered) < length {
+					break
+				}
+				flight.messages = append(flight.messages, handshakeMessage{messageType: buffered[0], body: buffered[4:length]})
+				buffered = buffered[length:]
+			}
+		}
+	}
+	return flight
+}
+
+// negotiatedVersion returns the version the ServerHello among messages chose, or zero if there's none.
+func negotiatedVersion(messages []handshakeMessage) uint16 {
+	for _, message := range messages {
+		if message.messageType != handshakeTypeServerHello {
+			continue
+		}
+		if hello, ok := parseServerHello(message.body); ok && !hello.helloRetryRequest {
+			return hello.version
+		}
+	}
+	return 0
+}
+
+// serverHello holds the fields of a ServerHello (or HelloRetryRequest) that diagnostics report.
+type serverHello struct {
+	helloRetryRequest bool
+	version           uint16
+	cipherSuite       uint16
+	keyShare          uint16
+	alpn              string
+	cookie            bool
+}
+
+func parseServerHello(body []byte) (*serverHello, bool) {
+	s := cryptobyte.String(body)
+	hello := &serverHello{}
+	var random []byte
+	var sessionId, extensions cryptobyte.String
+	var compression uint8
+	if !s.ReadUint16(&hello.version) || !s.ReadBytes(&random, 32) || !s.ReadUint8LengthPrefixed(&sessionId) ||
+		!s.ReadUint16(&hello.cipherSuite) || !s.ReadUint8(&compression) {
+		return nil, false
+	}
+	hello.helloRetryRequest = bytes.Equal(random, helloRetryRequestRandom)
+
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return hello, true
+	}
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			break
+		}
+		switch extension {
+		case extensionSupportedVersions:
+			data.ReadUint16(&hello.version)
+		case extensionKeyShare:
+			// The HelloRetryRequest only names the group, the ServerHello adds its key.
+			data.ReadUint16(&hello.keyShare)
+		case extensionCookie:
+			hello.cookie = true
+		case extensionALPN:
+			var protocols, protocol cryptobyte.String
+			if data.ReadUint16LengthPrefixed(&protocols) && protocols.ReadUint8LengthPrefixed(&protocol) {
+				hello.alpn = string(protocol)
+			}
+		}
+	}
+	return hello, true
+}
+
+// offeredKeyShares returns the groups of the key shares of the ClientHello with body.
+func offeredKeyShares(body []byte) []string {
+	s := cryptobyte.String(body)
+	var sessionId, cipherSuites, compression, extensions cryptobyte.String
+	if !s.Skip(2+32) || !s.ReadUint8LengthPrefixed(&sessionId) || !s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compression) || !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil
+	}
+
+	var groups []string
+	for !extensions.Empty() {
+		var extension uint16
+		var data, shares cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			break
+		}
+		if extension != extensionKeyShare || !data.ReadUint16LengthPrefixed(&shares) {
+			continue
+		}
+		for !shares.Empty() {
+			var group uint16
+			var key cryptobyte.String
+			if !shares.ReadUint16(&group) || !shares.ReadUint16LengthPrefixed(&key) {
+				break
+			}
+			if !isGrease(group) {
+				groups = append(groups, groupName(group))
+			}
+		}
+	}
+	return groups
+}
+
+// certificateCount returns the number of certificates of a TLS 1.2 Certificate message with body.
+func certificateCount(body []byte) int {
+	s := cryptobyte.String(body)
+	var certificates cryptobyte.String
+	if !s.ReadUint24LengthPrefixed(&certificates) {
+		return 0
+	}
+	count := 0
+	for !certificates.Empty() {
+		var certificate cryptobyte.String
+		if !certificates.ReadUint24LengthPrefixed(&certificate) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+func groupName(group uint16) string {
+	if group == 0 {
+		return ""
+	}
+	return utls.CurveID(group).String()
+}
+
+func alertDescription(code uint8) string {
+	return strings.TrimPrefix(utls.AlertError(code).Error(), "tls: ")
+}
+
+// alertCodes maps the messages of the TLS stack's alert errors to their codes.
+var alertCodes = sync.OnceValue(func() map[string]uint8 {
+	codes := make(map[string]uint8)
+	for code := range 256 {
+		if message := utls.AlertError(code).Error(); !strings.Contains(message, "alert(") {
+			codes[message] = uint8(code)
+		}
+	}
+	return codes
+})
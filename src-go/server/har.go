@@ -0,0 +1,503 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+)
+
+const (
+	// DefaultHarMaxBodyBytes is the number of bytes recorded of each body if HarRecordingOptions.MaxBodyBytes is 0.
+	DefaultHarMaxBodyBytes = 1 << 20
+
+	// maxHarEntries is the number of entries a recording keeps. Once it's reached, the oldest entries are dropped.
+	maxHarEntries = 10000
+)
+
+// HarRecordingOptions configure which requests StartRecording records.
+type HarRecordingOptions struct {
+	// IncludeHosts are the host patterns (see matchHostPattern) of the destinations to record. Leave empty to record all.
+	IncludeHosts []string
+
+	// ExcludeHosts are the host patterns of destinations that aren't recorded, even if they match IncludeHosts.
+	ExcludeHosts []string
+
+	// MaxBodyBytes is the number of bytes recorded of each request and response body, see DefaultHarMaxBodyBytes.
+	// Longer bodies are truncated in the recording only. A negative value records no bodies.
+	MaxBodyBytes int64
+}
+
+func (options *HarRecordingOptions) records(host string) bool {
+	return (len(options.IncludeHosts) == 0 || matchHostPatterns(options.IncludeHosts, host)) &&
+		!matchHostPatterns(options.ExcludeHosts, host)
+}
+
+// recorder records the requests sent to their destinations while a recording is running, see StartRecording.
+var recorder = &harRecorder{}
+
+type harRecorder struct {
+	mutex   sync.Mutex
+	options *HarRecordingOptions
+	entries []harEntry
+	dropped bool
+}
+
+// StartRecording starts recording the requests sent to their destinations, as they went over the wire, for ExportHar.
+// data is a JSON encoded HarRecordingOptions, or empty to record everything. Entries of a previous recording are discarded.
+func StartRecording(data string) error {
+	options := &HarRecordingOptions{}
+	if strings.TrimSpace(data) != "" {
+		if err := json.Unmarshal([]byte(data), options); err != nil {
+			return fmt.Errorf("invalid recording options: %w", err)
+		}
+	}
+
+	for _, pattern := range slices.Concat(options.IncludeHosts, options.ExcludeHosts) {
+		if strings.TrimSpace(pattern) == "" {
+			return errors.New("invalid recording options: host patterns must not be empty")
+		}
+	}
+
+	if options.MaxBodyBytes == 0 {
+		options.MaxBodyBytes = DefaultHarMaxBodyBytes
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.options = options
+	recorder.entries = nil
+	recorder.dropped = false
+
+	return nil
+}
+
+// StopRecording stops recording requests. The recorded entries are kept for ExportHar until the next StartRecording.
+func StopRecording() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.options = nil
+}
+
+// ExportHar returns the recorded requests as a HAR 1.2 document.
+// Headers are the ones written to the destination, in their order on the wire, including HTTP/2 pseudo headers.
+func ExportHar() (string, error) {
+	recorder.mutex.Lock()
+	entries := slices.Clone(recorder.entries)
+	recorder.mutex.Unlock()
+
+	if entries == nil {
+		entries = []harEntry{}
+	}
+
+	var doc struct {
+		Log harLog `json:"log"`
+	}
+	doc.Log = harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "Awesome TLS", Version: GetVersion().Version},
+		Entries: entries,
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// recording returns the options of the running recording if requests to host are recorded, or nil.
+func (r *harRecorder) recording(host string) *HarRecordingOptions {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.options == nil || !r.options.records(host) {
+		return nil
+	}
+
+	return r.options
+}
+
+func (r *harRecorder) add(entry harEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.options == nil {
+		return
+	}
+
+	if len(r.entries) >= maxHarEntries {
+		if !r.dropped {
+			recorderLog.Warn("recording reached its maximum number of entries, dropping the oldest ones", "entries", maxHarEntries)
+			r.dropped = true
+		}
+		r.entries = r.entries[1:]
+	}
+	r.entries = append(r.entries, entry)
+}
+
+// harTrace collects the request headers written to the destination, in their order on the wire.
+type harTrace struct {
+	mutex   sync.Mutex
+	headers []harNameValue
+
+	// wrote is set once all headers are written. Headers written after that belong to a retry, which starts over.
+	wrote bool
+}
+
+// withHarTrace returns a copy of ctx whose requests report their headers to trace.
+func withHarTrace(ctx context.Context, trace *harTrace) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaderField: func(key string, values []string) {
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+
+			if trace.wrote {
+				trace.headers = nil
+				trace.wrote = false
+			}
+			for _, value := range values {
+				// HTTP/1.1 reports the framing headers (e.g. Content-Length) when they're added and again where they're written.
+				trace.headers = slices.DeleteFunc(trace.headers, func(h harNameValue) bool {
+					return strings.EqualFold(h.Name, key) && h.Value == value
+				})
+				trace.headers = append(trace.headers, harNameValue{Name: key, Value: value})
+			}
+		},
+		WroteHeaders: func() {
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+
+			trace.wrote = true
+		},
+	})
+}
+
+// requestHeaders returns the headers written to the destination. Clients that don't report them
+// (like the bypass client) fall back to the headers of req, in the order given by its HeaderOrderKey.
+func (trace *harTrace) requestHeaders(req *fhttp.Request) []harNameValue {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	if len(trace.headers) > 0 {
+		return slices.Clone(trace.headers)
+	}
+
+	order := map[string]int{}
+	for i, name := range req.Header[fhttp.HeaderOrderKey] {
+		order[strings.ToLower(name)] = i
+	}
+
+	return sortedHeaders(req.Header, order)
+}
+
+// sortedHeaders returns the values of h, sorted by order and then by name, without the magic order keys.
+func sortedHeaders(h fhttp.Header, order map[string]int) []harNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		if name != fhttp.HeaderOrderKey && name != fhttp.PHeaderOrderKey {
+			names = append(names, name)
+		}
+	}
+
+	slices.SortFunc(names, func(a, b string) int {
+		i, iok := order[strings.ToLower(a)]
+		j, jok := order[strings.ToLower(b)]
+		switch {
+		case iok && jok:
+			return i - j
+		case iok:
+			return -1
+		case jok:
+			return 1
+		default:
+			return strings.Compare(a, b)
+		}
+	})
+
+	var headers []harNameValue
+	for _, name := range names {
+		for _, value := range h[name] {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+
+	return headers
+}
+
+// newHarEntry describes a request and its response. timer is the stageTimer of the attempt that got the response,
+// which returned at responded, and whose body was read until done. Secrets are redacted, see RedactionSettings.
+func newHarEntry(options *HarRecordingOptions, trace *harTrace, timer *stageTimer, req *fhttp.Request, reqBody []byte, reqBodySize int64, res *fhttp.Response, resBody []byte, responded, done time.Time) harEntry {
+	redactor := currentRedactor()
+	started, timings := harTimingsOf(timer, responded, done)
+	if req.URL.Scheme != "https" {
+		timings.SSL = -1
+	}
+	timer.mutex.Lock()
+	reused := timer.reused
+	timer.mutex.Unlock()
+
+	request := harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: res.Proto,
+		Cookies:     []harCookie{},
+		Headers:     redactor.headerValues(trace.requestHeaders(req), nil),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    reqBodySize,
+	}
+	for _, cookie := range req.Cookies() {
+		request.Cookies = append(request.Cookies, harCookie{Name: cookie.Name, Value: redactor.header("Cookie", cookie.Value)})
+	}
+	for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		request.QueryString = append(request.QueryString, harNameValue{Name: unescapeQuery(name), Value: unescapeQuery(value)})
+	}
+	if reqBodySize > 0 {
+		text, _, comment := harBody(redactor.body(reqBody), reqBodySize, options.MaxBodyBytes)
+		request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Comment: comment}
+	}
+
+	response := harResponse{
+		Status:      res.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, fmt.Sprint(res.StatusCode))),
+		HTTPVersion: res.Proto,
+		Cookies:     []harCookie{},
+		Headers:     redactor.headerValues(sortedHeaders(res.Header, nil), nil),
+		Content: harContent{
+			Size:     int64(len(resBody)),
+			MimeType: res.Header.Get("Content-Type"),
+		},
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	// HAR requires the lists, even if they're empty.
+	if response.Headers == nil {
+		response.Headers = []harNameValue{}
+	}
+	if request.Headers == nil {
+		request.Headers = []harNameValue{}
+	}
+	if res.ContentLength >= 0 {
+		response.BodySize = res.ContentLength
+	}
+	for _, cookie := range res.Cookies() {
+		c := harCookie{
+			Name:     cookie.Name,
+			Value:    redactor.header("Set-Cookie", cookie.Value),
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			c.Expires = cookie.Expires.Format(time.RFC3339)
+		}
+		response.Cookies = append(response.Cookies, c)
+	}
+	response.Content.Text, response.Content.Encoding, response.Content.Comment = harBody(redactor.body(resBody), int64(len(resBody)), options.MaxBodyBytes)
+
+	return harEntry{
+		StartedDateTime: started.Format(time.RFC3339Nano),
+		Time:            timings.total(),
+		Request:         request,
+		Response:        response,
+		Cache:           struct{}{},
+		Timings:         timings,
+		Reused:          reused,
+	}
+}
+
+// harBody returns the recorded text of body, its encoding (base64 if it isn't UTF-8) and a comment if it was truncated.
+// size is the size of the whole body, of which body may only be the start.
+func harBody(body []byte, size, limit int64) (text, encoding, comment string) {
+	if limit < 0 {
+		return "", "", "body not recorded"
+	}
+
+	if size > limit {
+		comment = fmt.Sprintf("truncated to %d of %d bytes", limit, size)
+		body = body[:min(limit, int64(len(body)))]
+	}
+
+	if utf8.Valid(body) {
+		return string(body), "", comment
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64", comment
+}
+
+func unescapeQuery(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// harTimingsOf returns when the attempt of timer started and the time it spent in each phase, from the stages it went
+// through. Phases that didn't happen, like connecting on a reused connection, are -1.
+func harTimingsOf(t *stageTimer, responded, done time.Time) (time.Time, harTimings) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	started := t.entered[stageDial]
+	dialed := t.entered[stageTLSHandshake]
+	gotConn := t.entered[stageWriteRequest]
+	wrote := t.entered[stageResponseHeader]
+
+	// Clients that don't report every event (like the bypass client) have their phases attributed to the next one.
+	gotConn = cmpOrTime(gotConn, wrote, responded)
+	wrote = cmpOrTime(wrote, gotConn)
+	firstByte := cmpOrTime(t.firstByte, responded)
+
+	timings := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+
+	if dialed.IsZero() || t.reused {
+		timings.Blocked = milliseconds(started, gotConn)
+	} else {
+		connectStart := cmpOrTime(t.connectStart, t.dnsDone, dialed)
+		timings.Blocked = milliseconds(started, cmpOrTime(t.dnsStart, connectStart))
+		if !t.dnsStart.IsZero() && !t.dnsDone.IsZero() {
+			timings.DNS = milliseconds(t.dnsStart, t.dnsDone)
+		}
+		// As defined by HAR, the connect time includes the TLS handshake.
+		timings.Connect = milliseconds(connectStart, gotConn)
+		timings.SSL = milliseconds(dialed, gotConn)
+	}
+
+	timings.Send = milliseconds(gotConn, wrote)
+	timings.Wait = milliseconds(wrote, firstByte)
+	timings.Receive = milliseconds(firstByte, done)
+
+	return started, timings
+}
+
+// cmpOrTime returns the first of times that isn't zero.
+func cmpOrTime(times ...time.Time) time.Time {
+	for _, t := range times {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// milliseconds returns the time from start to end in milliseconds, or 0 if end comes first.
+func milliseconds(start, end time.Time) float64 {
+	return max(float64(end.Sub(start))/float64(time.Millisecond), 0)
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	// Reused reports whether the request was sent on a connection that was open already, whose phases of connecting
+	// are -1 in Timings.
+	Reused bool `json:"_connectionReused"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings are the phases of a request in milliseconds, -1 if they don't apply.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// total is the time of the whole request. The TLS handshake is part of the connect time already.
+func (t harTimings) total() float64 {
+	total := 0.0
+	for _, phase := range []float64{t.Blocked, t.DNS, t.Connect, t.Send, t.Wait, t.Receive} {
+		total += max(phase, 0)
+	}
+	return total
+}
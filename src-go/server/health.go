@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HealthReport is the result of Healthcheck.
+type HealthReport struct {
+	// Healthy reports whether all checks passed.
+	Healthy bool
+
+	Checks []HealthCheck
+
+	// CertificateExpiry is when the CA of the current project expires, nil if it wasn't created yet.
+	CertificateExpiry *CertificateExpiry
+}
+
+// HealthCheck is the result of a single check of Healthcheck.
+type HealthCheck struct {
+	// Name identifies the check, e.g. "CertificateAuthority" or "Address:ForwardProxyAddress".
+	Name string
+
+	Passed bool
+
+	// Message explains the result, e.g. why the check failed.
+	Message string
+}
+
+func (r *HealthReport) add(name string, err error, message string) {
+	check := HealthCheck{Name: name, Passed: err == nil, Message: message}
+	if err != nil {
+		check.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Healthcheck checks that the CA certificate of the current project loads, that the settings in effect (and the ones
+// persisted for the project) parse and validate, and that every configured address is either bound by Awesome TLS
+// or free to bind. It doesn't change anything, so Burp can run it any time, e.g. for a diagnostics panel or bug report.
+func Healthcheck() HealthReport {
+	var report HealthReport
+
+	report.add("CertificateAuthority", checkCertificateAuthority(), "loads from "+CertificateAuthorityPath())
+
+	report.CertificateExpiry = getCertificateExpiry()
+	if expiry := report.CertificateExpiry; expiry != nil {
+		report.add("CertificateAuthorityExpiry", checkCertificateAuthorityExpiry(expiry), fmt.Sprintf("expires in %d days, on %s", expiry.DaysLeft, expiry.NotAfter.Format(time.DateOnly)))
+	}
+
+	current := state.Load()
+	report.add("Settings", checkSettings(current.saved), "parse and validate")
+
+	persisted, err := LoadPersistedSettings(current.settings.ProjectId)
+	if err == nil {
+		err = checkSettings(persisted)
+	}
+	report.add("PersistedSettings", err, "parse and validate")
+
+	bound := boundPorts()
+	for _, address := range configuredAddresses(current.settings) {
+		message, err := checkAddress(address.addr, bound)
+		report.add("Address:"+address.field, err, message)
+	}
+
+	report.Healthy = true
+	for _, check := range report.Checks {
+		report.Healthy = report.Healthy && check.Passed
+	}
+
+	return report
+}
+
+// checkCertificateAuthority checks that the CA certificate and its key can be read and belong together.
+// A missing CA isn't an error, since it's created when the spoof server starts.
+func checkCertificateAuthority() error {
+	cert, err := readCertFromDisk(caFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+
+	key, err := readPrivateKeyFromDisk(caKeyFile)
+	if err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+
+	if public, ok := cert.PublicKey.(*rsa.PublicKey); !ok || !public.Equal(key.Public()) {
+		return errors.New("the private key doesn't match the certificate")
+	}
+
+	return nil
+}
+
+// checkCertificateAuthorityExpiry checks that the CA hasn't expired. It passes while it only expires soon, which
+// CertificateExpiry.Warning reports.
+func checkCertificateAuthorityExpiry(expiry *CertificateExpiry) error {
+	if expiry.DaysLeft < 0 {
+		return fmt.Errorf("expired on %s: %s", expiry.NotAfter.Format(time.DateOnly), certificateRenewalAction)
+	}
+	return nil
+}
+
+// checkSettings checks that data would be accepted by SaveSettings. Empty data (nothing saved yet) is fine.
+func checkSettings(data string) error {
+	if strings.TrimSpace(data) == "" {
+		return nil
+	}
+
+	settings := environmentSettings()
+	if err := decodeSettings(data, settings); err != nil {
+		return err
+	}
+
+	return settings.validate()
+}
+
+type configuredAddress struct {
+	field string
+	addr  string
+}
+
+// configuredAddresses returns the addresses settings listen on, by the name of their field.
+func configuredAddresses(settings *Settings) []configuredAddress {
+	result := []configuredAddress{{"SpoofProxyAddress", settings.SpoofProxyAddress}}
+	for i, addr := range settings.interceptAddrs() {
+		result = append(result, configuredAddress{fmt.Sprintf("InterceptProxyAddress[%d]", i), addr})
+	}
+	for i, listener := range settings.Listeners {
+		result = append(result, configuredAddress{fmt.Sprintf("Listeners[%d].Address", i), listener.Address})
+	}
+	result = append(result,
+		configuredAddress{"ForwardProxyAddress", settings.ForwardProxyAddress},
+		configuredAddress{"SocksProxy.Address", settings.SocksProxy.address()},
+		configuredAddress{"ControlAddress", settings.ControlAddress},
+		configuredAddress{"AdminAddress", settings.AdminAddress},
+		configuredAddress{"MetricsAddress", settings.MetricsAddress},
+		configuredAddress{"PprofAddress", settings.PprofAddress},
+	)
+
+	return slices.DeleteFunc(result, func(address configuredAddress) bool {
+		return address.addr == ""
+	})
+}
+
+// boundPorts returns the TCP ports Awesome TLS listens on.
+func boundPorts() map[string]bool {
+	addrs := []string{GetListenAddress(), GetForwardProxyAddress(), GetSocksProxyAddress()}
+	addrs = append(addrs, GetInterceptListenAddresses()...)
+	for _, listener := range GetListeners() {
+		if listener.Running {
+			addrs = append(addrs, listener.Address)
+		}
+	}
+
+	control.mutex.Lock()
+	addrs = append(addrs, control.addr)
+	control.mutex.Unlock()
+
+	admin.mutex.Lock()
+	addrs = append(addrs, admin.addr)
+	admin.mutex.Unlock()
+
+	metrics.mutex.Lock()
+	addrs = append(addrs, metrics.addr)
+	metrics.mutex.Unlock()
+
+	profiling.mutex.Lock()
+	addrs = append(addrs, profiling.addr)
+	profiling.mutex.Unlock()
+
+	ports := make(map[string]bool)
+	for _, addr := range addrs {
+		if _, port, err := net.SplitHostPort(addr); err == nil && port != "0" {
+			ports[port] = true
+		}
+	}
+	return ports
+}
+
+// boundPipes returns the pipe addresses Awesome TLS listens on.
+func boundPipes() []string {
+	addrs := []string{GetListenAddress()}
+	for _, listener := range GetListeners() {
+		if listener.Running {
+			addrs = append(addrs, listener.Address)
+		}
+	}
+
+	return slices.DeleteFunc(addrs, func(addr string) bool {
+		_, ok := pipeName(addr)
+		return !ok
+	})
+}
+
+// checkAddress checks that addr is bound by Awesome TLS (one of the bound ports) or can be bound.
+func checkAddress(addr string, bound map[string]bool) (string, error) {
+	if name, ok := pipeName(addr); ok {
+		// Listening on a unix socket replaces any socket at its path, so pipes aren't bound just to check them.
+		if slices.Contains(boundPipes(), addr) {
+			return "bound", nil
+		}
+		return "pipe " + pipePath(name) + " isn't bound", nil
+	}
+
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		control.mutex.Lock()
+		defer control.mutex.Unlock()
+
+		if control.addr == addr && control.server != nil {
+			return "bound", nil
+		}
+		return "unix socket " + path + " isn't bound", nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err == nil {
+		listener.Close()
+		return "bindable", nil
+	}
+
+	// Binding fails if Awesome TLS listens on the address already.
+	if _, port, splitErr := net.SplitHostPort(addr); splitErr == nil && bound[port] {
+		return "bound", nil
+	}
+
+	return "", err
+}
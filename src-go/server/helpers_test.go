@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests share one spoof server, started by startSpoofServer, and the state directory TestMain creates.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "awesome-tls-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := SetStateDirectory(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+
+	StopServer()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testSettings are the settings tests start from, see saveTestSettings.
+const testSettings = `{"ConfigurationMode":"header","LogLevel":"error"}`
+
+var spoofStarted sync.Once
+
+// startSpoofServer starts the spoof server shared by the tests on a free port, if it isn't running yet, and returns
+// its address.
+func startSpoofServer(t testing.TB) string {
+	t.Helper()
+
+	spoofStarted.Do(func() {
+		if err := SaveSettings(testSettings); err != nil {
+			t.Fatal(err)
+		}
+		go StartServer("127.0.0.1:0")
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if addr := GetListenAddress(); addr != "" {
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the spoof server didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// saveTestSettings applies settings (a JSON object merged into testSettings) for the rest of the test. It starts the
+// spoof server first, so they're not replaced by the ones it starts with.
+func saveTestSettings(t testing.TB, settings string) {
+	t.Helper()
+
+	startSpoofServer(t)
+
+	merged := map[string]any{}
+	for _, data := range []string{testSettings, settings} {
+		if err := json.Unmarshal([]byte(data), &merged); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := json.Marshal(merged)
+	if err := SaveSettings(string(data)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := SaveSettings(testSettings); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// newTestOrigin starts an HTTPS destination with handler that speaks HTTP/2 and HTTP/1.1.
+func newTestOrigin(t testing.TB, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	origin := httptest.NewUnstartedServer(handler)
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// recordingOrigin is an HTTPS destination that keeps everything it received of each request, see assertNotReceived.
+type recordingOrigin struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	received []string
+}
+
+// newRecordingOrigin starts a recordingOrigin that replies with handler, speaking HTTP/2 if h2 is true and else only
+// HTTP/1.1.
+func newRecordingOrigin(t testing.TB, h2 bool, handler http.HandlerFunc) *recordingOrigin {
+	t.Helper()
+
+	origin := &recordingOrigin{}
+	origin.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The body is read for the dump, and its trailers arrive once it's read.
+		dump, err := httputil.DumpRequest(req, true)
+		if err != nil {
+			dump = fmt.Appendf(dump, "\n(reading the request failed: %s)", err)
+		}
+		for name, values := range req.Trailer {
+			dump = fmt.Appendf(dump, "\n%s: %s", name, strings.Join(values, ", "))
+		}
+		origin.mutex.Lock()
+		origin.received = append(origin.received, string(dump))
+		origin.mutex.Unlock()
+
+		handler(w, req)
+	}))
+	origin.EnableHTTP2 = h2
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// requests returns how many requests the origin received.
+func (o *recordingOrigin) requests() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.received)
+}
+
+// assertNotReceived fails the test if any request the origin received had an internal header (see
+// internalHeaderPrefixes) or any of markers, in its request line, headers, body or trailers.
+func (o *recordingOrigin) assertNotReceived(t testing.TB, markers ...string) {
+	t.Helper()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	assertNotLeaked(t, o.received, markers...)
+}
+
+// assertNotLeaked fails the test if any of the dumped requests has an internal header or any of markers, see
+// recordingOrigin.assertNotReceived.
+func assertNotLeaked(t testing.TB, dumps []string, markers ...string) {
+	t.Helper()
+
+	for i, dump := range dumps {
+		lower := strings.ToLower(dump)
+		for _, prefix := range internalHeaderPrefixes {
+			if strings.Contains(lower, "\n"+strings.ToLower(prefix)) {
+				t.Errorf("request %d reached the destination with an internal header:\n%s", i, dump)
+			}
+		}
+		for _, marker := range markers {
+			if strings.Contains(dump, marker) {
+				t.Errorf("request %d reached the destination with %q:\n%s", i, marker, dump)
+			}
+		}
+	}
+}
+
+// spoofClient sends requests to the spoof server, whose certificate is signed by the CA of the test's state directory.
+var spoofClient = &http.Client{
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, MaxIdleConnsPerHost: 16},
+	Timeout:   30 * time.Second,
+}
+
+// testConfig returns the transport configuration of a request to origin, with the fields of more.
+func testConfig(origin *httptest.Server, more map[string]any) string {
+	config := map[string]any{
+		"Host":        strings.TrimPrefix(strings.TrimPrefix(origin.URL, "https://"), "http://"),
+		"Scheme":      origin.URL[:strings.Index(origin.URL, ":")],
+		"Fingerprint": "chrome_131",
+	}
+	for key, value := range more {
+		config[key] = value
+	}
+	data, _ := json.Marshal(config)
+	return string(data)
+}
+
+// spoofRequest sends req to origin through the spoof server with the transport configuration of more (see
+// testConfig), and returns the response along with its body.
+func spoofRequest(t testing.TB, req *http.Request, origin *httptest.Server, more map[string]any) (*http.Response, string) {
+	t.Helper()
+
+	req.URL.Scheme, req.URL.Host = "https", startSpoofServer(t)
+	req.Host = strings.TrimPrefix(strings.TrimPrefix(origin.URL, "https://"), "http://")
+	req.Header.Set(ConfigurationHeaderKey, testConfig(origin, more))
+
+	res, err := spoofClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+// spoofGet sends a GET request for path to origin through the spoof server, see spoofRequest.
+func spoofGet(t testing.TB, origin *httptest.Server, path string, more map[string]any) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, "https://spoof"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spoofRequest(t, req, origin, more)
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// DefaultHookTimeoutMs is the default of HookSettings.TimeoutMs.
+const DefaultHookTimeoutMs = 2000
+
+// maxHookResponseBytes caps the size of a hook's reply, which includes the replacement body.
+const maxHookResponseBytes = 64 << 20
+
+// HookSettings configures webhooks that can change requests before they're sent to their destination,
+// and responses before they're returned, e.g. to sign requests or to redact responses with a local script.
+//
+// A hook is POSTed a JSON description of the request (HookRequest) or response (HookResponse), and replies with
+// the changes to make (HookMutations). An empty reply (or one with status 204) changes nothing.
+// Unlike other requests, whose body is streamed to the destination, hooked requests have their body buffered.
+type HookSettings struct {
+	// RequestUrl is the http(s) URL of the hook for requests. Leave empty to disable it.
+	RequestUrl string
+
+	// ResponseUrl is the http(s) URL of the hook for responses. Leave empty to disable it.
+	ResponseUrl string
+
+	// TimeoutMs is the number of milliseconds to wait for a hook's reply. Defaults to [DefaultHookTimeoutMs].
+	TimeoutMs int
+
+	// FailClosed fails requests with an error if a hook fails or times out.
+	// By default, the failure is logged and the request or response is passed on unchanged.
+	FailClosed bool
+}
+
+// HookRequest is the description of a request sent to HookSettings.RequestUrl.
+type HookRequest struct {
+	Method  string
+	Url     string
+	Headers []HeaderField
+	Body    []byte
+
+	// Profile is the profile the request is sent with, see Settings.Profiles. It's empty if none applies.
+	Profile string
+}
+
+// HookResponse is the description of a response sent to HookSettings.ResponseUrl,
+// along with the request it's the response to (after the request hook changed it).
+type HookResponse struct {
+	Request    HookRequest
+	StatusCode int
+	Headers    []HeaderField
+	Body       []byte
+}
+
+// HookMutations are the changes a hook replies with. They're applied in the order of the fields.
+type HookMutations struct {
+	// RemoveHeaders are the names of headers to remove.
+	RemoveHeaders []string
+
+	// ReplaceHeaders replace all headers of the same name. Repeating a name sets several values.
+	ReplaceHeaders []HeaderField
+
+	// AddHeaders are added next to any headers of the same name.
+	AddHeaders []HeaderField
+
+	// Body replaces the body if it's set, including with an empty string.
+	Body *[]byte
+}
+
+// hookClient sends requests to hooks. Hooks run locally, so it doesn't use any proxy.
+var hookClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+// hookFor returns the URL of the hook (RequestUrl or ResponseUrl) for requests to host, or "" if it doesn't apply.
+// Hooks don't apply to requests to their own host, which would otherwise loop if the hook sends requests through
+// Awesome TLS.
+func (hooks HookSettings) hookFor(hookURL, host string) string {
+	if hookURL == "" {
+		return ""
+	}
+
+	parsed, err := url.Parse(hookURL)
+	if err != nil || strings.EqualFold(parsed.Hostname(), strings.Trim(host, "[]")) {
+		return ""
+	}
+
+	return hookURL
+}
+
+func (hooks HookSettings) timeout() time.Duration {
+	if hooks.TimeoutMs == 0 {
+		return DefaultHookTimeoutMs * time.Millisecond
+	}
+	return time.Duration(hooks.TimeoutMs) * time.Millisecond
+}
+
+// call POSTs payload to the hook at hookURL and returns its mutations.
+func (hooks HookSettings) call(hookURL string, payload any) (*HookMutations, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *hookClient
+	client.Timeout = hooks.timeout()
+
+	res, err := client.Post(hookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("hook %s timed out after %s", hookURL, client.Timeout)
+		}
+		return nil, fmt.Errorf("hook %s: %w", hookURL, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHookResponseBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("hook %s: %w", hookURL, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("hook %s responded with status %d", hookURL, res.StatusCode)
+	}
+	if len(body) > maxHookResponseBytes {
+		return nil, fmt.Errorf("hook %s responded with more than %d bytes", hookURL, maxHookResponseBytes)
+	}
+
+	mutations := &HookMutations{}
+	if res.StatusCode == http.StatusNoContent || len(bytes.TrimSpace(body)) == 0 {
+		return mutations, nil
+	}
+	if err := json.Unmarshal(body, mutations); err != nil {
+		return nil, fmt.Errorf("hook %s responded with invalid mutations: %w", hookURL, err)
+	}
+
+	return mutations, nil
+}
+
+// failed handles err of a hook for key: it's returned if the hooks fail closed, and logged otherwise.
+func (hooks HookSettings) failed(key string, err error) error {
+	recentErrors.add(err)
+	if hooks.FailClosed {
+		return err
+	}
+
+	hooksLog.Warn("hook failed, continuing without it", "host", key, "error", err)
+	return nil
+}
+
+// applyRequestHook sends req to the request hook, if one applies to host, and applies its mutations to req and body.
+// req has to have its URL and header order set already. It returns the request's description sent to the hook
+// (after applying the mutations) for the response hook, or nil if there's no response hook.
+func (hooks HookSettings) applyRequestHook(req *fhttp.Request, body *[]byte, profile, host, key string) (*HookRequest, error) {
+	requestHook := hooks.hookFor(hooks.RequestUrl, host)
+	responseHook := hooks.hookFor(hooks.ResponseUrl, host)
+	if requestHook == "" && responseHook == "" {
+		return nil, nil
+	}
+
+	description := &HookRequest{
+		Method:  req.Method,
+		Url:     req.URL.String(),
+		Headers: headerFields(req.Header, req.Header[fhttp.HeaderOrderKey]),
+		Body:    *body,
+		Profile: profile,
+	}
+
+	if requestHook != "" {
+		mutations, err := hooks.call(requestHook, description)
+		if err != nil {
+			if err = hooks.failed(key, err); err != nil {
+				return nil, err
+			}
+		} else {
+			if mutations.apply(req.Header, body) {
+				setBody(req, *body)
+				description.Body = *body
+			}
+
+			// Hooks can't add headers that mustn't be sent upstream.
+			req.Header.Del("Content-Length")
+			removeHopByHopHeaders(req.Header)
+			removeInternalHeaders(req.Header)
+			description.Headers = headerFields(req.Header, req.Header[fhttp.HeaderOrderKey])
+		}
+	}
+
+	if responseHook == "" {
+		return nil, nil
+	}
+	return description, nil
+}
+
+// applyResponseHook sends res and its body to the response hook, if one applies to the host of request, and
+// applies its mutations to the header of res and body.
+func (hooks HookSettings) applyResponseHook(request *HookRequest, res *fhttp.Response, body *[]byte, host, key string) error {
+	responseHook := hooks.hookFor(hooks.ResponseUrl, host)
+	if request == nil || responseHook == "" {
+		return nil
+	}
+
+	mutations, err := hooks.call(responseHook, &HookResponse{
+		Request:    *request,
+		StatusCode: res.StatusCode,
+		Headers:    headerFields(res.Header, nil),
+		Body:       *body,
+	})
+	if err != nil {
+		return hooks.failed(key, err)
+	}
+
+	mutations.apply(res.Header, body)
+	return nil
+}
+
+// apply applies the mutations to h and body, and reports whether the body was replaced.
+func (mutations *HookMutations) apply(h fhttp.Header, body *[]byte) bool {
+	for _, name := range mutations.RemoveHeaders {
+		h.Del(name)
+	}
+
+	replaced := make(map[string]bool)
+	for _, header := range mutations.ReplaceHeaders {
+		name := fhttp.CanonicalHeaderKey(header.Name)
+		if !replaced[name] {
+			h.Del(name)
+			replaced[name] = true
+		}
+		h.Add(name, header.Value)
+	}
+
+	for _, header := range mutations.AddHeaders {
+		h.Add(header.Name, header.Value)
+	}
+
+	if mutations.Body == nil {
+		return false
+	}
+	*body = *mutations.Body
+	return true
+}
+
+// headerFields returns the headers of h in order (see sortedHeaders).
+func headerFields(h fhttp.Header, order []string) []HeaderField {
+	positions := make(map[string]int, len(order))
+	for i, name := range order {
+		positions[strings.ToLower(name)] = i
+	}
+
+	var fields []HeaderField
+	for _, header := range sortedHeaders(h, positions) {
+		fields = append(fields, HeaderField{Name: header.Name, Value: header.Value})
+	}
+	return fields
+}
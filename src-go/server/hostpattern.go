@@ -0,0 +1,31 @@
+package server
+
+import "strings"
+
+// matchHostPattern reports whether host matches pattern.
+// A pattern is either "*" (any host), an exact hostname or a wildcard like "*.example.com",
+// which matches all subdomains of example.com (but not example.com itself).
+// Matching is case-insensitive.
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return host == pattern
+	}
+}
+
+// matchHostPatterns reports whether host matches any of the patterns.
+func matchHostPatterns(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
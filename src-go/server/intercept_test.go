@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		data    string
+		isHTTP  bool
+		decided bool
+	}{
+		{data: "GET / HTTP/1.1\r\n", isHTTP: true, decided: true},
+		{data: "M-SEARCH * HTTP/1.1\n", isHTTP: true, decided: true},
+		{data: "POST /upload HTTP/1.0\r\nHost: a\r\n", isHTTP: true, decided: true},
+		{data: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", isHTTP: true, decided: true},
+		{data: "GET / SSH-2.0\r\n", decided: true},
+		{data: "get / HTTP/1.1\r\n", decided: true},
+		{data: "\x10\x12\x00\x04MQTT", decided: true},
+		{data: "SSH-2.0-OpenSSH_9.6\r\n", decided: true},
+		{data: "EHLO example.com\r\n", decided: true},
+		{data: "PRI * HTTP/2"},
+		{data: "PRI"},
+		{data: "GET"},
+		{data: "GET /very-long-target"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.data), func(t *testing.T) {
+			if isHTTP, decided := sniffHTTP([]byte(test.data)); isHTTP != test.isHTTP || decided != test.decided {
+				t.Errorf("got %t, %t, want %t, %t", isHTTP, decided, test.isHTTP, test.decided)
+			}
+		})
+	}
+}
+
+// TestInterceptClassifiesTunnels opens tunnels through the intercept proxy that carry HTTP, other protocols and
+// traffic that can't be classified, and checks whether each reaches Burp, is tunneled to its destination or is closed.
+func TestInterceptClassifiesTunnels(t *testing.T) {
+	startSpoofServer(t)
+	// Burp accepts the tunnel, rejects any handshake with an alert, so the proxy knows there's no HelloRetryRequest,
+	// and reports what the client sends through it.
+	toBurp := make(chan string, 1)
+	burp := newTestListener(t, func(conn net.Conn, done <-chan struct{}) {
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n\x15\x03\x03\x00\x02\x02\x28")
+		data, _ := io.ReadAll(reader)
+		toBurp <- string(data)
+	})
+	// The destination greets its clients first, and reports what they send.
+	toDestination := make(chan string, 1)
+	destination := newTestListener(t, func(conn net.Conn, done <-chan struct{}) {
+		fmt.Fprint(conn, "220 ready\r\n")
+		data, _ := io.ReadAll(conn)
+		toDestination <- string(data)
+	})
+
+	httpHello := string(clientHelloWithALPN(t, "intercept.test", []string{"h2", "http/1.1"}))
+	mqttHello := string(clientHelloWithALPN(t, "intercept.test", []string{"mqtt"}))
+
+	tests := []struct {
+		name          string
+		opaqueTraffic string
+		// send is what the client sends through the tunnel, after waiting for the destination's greeting if greeted.
+		send    string
+		greeted bool
+		// wantBurp and wantDestination are what Burp and the destination receive, or empty if they mustn't be
+		// connected to.
+		wantBurp, wantDestination string
+	}{
+		{name: "HTTP1", send: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", wantBurp: "GET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{name: "HTTP2 with prior knowledge", send: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", wantBurp: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"},
+		{name: "MQTT", send: "\x10\x12\x00\x04MQTT", wantDestination: "\x10\x12\x00\x04MQTT"},
+		{name: "TLS offering HTTP", send: httpHello, wantBurp: httpHello},
+		{name: "TLS offering MQTT", send: mqttHello, wantDestination: mqttHello},
+		{name: "server speaks first", greeted: true, send: "EHLO a\r\n", wantDestination: "EHLO a\r\n"},
+		{name: "MQTT rejected", opaqueTraffic: OpaqueTrafficReject, send: "\x10\x12\x00\x04MQTT"},
+		{name: "unparseable ClientHello", send: "\x16\x03\x01\x00\x05\x01\x00\x00\x01\x00"},
+		{name: "incomplete request line", send: "GET /"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saveTestSettings(t, fmt.Sprintf(`{"UseInterceptedFingerprint":true,"InterceptProxyAddress":"127.0.0.1:0","BurpProxyAddress":%q,"InterceptOpaqueTraffic":%q}`, burp, test.opaqueTraffic))
+
+			conn, err := net.Dial("tcp", GetInterceptListenAddresses()[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", destination)
+			if res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect}); err != nil || res.StatusCode != http.StatusOK {
+				t.Fatalf("the tunnel wasn't accepted: %v", err)
+			}
+			if test.greeted {
+				if greeting, err := reader.ReadString('\n'); err != nil || greeting != "220 ready\r\n" {
+					t.Fatalf("got the greeting %q (%v)", greeting, err)
+				}
+			}
+			io.WriteString(conn, test.send)
+			if test.wantBurp != "" || test.wantDestination != "" {
+				conn.(*net.TCPConn).CloseWrite()
+			}
+
+			// Connections that are closed are closed once they're classified, at the latest after sniffTimeout.
+			conn.SetReadDeadline(time.Now().Add(sniffTimeout + 5*time.Second))
+			io.Copy(io.Discard, reader)
+			for _, want := range []struct {
+				name     string
+				received chan string
+				want     string
+			}{{"Burp", toBurp, test.wantBurp}, {"the destination", toDestination, test.wantDestination}} {
+				select {
+				case received := <-want.received:
+					if received != want.want {
+						t.Errorf("%s received %q, want %q", want.name, received, want.want)
+					}
+				case <-time.After(100 * time.Millisecond):
+					if want.want != "" {
+						t.Errorf("%s received nothing, want %q", want.name, want.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// errLimitReached is returned by tryAcquire when there's no free slot.
+var errLimitReached = errors.New("concurrent request limit reached")
+
+// limiter limits the number of requests sent at the same time, see Settings.MaxConcurrentRequests and
+// Settings.MaxConcurrentRequestsPerHost.
+var limiter = &requestLimiter{}
+
+// requestLimiter queues requests beyond its limits until a slot frees up. A limit of 0 doesn't limit anything.
+type requestLimiter struct {
+	mutex   sync.Mutex
+	total   semaphore
+	perHost int
+	hosts   map[string]*hostSemaphore
+
+	// queued counts the requests waiting for a slot, see AdminStatus.QueuedRequests.
+	queued atomic.Int64
+}
+
+// semaphore is a counting semaphore whose slots are the capacity of its channel. It's nil if there's no limit.
+type semaphore chan struct{}
+
+// hostSemaphore is the semaphore of a host, along with the number of requests that use it, so it's removed once
+// there are none.
+type hostSemaphore struct {
+	slots semaphore
+	users int
+}
+
+// configure applies the limits. Requests already holding a slot release it to the semaphore they got it from,
+// so for a moment there can be more requests than the new limit.
+func (l *requestLimiter) configure(total, perHost int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if total != cap(l.total) {
+		l.total = newSemaphore(total)
+	}
+	if perHost != l.perHost {
+		l.perHost = perHost
+		l.hosts = nil
+	}
+}
+
+func newSemaphore(slots int) semaphore {
+	if slots <= 0 {
+		return nil
+	}
+	return make(semaphore, slots)
+}
+
+// acquire waits for a slot for a request to host, or for ctx to be done, e.g. because Burp aborted the request.
+// It returns the slots the request holds until it releases them.
+func (l *requestLimiter) acquire(ctx context.Context, host string) (*requestSlots, error) {
+	return l.take(host, func(s semaphore) error { return l.wait(ctx, s) })
+}
+
+// tryAcquire takes a slot for a request to host like acquire, unless it would have to wait for one.
+// It returns the function that releases the slot.
+func (l *requestLimiter) tryAcquire(host string) (func(), bool) {
+	slots, err := l.take(host, func(s semaphore) error {
+		select {
+		case s <- struct{}{}:
+			return nil
+		default:
+			return errLimitReached
+		}
+	})
+	if err != nil {
+		return nil, false
+	}
+	return slots.release, true
+}
+
+// take takes a slot of each semaphore that applies to host with wait.
+func (l *requestLimiter) take(host string, wait func(semaphore) error) (*requestSlots, error) {
+	l.mutex.Lock()
+	total := l.total
+	slots := &requestSlots{limiter: l, hostName: host}
+	if l.perHost > 0 {
+		if l.hosts == nil {
+			l.hosts = make(map[string]*hostSemaphore)
+		}
+		if slots.hostSlots = l.hosts[host]; slots.hostSlots == nil {
+			slots.hostSlots = &hostSemaphore{slots: newSemaphore(l.perHost)}
+			l.hosts[host] = slots.hostSlots
+		}
+		slots.hostSlots.users++
+	}
+	l.mutex.Unlock()
+
+	// The host's slot is taken first, so requests queued for a busy host don't hold slots other hosts could use.
+	if slots.hostSlots != nil {
+		if err := wait(slots.hostSlots.slots); err != nil {
+			slots.release()
+			return nil, err
+		}
+		slots.host = slots.hostSlots.slots
+	}
+	if total != nil {
+		if err := wait(total); err != nil {
+			slots.release()
+			return nil, err
+		}
+		slots.total = total
+	}
+
+	return slots, nil
+}
+
+// requestSlots are the slots a request holds. The slot of the total limit only covers the wait for the response
+// headers, see releaseTotal, while the host's is held until the response is written.
+type requestSlots struct {
+	limiter   *requestLimiter
+	hostName  string
+	hostSlots *hostSemaphore
+
+	// host and total are the semaphores whose slot is held, nil if there's none.
+	host  semaphore
+	total semaphore
+}
+
+// releaseTotal releases the slot of the total limit once the response headers arrived. Reading the response body only
+// waits on its destination, so destinations that are slow to send their bodies don't hold up requests to others.
+func (s *requestSlots) releaseTotal() {
+	if s.total != nil {
+		<-s.total
+		s.total = nil
+	}
+}
+
+// release releases the slots still held.
+func (s *requestSlots) release() {
+	s.releaseTotal()
+	if s.host != nil {
+		<-s.host
+		s.host = nil
+	}
+	if s.hostSlots != nil {
+		l := s.limiter
+		l.mutex.Lock()
+		if s.hostSlots.users--; s.hostSlots.users == 0 && l.hosts[s.hostName] == s.hostSlots {
+			delete(l.hosts, s.hostName)
+		}
+		l.mutex.Unlock()
+		s.hostSlots = nil
+	}
+}
+
+// wait takes a slot of s, counting the request as queued if it has to wait for it.
+func (l *requestLimiter) wait(ctx context.Context, s semaphore) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
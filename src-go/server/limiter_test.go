@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// p99 returns the 99th percentile of latencies.
+func p99(latencies []time.Duration) time.Duration {
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	return sorted[(len(sorted)*99+99)/100-1]
+}
+
+func TestReleaseTotalKeepsTheHostSlot(t *testing.T) {
+	l := &requestLimiter{}
+	l.configure(1, 1)
+
+	slots, err := l.acquire(context.Background(), "slow.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots.releaseTotal()
+
+	if _, ok := l.tryAcquire("slow.test"); ok {
+		t.Error("got a slot for the host whose request reads its body")
+	}
+	release, ok := l.tryAcquire("fast.test")
+	if !ok {
+		t.Fatal("the request reading its body still holds the slot of the total limit")
+	}
+	release()
+	slots.release()
+	if _, ok := l.tryAcquire("slow.test"); !ok {
+		t.Error("the host's slot wasn't released")
+	}
+}
+
+// TestSlowBodiesDontDelayOtherDestinations fills the total limit with requests to a destination that sends its
+// response headers and then stalls its bodies, and checks that requests to another destination keep their latency.
+func TestSlowBodiesDontDelayOtherDestinations(t *testing.T) {
+	const maxConcurrentRequests, slowRequests, fastRequests = 4, 8, 100
+	saveTestSettings(t, fmt.Sprintf(`{"MaxConcurrentRequests":%d}`, maxConcurrentRequests))
+
+	stalled := make(chan struct{})
+	var stall sync.Once
+	unstall := func() { stall.Do(func() { close(stalled) }) }
+	t.Cleanup(unstall)
+	var sentHeaders atomic.Int64
+	slow := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		sentHeaders.Add(1)
+		select {
+		case <-stalled:
+		case <-req.Context().Done():
+		}
+		fmt.Fprint(w, "slow")
+	})
+	fast := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "fast")
+	})
+
+	latencies := func() []time.Duration {
+		latencies := make([]time.Duration, fastRequests)
+		for i := range latencies {
+			start := time.Now()
+			if res, body := spoofGet(t, fast, "/", nil); res.StatusCode != http.StatusOK || body != "fast" {
+				t.Fatalf("fast request %d: got %d %q", i, res.StatusCode, body)
+			}
+			latencies[i] = time.Since(start)
+		}
+		return latencies
+	}
+	baseline := p99(latencies())
+
+	var wg sync.WaitGroup
+	for range slowRequests {
+		wg.Go(func() {
+			if res, body := spoofGet(t, slow, "/", nil); res.StatusCode != http.StatusOK || body != "slow" {
+				t.Errorf("slow request: got %d %q", res.StatusCode, body)
+			}
+		})
+	}
+	defer wg.Wait()
+	defer unstall()
+
+	// More requests than the limit got their headers, so none holds a slot of the total limit reading its body.
+	for deadline := time.Now().Add(10 * time.Second); sentHeaders.Load() < slowRequests; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d slow requests got their response headers, the others wait for the %d slots", sentHeaders.Load(), slowRequests, maxConcurrentRequests)
+		}
+	}
+
+	// The bound leaves room for a loaded machine, but not for waiting on the stalled bodies, which don't end.
+	loaded := p99(latencies())
+	t.Logf("P99 latency of the fast destination: %s alone, %s along with %d stalled bodies", baseline, loaded, slowRequests)
+	if bound := 10*baseline + 200*time.Millisecond; loaded > bound {
+		t.Errorf("P99 latency of the fast destination grew from %s to %s with stalled bodies of another, want at most %s", baseline, loaded, bound)
+	}
+}
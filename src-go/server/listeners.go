@@ -0,0 +1,258 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ListenerSettings configure an additional spoof server listener, see Settings.Listeners.
+// Fields that are left empty (or zero) inherit the value of the global settings.
+type ListenerSettings struct {
+	// Name identifies the listener in StartListener and StopListener.
+	Name string
+
+	// Address is the address the listener listens on ([ip:]port or pipe://name, see Settings.SpoofProxyAddress).
+	Address string
+
+	Fingerprint                   string
+	HexClientHello                HexClientHello
+	HttpTimeout                   int
+	DialTimeout                   int
+	TlsHandshakeTimeout           int
+	ResponseHeaderTimeout         int
+	IdleReadTimeout               int
+	UseInterceptedFingerprint     *bool
+	InterceptedFingerprintDefault string
+	ExternalProxyUrl              string
+}
+
+// transportConfig returns the TransportConfig that requests to the listener start from, on top of defaults.
+func (listener *ListenerSettings) transportConfig(defaults TransportConfig) TransportConfig {
+	config := defaults
+
+	if listener.Fingerprint != "" || listener.HexClientHello != "" {
+		config.Fingerprint = listener.Fingerprint
+		config.HexClientHello = listener.HexClientHello
+	}
+
+	for _, timeout := range []struct {
+		value  int
+		target *int
+	}{
+		{listener.HttpTimeout, &config.HttpTimeout},
+		{listener.DialTimeout, &config.DialTimeout},
+		{listener.TlsHandshakeTimeout, &config.TlsHandshakeTimeout},
+		{listener.ResponseHeaderTimeout, &config.ResponseHeaderTimeout},
+		{listener.IdleReadTimeout, &config.IdleReadTimeout},
+	} {
+		if timeout.value != 0 {
+			*timeout.target = timeout.value
+		}
+	}
+
+	if listener.UseInterceptedFingerprint != nil {
+		config.UseInterceptedFingerprint = *listener.UseInterceptedFingerprint
+	}
+
+	if listener.InterceptedFingerprintDefault != "" {
+		config.InterceptedFingerprintDefault = listener.InterceptedFingerprintDefault
+	}
+
+	if listener.ExternalProxyUrl != "" {
+		config.ExternalProxyUrl = listener.ExternalProxyUrl
+	}
+
+	return config
+}
+
+// ListenerStatus describes a listener as returned by GetListeners.
+type ListenerStatus struct {
+	Name string
+
+	// Address is the address the listener listens on (see GetListenAddress), or the configured one if it isn't running.
+	Address string
+
+	Running bool
+}
+
+// listeners manages the spoof server listeners configured in Settings.Listeners.
+// They share the spoof server's certificate and TLS configuration, so they only run while it does.
+var listeners = &listenerGroup{
+	servers: make(map[string]*spoofServer),
+}
+
+type listenerGroup struct {
+	mutex   sync.Mutex
+	servers map[string]*spoofServer
+	config  []ListenerSettings
+}
+
+// sync applies the listeners of the settings: new listeners are started if the spoof server is running,
+// running listeners move to their new address and removed listeners are stopped.
+// Listeners that were stopped with StopListener stay stopped.
+func (g *listenerGroup) sync(config []ListenerSettings) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var errs []error
+
+	for _, listener := range config {
+		server, ok := g.servers[listener.Name]
+		switch {
+		case !ok:
+			server = &spoofServer{name: listener.Name}
+			if spoof.running() {
+				if err := server.startListener(listener.Address); err != nil {
+					errs = append(errs, fmt.Errorf("listener '%s': %w", listener.Name, err))
+					continue
+				}
+				publishEvent(EventListenerStarted, map[string]string{"name": listener.Name, "address": listener.Address})
+			}
+			g.servers[listener.Name] = server
+		default:
+			commit, _, err := server.rebind(listener.Address)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("listener '%s': %w", listener.Name, err))
+				continue
+			}
+			commit()
+		}
+	}
+
+	for name, server := range g.servers {
+		if !slices.ContainsFunc(config, func(listener ListenerSettings) bool { return listener.Name == name }) {
+			delete(g.servers, name)
+			if !server.running() {
+				continue
+			}
+			if err := server.stop(); err != nil {
+				errs = append(errs, fmt.Errorf("listener '%s': stop: %w", name, err))
+				continue
+			}
+			publishEvent(EventListenerStopped, map[string]string{"name": name})
+		}
+	}
+
+	g.config = config
+
+	return errors.Join(errs...)
+}
+
+// address returns the configured address of the listener name. The caller must hold the mutex.
+func (g *listenerGroup) address(name string) (string, bool) {
+	for _, listener := range g.config {
+		if listener.Name == name {
+			return listener.Address, true
+		}
+	}
+	return "", false
+}
+
+// start starts the listener name, or every listener if name is empty. Listeners that are already running are skipped.
+func (g *listenerGroup) start(name string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.address(name); name != "" && !ok {
+		return fmt.Errorf("no listener named '%s'", name)
+	}
+
+	if !spoof.running() {
+		return errors.New("spoof server isn't running")
+	}
+
+	var errs []error
+
+	for _, listener := range g.config {
+		if name != "" && listener.Name != name {
+			continue
+		}
+
+		server := g.servers[listener.Name]
+		if server.running() {
+			continue
+		}
+
+		if err := server.startListener(listener.Address); err != nil {
+			errs = append(errs, fmt.Errorf("listener '%s': %w", listener.Name, err))
+			continue
+		}
+
+		publishEvent(EventListenerStarted, map[string]string{"name": listener.Name, "address": listener.Address})
+	}
+
+	return errors.Join(errs...)
+}
+
+// stop stops the listener name, or every listener if name is empty.
+func (g *listenerGroup) stop(name string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.address(name); name != "" && !ok {
+		return fmt.Errorf("no listener named '%s'", name)
+	}
+
+	var errs []error
+
+	for listenerName, server := range g.servers {
+		if name != "" && listenerName != name {
+			continue
+		}
+
+		if !server.running() {
+			continue
+		}
+
+		if err := server.stop(); err != nil {
+			errs = append(errs, fmt.Errorf("listener '%s': stop: %w", listenerName, err))
+			continue
+		}
+
+		publishEvent(EventListenerStopped, map[string]string{"name": listenerName})
+	}
+
+	return errors.Join(errs...)
+}
+
+func (g *listenerGroup) status() []ListenerStatus {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	result := make([]ListenerStatus, 0, len(g.config))
+
+	for _, listener := range g.config {
+		status := ListenerStatus{Name: listener.Name, Address: listener.Address}
+		if addr := g.servers[listener.Name].listenAddr(); addr != "" {
+			status.Address = addr
+			status.Running = true
+		}
+		result = append(result, status)
+	}
+
+	return result
+}
+
+// StartListener starts the listener with the given name, which must be configured in Settings.Listeners.
+// Listeners are also started by StartServer, so this is only needed after StopListener.
+func StartListener(name string) error {
+	if name == "" {
+		return errors.New("name must be provided")
+	}
+	return listeners.start(name)
+}
+
+// StopListener stops the listener with the given name until StartListener or StartServer is called.
+func StopListener(name string) error {
+	if name == "" {
+		return errors.New("name must be provided")
+	}
+	return listeners.stop(name)
+}
+
+// GetListeners returns the listeners configured in Settings.Listeners.
+func GetListeners() []ListenerStatus {
+	return listeners.status()
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// sourceAddresses caches the addresses that TransportConfig.LocalAddress values resolve to.
+var sourceAddresses = &sourceAddressCache{
+	entries: make(map[string]*net.TCPAddr),
+}
+
+type sourceAddressCache struct {
+	mutex   sync.Mutex
+	entries map[string]*net.TCPAddr
+}
+
+// resolve returns the address to bind connections to for localAddress, which is either an IP address or the name
+// of a network interface. For an interface, its first IPv4 address is used, or its first IPv6 address if it has none.
+func (c *sourceAddressCache) resolve(localAddress string) (*net.TCPAddr, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if addr, ok := c.entries[localAddress]; ok {
+		return addr, nil
+	}
+
+	addr, err := resolveLocalAddress(localAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[localAddress] = addr
+
+	return addr, nil
+}
+
+// invalidate forgets the address localAddress resolved to, e.g. because a VPN reconnected with another address.
+func (c *sourceAddressCache) invalidate(localAddress string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, localAddress)
+}
+
+// clear forgets every resolved address.
+func (c *sourceAddressCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	clear(c.entries)
+}
+
+func resolveLocalAddress(localAddress string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(localAddress); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(localAddress)
+	if err != nil {
+		return nil, fmt.Errorf("local address '%s' is neither an IP address nor a network interface: %w", localAddress, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("addresses of network interface '%s': %w", localAddress, err)
+	}
+
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+
+	if ipv6 == nil {
+		return nil, fmt.Errorf("network interface '%s' has no usable address", localAddress)
+	}
+
+	return &net.TCPAddr{IP: ipv6}, nil
+}
+
+// dialFrom connects to addr like dialUpstream, from the address localAddress resolves to (see sourceAddressCache.resolve).
+// If the address is no longer assigned to the host, it's resolved again and the connection retried once.
+func dialFrom(ctx context.Context, localAddress string, dial func(ctx context.Context, localAddr net.Addr) (net.Conn, error)) (net.Conn, error) {
+	if localAddress == "" {
+		return dial(ctx, nil)
+	}
+
+	localAddr, err := sourceAddresses.resolve(localAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(ctx, localAddr)
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return conn, err
+	}
+
+	sourceAddresses.invalidate(localAddress)
+
+	refreshed, resolveErr := sourceAddresses.resolve(localAddress)
+	if resolveErr != nil || refreshed.IP.Equal(localAddr.IP) {
+		return nil, err
+	}
+
+	connectionLog.Info("local address changed", "localAddress", localAddress, "from", localAddr.IP, "to", refreshed.IP)
+
+	return dial(ctx, refreshed)
+}
+
+// checkLocalAddress reports whether localAddress currently resolves to an address assigned to one of the host's interfaces.
+func checkLocalAddress(localAddress string) error {
+	addr, err := resolveLocalAddress(localAddress)
+	if err != nil {
+		return err
+	}
+
+	assigned, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range assigned {
+		// Any loopback address can be bound when a loopback interface is up (e.g. 127.0.0.2 with lo on 127.0.0.1/8).
+		if ipNet, ok := a.(*net.IPNet); ok && (ipNet.IP.Equal(addr.IP) || ipNet.IP.IsLoopback() && ipNet.Contains(addr.IP)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("local address %s isn't assigned to any network interface", addr.IP)
+}
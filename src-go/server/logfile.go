@@ -0,0 +1,185 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of Settings.LogMaxSizeMB and Settings.LogMaxBackups.
+const (
+	DefaultLogMaxSizeMB  = 10
+	DefaultLogMaxBackups = 3
+)
+
+// logFileCheckInterval is how often rotatingFile checks that its path still names the file it writes to.
+const logFileCheckInterval = time.Second
+
+// logFile is the file of Settings.LogFile.
+var logFile = &rotatingFile{}
+
+// logWriter writes the log to stderr and to logFile. The loggers write each record with a single call, so records are
+// never split between rotated files.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	// Burp may not give the library a stderr at all, which mustn't keep the records from the file.
+	os.Stderr.Write(p)
+	return logFile.Write(p)
+}
+
+// logFilePath returns the path of Settings.LogFile. Relative paths are in the shared state directory.
+func logFilePath(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(stateDirectory(""), name)
+}
+
+// rotatingFile appends to the file at path, and rotates it once writing would make it larger than maxBytes: the file
+// becomes path.1, the previous path.1 becomes path.2 and so on, keeping maxBackups of them. If the file is deleted or
+// moved, it's created again. Writes are dropped while there's no file. It's safe for concurrent use.
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	file *os.File
+	// info is the FileInfo of file when it was opened, to tell whether path still names it.
+	info os.FileInfo
+	size int64
+	// checked is when path was last checked, see logFileCheckInterval.
+	checked time.Time
+}
+
+// configure writes to path from now on, or closes the file if path is empty. If the file can't be opened, the file
+// written so far is kept and the error returned.
+func (f *rotatingFile) configure(path string, maxSizeMB, maxBackups int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.maxBytes = int64(cmp.Or(maxSizeMB, DefaultLogMaxSizeMB)) << 20
+	f.maxBackups = cmp.Or(maxBackups, DefaultLogMaxBackups)
+
+	switch {
+	case path == "":
+		f.close()
+	case path != f.path || f.file == nil:
+		file, info, err := openLogFile(path)
+		if err != nil {
+			return err
+		}
+		f.close()
+		f.file, f.info, f.size, f.checked = file, info, info.Size(), time.Now()
+	}
+	f.path = path
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.path == "" {
+		return len(p), nil
+	}
+	if now := time.Now(); now.Sub(f.checked) >= logFileCheckInterval {
+		f.checked = now
+		f.reopenIfMoved()
+	}
+	if f.file != nil && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		f.rotate()
+	}
+	if f.file == nil {
+		return len(p), nil
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// reopenIfMoved opens path again unless it still names the file, e.g. because the file was deleted, or the previous
+// attempt to open it failed. The caller must hold the mutex.
+func (f *rotatingFile) reopenIfMoved() {
+	if f.file != nil {
+		if info, err := os.Stat(f.path); err == nil && os.SameFile(info, f.info) {
+			return
+		}
+	}
+
+	f.close()
+	file, info, err := openLogFile(f.path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open the log file, retrying in %s: %s\n", logFileCheckInterval, err)
+		return
+	}
+	f.file, f.info, f.size = file, info, info.Size()
+}
+
+// rotate moves the file to path.1 and opens a new one, removing the backups beyond maxBackups. The caller must hold
+// the mutex.
+func (f *rotatingFile) rotate() {
+	// The file is closed first, since open files can't be renamed on Windows.
+	f.close()
+
+	os.Remove(f.backup(f.maxBackups))
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(f.backup(i), f.backup(i+1))
+	}
+	os.Rename(f.path, f.backup(1))
+	f.removeStaleBackups()
+
+	f.checked = time.Now()
+	file, info, err := openLogFile(f.path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open the log file after rotating it, retrying in %s: %s\n", logFileCheckInterval, err)
+		return
+	}
+	f.file, f.info, f.size = file, info, info.Size()
+}
+
+// removeStaleBackups removes the backups beyond maxBackups, kept from a larger LogMaxBackups.
+func (f *rotatingFile) removeStaleBackups() {
+	backups, _ := filepath.Glob(f.path + ".*")
+	for _, backup := range backups {
+		if i, err := strconv.Atoi(strings.TrimPrefix(backup, f.path+".")); err == nil && i > f.maxBackups {
+			os.Remove(backup)
+		}
+	}
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// close closes the file, if it's open. The caller must hold the mutex.
+func (f *rotatingFile) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file, f.info, f.size = nil, nil, 0
+	}
+}
+
+// openLogFile opens path for appending, creating it and its directory if needed, readable by the user only.
+func openLogFile(path string) (*os.File, os.FileInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
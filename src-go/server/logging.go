@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Levels of Settings.LogLevel, from the least to the most verbose.
+const (
+	LogLevelError = "error"
+	LogLevelWarn  = "warn"
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+	LogLevelTrace = "trace"
+)
+
+// Formats of Settings.LogFormat.
+const (
+	// LogFormatConsole writes a line of key=value pairs per record.
+	LogFormatConsole = "console"
+	// LogFormatJson writes a JSON object per record.
+	LogFormatJson = "json"
+)
+
+// levelTrace is the level of LogLevelTrace, for the steps of every connection and handshake.
+const levelTrace = slog.LevelDebug - 4
+
+var logLevels = map[string]slog.Level{
+	LogLevelError: slog.LevelError,
+	LogLevelWarn:  slog.LevelWarn,
+	LogLevelInfo:  slog.LevelInfo,
+	LogLevelDebug: slog.LevelDebug,
+	LogLevelTrace: levelTrace,
+}
+
+// maxLogRecords is the number of log records GetLogs returns at most.
+const maxLogRecords = 1000
+
+var (
+	// logLevel is the level of Settings.LogLevel. Every logger checks it for each record, so changing it applies at once.
+	logLevel = new(slog.LevelVar)
+
+	// logJson is whether Settings.LogFormat is LogFormatJson.
+	logJson atomic.Bool
+)
+
+// logOutput is the handler of every logger, see newLogger.
+var logOutput = newLogHandler(logWriter{})
+
+// The loggers of the components of the server, by the value of their component field.
+var (
+	adminLog       = newLogger("admin")
+	certificateLog = newLogger("certificates")
+	connectionLog  = newLogger("connections")
+	controlLog     = newLogger("control")
+	dnsLog         = newLogger("dns")
+	forwardLog     = newLogger("forward")
+	hooksLog       = newLogger("hooks")
+	interceptLog   = newLogger("intercept")
+	libraryLog     = newLogger("library")
+	listenerLog    = newLogger("listeners")
+	metricsLog     = newLogger("metrics")
+	mirrorLog      = newLogger("mirror")
+	pprofLog       = newLogger("pprof")
+	prewarmLog     = newLogger("prewarm")
+	recorderLog    = newLogger("har")
+	scriptLog      = newLogger("script")
+	settingsLog    = newLogger("settings")
+	socksLog       = newLogger("socks")
+	spoofLog       = newLogger("spoof")
+)
+
+// newLogger returns the logger of component. Records carry its name in their component field.
+func newLogger(component string) *slog.Logger {
+	return slog.New(logOutput).With("component", component)
+}
+
+func init() {
+	// The log package (used by dependencies and the commands) logs at the info level, without a component.
+	slog.SetDefault(slog.New(logOutput))
+}
+
+// effectiveLogLevel returns the level of Settings.LogLevel. Debug lowers it to LogLevelDebug, like it did before LogLevel.
+func (settings *Settings) effectiveLogLevel() slog.Level {
+	level, ok := logLevels[settings.LogLevel]
+	if !ok {
+		level = slog.LevelInfo
+	}
+	if settings.Debug {
+		level = min(level, slog.LevelDebug)
+	}
+	return level
+}
+
+// configureLogging applies Settings.LogLevel and Settings.LogFormat.
+func configureLogging(level slog.Level, format string) {
+	logLevel.Set(level)
+	logJson.Store(format == LogFormatJson)
+}
+
+// logEnabled reports whether records of level are logged, to skip preparing the ones that aren't.
+func logEnabled(level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+// levelName returns the name of level in Settings.LogLevel.
+func levelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return LogLevelError
+	case level >= slog.LevelWarn:
+		return LogLevelWarn
+	case level >= slog.LevelInfo:
+		return LogLevelInfo
+	case level >= slog.LevelDebug:
+		return LogLevelDebug
+	default:
+		return LogLevelTrace
+	}
+}
+
+// logHandler writes records to stderr and Settings.LogFile in the format of Settings.LogFormat, keeps them for GetLogs and forwards them to
+// the subscribers of the Logs call of the control plane. Secrets are redacted first, see RedactionSettings.
+type logHandler struct {
+	console slog.Handler
+	json    slog.Handler
+
+	// fields are the attributes added with WithAttrs, with the keys qualified by their groups.
+	fields []slog.Attr
+	// group is the prefix of the keys of the record's attributes, for the groups added with WithGroup.
+	group string
+}
+
+func newLogHandler(w io.Writer) *logHandler {
+	options := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.LevelKey && len(groups) == 0 {
+				attr.Value = slog.StringValue(levelName(attr.Value.Any().(slog.Level)))
+			}
+			return attr
+		},
+	}
+	return &logHandler{console: slog.NewTextHandler(w, options), json: slog.NewJSONHandler(w, options)}
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return logEnabled(level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	r = currentRedactor().record(r)
+	record := LogRecord{Time: r.Time, Level: levelName(r.Level), Message: r.Message, Fields: make(map[string]any, len(h.fields)+r.NumAttrs())}
+	for _, attr := range h.fields {
+		addLogField(record.Fields, "", attr)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		addLogField(record.Fields, h.group, attr)
+		return true
+	})
+
+	logHistory.add(&record)
+	logs.publish(logEntry{time: record.Time, message: record.String()})
+
+	if logJson.Load() {
+		return h.json.Handle(ctx, r)
+	}
+	return h.console.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactor := currentRedactor()
+	attrs = slices.Clone(attrs)
+	for i, attr := range attrs {
+		attrs[i] = redactor.attr(attr)
+	}
+	fields := slices.Clip(h.fields)
+	for _, attr := range attrs {
+		fields = append(fields, slog.Attr{Key: h.group + attr.Key, Value: attr.Value})
+	}
+	return &logHandler{console: h.console.WithAttrs(attrs), json: h.json.WithAttrs(attrs), fields: fields, group: h.group}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &logHandler{console: h.console.WithGroup(name), json: h.json.WithGroup(name), fields: h.fields, group: h.group + name + "."}
+}
+
+// addLogField adds attr to fields under its key prefixed with prefix, and the attributes of groups under their
+// dotted path. Values are kept as they'd be encoded in JSON: numbers, booleans, times and strings.
+func addLogField(fields map[string]any, prefix string, attr slog.Attr) {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, attr := range value.Group() {
+			addLogField(fields, prefix, attr)
+		}
+		return
+	case slog.KindString, slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool, slog.KindTime:
+		if attr.Key != "" {
+			fields[prefix+attr.Key] = value.Any()
+		}
+	default:
+		if attr.Key != "" {
+			fields[prefix+attr.Key] = value.String()
+		}
+	}
+}
+
+// LogRecord is a record of the server's log, see GetLogs.
+type LogRecord struct {
+	// Sequence numbers the records from one, so that polling GetLogs with the last one returns the records since.
+	Sequence uint64
+	Time     time.Time
+	// Level is one of the levels of Settings.LogLevel.
+	Level   string
+	Message string
+
+	// Fields are the attributes of the record: component names the part of the server that logged it, and host,
+	// requestId, traceId and durationMs are set for the records of requests.
+	Fields map[string]any
+}
+
+// String formats the record like a line of the log, without its time.
+func (r LogRecord) String() string {
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(r.Level))
+	b.WriteByte(' ')
+	if component, ok := r.Fields["component"]; ok {
+		fmt.Fprintf(&b, "%s: ", component)
+	}
+	b.WriteString(r.Message)
+	for _, key := range slices.Sorted(maps.Keys(r.Fields)) {
+		if key != "component" {
+			fmt.Fprintf(&b, " %s=%v", key, r.Fields[key])
+		}
+	}
+	return b.String()
+}
+
+// logHistory keeps the last maxLogRecords records logged.
+var logHistory = &logRecords{}
+
+type logRecords struct {
+	mutex    sync.Mutex
+	records  []LogRecord
+	sequence uint64
+}
+
+// add numbers record and keeps it.
+func (h *logRecords) add(record *LogRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sequence++
+	record.Sequence = h.sequence
+	if len(h.records) >= maxLogRecords {
+		h.records = h.records[1:]
+	}
+	h.records = append(h.records, *record)
+}
+
+// since returns the records after the one numbered after, oldest first.
+func (h *logRecords) since(after uint64) []LogRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := sort.Search(len(h.records), func(i int) bool { return h.records[i].Sequence > after })
+	return slices.Clone(h.records[i:])
+}
+
+// GetLogs returns the records logged after the one numbered after, oldest first. Only the last maxLogRecords records
+// are kept, and only the ones of Settings.LogLevel and above are logged in the first place.
+func GetLogs(after uint64) []LogRecord {
+	return logHistory.since(after)
+}
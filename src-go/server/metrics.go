@@ -0,0 +1,436 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxMetricsHostBuckets is the maximum of Settings.MetricsHostBuckets, which bounds the cardinality of the host label.
+const maxMetricsHostBuckets = 1024
+
+// Outcomes of requests in the requests_total metric.
+const (
+	outcomeSuccess   = "success"
+	outcomeTruncated = "truncated"
+	outcomeTimeout   = "timeout"
+	outcomeError     = "error"
+)
+
+// metricsRegistry holds the metrics served on Settings.MetricsAddress.
+// They're collected whether or not the endpoint is enabled, which costs next to nothing.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "requests_total",
+		Help:      "Requests sent to their destinations, by outcome and class of destination host.",
+	}, []string{"outcome", "host_class", "host_bucket"})
+
+	dialDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "awesometls",
+		Name:      "dial_duration_seconds",
+		Help:      "Time to connect to destinations, including upstream proxies.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	handshakeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "awesometls",
+		Name:      "tls_handshake_duration_seconds",
+		Help:      "Duration of TLS handshakes with destinations.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	requestPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "awesometls",
+		Name:      "request_phase_duration_seconds",
+		Help:      "Duration of the phases of requests, see RequestTimings: dns, connect, tls (on new connections only), write, ttfb and body.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"phase"})
+
+	upstreamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "upstream_bytes_total",
+		Help:      "Bytes sent to (out) and received from (in) destinations on the wire, including TLS and upstream proxy overhead.",
+	}, []string{"direction"})
+
+	fingerprintRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "fingerprint_requests_total",
+		Help:      "Requests by the fingerprint they were sent with: a fingerprint name, hex, intercepted or bypass.",
+	}, []string{"fingerprint"})
+
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "retries_total",
+		Help:      "Retried requests, by the class of error that caused the retry.",
+	}, []string{"class"})
+
+	capturesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "intercepted_fingerprints_captured_total",
+		Help:      "Fingerprints captured by the intercept proxy.",
+	})
+
+	mirrorRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "mirror_records_total",
+		Help:      "Requests and their responses written to the mirror sink.",
+	})
+
+	mirrorDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "mirror_dropped_total",
+		Help:      "Requests that weren't mirrored, because the queue was full (queue_full) or the sink failed (sink_error).",
+	}, []string{"reason"})
+
+	dnsLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "dns_lookups_total",
+		Help:      "Host name lookups of connections, by whether the addresses (or the host not existing) were cached: hit, miss, negative_hit, negative_miss or error.",
+	}, []string{"result"})
+
+	prewarmRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "prewarm_requests_total",
+		Help:      "Requests that kept connections to destinations warm, see PrewarmSettings, by result: success or error.",
+	}, []string{"result"})
+
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "awesometls",
+		Name:      "cache_evictions_total",
+		Help:      "Entries caches evicted, by cache and reason: capacity (to make room for another one, see CacheSettings) or expired.",
+	}, []string{"cache", "reason"})
+
+	// requestsInFlight and upstreamConnections back gauges, which can't be read back for upstream_idle_connections.
+	requestsInFlight    atomic.Int64
+	upstreamConnections atomic.Int64
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		dialDuration,
+		handshakeDuration,
+		requestPhaseDuration,
+		upstreamBytes,
+		fingerprintRequests,
+		retriesTotal,
+		capturesTotal,
+		mirrorRecords,
+		mirrorDropped,
+		dnsLookups,
+		prewarmRequests,
+		cacheEvictions,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "awesometls",
+			Name:      "panics_recovered_total",
+			Help:      "Panics recovered from, which failed only the request, connection or task that caused them.",
+		}, func() float64 {
+			return float64(panicsRecovered.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "awesometls",
+			Name:      "client_connections",
+			Help:      "Open connections from clients to the spoof server, its listeners and the proxies.",
+		}, func() float64 {
+			return float64(activeConnections.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "awesometls",
+			Name:      "requests_in_flight",
+			Help:      "Requests being sent to their destinations.",
+		}, func() float64 {
+			return float64(requestsInFlight.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "awesometls",
+			Name:      "requests_queued",
+			Help:      "Requests waiting for a slot of MaxConcurrentRequests or MaxConcurrentRequestsPerHost, also counted in requests_in_flight.",
+		}, func() float64 {
+			return float64(limiter.queued.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "awesometls",
+			Name:      "client_connections_queued",
+			Help:      "Listeners waiting for a client connection to close before accepting another one.",
+		}, func() float64 {
+			return float64(clientConnections.waiting.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "awesometls",
+			Name:      "upstream_connections",
+			Help:      "Open connections to destinations.",
+		}, func() float64 {
+			return float64(upstreamConnections.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "awesometls",
+			Name:      "upstream_idle_connections",
+			Help:      "Estimated connections to destinations without a request in flight. HTTP/2 connections carrying several requests make this an underestimate.",
+		}, func() float64 {
+			return float64(max(upstreamConnections.Load()-requestsInFlight.Load(), 0))
+		}),
+	)
+
+	for _, name := range cacheNames {
+		metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "awesometls",
+			Name:        "cache_entries",
+			Help:        "Entries of the server's caches, by cache, see CacheSettings.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}, func() float64 {
+			return float64(cacheSizes()[name])
+		}))
+	}
+}
+
+// startRequestMetrics counts a request as in flight. The returned function counts it as done, with its outcome and
+// its trace ID as the exemplar.
+func startRequestMetrics(host string, buckets int, traceId string) func(outcome string) {
+	requestsInFlight.Add(1)
+
+	return func(outcome string) {
+		requestsInFlight.Add(-1)
+		counter := requestsTotal.WithLabelValues(outcome, hostClass(host), hostBucket(host, buckets))
+		counter.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"trace_id": traceId})
+	}
+}
+
+// requestOutcome returns the outcome of a request that failed with err.
+func requestOutcome(err error) string {
+	var timeoutErr *stageTimeoutError
+	var netErr net.Error
+	if errors.As(err, &timeoutErr) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return outcomeTimeout
+	}
+	return outcomeError
+}
+
+// fingerprintLabel returns the fingerprint label of a request sent with config. Its values are bounded, since
+// unknown fingerprint names fail before the request is sent.
+func fingerprintLabel(config *TransportConfig, bypass, intercepted bool) string {
+	switch {
+	case bypass:
+		return "bypass"
+	case intercepted:
+		return "intercepted"
+	case config.HexClientHello != "":
+		return "hex"
+	case config.Fingerprint == "" || strings.EqualFold(config.Fingerprint, "default"):
+		return "default"
+	}
+	return config.Fingerprint
+}
+
+// hostClass returns the class of host for the host_class label: loopback, private, public_ip or hostname.
+// Host names aren't resolved.
+func hostClass(host string) string {
+	if strings.EqualFold(host, "localhost") {
+		return "loopback"
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	switch {
+	case ip == nil:
+		return "hostname"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast():
+		return "private"
+	default:
+		return "public_ip"
+	}
+}
+
+// hostBucket returns the host_bucket label of host: the bucket its name hashes into, or an empty string
+// (which is the same as no label) if buckets is zero, see Settings.MetricsHostBuckets.
+func hostBucket(host string, buckets int) string {
+	if buckets <= 0 {
+		return ""
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(host)))
+
+	return strconv.Itoa(int(h.Sum32() % uint32(buckets)))
+}
+
+// meteredConn counts the bytes of a connection to a destination in upstream_bytes_total and the connection itself
+// in upstream_connections until it's closed, and its requests for GetConnectionStats.
+type meteredConn struct {
+	net.Conn
+	once sync.Once
+
+	address     string
+	fingerprint string
+	proxy       string
+	openedAt    time.Time
+
+	mutex    sync.Mutex
+	protocol string
+	active   int
+	requests uint64
+	reuses   uint64
+	idleFrom time.Time
+}
+
+func newMeteredConn(conn net.Conn, address, fingerprint, proxy string) *meteredConn {
+	upstreamConnections.Add(1)
+	now := time.Now()
+	c := &meteredConn{Conn: conn, address: address, fingerprint: fingerprint, proxy: proxy, openedAt: now, idleFrom: now}
+	upstreamConns.add(c)
+	return c
+}
+
+// acquire counts a request on the connection, see acquireConnection.
+func (c *meteredConn) acquire(protocol string, reused, tls bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.requests == 0 && tls {
+		upstreamConns.handshakes.Add(1)
+	}
+	if reused {
+		c.reuses++
+		upstreamConns.reused.Add(1)
+	}
+	c.protocol = cmp.Or(protocol, c.protocol)
+	c.requests++
+	c.active++
+}
+
+func (c *meteredConn) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.active--
+	if c.active == 0 {
+		c.idleFrom = time.Now()
+	}
+}
+
+func (c *meteredConn) stats(now time.Time) UpstreamConnection {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	connection := UpstreamConnection{
+		Address:      c.address,
+		Fingerprint:  c.fingerprint,
+		Proxy:        c.proxy,
+		LocalAddress: c.LocalAddr().String(),
+		Protocol:     c.protocol,
+		Active:       c.active,
+		Requests:     c.requests,
+		Reuses:       c.reuses,
+		OpenedAt:     c.openedAt,
+		AgeMs:        now.Sub(c.openedAt).Milliseconds(),
+	}
+	if c.active == 0 {
+		connection.IdleMs = now.Sub(c.idleFrom).Milliseconds()
+	}
+	return connection
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	upstreamBytes.WithLabelValues("in").Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	upstreamBytes.WithLabelValues("out").Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.once.Do(func() {
+		upstreamConnections.Add(-1)
+		upstreamConns.remove(c)
+	})
+	return c.Conn.Close()
+}
+
+func (c *meteredConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Close()
+}
+
+// metrics serves the metrics on Settings.MetricsAddress.
+// Like the admin API, it's independent of the spoof server, so it runs as soon as the address is set.
+var metrics = &metricsServer{}
+
+type metricsServer struct {
+	mutex  sync.Mutex
+	addr   string
+	server *http.Server
+}
+
+// sync moves the metrics endpoint to addr, or stops it if addr is empty.
+func (m *metricsServer) sync(addr string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if addr == m.addr {
+		return nil
+	}
+
+	previous := m.server
+
+	m.server = nil
+	if addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			m.server = previous
+			return err
+		}
+		listener = supervise("metrics", addr, listener)
+
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+
+		m.server = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func(server *http.Server) {
+			defer recoverPanic(metricsLog, "serve")
+
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				metricsLog.Error("serve failed", "error", err)
+			}
+		}(m.server)
+	}
+	m.addr = addr
+
+	if previous != nil {
+		go func() {
+			defer recoverPanic(metricsLog, "shutdown")
+
+			if err := previous.Shutdown(context.Background()); err != nil {
+				metricsLog.Warn("shutdown of the previous listener failed", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SettingsSchemaVersion is the version of the Settings JSON format.
+// Whenever a field is renamed or its meaning changes, increment it and add a migration to settingsMigrations.
+const SettingsSchemaVersion = 2
+
+// settingsMigration migrates the fields of settings from one schema version to the next.
+type settingsMigration func(fields map[string]json.RawMessage)
+
+// settingsMigrations[i] migrates settings of schema version i+1 to version i+2.
+// The array length makes sure there's a migration for every version.
+var settingsMigrations = [SettingsSchemaVersion - 1]settingsMigration{
+	migrateSettingsV1,
+}
+
+func init() {
+	for i, migration := range settingsMigrations {
+		if migration == nil {
+			panic(fmt.Sprintf("missing settings migration from schema version %d", i+1))
+		}
+	}
+}
+
+// migrateSettingsV1 migrates settings saved before schema versions were introduced.
+// Those may still use the field names of TransportConfig, which used to carry all settings.
+func migrateSettingsV1(fields map[string]json.RawMessage) {
+	renameSettingsField(fields, "InterceptProxyAddr", "InterceptProxyAddress")
+	renameSettingsField(fields, "BurpAddr", "BurpProxyAddress")
+}
+
+// renameSettingsField moves the value of field from to field to, unless to is already set.
+func renameSettingsField(fields map[string]json.RawMessage, from, to string) {
+	value, ok := fields[from]
+	if !ok {
+		return
+	}
+
+	delete(fields, from)
+
+	if _, ok = fields[to]; !ok {
+		fields[to] = value
+	}
+}
+
+// migrateSettings upgrades settings JSON of any supported schema version to SettingsSchemaVersion.
+// Settings without a schema version are assumed to be version 1.
+func migrateSettings(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, SettingsErrors{{Reason: err.Error(), Code: SettingsErrorInvalidJSON}}
+	}
+
+	version := 1
+	if raw, ok := fields["SchemaVersion"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, SettingsErrors{{Field: "SchemaVersion", Value: string(raw), Reason: "must be an integer", Code: SettingsErrorInvalidType}}
+		}
+	}
+
+	switch {
+	case version > SettingsSchemaVersion:
+		return nil, SettingsErrors{{
+			Field:  "SchemaVersion",
+			Value:  fmt.Sprint(version),
+			Reason: fmt.Sprintf("settings were saved by a newer version (schema version %d, supported up to %d)", version, SettingsSchemaVersion),
+			Code:   SettingsErrorUnsupportedVersion,
+		}}
+	case version < 1:
+		return nil, SettingsErrors{{Field: "SchemaVersion", Value: fmt.Sprint(version), Reason: "must be at least 1", Code: SettingsErrorUnsupportedVersion}}
+	case version == SettingsSchemaVersion:
+		return data, nil
+	}
+
+	for _, migration := range settingsMigrations[version-1:] {
+		migration(fields)
+	}
+
+	fields["SchemaVersion"] = json.RawMessage(fmt.Sprint(SettingsSchemaVersion))
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// want is the migrated JSON, compared field by field.
+		want string
+		// wantCode is the code of the error, if the settings can't be migrated.
+		wantCode string
+	}{
+		{
+			name: "v1 field names",
+			data: `{"InterceptProxyAddr":"127.0.0.1:8887","BurpAddr":"127.0.0.1:8080","SpoofProxyAddress":"127.0.0.1:8886"}`,
+			want: `{"InterceptProxyAddress":"127.0.0.1:8887","BurpProxyAddress":"127.0.0.1:8080","SpoofProxyAddress":"127.0.0.1:8886","SchemaVersion":2}`,
+		},
+		{
+			name: "explicit schema version 1",
+			data: `{"SchemaVersion":1,"BurpAddr":"127.0.0.1:8080"}`,
+			want: `{"BurpProxyAddress":"127.0.0.1:8080","SchemaVersion":2}`,
+		},
+		{
+			name: "v1 with a current name too",
+			data: `{"InterceptProxyAddr":"127.0.0.1:1","InterceptProxyAddress":"127.0.0.1:2"}`,
+			want: `{"InterceptProxyAddress":"127.0.0.1:2","SchemaVersion":2}`,
+		},
+		{
+			name: "v1 without renamed fields",
+			data: `{"Fingerprint":"chrome_131","HttpTimeout":30}`,
+			want: `{"Fingerprint":"chrome_131","HttpTimeout":30,"SchemaVersion":2}`,
+		},
+		{
+			name: "v1 with null values",
+			data: `{"BurpAddr":null}`,
+			want: `{"BurpProxyAddress":null,"SchemaVersion":2}`,
+		},
+		{
+			name: "empty v1",
+			data: `{}`,
+			want: `{"SchemaVersion":2}`,
+		},
+		{
+			// The current version is taken as it is, even with fields that look like v1 ones.
+			name: "v2",
+			data: `{"SchemaVersion":2,"BurpAddr":"127.0.0.1:8080"}`,
+			want: `{"SchemaVersion":2,"BurpAddr":"127.0.0.1:8080"}`,
+		},
+		{
+			name:     "newer version",
+			data:     `{"SchemaVersion":3}`,
+			wantCode: SettingsErrorUnsupportedVersion,
+		},
+		{
+			name:     "version 0",
+			data:     `{"SchemaVersion":0}`,
+			wantCode: SettingsErrorUnsupportedVersion,
+		},
+		{
+			name:     "version of the wrong type",
+			data:     `{"SchemaVersion":"2"}`,
+			wantCode: SettingsErrorInvalidType,
+		},
+		{
+			name:     "not an object",
+			data:     `["BurpAddr"]`,
+			wantCode: SettingsErrorInvalidJSON,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migrated, err := migrateSettings([]byte(test.data))
+
+			if test.wantCode != "" {
+				var errs SettingsErrors
+				if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Code != test.wantCode {
+					t.Fatalf("got %s and the error %v, want the error code %s", migrated, err, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want map[string]any
+			if err := json.Unmarshal(migrated, &got); err != nil {
+				t.Fatalf("migrated to invalid JSON %s: %s", migrated, err)
+			}
+			json.Unmarshal([]byte(test.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("migrated to %s, want %s", migrated, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeSettingsMigratesV1(t *testing.T) {
+	var settings Settings
+	if err := decodeSettings(`{"InterceptProxyAddr":"127.0.0.1:8887","BurpAddr":"127.0.0.1:8080"}`, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings.InterceptProxyAddress != "127.0.0.1:8887" || settings.BurpProxyAddress != "127.0.0.1:8080" {
+		t.Errorf("decoded InterceptProxyAddress %q and BurpProxyAddress %q from v1 settings", settings.InterceptProxyAddress, settings.BurpProxyAddress)
+	}
+}
+
+func TestLoadPersistedSettingsMigratesV1(t *testing.T) {
+	const project = "migration-test"
+	dir := stateDirectory(project)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.WriteFile(path.Join(dir, settingsFile), []byte(`{"BurpAddr":"127.0.0.1:8080"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := LoadPersistedSettings(project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	json.Unmarshal([]byte(data), &fields)
+	if want := map[string]any{"BurpProxyAddress": "127.0.0.1:8080", "SchemaVersion": float64(SettingsSchemaVersion)}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("loaded %s, want the settings migrated to %v", data, want)
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// Sinks of MirrorSettings.Sink.
+const (
+	// MirrorSinkDirectory writes each request and its response to a raw HTTP file in the directory MirrorSettings.Address.
+	MirrorSinkDirectory = "directory"
+
+	// MirrorSinkUnix writes MirrorRecord JSON lines to the unix socket MirrorSettings.Address, reconnecting as needed.
+	MirrorSinkUnix = "unix"
+
+	// MirrorSinkHttp POSTs each MirrorRecord as JSON to the http(s) URL MirrorSettings.Address.
+	MirrorSinkHttp = "http"
+)
+
+var mirrorSinks = []string{MirrorSinkDirectory, MirrorSinkUnix, MirrorSinkHttp}
+
+const (
+	// DefaultMirrorMaxBodyBytes is the number of bytes mirrored of each body if MirrorSettings.MaxBodyBytes is 0.
+	DefaultMirrorMaxBodyBytes = 1 << 20
+
+	// DefaultMirrorQueueSize is the number of records waiting for the sink if MirrorSettings.QueueSize is 0.
+	DefaultMirrorQueueSize = 1000
+
+	// maxMirrorQueueSize is the maximum of MirrorSettings.QueueSize.
+	maxMirrorQueueSize = 100000
+
+	// mirrorTimeout is how long writing a record to a unix socket or an HTTP sink may take.
+	mirrorTimeout = 10 * time.Second
+)
+
+// MirrorSettings configure mirroring every request and its response, as they were sent to and received from the
+// destination, to a sink for evidence collection. Records are queued and written in the background, so a slow or
+// failing sink never delays requests. Records that don't fit in the queue, or that the sink fails to take, are
+// dropped, logged and counted in the mirror_dropped_total metric.
+type MirrorSettings struct {
+	// Sink is where records go: MirrorSinkDirectory, MirrorSinkUnix or MirrorSinkHttp. Leave empty to disable mirroring.
+	Sink string
+
+	// Address is the directory, unix socket path or URL of the sink.
+	Address string
+
+	// IncludeHosts are the host patterns (see matchHostPattern) of the destinations to mirror. Leave empty to mirror all.
+	IncludeHosts []string
+
+	// ExcludeHosts are the host patterns of destinations that aren't mirrored, even if they match IncludeHosts.
+	ExcludeHosts []string
+
+	// MaxBodyBytes is the number of bytes mirrored of each body, see DefaultMirrorMaxBodyBytes.
+	// Longer bodies are truncated in the mirrored copy only. A negative value mirrors no bodies.
+	MaxBodyBytes int64
+
+	// QueueSize is the number of records that can wait for the sink, see DefaultMirrorQueueSize.
+	QueueSize int
+
+	// RedactHeaders are the names of headers whose values are redacted in mirrored copies, on top of the ones of
+	// Settings.Redaction (which include Authorization, Proxy-Authorization, Cookie and Set-Cookie).
+	RedactHeaders []string
+}
+
+// clone returns a copy of the settings that doesn't share their slices.
+func (settings MirrorSettings) clone() MirrorSettings {
+	settings.IncludeHosts = slices.Clone(settings.IncludeHosts)
+	settings.ExcludeHosts = slices.Clone(settings.ExcludeHosts)
+	settings.RedactHeaders = slices.Clone(settings.RedactHeaders)
+	return settings
+}
+
+func (settings *MirrorSettings) mirrors(host string) bool {
+	return settings.Sink != "" &&
+		(len(settings.IncludeHosts) == 0 || matchHostPatterns(settings.IncludeHosts, host)) &&
+		!matchHostPatterns(settings.ExcludeHosts, host)
+}
+
+func (settings *MirrorSettings) maxBodyBytes() int64 {
+	return cmp.Or(settings.MaxBodyBytes, DefaultMirrorMaxBodyBytes)
+}
+
+func (settings *MirrorSettings) queueSize() int {
+	return cmp.Or(settings.QueueSize, DefaultMirrorQueueSize)
+}
+
+// MirrorRecord is a mirrored request and its response.
+type MirrorRecord struct {
+	Time     time.Time
+	Request  MirrorRequest
+	Response MirrorResponse
+}
+
+// MirrorRequest is a request as it was sent to the destination. Headers are in their order on the wire,
+// including HTTP/2 pseudo headers.
+type MirrorRequest struct {
+	Method  string
+	Url     string
+	Proto   string
+	Headers []HeaderField
+	Body    []byte
+
+	// BodyTruncated reports whether the body was cut off at MirrorSettings.MaxBodyBytes.
+	BodyTruncated bool
+}
+
+// MirrorResponse is a response as it was received from the destination, before hooks and scripts changed it.
+// The body is the decompressed one, cut off at MaxResponseBytes.
+type MirrorResponse struct {
+	StatusCode int
+	Proto      string
+	Headers    []HeaderField
+	Body       []byte
+
+	// BodyTruncated reports whether the body was cut off at MirrorSettings.MaxBodyBytes.
+	BodyTruncated bool
+}
+
+// mirror writes the records of the requests that match the current MirrorSettings to their sink.
+var mirror = &mirrorQueue{}
+
+type mirrorQueue struct {
+	// mutex guards settings and records, which are replaced (and closed) when the settings change.
+	mutex    sync.RWMutex
+	settings *MirrorSettings
+	records  chan *MirrorRecord
+
+	// full is set while records are dropped because the queue is full, so that's logged once.
+	full atomic.Bool
+}
+
+// configure starts mirroring with settings. Records queued for the previous sink are still written to it.
+func (q *mirrorQueue) configure(settings MirrorSettings) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.settings != nil && q.settings.Sink == settings.Sink && q.settings.Address == settings.Address &&
+		cap(q.records) == settings.queueSize() {
+		// The sink stays the same, so its connection is kept.
+		settings := settings.clone()
+		q.settings = &settings
+		return
+	}
+
+	if q.records != nil {
+		close(q.records)
+		q.records = nil
+		q.settings = nil
+	}
+	if settings.Sink == "" {
+		return
+	}
+
+	records := make(chan *MirrorRecord, settings.queueSize())
+	go writeMirrorRecords(newMirrorSink(settings.Sink, settings.Address), records)
+
+	settings = settings.clone()
+	q.settings = &settings
+	q.records = records
+}
+
+// mirroring returns the settings of the mirror if requests to host are mirrored, or nil.
+func (q *mirrorQueue) mirroring(host string) *MirrorSettings {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if q.settings == nil || !q.settings.mirrors(host) {
+		return nil
+	}
+	return q.settings
+}
+
+// add queues record for the sink without waiting, or drops it if the queue is full.
+func (q *mirrorQueue) add(record *MirrorRecord) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if q.records == nil {
+		return
+	}
+
+	select {
+	case q.records <- record:
+		q.full.Store(false)
+	default:
+		mirrorDropped.WithLabelValues("queue_full").Inc()
+		if !q.full.Swap(true) {
+			mirrorLog.Warn("queue is full, dropping records until the sink catches up, see Mirror.QueueSize", "records", cap(q.records))
+		}
+	}
+}
+
+// newMirrorRecord describes a request and its response for settings, sharing their bodies unless they're redacted.
+func newMirrorRecord(settings *MirrorSettings, trace *harTrace, req *fhttp.Request, reqBody []byte, res *fhttp.Response, resBody []byte) *MirrorRecord {
+	redactor := currentRedactor()
+	limit := settings.maxBodyBytes()
+	record := &MirrorRecord{
+		Time: time.Now(),
+		Request: MirrorRequest{
+			Method:  req.Method,
+			Url:     req.URL.String(),
+			Proto:   res.Proto,
+			Headers: redactHeaders(redactor, trace.requestHeaders(req), settings.RedactHeaders),
+		},
+		Response: MirrorResponse{
+			StatusCode: res.StatusCode,
+			Proto:      res.Proto,
+			Headers:    redactHeaders(redactor, sortedHeaders(res.Header, nil), settings.RedactHeaders),
+		},
+	}
+	record.Request.Body, record.Request.BodyTruncated = mirrorBody(redactor.body(reqBody), limit)
+	record.Response.Body, record.Response.BodyTruncated = mirrorBody(redactor.body(resBody), limit)
+	return record
+}
+
+// mirrorBody returns body cut off at limit, or nothing if limit is negative, and whether it was cut off.
+func mirrorBody(body []byte, limit int64) ([]byte, bool) {
+	if limit < 0 {
+		return nil, len(body) > 0
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], true
+	}
+	return body, false
+}
+
+// redactHeaders returns headers as HeaderFields, with the values of the headers redactor redacts, and of the ones
+// named in more, redacted.
+func redactHeaders(redactor *redactor, headers []harNameValue, more []string) []HeaderField {
+	fields := make([]HeaderField, 0, len(headers))
+	for _, header := range redactor.headerValues(headers, more) {
+		fields = append(fields, HeaderField{Name: header.Name, Value: header.Value})
+	}
+	return fields
+}
+
+// mirrorSink writes records to a sink.
+type mirrorSink interface {
+	write(record *MirrorRecord) error
+	close()
+}
+
+func newMirrorSink(sink, address string) mirrorSink {
+	switch sink {
+	case MirrorSinkDirectory:
+		return &directorySink{dir: address}
+	case MirrorSinkUnix:
+		return &unixSink{path: address}
+	default:
+		return &httpSink{url: address}
+	}
+}
+
+// writeMirrorRecords writes the records to sink until records is closed.
+func writeMirrorRecords(sink mirrorSink, records <-chan *MirrorRecord) {
+	defer recoverPanic(mirrorLog, "mirror")
+	defer sink.close()
+
+	failing := false
+	for record := range records {
+		if err := sink.write(record); err != nil {
+			mirrorDropped.WithLabelValues("sink_error").Inc()
+			if !failing {
+				mirrorLog.Warn("mirroring failed, dropping records until it works again", "error", err)
+				recentErrors.add(fmt.Errorf("mirror: %w", err))
+				failing = true
+			}
+			continue
+		}
+
+		mirrorRecords.Inc()
+		if failing {
+			mirrorLog.Info("mirroring works again")
+			failing = false
+		}
+	}
+}
+
+// directorySink writes each record to a raw HTTP file in dir, named after its time and destination.
+type directorySink struct {
+	dir string
+	seq int
+}
+
+// unsafeFileNameChars are the characters of a host that aren't used in file names.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func (s *directorySink) write(record *MirrorRecord) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	host := "unknown"
+	if target, err := url.Parse(record.Request.Url); err == nil && target.Host != "" {
+		host = unsafeFileNameChars.ReplaceAllString(target.Host, "_")
+	}
+	s.seq++
+	name := fmt.Sprintf("%s-%06d-%s.http", record.Time.UTC().Format("20060102T150405.000000000Z"), s.seq, host)
+
+	var buf bytes.Buffer
+	writeRawRecord(&buf, record)
+
+	return os.WriteFile(filepath.Join(s.dir, name), buf.Bytes(), 0600)
+}
+
+func (s *directorySink) close() {}
+
+// writeRawRecord writes record as a raw HTTP request, followed by a blank line and the raw response.
+func writeRawRecord(buf *bytes.Buffer, record *MirrorRecord) {
+	target := record.Request.Url
+	if parsed, err := url.Parse(target); err == nil {
+		target = parsed.RequestURI()
+	}
+
+	fmt.Fprintf(buf, "%s %s %s\r\n", record.Request.Method, target, record.Request.Proto)
+	writeRawMessage(buf, record.Request.Headers, record.Request.Body, record.Request.BodyTruncated)
+	buf.WriteString("\r\n")
+
+	fmt.Fprintf(buf, "%s %d %s\r\n", record.Response.Proto, record.Response.StatusCode, http.StatusText(record.Response.StatusCode))
+	writeRawMessage(buf, record.Response.Headers, record.Response.Body, record.Response.BodyTruncated)
+}
+
+func writeRawMessage(buf *bytes.Buffer, headers []HeaderField, body []byte, truncated bool) {
+	for _, header := range headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", header.Name, header.Value)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	if truncated {
+		buf.WriteString("\r\n[truncated]")
+	}
+	buf.WriteString("\r\n")
+}
+
+// unixSink writes records as JSON lines to the unix socket at path, connecting on the first record
+// and again after a failed write.
+type unixSink struct {
+	path string
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (s *unixSink) write(record *MirrorRecord) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.path, mirrorTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		s.w = bufio.NewWriter(conn)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(mirrorTimeout))
+	s.w.Write(data)
+	s.w.WriteByte('\n')
+	if err = s.w.Flush(); err != nil {
+		s.close()
+	}
+	return err
+}
+
+func (s *unixSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// httpSink POSTs each record as JSON to url.
+type httpSink struct {
+	url string
+}
+
+// mirrorClient sends records to HTTP sinks. They're collected locally, so it doesn't use any proxy.
+var mirrorClient = &http.Client{Transport: &http.Transport{Proxy: nil}, Timeout: mirrorTimeout}
+
+func (s *httpSink) write(record *MirrorRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	res, err := mirrorClient.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %d", s.url, res.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) close() {
+	mirrorClient.CloseIdleConnections()
+}
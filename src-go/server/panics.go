@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// panicsRecovered counts the panics recovered since the server started, see AdminStatus.Panics.
+var panicsRecovered atomic.Uint64
+
+// panicError is a recovered panic, with the stack of the goroutine that panicked.
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (err *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.value)
+}
+
+// recovered reports the panic r recovered from in task, logging it with logger along with its stack, and returns it
+// as an error with ErrorInternal. It must be called by the deferred function that recovered, so the stack is the
+// one of the panic.
+func recovered(logger *slog.Logger, task string, r any) error {
+	err := &panicError{value: r, stack: debug.Stack()}
+	panicsRecovered.Add(1)
+	logger.Error("recovered from a panic", "task", task, "panic", fmt.Sprint(r), "stack", string(err.stack))
+	return withCode(ErrorInternal, err)
+}
+
+// recoverPanic recovers from a panic of task, a goroutine or the handling of a connection, which ends it instead of
+// the process Burp runs the server in. It must be deferred directly, e.g. `defer recoverPanic(socksLog, "connection")`.
+func recoverPanic(logger *slog.Logger, task string) {
+	if r := recover(); r != nil {
+		recentErrors.add(fmt.Errorf("%s: %w", task, recovered(logger, task, r)))
+	}
+}
+
+// recoverHandler recovers from a panic of a handler of requests before it sent them (see send, which recovers from
+// its own), responding with an ErrorInternal error. It must be deferred directly by the handler.
+func recoverHandler(w fhttp.ResponseWriter, logger *slog.Logger) {
+	if r := recover(); r != nil {
+		writeError(w, logger, nil, recovered(logger, "request", r))
+	}
+}
+
+// RecoveredPanic reports the panic r that the exported function of the C library named function recovered from, like
+// the ones recovered in the server: it's logged with its stack, counted in AdminStatus.Panics and kept in the recent
+// errors. It returns the panic as an error, and must be called by the deferred function that recovered.
+func RecoveredPanic(function string, r any) error {
+	err := recovered(libraryLog, function, r)
+	recentErrors.add(fmt.Errorf("%s: %w", function, err))
+	return err
+}
+
+// recoverPanicAsError recovers from a panic of task like recoverPanic, and returns it as *err instead, for the
+// caller of task to handle like other errors. It must be deferred directly by a function with the named result err.
+func recoverPanicAsError(logger *slog.Logger, task string, err *error) {
+	if r := recover(); r != nil {
+		*err = recovered(logger, task, r)
+	}
+}
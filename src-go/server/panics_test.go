@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// panickingTransport panics on the first panics round trips, and replies with no mutations to the others.
+type panickingTransport struct {
+	panics atomic.Int32
+}
+
+func (p *panickingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p.panics.Add(-1) >= 0 {
+		panic("injected by the test")
+	}
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+}
+
+func TestPanicInRequestHookFailsOnlyThatRequest(t *testing.T) {
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "served")
+	})
+
+	// The hook client is replaced before the settings are applied, which the requests load atomically.
+	transport := &panickingTransport{}
+	transport.panics.Store(1)
+	previous := hookClient
+	hookClient = &http.Client{Transport: transport}
+	t.Cleanup(func() { hookClient = previous })
+	saveTestSettings(t, `{"Hooks":{"RequestUrl":"http://hook.test/request"}}`)
+
+	panics := panicsRecovered.Load()
+
+	res, body := spoofGet(t, origin, "/", nil)
+	if res.StatusCode != http.StatusInternalServerError || res.Header.Get(ErrorCodeHeaderKey) != ErrorInternal {
+		t.Fatalf("request whose hook panicked: got %d (%s) %q, want 500 (%s)", res.StatusCode, res.Header.Get(ErrorCodeHeaderKey), body, ErrorInternal)
+	}
+	if !strings.Contains(body, "injected by the test") {
+		t.Errorf("error body %q doesn't name the panic", body)
+	}
+	if got := panicsRecovered.Load() - panics; got != 1 {
+		t.Errorf("panicsRecovered grew by %d, want 1", got)
+	}
+
+	var traceId string
+	for _, recent := range GetRecentErrors() {
+		if strings.Contains(recent.Message, "injected by the test") {
+			traceId = recent.TraceId
+			if recent.Code != ErrorInternal {
+				t.Errorf("recent error code = %s, want %s", recent.Code, ErrorInternal)
+			}
+			break
+		}
+	}
+	if traceId == "" || traceId != res.Header.Get(TraceIdHeaderKey) {
+		t.Errorf("recent errors don't have the panic of trace %s", res.Header.Get(TraceIdHeaderKey))
+	}
+
+	for i := range 3 {
+		res, body := spoofGet(t, origin, "/", nil)
+		if res.StatusCode != http.StatusOK || body != "served" {
+			t.Fatalf("request %d after the panic: got %d %q, want 200 %q", i, res.StatusCode, body, "served")
+		}
+	}
+}
+
+func TestRecoverPanicEndsOnlyTheGoroutine(t *testing.T) {
+	panics := panicsRecovered.Load()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverPanic(connectionLog, "test task")
+		panic("injected by the test")
+	}()
+	<-done
+
+	if got := panicsRecovered.Load() - panics; got != 1 {
+		t.Errorf("panicsRecovered grew by %d, want 1", got)
+	}
+	if errors := GetRecentErrors(); len(errors) == 0 || !strings.HasPrefix(errors[0].Message, "test task: panic: injected by the test") {
+		t.Errorf("most recent error = %+v, want the panic of the test task", errors)
+	}
+}
+
+func TestRecoverPanicAsErrorHasInternalCode(t *testing.T) {
+	fail := func() (err error) {
+		defer recoverPanicAsError(connectionLog, "dial", &err)
+		panic("injected by the test")
+	}
+
+	err := fail()
+	if code := errorCode(err); code != ErrorInternal {
+		t.Errorf("errorCode(%v) = %s, want %s", err, code, ErrorInternal)
+	}
+}
+
+func TestRecoveredPanicIsCounted(t *testing.T) {
+	panics := panicsRecovered.Load()
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = RecoveredPanic("awesome_tls_test", r)
+			}
+		}()
+		panic("injected by the test")
+	}()
+
+	if err == nil || err.Error() != "panic: injected by the test" {
+		t.Errorf("RecoveredPanic returned %v", err)
+	}
+	if got := panicsRecovered.Load() - panics; got != 1 {
+		t.Errorf("panicsRecovered grew by %d, want 1", got)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// settingsFile is the file in the state directory of a project that holds the last settings applied by SaveSettings.
+const settingsFile = "settings.json"
+
+// persistSettings writes the settings passed to SaveSettings to the state directory of their project,
+// so they survive Burp's own copy (see LoadPersistedSettings). Passwords are removed unless PersistSecrets is enabled.
+// Fields that were read from environment variables are only persisted if data sets them as well.
+func persistSettings(data string, projectId string, includeSecrets bool) error {
+	settings := &Settings{}
+	if err := decodeSettings(data, settings); err != nil {
+		return err
+	}
+
+	persisted, _ := copySettings(settings, includeSecrets)
+	persisted.SchemaVersion = SettingsSchemaVersion
+
+	raw, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path.Join(stateDirectory(projectId), settingsFile), raw, 0o600)
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames it, so readers never see a partial file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(path.Dir(name), path.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// LoadPersistedSettings returns the settings last applied by SaveSettings for projectId (or the shared state if empty),
+// migrated to the current schema version, so Burp can restore its settings tab when its own copy is gone.
+// It returns an empty string if no settings were persisted yet.
+func LoadPersistedSettings(projectId string) (string, error) {
+	if err := validateProjectId(projectId); err != nil {
+		return "", fmt.Errorf("invalid project id: %w", err)
+	}
+
+	raw, err := os.ReadFile(path.Join(stateDirectory(projectId), settingsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	migrated, err := migrateSettings(raw)
+	if err != nil {
+		return "", fmt.Errorf("persisted settings: %w", err)
+	}
+
+	return string(migrated), nil
+}
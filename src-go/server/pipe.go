@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// pipeAddressPrefix is the prefix of a spoof server or listener address that names a local pipe instead of a TCP
+// address: a named pipe on Windows (see pipePath) and a unix socket elsewhere. It's for machines whose firewall blocks
+// even loopback listeners. Requests are plain HTTP/1.1 over the pipe, with the same configuration header as over TCP,
+// since only the current user can connect to it.
+const pipeAddressPrefix = "pipe://"
+
+var pipeNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// pipeName returns the name of the pipe addr refers to, if it's a pipe address.
+func pipeName(addr string) (string, bool) {
+	return strings.CutPrefix(addr, pipeAddressPrefix)
+}
+
+// listenAddress listens on addr, which is either a TCP address or a pipe address.
+func listenAddress(addr string) (net.Listener, error) {
+	if name, ok := pipeName(addr); ok {
+		return listenPipe(name)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// PipePath returns the path of the named pipe or unix socket that the pipe address addr listens on,
+// or an empty string if addr isn't a pipe address.
+func PipePath(addr string) string {
+	if name, ok := pipeName(addr); ok {
+		return pipePath(name)
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// maxSocketPathLength is the longest path of a unix socket that every system takes (macOS has the shortest limit).
+const maxSocketPathLength = 103
+
+// pipePath returns the path of the unix socket called name, in the shared state directory (see stateDirectory). Only
+// the current user can open that directory, so no one else can connect to the socket, even before listenPipe
+// restricts its permissions.
+func pipePath(name string) string {
+	return filepath.Join(stateDirectory(""), "pipe-"+name+".sock")
+}
+
+// listenPipe listens on the unix socket called name. Only the current user may connect to it.
+func listenPipe(name string) (net.Listener, error) {
+	path := pipePath(name)
+	if len(path) > maxSocketPathLength {
+		return nil, fmt.Errorf("the path of the unix socket %s is longer than %d bytes, use a shorter pipe name or state directory", path, maxSocketPathLength)
+	}
+
+	// A socket left behind by a previous process would make listening fail.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,119 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestListenerOnAPipe sends a request through a listener on a pipe address, whose unix socket must be in the state
+// directory and only accessible to the current user.
+func TestListenerOnAPipe(t *testing.T) {
+	startSpoofServer(t)
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "piped")
+	})
+	saveTestSettings(t, `{"Listeners":[{"Name":"piped","Address":"pipe://test"}]}`)
+
+	path := PipePath("pipe://test")
+	if dir := filepath.Dir(path); dir != stateDirectory("") {
+		t.Errorf("the socket is in %s, want the state directory %s", dir, stateDirectory(""))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode(); mode&os.ModeSocket == 0 || mode.Perm() != 0o600 {
+		t.Errorf("the socket has the mode %s, want a socket only the current user can connect to", mode)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodGet, "http://pipe/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = strings.TrimPrefix(origin.URL, "https://")
+	req.Header.Set(ConfigurationHeaderKey, testConfig(origin, nil))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); res.StatusCode != http.StatusOK || string(body) != "piped" {
+		t.Errorf("got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestListenPipeRejectsLongPaths(t *testing.T) {
+	name := strings.Repeat("x", maxSocketPathLength)
+	if listener, err := listenPipe(name); err == nil {
+		listener.Close()
+		t.Fatalf("listened on %s, which some systems can't", pipePath(name))
+	}
+}
+
+// BenchmarkPipeListener downloads responses through a listener on a pipe, and through the spoof server on a loopback
+// address for comparison, with a connection kept alive per parallel client.
+func BenchmarkPipeListener(b *testing.B) {
+	const responseBytes = 64 << 10
+	response := strings.Repeat("x", responseBytes)
+	origin := newTestOrigin(b, func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, response)
+	})
+	saveTestSettings(b, `{"Listeners":[{"Name":"piped","Address":"pipe://benchmark"}]}`)
+	config := testConfig(origin, nil)
+	host := strings.TrimPrefix(origin.URL, "https://")
+
+	pipeClient := &http.Client{Transport: &http.Transport{
+		MaxIdleConnsPerHost: 64,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", PipePath("pipe://benchmark"))
+		},
+	}}
+	defer pipeClient.CloseIdleConnections()
+
+	for _, bench := range []struct {
+		name   string
+		url    string
+		client *http.Client
+	}{
+		{"loopback", "https://" + startSpoofServer(b) + "/", spoofClient},
+		{"pipe", "http://pipe/", pipeClient},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(responseBytes)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req, err := http.NewRequest(http.MethodGet, bench.url, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					req.Host = host
+					req.Header.Set(ConfigurationHeaderKey, config)
+					res, err := bench.client.Do(req)
+					if err != nil {
+						b.Fatal(err)
+					}
+					n, _ := io.Copy(io.Discard, res.Body)
+					res.Body.Close()
+					if res.StatusCode != http.StatusOK || n != responseBytes {
+						b.Fatalf("got %d with %d bytes", res.StatusCode, n)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// pipeBufferSize is the size of the buffers of the named pipe in each direction, large enough to not slow down
+// requests and responses compared to a loopback TCP connection.
+const pipeBufferSize = 1 << 16
+
+// pipePath returns the path of the named pipe called name.
+func pipePath(name string) string {
+	return `\\.\pipe\awesome-tls-` + name
+}
+
+// listenPipe listens on the named pipe called name. Only the current user (and administrators) may connect to it.
+func listenPipe(name string) (net.Listener, error) {
+	return winio.ListenPipe(pipePath(name), &winio.PipeConfig{
+		SecurityDescriptor: "D:P(A;;GA;;;OW)(A;;GA;;;BA)(A;;GA;;;SY)",
+		InputBufferSize:    pipeBufferSize,
+		OutputBufferSize:   pipeBufferSize,
+	})
+}
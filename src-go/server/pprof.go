@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+)
+
+// profiling serves net/http/pprof on Settings.PprofAddress, to diagnose performance problems.
+var profiling = &pprofServer{}
+
+type pprofServer struct {
+	mutex  sync.Mutex
+	addr   string
+	server *http.Server
+}
+
+// sync moves the pprof endpoint to addr, or stops it if addr is empty.
+func (p *pprofServer) sync(addr string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if addr == p.addr {
+		return nil
+	}
+
+	previous := p.server
+
+	p.server = nil
+	if addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			p.server = previous
+			return err
+		}
+		listener = supervise("pprof", addr, listener)
+
+		// The handlers are registered on their own mux rather than http.DefaultServeMux, which importing
+		// net/http/pprof registers them on as well, so they're only reachable here.
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		p.server = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func(server *http.Server) {
+			defer recoverPanic(pprofLog, "serve")
+
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				pprofLog.Error("serve failed", "error", err)
+			}
+		}(p.server)
+
+		pprofLog.Info("listening", "url", fmt.Sprintf("http://%s/debug/pprof/", listener.Addr()))
+	}
+	p.addr = addr
+
+	if previous != nil {
+		go func() {
+			defer recoverPanic(pprofLog, "shutdown")
+
+			if err := previous.Shutdown(context.Background()); err != nil {
+				pprofLog.Warn("shutdown of the previous listener failed", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+)
+
+// Defaults of PrewarmSettings.
+const (
+	DefaultPrewarmRecentHosts     = 8
+	DefaultPrewarmIdleSeconds     = 300
+	DefaultPrewarmIntervalSeconds = 30
+)
+
+// maxPrewarmConnections caps PrewarmSettings.Connections. It's also the number of idle connections clients keep
+// to each destination, which is 2 by default.
+const maxPrewarmConnections = 8
+
+// prewarmTimeout is how long the request that refreshes a warm connection may take.
+const prewarmTimeout = 15 * time.Second
+
+// PrewarmSettings configure keeping connections to destinations open between requests, e.g. while a request is
+// edited in Repeater, so the next one doesn't wait for the DNS lookup, the TCP connection and the TLS handshake.
+// Every IntervalSeconds, each warm destination gets a HEAD / request on each of its connections, which keeps them from
+// idling out and opens the ones the destination closed. They're sent with the fingerprint, upstream proxy and
+// User-Agent of the last request to the destination, and show up in its logs.
+//
+// Warm requests count against MaxConcurrentRequests and MaxConcurrentRequestsPerHost, but never wait for a slot:
+// connections that would exceed the limits aren't warmed. Changing the settings closes the warm connections along
+// with the other idle ones, and forgets the recent destinations until they're sent requests again.
+type PrewarmSettings struct {
+	// Connections is the number of connections to keep open to each warm destination, at most 8. Destinations that
+	// negotiate HTTP/2 multiplex requests on a single connection, so they get one. Zero (the default) disables warming.
+	Connections int
+
+	// Hosts are destinations to keep warm even before requests are sent to them, as `host`, `host:port` or
+	// `scheme://host[:port]` (https by default). They're sent with the transport settings of the spoof server,
+	// including the profile their host maps to.
+	Hosts []string
+
+	// RecentHosts is the number of destinations that requests were last sent to that are kept warm (besides Hosts).
+	// Defaults to [DefaultPrewarmRecentHosts], -1 only keeps Hosts warm.
+	RecentHosts int
+
+	// IdleSeconds is the number of seconds a recent destination is kept warm after its last request.
+	// Defaults to [DefaultPrewarmIdleSeconds].
+	IdleSeconds int
+
+	// IntervalSeconds is the number of seconds between refreshes, which must be shorter than the time destinations
+	// (and the 90 seconds clients) keep idle connections open. Defaults to [DefaultPrewarmIntervalSeconds].
+	IntervalSeconds int
+}
+
+// clone returns a copy of the settings that doesn't share their slice.
+func (settings PrewarmSettings) clone() PrewarmSettings {
+	settings.Hosts = slices.Clone(settings.Hosts)
+	return settings
+}
+
+// effective returns the settings with their defaults filled in.
+func (settings PrewarmSettings) effective() PrewarmSettings {
+	settings.RecentHosts = cmp.Or(settings.RecentHosts, DefaultPrewarmRecentHosts)
+	settings.IdleSeconds = cmp.Or(settings.IdleSeconds, DefaultPrewarmIdleSeconds)
+	settings.IntervalSeconds = cmp.Or(settings.IntervalSeconds, DefaultPrewarmIntervalSeconds)
+	return settings
+}
+
+// prewarmer keeps the connections of PrewarmSettings warm while the spoof server runs.
+var prewarmer = &connectionPrewarmer{settings: PrewarmSettings{}.effective(), wake: make(chan struct{}, 1)}
+
+type connectionPrewarmer struct {
+	mutex    sync.Mutex
+	settings PrewarmSettings
+
+	// recent are the destinations requests were sent to, by prewarmKey.
+	recent map[string]prewarmTarget
+
+	// userAgent is the User-Agent of the last request, which the requests to Hosts that weren't sent any use.
+	userAgent string
+
+	// wake makes run refresh the connections right away, once the settings changed.
+	wake chan struct{}
+}
+
+// prewarmTarget is a destination to keep connections to, along with the configuration to send requests with.
+type prewarmTarget struct {
+	config     TransportConfig
+	name, port string
+	bypass     bool
+	userAgent  string
+
+	// state is the transportState whose client the connections belong to.
+	state *transportState
+	used  time.Time
+}
+
+func prewarmKey(scheme, name, port string) string {
+	return scheme + "://" + net.JoinHostPort(name, port)
+}
+
+// configure applies settings, forgetting the recent destinations.
+func (p *connectionPrewarmer) configure(settings PrewarmSettings) {
+	p.mutex.Lock()
+	p.settings = settings.effective()
+	p.recent = nil
+	p.mutex.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// touch records a request to the destination name and port, sent with config by the state current.
+func (p *connectionPrewarmer) touch(current *transportState, config *TransportConfig, name, port string, bypass bool, userAgent string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.settings.Connections == 0 {
+		return
+	}
+	if userAgent != "" {
+		p.userAgent = userAgent
+	}
+	if p.settings.RecentHosts < 0 {
+		return
+	}
+
+	key := prewarmKey(config.Scheme, name, port)
+	if _, ok := p.recent[key]; !ok {
+		if p.recent == nil {
+			p.recent = make(map[string]prewarmTarget)
+		}
+		for len(p.recent) >= p.settings.RecentHosts {
+			oldest := ""
+			for other, target := range p.recent {
+				if oldest == "" || target.used.Before(p.recent[oldest].used) {
+					oldest = other
+				}
+			}
+			delete(p.recent, oldest)
+		}
+	}
+	p.recent[key] = prewarmTarget{config: *config, name: name, port: port, bypass: bypass, userAgent: userAgent, state: current, used: time.Now()}
+}
+
+// run refreshes the warm connections every PrewarmSettings.IntervalSeconds, until stopped is closed.
+func (p *connectionPrewarmer) run(stopped <-chan struct{}) {
+	defer recoverPanic(prewarmLog, "prewarmer")
+
+	for {
+		p.refresh()
+
+		p.mutex.Lock()
+		interval := time.Duration(p.settings.IntervalSeconds) * time.Second
+		p.mutex.Unlock()
+
+		select {
+		case <-stopped:
+			return
+		case <-p.wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// refresh sends a request on each warm connection of each destination, at the same time.
+func (p *connectionPrewarmer) refresh() {
+	current := state.Load()
+	connections, targets := p.targets(current)
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Go(func() {
+			p.warm(current, &target, connections)
+		})
+	}
+	wg.Wait()
+}
+
+// targets returns the number of connections to keep to each destination, and the destinations to keep warm: the
+// recent ones that current sent requests to, then the ones of PrewarmSettings.Hosts that aren't among them.
+func (p *connectionPrewarmer) targets(current *transportState) (int, []prewarmTarget) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.settings.Connections == 0 {
+		return 0, nil
+	}
+
+	var targets []prewarmTarget
+	seen := make(map[string]bool)
+	idle := time.Duration(p.settings.IdleSeconds) * time.Second
+	for key, target := range p.recent {
+		// Requests sent with the previous settings used clients whose connections were closed with them.
+		if target.state != current || time.Since(target.used) > idle {
+			delete(p.recent, key)
+			continue
+		}
+		targets = append(targets, target)
+		seen[key] = true
+	}
+
+	for _, host := range p.settings.Hosts {
+		target, err := newPrewarmTarget(current, host, p.userAgent)
+		if err != nil {
+			// The hosts are validated along with the settings.
+			continue
+		}
+		if key := prewarmKey(target.config.Scheme, target.name, target.port); !seen[key] {
+			targets = append(targets, target)
+			seen[key] = true
+		}
+	}
+
+	return p.settings.Connections, targets
+}
+
+// newPrewarmTarget returns the target of an entry of PrewarmSettings.Hosts, with the configuration current would send
+// a request to it with, short of the fields Burp sets per request.
+func newPrewarmTarget(current *transportState, host, userAgent string) (prewarmTarget, error) {
+	scheme, hostport, name, port, err := parsePrewarmHost(host)
+	if err != nil {
+		return prewarmTarget{}, err
+	}
+
+	config := current.defaultsFor("")
+	config.Host, config.Scheme = hostport, scheme
+	if err := current.settings.applyProfile(&config, name); err != nil {
+		return prewarmTarget{}, err
+	}
+
+	bypass := matchBypassHost(current.settings.BypassHosts, name)
+	if !bypass && config.useInterceptedFingerprint(name) {
+		if captured, _, _ := captures.lookup(name, port, config.InterceptedFingerprintDefault); captured != nil {
+			config.useCapture(captured)
+		}
+	}
+
+	return prewarmTarget{config: config, name: name, port: port, bypass: bypass, userAgent: userAgent, state: current}, nil
+}
+
+// parsePrewarmHost parses an entry of PrewarmSettings.Hosts into its scheme, its host as the Host header carries it,
+// and the name and port of the destination.
+func parsePrewarmHost(host string) (scheme, hostport, name, port string, err error) {
+	scheme, hostport = "https", strings.TrimSpace(host)
+	if before, after, ok := strings.Cut(hostport, "://"); ok {
+		scheme, hostport = strings.ToLower(before), after
+	}
+	if scheme != "http" && scheme != "https" {
+		return "", "", "", "", fmt.Errorf("unsupported scheme '%s', must be http or https", scheme)
+	}
+	if strings.ContainsAny(hostport, "/?#@") {
+		return "", "", "", "", errors.New("must be a host with an optional port, without a path")
+	}
+
+	if name, port, err = net.SplitHostPort(hostport); err != nil {
+		name, port = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), "443"
+		if scheme == "http" {
+			port = "80"
+		}
+	}
+	if name == "" {
+		return "", "", "", "", errors.New("missing host")
+	}
+
+	return scheme, hostport, name, port, nil
+}
+
+// warm sends connections requests to target at the same time, so each takes a connection of its own if the
+// destination speaks HTTP/1.1. Requests that don't get a slot of the limits aren't sent.
+func (p *connectionPrewarmer) warm(current *transportState, target *prewarmTarget, connections int) {
+	var client requestDoer
+	var err error
+	if target.bypass {
+		client, err = current.bypassClientFor(&target.config)
+	} else {
+		client, err = current.clientFor(&target.config)
+	}
+	if err != nil {
+		prewarmLog.Debug("prewarming connections failed", "host", captureKey(target.name, target.port), "error", err)
+		return
+	}
+
+	var releases []func()
+	for range connections {
+		release, ok := limiter.tryAcquire(target.name)
+		if !ok {
+			prewarmLog.Debug("not prewarming more connections, the concurrent request limits are reached", "host", captureKey(target.name, target.port))
+			break
+		}
+		releases = append(releases, release)
+	}
+
+	barrier := newPrewarmBarrier(len(releases))
+	var wg sync.WaitGroup
+	for _, release := range releases {
+		wg.Go(func() {
+			defer release()
+			prewarmRequests.WithLabelValues(p.send(client, target, barrier)).Inc()
+		})
+	}
+	wg.Wait()
+}
+
+// send sends the request that warms a connection to target, and returns its result label of prewarm_requests_total.
+func (p *connectionPrewarmer) send(client requestDoer, target *prewarmTarget, barrier *prewarmBarrier) string {
+	ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+	defer cancel()
+
+	arrive := sync.OnceFunc(barrier.arrived.Done)
+	defer arrive()
+	var use atomic.Pointer[connectionUse]
+	defer func() { use.Load().release() }()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			use.Store(acquireConnection(info.Conn, info.Reused))
+			arrive()
+			barrier.wait(ctx)
+		},
+	})
+
+	req, err := fhttp.NewRequestWithContext(ctx, fhttp.MethodHead, target.config.Scheme+"://"+target.config.Host+"/", nil)
+	if err != nil {
+		prewarmLog.Debug("prewarming a connection failed", "host", captureKey(target.name, target.port), "error", err)
+		return "error"
+	}
+	// An empty User-Agent keeps the client from sending its own.
+	req.Header["User-Agent"] = []string{target.userAgent}
+
+	res, err := client.Do(req)
+	if err != nil {
+		prewarmLog.Debug("prewarming a connection failed", "host", captureKey(target.name, target.port), "error", err)
+		return "error"
+	}
+	res.Body.Close()
+
+	return "success"
+}
+
+// prewarmBarrierTimeout is how long the requests of a refresh that got a connection wait for the others.
+const prewarmBarrierTimeout = 5 * time.Second
+
+// prewarmBarrier holds the requests of a refresh once they got a connection, until each of them got one or failed.
+// Otherwise a request could finish before another one got a connection, which would then reuse its connection
+// instead of warming another one (and cancel the connection it was dialing once it's done).
+type prewarmBarrier struct {
+	arrived sync.WaitGroup
+	all     chan struct{}
+}
+
+func newPrewarmBarrier(requests int) *prewarmBarrier {
+	b := &prewarmBarrier{all: make(chan struct{})}
+	b.arrived.Add(requests)
+	go func() {
+		b.arrived.Wait()
+		close(b.all)
+	}()
+	return b
+}
+
+// wait waits for every request to get a connection or fail, for ctx to be done or for prewarmBarrierTimeout.
+func (b *prewarmBarrier) wait(ctx context.Context) {
+	timer := time.NewTimer(prewarmBarrierTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-b.all:
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Profile is a named set of transport settings, see Settings.Profiles.
+// Fields that are left empty (or zero) keep the value the request would otherwise use.
+type Profile struct {
+	// Fingerprint is the TLS fingerprint to use. Its client profile also determines the HTTP/2 fingerprint
+	// (SETTINGS, window update, priorities and pseudo-header order), unless Http2Fingerprint is set.
+	Fingerprint string
+
+	// HexClientHello is a Client Hello to use instead of Fingerprint, with the default HTTP/2 fingerprint unless
+	// Http2Fingerprint is set.
+	HexClientHello HexClientHello
+
+	// Http2Fingerprint is the fingerprint whose HTTP/2 fingerprint is sent, whichever TLS fingerprint is used, see
+	// TransportConfig.Http2Fingerprint.
+	Http2Fingerprint string
+
+	// HeaderOrder replaces the order of headers Burp sends with each request.
+	HeaderOrder []string
+
+	// ExternalProxyUrl replaces the upstream proxy, including the one Burp's rules select for the request.
+	ExternalProxyUrl string
+
+	// LocalAddress replaces the address connections are made from, see TransportConfig.LocalAddress.
+	LocalAddress string
+
+	HttpTimeout           int
+	DialTimeout           int
+	TlsHandshakeTimeout   int
+	ResponseHeaderTimeout int
+	IdleReadTimeout       int
+	MaxResponseBytes      *int64
+}
+
+// ProfileHost maps destinations matching a host pattern (see matchHostPattern) to a profile, see Settings.ProfileHosts.
+type ProfileHost struct {
+	Host    string
+	Profile string
+}
+
+// ProfileDescription describes a profile as returned by ListProfiles.
+type ProfileDescription struct {
+	Name    string
+	Profile Profile
+
+	// Default reports whether the profile is Settings.DefaultProfile.
+	Default bool
+
+	// Hosts are the host patterns of Settings.ProfileHosts that map to the profile.
+	Hosts []string
+}
+
+// apply overrides the fields of config that the profile sets.
+func (profile *Profile) apply(config *TransportConfig) {
+	if profile.Fingerprint != "" || profile.HexClientHello != "" {
+		config.Fingerprint = profile.Fingerprint
+		config.HexClientHello = profile.HexClientHello
+	}
+
+	if profile.Http2Fingerprint != "" {
+		config.Http2Fingerprint = profile.Http2Fingerprint
+	}
+
+	if len(profile.HeaderOrder) > 0 {
+		config.HeaderOrder = slices.Clone(profile.HeaderOrder)
+	}
+
+	if profile.ExternalProxyUrl != "" {
+		config.ExternalProxyUrl = profile.ExternalProxyUrl
+	}
+
+	if profile.LocalAddress != "" {
+		config.LocalAddress = profile.LocalAddress
+	}
+
+	for _, timeout := range []struct {
+		value  int
+		target *int
+	}{
+		{profile.HttpTimeout, &config.HttpTimeout},
+		{profile.DialTimeout, &config.DialTimeout},
+		{profile.TlsHandshakeTimeout, &config.TlsHandshakeTimeout},
+		{profile.ResponseHeaderTimeout, &config.ResponseHeaderTimeout},
+		{profile.IdleReadTimeout, &config.IdleReadTimeout},
+	} {
+		if timeout.value != 0 {
+			*timeout.target = timeout.value
+		}
+	}
+
+	if profile.MaxResponseBytes != nil {
+		maxResponseBytes := *profile.MaxResponseBytes
+		config.MaxResponseBytes = &maxResponseBytes
+	}
+}
+
+// profileFor returns the name of the profile for a request to host, or an empty string if none applies.
+// The profile named by the request takes precedence over the first matching ProfileHosts entry, which takes precedence
+// over DefaultProfile.
+func (settings *Settings) profileFor(config *TransportConfig, host string) string {
+	if config.Profile != "" {
+		return config.Profile
+	}
+
+	for _, mapping := range settings.ProfileHosts {
+		if matchHostPattern(mapping.Host, host) {
+			return mapping.Profile
+		}
+	}
+
+	return settings.DefaultProfile
+}
+
+// applyProfile applies the profile for a request to host to config.
+func (settings *Settings) applyProfile(config *TransportConfig, host string) error {
+	name := settings.profileFor(config, host)
+	if name == "" {
+		return nil
+	}
+
+	profile, ok := settings.Profiles[name]
+	if !ok {
+		// Profiles referenced by the settings are validated, so this is a profile requested by a single request.
+		return fmt.Errorf("unknown profile '%s'", name)
+	}
+
+	profile.apply(config)
+	spoofLog.Debug("using profile", "profile", name, "host", host)
+
+	return nil
+}
+
+// ListProfiles returns the profiles of the settings in effect, sorted by name.
+// Passwords are removed from their upstream proxies.
+func ListProfiles() []ProfileDescription {
+	settings := state.Load().settings
+
+	result := make([]ProfileDescription, 0, len(settings.Profiles))
+	for _, name := range slices.Sorted(maps.Keys(settings.Profiles)) {
+		profile := settings.Profiles[name]
+		profile.HeaderOrder = slices.Clone(profile.HeaderOrder)
+		profile.ExternalProxyUrl = withoutPassword(profile.ExternalProxyUrl)
+
+		description := ProfileDescription{
+			Name:    name,
+			Profile: profile,
+			Default: name == settings.DefaultProfile,
+		}
+		for _, mapping := range settings.ProfileHosts {
+			if mapping.Profile == name {
+				description.Hosts = append(description.Hosts, mapping.Host)
+			}
+		}
+
+		result = append(result, description)
+	}
+
+	return result
+}
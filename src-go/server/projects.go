@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+// projectsDirectory is the subdirectory of the shared state directory that holds the state of each project.
+const projectsDirectory = "projects"
+
+// maxProjectIdLength is the maximum length of Settings.ProjectId.
+const maxProjectIdLength = 128
+
+// stateRoot is the directory set with SetStateDirectory, if any.
+var stateRoot atomic.Pointer[string]
+
+// SetStateDirectory keeps the on-disk state (the CA, captured fingerprints and persisted settings) in dir
+// instead of the user's configuration directory. It should be called before StartServer.
+func SetStateDirectory(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	stateRoot.Store(&dir)
+	return nil
+}
+
+// stateDirectory returns the directory that holds the on-disk state of projectId, or the shared state if it's empty.
+// The directory is created if it doesn't exist yet.
+func stateDirectory(projectId string) string {
+	dir := ""
+	if root := stateRoot.Load(); root != nil {
+		dir = *root
+	} else if userConfigDir, err := os.UserConfigDir(); err == nil {
+		dir = path.Join(userConfigDir, "burp-awesome-tls")
+		_ = os.Mkdir(dir, 0o700)
+	}
+
+	if projectId != "" {
+		dir = path.Join(dir, projectsDirectory, projectId)
+		_ = os.MkdirAll(dir, 0o700)
+	}
+
+	return dir
+}
+
+// currentProjectId returns the ProjectId of the settings in effect.
+func currentProjectId() string {
+	return state.Load().settings.ProjectId
+}
+
+// validateProjectId checks that projectId can be used as the name of its state directory.
+func validateProjectId(projectId string) error {
+	if len(projectId) > maxProjectIdLength {
+		return fmt.Errorf("must not be longer than %d characters", maxProjectIdLength)
+	}
+
+	if projectId == "." || projectId == ".." {
+		return errors.New("must not be '.' or '..'")
+	}
+
+	for _, r := range projectId {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return fmt.Errorf("must only contain letters, digits, '.', '-' and '_', found '%c'", r)
+		}
+	}
+
+	return nil
+}
+
+// copySharedCertificateAuthority copies the shared CA into the state directory of projectId, unless the project already has one.
+// This is done the first time a project is used, so clients that trust the shared CA keep working.
+func copySharedCertificateAuthority(projectId string) error {
+	if projectId == "" {
+		return nil
+	}
+
+	projectDir := stateDirectory(projectId)
+	if _, err := os.Stat(path.Join(projectDir, caFile)); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	sharedDir := stateDirectory("")
+
+	cert, err := os.ReadFile(path.Join(sharedDir, caFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	key, err := os.ReadFile(path.Join(sharedDir, caKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The key is written first, so an interrupted copy is retried the next time.
+	if err = os.WriteFile(path.Join(projectDir, caKeyFile), key, 0o600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(path.Join(projectDir, caFile), cert, 0o600); err != nil {
+		return err
+	}
+
+	certificateLog.Info("copied the shared certificate authority into the project", "project", projectId)
+
+	return nil
+}
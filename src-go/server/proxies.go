@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// proxies manages the intercept proxy listeners.
+// Each listener has its own lifecycle, but they all share the same fingerprint store.
+var proxies = &proxyGroup{
+	listeners: make(map[string]*interceptProxy),
+}
+
+type proxyGroup struct {
+	mutex     sync.Mutex
+	listeners map[string]*interceptProxy
+
+	// The addresses that listen since the last sync and the burp address they forward to. An address that failed to
+	// bind isn't one of them, so syncing the same configuration again retries it.
+	addrs    []string
+	burpAddr string
+}
+
+// sync makes sure an intercept proxy listens on each of addrs and stops the listeners on any other address.
+// Listeners that are already running on one of addrs are kept as-is, apart from updating their options.
+// An address that fails to bind doesn't prevent the others from starting;
+// the returned error joins a *proxyAddrError for each failed address.
+func (g *proxyGroup) sync(addrs []string, burpAddr string, opts InterceptOptions) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, listener := range g.listeners {
+		listener.configure(opts)
+	}
+
+	if slices.Equal(addrs, g.addrs) && burpAddr == g.burpAddr {
+		return nil
+	}
+
+	var errs []error
+
+	// New listeners are started before any are stopped, so moving to a different address never leaves a gap.
+	for _, addr := range addrs {
+		if _, ok := g.listeners[addr]; ok {
+			continue
+		}
+		errs = append(errs, g.start(addr, burpAddr, opts))
+	}
+
+	for addr, listener := range g.listeners {
+		switch {
+		case !slices.Contains(addrs, addr):
+			errs = append(errs, g.stopListener(addr, listener))
+		case listener.burpAddr != burpAddr:
+			// The address doesn't change, so the listener has to be stopped before it can be started again.
+			errs = append(errs, g.stopListener(addr, listener), g.start(addr, burpAddr, opts))
+		}
+	}
+
+	g.addrs = slices.DeleteFunc(slices.Clone(addrs), func(addr string) bool {
+		_, ok := g.listeners[addr]
+		return !ok
+	})
+	g.burpAddr = burpAddr
+
+	return errors.Join(errs...)
+}
+
+// proxyAddrError is the error of an address proxyGroup.sync failed to start or stop an intercept proxy on.
+type proxyAddrError struct {
+	addr string
+	err  error
+}
+
+func (e *proxyAddrError) Error() string {
+	return fmt.Sprintf("intercept proxy %s: %s", e.addr, e.err)
+}
+
+func (e *proxyAddrError) Unwrap() error {
+	return e.err
+}
+
+// interceptBindErrors returns a SettingsError for each address in err, an error returned by proxyGroup.sync.
+func interceptBindErrors(err error) SettingsErrors {
+	joined := []error{err}
+	if multi, ok := err.(interface{ Unwrap() []error }); ok {
+		joined = multi.Unwrap()
+	}
+
+	var errs SettingsErrors
+
+	for _, err := range joined {
+		var addrErr *proxyAddrError
+		if !errors.As(err, &addrErr) {
+			errs = append(errs, SettingsError{Field: "InterceptProxyAddress", Reason: err.Error(), Code: SettingsErrorBindFailed})
+			continue
+		}
+		errs = append(errs, SettingsError{Field: "InterceptProxyAddress", Value: addrErr.addr, Reason: err.Error(), Code: SettingsErrorBindFailed})
+	}
+
+	return errs
+}
+
+// start starts an intercept proxy listening on addr. The caller must hold the mutex.
+func (g *proxyGroup) start(addr, burpAddr string, opts InterceptOptions) error {
+	listener, err := newInterceptProxy(addr, burpAddr, opts)
+	if err != nil {
+		return &proxyAddrError{addr: addr, err: err}
+	}
+
+	g.listeners[addr] = listener
+
+	go listener.Start()
+
+	return nil
+}
+
+// stopListener stops the intercept proxy listening on addr. The caller must hold the mutex.
+// Connections it already accepted are not interrupted.
+func (g *proxyGroup) stopListener(addr string, listener *interceptProxy) error {
+	delete(g.listeners, addr)
+
+	if err := listener.Stop(); err != nil {
+		return &proxyAddrError{addr: addr, err: fmt.Errorf("stop: %w", err)}
+	}
+
+	return nil
+}
+
+// stop stops all intercept proxy listeners.
+func (g *proxyGroup) stop() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var errs []error
+
+	for addr, listener := range g.listeners {
+		errs = append(errs, g.stopListener(addr, listener))
+	}
+
+	g.addrs = nil
+	g.burpAddr = ""
+
+	return errors.Join(errs...)
+}
+
+// GetInterceptListenAddresses returns the addresses the intercept proxy listens on, which have the ports that were chosen
+// for addresses with port 0 in InterceptProxyAddress. Unspecified IPs are replaced like in GetListenAddress.
+func GetInterceptListenAddresses() []string {
+	return proxies.listenAddrs()
+}
+
+func (g *proxyGroup) listenAddrs() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var addrs []string
+	for _, addr := range g.addrs {
+		if listener, ok := g.listeners[addr]; ok {
+			addrs = append(addrs, dialableAddr(listener.listener.Addr()))
+		}
+	}
+
+	return addrs
+}
+
+// splitAddrs splits a comma-separated list of addresses.
+func splitAddrs(addrs string) []string {
+	var result []string
+
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" && !slices.Contains(result, addr) {
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
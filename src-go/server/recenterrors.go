@@ -0,0 +1,134 @@
+package server
+
+import (
+	"cmp"
+	"sync"
+	"time"
+)
+
+// Defaults of RecentErrorSettings.
+const (
+	DefaultMaxRecentErrors            = 100
+	DefaultRecentErrorCoalesceSeconds = 60
+)
+
+// RecentErrorSettings bound the errors kept for GetRecentErrors, which are only kept in memory. Zero keeps the defaults.
+type RecentErrorSettings struct {
+	// MaxEntries is the number of errors kept, forgetting the oldest ones first. Defaults to [DefaultMaxRecentErrors].
+	MaxEntries int
+
+	// CoalesceSeconds is how long after an error the same error counts as a repeat of it rather than a new entry, so
+	// a flapping destination doesn't flood the errors. Defaults to [DefaultRecentErrorCoalesceSeconds].
+	CoalesceSeconds int
+}
+
+// effective returns the settings with their defaults filled in.
+func (settings RecentErrorSettings) effective() RecentErrorSettings {
+	settings.MaxEntries = cmp.Or(settings.MaxEntries, DefaultMaxRecentErrors)
+	settings.CoalesceSeconds = cmp.Or(settings.CoalesceSeconds, DefaultRecentErrorCoalesceSeconds)
+	return settings
+}
+
+// RecentError is an error returned to a client or reported by a part of the server, see GetRecentErrors. Errors with
+// the same code, host and message count as one while they repeat within RecentErrorSettings.CoalesceSeconds.
+type RecentError struct {
+	// Time is when the error last happened, and FirstTime when it first did.
+	Time      time.Time
+	FirstTime time.Time
+	// Count is the number of times the error happened.
+	Count int
+
+	// Code is the code of the error of a request (see RequestError), and Host its destination.
+	Code string `json:",omitempty"`
+	Host string `json:",omitempty"`
+	// TraceId is the TransportConfig.TraceId of the request that last failed with the error, if it was one.
+	TraceId string `json:",omitempty"`
+	Message string
+}
+
+// recentErrors keeps the last errors returned to clients, see GetRecentErrors.
+var recentErrors = &errorHistory{max: DefaultMaxRecentErrors, coalesce: DefaultRecentErrorCoalesceSeconds * time.Second}
+
+type errorHistory struct {
+	mutex    sync.Mutex
+	max      int
+	coalesce time.Duration
+	// entries are the errors, from the one that happened the longest ago.
+	entries []RecentError
+}
+
+func (h *errorHistory) configure(settings RecentErrorSettings) {
+	settings = settings.effective()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.max = settings.MaxEntries
+	h.coalesce = time.Duration(settings.CoalesceSeconds) * time.Second
+	h.trim()
+}
+
+func (h *errorHistory) add(err error) {
+	h.addRequest(err, "", "", "")
+}
+
+// addRequest keeps err of the request with traceId to host, which failed with code. A repeat of an error that
+// happened within the coalescing window is counted in its entry, which becomes the most recent one.
+func (h *errorHistory) addRequest(err error, code, host, traceId string) {
+	now := time.Now()
+	entry := RecentError{Time: now, FirstTime: now, Count: 1, Code: code, Host: host, TraceId: traceId, Message: currentRedactor().text(err.Error())}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		previous := h.entries[i]
+		if now.Sub(previous.Time) > h.coalesce {
+			break
+		}
+		if previous.Code == code && previous.Host == host && previous.Message == entry.Message {
+			entry.FirstTime, entry.Count = previous.FirstTime, previous.Count+1
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			break
+		}
+	}
+	h.entries = append(h.entries, entry)
+	h.trim()
+}
+
+// trim forgets the oldest entries beyond the maximum.
+func (h *errorHistory) trim() {
+	if excess := len(h.entries) - h.max; excess > 0 {
+		h.entries = append(h.entries[:0:0], h.entries[excess:]...)
+	}
+}
+
+// list returns the errors, most recent first.
+func (h *errorHistory) list() []RecentError {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := make([]RecentError, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		result = append(result, h.entries[i])
+	}
+	return result
+}
+
+func (h *errorHistory) clear() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.entries = nil
+}
+
+// GetRecentErrors returns the last errors of requests and of the server's listeners, proxies, hooks and mirror, most
+// recent first, with repeats counted in one entry.
+func GetRecentErrors() []RecentError {
+	return recentErrors.list()
+}
+
+// ClearRecentErrors forgets the errors returned by GetRecentErrors.
+func ClearRecentErrors() {
+	recentErrors.clear()
+}
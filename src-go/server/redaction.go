@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// redactedValue replaces what's redacted, unless RedactionSettings.PreserveLength is set.
+const redactedValue = "[redacted]"
+
+// defaultRedactedHeaders are the headers that are always redacted, unless RedactionSettings.Disabled is set.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// RedactionSettings configure redacting secrets from what the server writes out of the requests it sends: the log,
+// wire captures, HAR recordings, mirrored records, recent errors and events. Requests and responses themselves are
+// never changed. By default the values of defaultRedactedHeaders are redacted, like the credentials of URLs.
+type RedactionSettings struct {
+	// Headers are the names of more headers whose values are redacted, e.g. X-Auth-Token.
+	Headers []string
+
+	// BodyPatterns are regular expressions (in RE2 syntax) of the secrets redacted from bodies, and from the
+	// messages of the log and of errors. If a pattern has groups, only what they match is redacted, e.g. the
+	// value of `"password":"([^"]*)"`.
+	BodyPatterns []string
+
+	// PreserveLength replaces redacted values with a token that says how many bytes they had, like "[redacted:32]".
+	PreserveLength bool
+
+	// Strict redacts whole bodies instead of the matches of BodyPatterns.
+	Strict bool
+
+	// Disabled turns redaction off, including the default headers.
+	Disabled bool
+}
+
+// redaction is the redactor of Settings.Redaction, see currentRedactor.
+var redaction atomic.Pointer[redactor]
+
+// currentRedactor returns the redactor of Settings.Redaction, or of the defaults until settings are applied. The
+// loggers are created while the package is initialized, so it can't be a variable initialized with the defaults.
+func currentRedactor() *redactor {
+	if r := redaction.Load(); r != nil {
+		return r
+	}
+	redaction.CompareAndSwap(nil, newRedactor(RedactionSettings{}))
+	return redaction.Load()
+}
+
+// redactor redacts secrets according to RedactionSettings.
+type redactor struct {
+	disabled       bool
+	preserveLength bool
+	strict         bool
+
+	// headers are the lower-case names of the redacted headers.
+	headers map[string]bool
+	// headerLines matches the values of the redacted headers in header lines of HTTP/1.1 messages, and
+	// headerFields in other text, e.g. "Cookie: ..." in an error message quoting a response.
+	headerLines  *regexp.Regexp
+	headerFields *regexp.Regexp
+	// urlCredentials matches the credentials of URLs, e.g. of an upstream proxy.
+	urlCredentials *regexp.Regexp
+	patterns       []*regexp.Regexp
+}
+
+// newRedactor compiles settings, which were validated. Patterns that don't compile are left out.
+func newRedactor(settings RedactionSettings) *redactor {
+	r := &redactor{
+		disabled:       settings.Disabled,
+		preserveLength: settings.PreserveLength,
+		strict:         settings.Strict,
+		headers:        map[string]bool{},
+		urlCredentials: regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://([^/?#@\s"']+)@`),
+	}
+
+	var names []string
+	for _, name := range slices.Concat(defaultRedactedHeaders, settings.Headers) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !r.headers[name] {
+			r.headers[name] = true
+			names = append(names, regexp.QuoteMeta(name))
+		}
+	}
+	alternatives := strings.Join(names, "|")
+	r.headerLines = regexp.MustCompile(`(?im)^(?:` + alternatives + `)[ \t]*:[ \t]*([^\r\n]*)`)
+	r.headerFields = regexp.MustCompile(`(?i)\b(?:` + alternatives + `)["']?\s*[:=]\s*["']?([^\r\n"'\\]*)`)
+
+	for _, pattern := range settings.BodyPatterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			r.patterns = append(r.patterns, re)
+		}
+	}
+	return r
+}
+
+// token returns what replaces a redacted value of length bytes.
+func (r *redactor) token(length int) string {
+	if r.preserveLength {
+		return fmt.Sprintf("[redacted:%d]", length)
+	}
+	return redactedValue
+}
+
+// redactsHeader reports whether the values of the header named name are redacted.
+func (r *redactor) redactsHeader(name string) bool {
+	return !r.disabled && r.headers[strings.ToLower(name)]
+}
+
+// header returns value of the header named name, redacted if it's one of the redacted headers.
+func (r *redactor) header(name, value string) string {
+	if r.redactsHeader(name) {
+		return r.token(len(value))
+	}
+	return value
+}
+
+// text returns s with the values of redacted headers, the credentials of URLs and the matches of BodyPatterns
+// redacted.
+func (r *redactor) text(s string) string {
+	if r.disabled {
+		return s
+	}
+
+	data := []byte(s)
+	changed := false
+	for _, re := range slices.Concat([]*regexp.Regexp{r.headerFields, r.urlCredentials}, r.patterns) {
+		var replaced bool
+		data, replaced = r.replace(re, data)
+		changed = changed || replaced
+	}
+	if !changed {
+		return s
+	}
+	return string(data)
+}
+
+// body returns body with the matches of BodyPatterns redacted, or redacted entirely in strict mode. body isn't
+// changed, the redacted body is a copy.
+func (r *redactor) body(body []byte) []byte {
+	if r.disabled || len(body) == 0 {
+		return body
+	}
+	if r.strict {
+		return []byte(r.token(len(body)))
+	}
+
+	for _, re := range r.patterns {
+		body, _ = r.replace(re, body)
+	}
+	return body
+}
+
+// http1 returns data, HTTP/1.1 messages as they went over the wire, with the values of redacted headers redacted,
+// and the bodies as body does. In strict mode, everything after the first header block is redacted.
+func (r *redactor) http1(data []byte) []byte {
+	if r.disabled {
+		return data
+	}
+
+	data, _ = r.replace(r.headerLines, data)
+	if r.strict {
+		if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 && i+4 < len(data) {
+			return append(data[:i+4:i+4], r.token(len(data)-i-4)...)
+		}
+		return data
+	}
+	for _, re := range r.patterns {
+		data, _ = r.replace(re, data)
+	}
+	return data
+}
+
+// headerValues returns a copy of headers with the values of redacted headers, and of more, redacted.
+func (r *redactor) headerValues(headers []harNameValue, more []string) []harNameValue {
+	redacted := make([]harNameValue, 0, len(headers))
+	for _, header := range headers {
+		if slices.ContainsFunc(more, func(name string) bool { return strings.EqualFold(name, header.Name) }) {
+			header.Value = r.token(len(header.Value))
+		} else {
+			header.Value = r.header(header.Name, header.Value)
+		}
+		redacted = append(redacted, header)
+	}
+	return redacted
+}
+
+// replace returns data with the matches of re replaced by tokens, or only what its groups match if it has any, and
+// whether anything was replaced. data isn't changed.
+func (r *redactor) replace(re *regexp.Regexp, data []byte) ([]byte, bool) {
+	matches := re.FindAllSubmatchIndex(data, -1)
+	if matches == nil {
+		return data, false
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for _, match := range matches {
+		spans := match[:2]
+		if len(match) > 2 {
+			spans = match[2:]
+		}
+		for i := 0; i+1 < len(spans); i += 2 {
+			start, end := spans[i], spans[i+1]
+			// Groups that didn't match, matched nothing or are nested in one that was redacted are skipped.
+			if start < last || end <= start {
+				continue
+			}
+			b.Write(data[last:start])
+			b.WriteString(r.token(end - start))
+			last = end
+		}
+	}
+	if last == 0 {
+		return data, false
+	}
+	b.Write(data[last:])
+	return b.Bytes(), true
+}
+
+// attr returns attr of a log record with the values of attributes named like redacted headers redacted, and the
+// secrets of strings and errors redacted as text does.
+func (r *redactor) attr(attr slog.Attr) slog.Attr {
+	if r.disabled {
+		return attr
+	}
+
+	value := attr.Value.Resolve()
+	switch {
+	case r.headers[strings.ToLower(attr.Key)]:
+		attr.Value = slog.StringValue(r.token(len(value.String())))
+	case value.Kind() == slog.KindGroup:
+		group := value.Group()
+		attrs := make([]slog.Attr, 0, len(group))
+		for _, attr := range group {
+			attrs = append(attrs, r.attr(attr))
+		}
+		attr.Value = slog.GroupValue(attrs...)
+	case value.Kind() == slog.KindString:
+		attr.Value = slog.StringValue(r.text(value.String()))
+	case value.Kind() == slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			attr.Value = slog.StringValue(r.text(err.Error()))
+		} else {
+			attr.Value = value
+		}
+	default:
+		attr.Value = value
+	}
+	return attr
+}
+
+// record returns a copy of rec with its message and attributes redacted.
+func (r *redactor) record(rec slog.Record) slog.Record {
+	if r.disabled {
+		return rec
+	}
+
+	redacted := slog.NewRecord(rec.Time, rec.Level, r.text(rec.Message), rec.PC)
+	rec.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(r.attr(attr))
+		return true
+	})
+	return redacted
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptest"
+)
+
+// HeaderField is a header of a request or response, in the order it's sent in.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Request is a request to send with SendRequest.
+type Request struct {
+	Method  string
+	Url     string
+	Headers []HeaderField
+	Body    []byte
+
+	// TransportConfig is the configuration of the request, as sent in the ConfigurationHeaderKey header.
+	// Leave empty to use the saved settings. Host and Scheme default to the ones of Url, and HeaderOrder to
+	// the order of Headers.
+	TransportConfig string
+}
+
+// Response is the response to a request sent with SendRequest.
+type Response struct {
+	StatusCode int
+	Headers    []HeaderField
+	Body       []byte
+
+	// Truncated reports whether the body was cut off at MaxResponseBytes.
+	Truncated bool
+}
+
+// SendRequest sends a request (see Request) to its destination like the spoof server does, without going through
+// a listener, so programs that load the library can use its fingerprints directly.
+// Errors sending the request are reported as a response with status 500, like the spoof server reports them.
+func SendRequest(data string) (*Response, error) {
+	var request Request
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	target, err := url.Parse(request.Url)
+	if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, fmt.Errorf("invalid request: URL '%s' must be an absolute http or https URL", request.Url)
+	}
+
+	req, err := fhttp.NewRequest(strings.ToUpper(cmp.Or(request.Method, fhttp.MethodGet)), target.String(), bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	if len(request.Body) == 0 {
+		req.Body = nil
+	}
+
+	var headerOrder []string
+	for _, header := range request.Headers {
+		req.Header.Add(header.Name, header.Value)
+		headerOrder = append(headerOrder, header.Name)
+	}
+
+	current := state.Load()
+	defaults := current.defaultsFor("")
+	config := &defaults
+	if request.TransportConfig != "" {
+		if config, err = ParseTransportConfig(request.TransportConfig, defaults); err != nil {
+			return nil, fmt.Errorf("invalid transport configuration: %w", err)
+		}
+	}
+	if config.Host == "" {
+		config.Host = target.Host
+	}
+	if config.Scheme == "" {
+		config.Scheme = target.Scheme
+	}
+	if len(config.HeaderOrder) == 0 {
+		config.HeaderOrder = headerOrder
+	}
+
+	recorder := httptest.NewRecorder()
+	current.send(recorder, req, defaults, config)
+
+	result := recorder.Result()
+	defer result.Body.Close()
+
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &Response{
+		StatusCode: result.StatusCode,
+		Body:       body,
+		Truncated:  result.Header.Get(TruncatedHeaderKey) != "",
+	}
+	result.Header.Del(TruncatedHeaderKey)
+	// The order of the destination's response headers isn't kept, so they're sorted by name.
+	for _, name := range slices.Sorted(maps.Keys(result.Header)) {
+		for _, value := range result.Header.Values(name) {
+			response.Headers = append(response.Headers, HeaderField{Name: name, Value: value})
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// maxSpooledMemoryBytes is the number of bytes of a request body that replayableBody keeps in memory.
+// The rest of the body is spilled to a temporary file.
+const maxSpooledMemoryBytes = 1 << 20
+
+// errBodySuperseded is returned when reading the body of an attempt after another attempt started sending it.
+var errBodySuperseded = errors.New("request body is being sent again by another attempt")
+
+// errBodyNotReplayable is returned when sending a body again whose spool is gone.
+var errBodyNotReplayable = errors.New("request body can't be sent again")
+
+// hasBody reports whether req has a body to stream.
+func hasBody(req *fhttp.Request) bool {
+	return req.Body != nil && req.Body != fhttp.NoBody
+}
+
+// replayableBody streams a request body from Burp to the destination, keeping the part that's been sent in a spool
+// so a retry can send it again. Nothing is read ahead: a retry after an error that happened before the body was
+// sent (e.g. dialing) doesn't have anything to send again, and the first attempt's memory stays bounded whatever
+// the size of the body.
+type replayableBody struct {
+	// readMutex serializes reads from source, which happen without holding mutex so they don't block
+	// starting another attempt or releasing the spool.
+	readMutex sync.Mutex
+	source    io.Reader
+
+	mutex sync.Mutex
+	// err is the error source returned, io.EOF once it's been read entirely.
+	err error
+
+	// memory and then file hold the size bytes read from source so far, while spooling.
+	memory   []byte
+	file     *os.File
+	size     int64
+	spooling bool
+
+	// broken reports that spooling failed, so the body can't be sent again.
+	broken   bool
+	released bool
+
+	// attempt counts the readers returned by reader. Only the last one can read.
+	attempt int
+}
+
+func newReplayableBody(source io.Reader) *replayableBody {
+	return &replayableBody{source: source, spooling: true}
+}
+
+// reader returns the body of the next attempt, which starts over with what's in the spool, or false if the body
+// can't be sent again. Once last is true, the rest of the body isn't spooled anymore.
+func (b *replayableBody) reader(last bool) (io.ReadCloser, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.broken || b.released || (!b.spooling && b.attempt > 0) {
+		return nil, false
+	}
+	if last {
+		b.spooling = false
+	}
+
+	b.attempt++
+	return &replayReader{body: b, attempt: b.attempt}, true
+}
+
+// replayable reports whether the body can be sent again, which it can if there's no body.
+func (b *replayableBody) replayable() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.broken && !b.released
+}
+
+// getBody is a fhttp.Request.GetBody that lets the transport send the body again itself, e.g. after the destination
+// closed an HTTP/2 connection before processing the request.
+func (b *replayableBody) getBody() (io.ReadCloser, error) {
+	body, ok := b.reader(false)
+	if !ok {
+		return nil, errBodyNotReplayable
+	}
+	return body, nil
+}
+
+// stopSpooling keeps the rest of the body from being spooled, once it won't be sent again.
+func (b *replayableBody) stopSpooling() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.spooling = false
+}
+
+// release frees the spool. Attempts can't read the body anymore. Releasing a nil body does nothing.
+func (b *replayableBody) release() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.released = true
+	b.freeSpool()
+}
+
+func (b *replayableBody) freeSpool() {
+	b.memory = nil
+	if b.file != nil {
+		b.file.Close()
+		if err := os.Remove(b.file.Name()); err != nil {
+			spoofLog.Warn("removing the spooled request body failed", "error", err)
+		}
+		b.file = nil
+	}
+}
+
+// spool appends data read from source to the spool. It must be called with mutex held.
+func (b *replayableBody) spool(data []byte) {
+	if room := maxSpooledMemoryBytes - len(b.memory); room > 0 {
+		n := min(room, len(data))
+		b.memory = append(b.memory, data[:n]...)
+		b.size += int64(n)
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	var err error
+	if b.file == nil {
+		b.file, err = os.CreateTemp("", "awesometls-body-*")
+	}
+	if err == nil {
+		_, err = b.file.Write(data)
+	}
+	if err != nil {
+		// The attempt goes on, but the body can't be sent again if it fails.
+		spoofLog.Warn("spooling the request body failed, it won't be retried", "error", err)
+		b.broken = true
+		b.spooling = false
+		b.freeSpool()
+		return
+	}
+	b.size += int64(len(data))
+}
+
+// readSpool reads the spool at offset into p. It must be called with mutex held.
+func (b *replayableBody) readSpool(p []byte, offset int64) (int, error) {
+	p = p[:min(int64(len(p)), b.size-offset)]
+	if offset < int64(len(b.memory)) {
+		return copy(p, b.memory[offset:]), nil
+	}
+	n, err := b.file.ReadAt(p, offset-int64(len(b.memory)))
+	if n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// replayReader is the body of one attempt, see replayableBody.reader.
+type replayReader struct {
+	body    *replayableBody
+	attempt int
+	offset  int64
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	b := r.body
+	if n, err, done := r.readSpooled(p); done {
+		return n, err
+	}
+
+	b.readMutex.Lock()
+	defer b.readMutex.Unlock()
+
+	// Another attempt may have read from source while this one waited.
+	if n, err, done := r.readSpooled(p); done {
+		return n, err
+	}
+
+	n, err := b.source.Read(p)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// What a superseded attempt read is spooled for the current one, even if it's the last.
+	stale := r.attempt != b.attempt
+	if n > 0 && (b.spooling || stale) && !b.released && !b.broken {
+		b.spool(p[:n])
+	}
+	if err != nil {
+		b.err = err
+	}
+	if stale {
+		return 0, errBodySuperseded
+	}
+	r.offset += int64(n)
+	if !b.spooling && r.offset >= b.size {
+		// It's the last attempt and it's past what was spooled, which nothing will read again.
+		b.freeSpool()
+	}
+
+	return n, err
+}
+
+// readSpooled reads from the spool if the reader hasn't caught up with it yet, or returns the error of source once
+// it's been read. It reports whether it did either.
+func (r *replayReader) readSpooled(p []byte) (int, error, bool) {
+	b := r.body
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.released || r.attempt != b.attempt {
+		return 0, errBodySuperseded, true
+	}
+	if r.offset < b.size {
+		if b.memory == nil && b.file == nil {
+			return 0, errBodyNotReplayable, true
+		}
+		n, err := b.readSpool(p, r.offset)
+		r.offset += int64(n)
+		return n, err, true
+	}
+	if b.err != nil && r.offset >= b.size {
+		return 0, b.err, true
+	}
+	return 0, nil, false
+}
+
+// Close doesn't close the source, which belongs to the request from Burp.
+func (r *replayReader) Close() error {
+	return nil
+}
+
+// releasingBody releases a replayableBody once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	body *replayableBody
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.body.release()
+	return err
+}
+
+// bodyTap keeps the first bytes of a request body while it's streamed to the destination, for the recorder and
+// the mirror (see HarRecordingOptions.MaxBodyBytes and MirrorSettings.MaxBodyBytes), and counts the rest.
+type bodyTap struct {
+	io.ReadCloser
+
+	mutex sync.Mutex
+	data  []byte
+	limit int
+	size  int64
+}
+
+// tapLimit returns the number of bytes of a request body to keep for recording and mirroring, one more than the
+// larger of their limits so they can tell whether it was cut off.
+func tapLimit(recording *HarRecordingOptions, mirroring *MirrorSettings) int {
+	var limit int64
+	if recording != nil {
+		limit = max(limit, recording.MaxBodyBytes)
+	}
+	if mirroring != nil {
+		limit = max(limit, mirroring.maxBodyBytes())
+	}
+	return int(limit) + 1
+}
+
+// tapBody replaces the body of req with a bodyTap that keeps up to limit bytes.
+func tapBody(req *fhttp.Request, limit int) *bodyTap {
+	tap := &bodyTap{ReadCloser: req.Body, limit: limit}
+	req.Body = tap
+	return tap
+}
+
+func (t *bodyTap) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if room := t.limit - len(t.data); room > 0 {
+		t.data = append(t.data, p[:min(room, n)]...)
+	}
+	t.size += int64(n)
+
+	return n, err
+}
+
+// body returns the bytes kept so far and the size of the body read so far. A destination that responds before it
+// received the body entirely leaves the rest of it unread.
+func (t *bodyTap) body() ([]byte, int64) {
+	if t == nil {
+		return nil, 0
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.data, t.size
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"syscall"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// Classes of errors that RetryPolicy.RetryOn can make retryable.
+const (
+	// RetryOnDial retries requests whose connection to the destination (or the upstream proxy) couldn't be established.
+	RetryOnDial = "dial"
+	// RetryOnHandshake retries requests whose TLS handshake with the destination failed.
+	RetryOnHandshake = "handshake"
+	// RetryOnReset retries requests whose connection was reset or closed before the response headers arrived.
+	RetryOnReset = "reset"
+	// RetryOnProxyStatus retries requests whose upstream proxy answered the CONNECT request with 502 or 503.
+	RetryOnProxyStatus = "proxy_status"
+)
+
+// retryClasses are all the classes of RetryPolicy.RetryOn, in the order they're documented.
+var retryClasses = []string{RetryOnDial, RetryOnHandshake, RetryOnReset, RetryOnProxyStatus}
+
+// Defaults of a RetryPolicy.
+const (
+	DefaultRetryInitialBackoffMs = 100
+	DefaultRetryMaxBackoffMs     = 2000
+)
+
+// RetryPolicy determines which failed requests are sent again, and how long to wait before each retry.
+// The zero value never retries.
+type RetryPolicy struct {
+	// RetryCount is the maximum number of retries after the first attempt.
+	// Request bodies are still streamed: the part that's been sent is kept, in memory up to 1 MB and then in a
+	// temporary file, until the response arrives.
+	RetryCount int
+
+	// InitialBackoffMs is the number of milliseconds to wait before the first retry, doubling with each retry.
+	// Defaults to [DefaultRetryInitialBackoffMs].
+	InitialBackoffMs int
+
+	// MaxBackoffMs caps the number of milliseconds to wait before a retry. Defaults to [DefaultRetryMaxBackoffMs].
+	MaxBackoffMs int
+
+	// Jitter waits a random time between half of the backoff and the full backoff. Defaults to true.
+	Jitter *bool
+
+	// RetryOn are the classes of errors to retry (RetryOnDial, RetryOnHandshake, RetryOnReset and RetryOnProxyStatus).
+	// Defaults to all of them.
+	RetryOn []string
+}
+
+// clone returns a copy of the policy that doesn't share its slice and pointer.
+func (policy RetryPolicy) clone() RetryPolicy {
+	policy.RetryOn = slices.Clone(policy.RetryOn)
+	if policy.Jitter != nil {
+		jitter := *policy.Jitter
+		policy.Jitter = &jitter
+	}
+	return policy
+}
+
+// effective returns the policy with its defaults filled in.
+func (policy RetryPolicy) effective() RetryPolicy {
+	policy = policy.clone()
+
+	if policy.InitialBackoffMs == 0 {
+		policy.InitialBackoffMs = DefaultRetryInitialBackoffMs
+	}
+	if policy.MaxBackoffMs == 0 {
+		policy.MaxBackoffMs = max(DefaultRetryMaxBackoffMs, policy.InitialBackoffMs)
+	}
+	if policy.Jitter == nil {
+		jitter := true
+		policy.Jitter = &jitter
+	}
+	if len(policy.RetryOn) == 0 {
+		policy.RetryOn = slices.Clone(retryClasses)
+	}
+
+	return policy
+}
+
+// backoff returns how long to wait before the retry-th retry of an effective policy.
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := time.Duration(policy.InitialBackoffMs) * time.Millisecond
+	limit := time.Duration(policy.MaxBackoffMs) * time.Millisecond
+
+	for i := 1; i < retry && backoff < limit; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, limit)
+
+	if *policy.Jitter && backoff > 0 {
+		backoff = backoff/2 + rand.N(backoff/2+1)
+	}
+
+	return backoff
+}
+
+// retryClass returns the class of err, which happened in stage, or an empty string if it's none of retryClasses.
+func retryClass(err error, stage string) string {
+	var statusErr *proxyStatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == fhttp.StatusBadGateway || statusErr.StatusCode == fhttp.StatusServiceUnavailable {
+			return RetryOnProxyStatus
+		}
+		return ""
+	}
+
+	switch stage {
+	case stageDial:
+		return RetryOnDial
+	case stageTLSHandshake:
+		return RetryOnHandshake
+	case stageWriteRequest, stageResponseHeader:
+		if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return RetryOnReset
+		}
+	}
+
+	return ""
+}
+
+// doWithRetries sends req with client, retrying according to the effective policy.
+// It returns the response along with the stageTimer of the attempt it belongs to, whose stages continue with reading the body.
+// The caller must cancel the timer. Errors name the stage that timed out, if any. Retries are logged with requestLog.
+func doWithRetries(client requestDoer, req *fhttp.Request, config *TransportConfig, policy RetryPolicy, requestLog *slog.Logger) (*fhttp.Response, *stageTimer, error) {
+	// The body is sent again with each retry, so the part of it that's been sent is spooled if retries are possible.
+	var replay *replayableBody
+	if spooled, ok := req.Body.(*replayReader); ok {
+		// The body was spooled entirely to identify the request (see takeRegisteredConfig), so it's sent from there.
+		replay = spooled.body
+	} else if policy.RetryCount > 0 && hasBody(req) {
+		replay = newReplayableBody(req.Body)
+	}
+
+	for retry := 0; ; retry++ {
+		ctx, timer := withStageTimer(req.Context(), config)
+		attempt := req.WithContext(ctx)
+		if replay != nil {
+			body, ok := replay.reader(retry == policy.RetryCount)
+			if !ok {
+				timer.cancel()
+				replay.release()
+				return nil, nil, errBodyNotReplayable
+			}
+			attempt.Body = body
+			attempt.GetBody = replay.getBody
+		}
+
+		timer.enter(stageDial)
+		res, err := client.Do(attempt)
+		if err == nil {
+			if replay != nil {
+				replay.stopSpooling()
+				res.Body = &releasingBody{ReadCloser: res.Body, body: replay}
+			}
+			return res, timer, nil
+		}
+
+		timer.cancel()
+		err = timer.diagnoseHandshake(timer.wrap(err), timer.current())
+		if timer.current() == stageTLSHandshake {
+			upstreamConns.failed.Add(1)
+		}
+
+		class := retryClass(err, timer.current())
+		if retry >= policy.RetryCount || class == "" || !slices.Contains(policy.RetryOn, class) || req.Context().Err() != nil || !replay.replayable() {
+			if replay != nil {
+				replay.release()
+			}
+			return nil, nil, withCode(stageErrorCode(err, timer.current()), err)
+		}
+
+		retriesTotal.WithLabelValues(class).Inc()
+
+		backoff := policy.backoff(retry + 1)
+		requestLog.Info("retrying request", "retry", retry+1, "retryCount", policy.RetryCount, "class", class, "backoffMs", backoff.Milliseconds(), "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			if replay != nil {
+				replay.release()
+			}
+			return nil, nil, context.Cause(req.Context())
+		}
+	}
+}
+
+// GetRetryPolicy returns the retry policy in effect, with its defaults filled in.
+func GetRetryPolicy() RetryPolicy {
+	return state.Load().settings.RetryPolicy.effective()
+}
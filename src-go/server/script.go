@@ -0,0 +1,497 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	starjson "go.starlark.net/lib/json"
+	starmath "go.starlark.net/lib/math"
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// DefaultScriptTimeoutMs is the default of ScriptSettings.TimeoutMs.
+	DefaultScriptTimeoutMs = 100
+
+	// DefaultScriptMaxSteps is the default of ScriptSettings.MaxSteps.
+	DefaultScriptMaxSteps = 1_000_000
+
+	// maxScriptBodyBytes caps the size of a body set by a script.
+	maxScriptBodyBytes = 64 << 20
+)
+
+// ScriptSettings configures a Starlark script (https://github.com/bazelbuild/starlark) that transforms requests
+// before they're sent and responses before they're returned, without the round trip of a webhook (see HookSettings).
+//
+// The script defines on_request(req), on_response(req, res) or both. req has the fields method, url, headers, body,
+// profile (read-only), fingerprint and proxy; res has status, headers and body. Headers are a list of (name, value)
+// pairs in the order they're sent, with the helpers header(name), set_header(name, value), add_header(name, value)
+// and remove_header(name). Setting fingerprint or proxy changes the fingerprint and upstream proxy of the request.
+// The json, math and time modules are predeclared.
+//
+// Scripts can't access files or the network. Each call is limited by TimeoutMs and MaxSteps (which also limits how
+// much memory it can build up), and bodies it sets by maxScriptBodyBytes. Errors fail the request they happen in.
+type ScriptSettings struct {
+	// Source is the source of the script. Leave empty to disable it.
+	Source string
+
+	// TimeoutMs is the number of milliseconds a call of the script may take. Defaults to [DefaultScriptTimeoutMs].
+	TimeoutMs int
+
+	// MaxSteps is the number of computation steps a call of the script may take. Defaults to [DefaultScriptMaxSteps].
+	MaxSteps int
+}
+
+func (settings ScriptSettings) timeout() time.Duration {
+	if settings.TimeoutMs == 0 {
+		return DefaultScriptTimeoutMs * time.Millisecond
+	}
+	return time.Duration(settings.TimeoutMs) * time.Millisecond
+}
+
+func (settings ScriptSettings) maxSteps() uint64 {
+	if settings.MaxSteps == 0 {
+		return DefaultScriptMaxSteps
+	}
+	return uint64(settings.MaxSteps)
+}
+
+// script is a compiled script, whose functions can be called concurrently.
+type script struct {
+	settings   ScriptSettings
+	onRequest  starlark.Callable
+	onResponse starlark.Callable
+}
+
+var scriptModules = starlark.StringDict{
+	"json": starjson.Module,
+	"math": starmath.Module,
+	"time": startime.Module,
+}
+
+// compileScript compiles and runs the top level of the script of settings, or returns nil if there's none.
+func compileScript(settings ScriptSettings) (*script, error) {
+	if strings.TrimSpace(settings.Source) == "" {
+		return nil, nil
+	}
+
+	compiled := &script{settings: settings}
+	thread, stop := compiled.thread("load")
+	defer stop()
+
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, "script.star", settings.Source, scriptModules)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	// Frozen values can be shared by the threads of concurrent requests.
+	globals.Freeze()
+
+	for name, callable := range map[string]*starlark.Callable{"on_request": &compiled.onRequest, "on_response": &compiled.onResponse} {
+		value, ok := globals[name]
+		if !ok {
+			continue
+		}
+		if *callable, ok = value.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("%s must be a function, not %s", name, value.Type())
+		}
+	}
+	if compiled.onRequest == nil && compiled.onResponse == nil {
+		return nil, errors.New("the script defines neither on_request nor on_response")
+	}
+
+	return compiled, nil
+}
+
+// thread returns a thread for a call of the script, limited by its settings until stop is called.
+func (s *script) thread(name string) (thread *starlark.Thread, stop func()) {
+	thread = &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			scriptLog.Info(msg, "thread", name)
+		},
+	}
+	thread.SetMaxExecutionSteps(s.settings.maxSteps())
+
+	timeout := s.settings.timeout()
+	timer := time.AfterFunc(timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %s, see Script.TimeoutMs", timeout))
+	})
+	return thread, func() { timer.Stop() }
+}
+
+// call calls fn (one of the script's functions) with args.
+func (s *script) call(fn starlark.Callable, args ...starlark.Value) error {
+	thread, stop := s.thread(fn.Name())
+	defer stop()
+
+	_, err := starlark.Call(thread, fn, args, nil)
+	if err != nil {
+		return scriptError(err)
+	}
+	return nil
+}
+
+// scriptError returns err with the script's backtrace, if it has one.
+func scriptError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return fmt.Errorf("script: %s", evalErr.Backtrace())
+	}
+	return fmt.Errorf("script: %w", err)
+}
+
+// applyToRequest calls on_request with req (and its body) and applies the changes it makes to req and config.
+// It returns the request object for applyToResponse.
+func (s *script) applyToRequest(req *fhttp.Request, config *TransportConfig, profile string) (*scriptMessage, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		setBody(req, body)
+	}
+
+	target := *req.URL
+	target.Scheme = config.Scheme
+	target.Host = config.Host
+	headers := headerFields(req.Header, config.HeaderOrder)
+
+	message := newScriptMessage("request", map[string]starlark.Value{
+		"method":      starlark.String(req.Method),
+		"url":         starlark.String(target.String()),
+		"headers":     scriptHeaders(headers),
+		"body":        starlark.Bytes(body),
+		"profile":     starlark.String(profile),
+		"fingerprint": starlark.String(config.Fingerprint),
+		"proxy":       starlark.String(config.ExternalProxyUrl),
+	}, "profile")
+
+	if s.onRequest == nil {
+		return message, nil
+	}
+	if err := s.call(s.onRequest, message); err != nil {
+		return nil, err
+	}
+
+	req.Method = message.string("method")
+
+	if rawURL := message.string("url"); rawURL != target.String() {
+		changed, err := url.Parse(rawURL)
+		if err != nil || changed.Host == "" || (changed.Scheme != "http" && changed.Scheme != "https") {
+			return nil, fmt.Errorf("script: url '%s' must be an absolute http or https URL", rawURL)
+		}
+		config.Scheme = changed.Scheme
+		config.Host = changed.Host
+		req.Host = changed.Host
+		req.URL = changed
+	}
+
+	changedHeaders, err := message.headers()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(headers, changedHeaders) {
+		req.Header = make(fhttp.Header, len(changedHeaders))
+		config.HeaderOrder = nil
+		for _, header := range changedHeaders {
+			if len(req.Header.Values(header.Name)) == 0 {
+				config.HeaderOrder = append(config.HeaderOrder, strings.ToLower(header.Name))
+			}
+			req.Header.Add(header.Name, header.Value)
+		}
+		// Like hooks, scripts can't add headers that mustn't be sent upstream.
+		removeInternalHeaders(req.Header)
+	}
+
+	if changedBody := message.bytes("body"); !bytes.Equal(changedBody, body) {
+		setBody(req, changedBody)
+	}
+
+	if fingerprint := message.string("fingerprint"); fingerprint != config.Fingerprint {
+		// The script's choice takes precedence over the intercepted fingerprint and the ClientHello of the settings.
+		disabled := false
+		config.Fingerprint = fingerprint
+		config.HexClientHello = ""
+		config.ForceInterceptedFingerprint = &disabled
+	}
+
+	config.ExternalProxyUrl = message.string("proxy")
+
+	return message, nil
+}
+
+// applyToResponse calls on_response with request (see applyToRequest), res and its body, and applies the changes it
+// makes to res and body.
+func (s *script) applyToResponse(request *scriptMessage, res *fhttp.Response, body *[]byte) error {
+	if s.onResponse == nil {
+		return nil
+	}
+
+	request.Freeze()
+	message := newScriptMessage("response", map[string]starlark.Value{
+		"status":  starlark.MakeInt(res.StatusCode),
+		"headers": scriptHeaders(headerFields(res.Header, nil)),
+		"body":    starlark.Bytes(*body),
+	})
+	if err := s.call(s.onResponse, request, message); err != nil {
+		return err
+	}
+
+	status, err := message.int("status")
+	if err != nil {
+		return err
+	}
+	if status < 100 || status > 999 {
+		return fmt.Errorf("script: status %d must be between 100 and 999", status)
+	}
+	res.StatusCode = status
+
+	headers, err := message.headers()
+	if err != nil {
+		return err
+	}
+	for name := range res.Header {
+		delete(res.Header, name)
+	}
+	for _, header := range headers {
+		res.Header.Add(header.Name, header.Value)
+	}
+
+	*body = message.bytes("body")
+	return nil
+}
+
+// scriptHeaders returns headers as a list of (name, value) tuples.
+func scriptHeaders(headers []HeaderField) *starlark.List {
+	elems := make([]starlark.Value, 0, len(headers))
+	for _, header := range headers {
+		elems = append(elems, starlark.Tuple{starlark.String(header.Name), starlark.String(header.Value)})
+	}
+	return starlark.NewList(elems)
+}
+
+// scriptMessage is the request or response a script is called with. Its fields keep their types when assigned,
+// except that strings can be assigned to body.
+type scriptMessage struct {
+	kind     string
+	fields   map[string]starlark.Value
+	readOnly []string
+	frozen   bool
+}
+
+var _ starlark.HasSetField = (*scriptMessage)(nil)
+
+func newScriptMessage(kind string, fields map[string]starlark.Value, readOnly ...string) *scriptMessage {
+	return &scriptMessage{kind: kind, fields: fields, readOnly: readOnly}
+}
+
+func (m *scriptMessage) String() string {
+	return fmt.Sprintf("<%s>", m.kind)
+}
+
+func (m *scriptMessage) Type() string { return m.kind }
+
+func (m *scriptMessage) Freeze() {
+	if m.frozen {
+		return
+	}
+	m.frozen = true
+	for _, value := range m.fields {
+		value.Freeze()
+	}
+}
+
+func (m *scriptMessage) Truth() starlark.Bool { return starlark.True }
+
+func (m *scriptMessage) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", m.kind)
+}
+
+var scriptMessageMethods = map[string]func(m *scriptMessage, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error){
+	"header":        (*scriptMessage).header,
+	"set_header":    (*scriptMessage).setHeader,
+	"add_header":    (*scriptMessage).addHeader,
+	"remove_header": (*scriptMessage).removeHeader,
+}
+
+func (m *scriptMessage) Attr(name string) (starlark.Value, error) {
+	if value, ok := m.fields[name]; ok {
+		return value, nil
+	}
+	if method, ok := scriptMessageMethods[name]; ok {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return method(m, args, kwargs)
+		}).BindReceiver(m), nil
+	}
+	return nil, nil
+}
+
+func (m *scriptMessage) AttrNames() []string {
+	names := make([]string, 0, len(m.fields)+len(scriptMessageMethods))
+	for name := range m.fields {
+		names = append(names, name)
+	}
+	for name := range scriptMessageMethods {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (m *scriptMessage) SetField(name string, value starlark.Value) error {
+	current, ok := m.fields[name]
+	switch {
+	case !ok:
+		return starlark.NoSuchAttrError(fmt.Sprintf("%s has no field %s", m.kind, name))
+	case m.frozen:
+		return fmt.Errorf("cannot set %s.%s after on_request", m.kind, name)
+	case slices.Contains(m.readOnly, name):
+		return fmt.Errorf("%s.%s is read-only", m.kind, name)
+	}
+
+	if text, isString := value.(starlark.String); isString && name == "body" {
+		value = starlark.Bytes(text)
+	}
+	if value.Type() != current.Type() {
+		return fmt.Errorf("%s.%s must be %s, not %s", m.kind, name, current.Type(), value.Type())
+	}
+	if body, isBytes := value.(starlark.Bytes); isBytes && len(body) > maxScriptBodyBytes {
+		return fmt.Errorf("%s.%s must not be longer than %d bytes", m.kind, name, maxScriptBodyBytes)
+	}
+
+	m.fields[name] = value
+	return nil
+}
+
+// header returns the value of the first header named name, or None.
+func (m *scriptMessage) header(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs("header", args, kwargs, "name", &name); err != nil {
+		return nil, err
+	}
+
+	headers, err := m.headers()
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return starlark.String(header.Value), nil
+		}
+	}
+	return starlark.None, nil
+}
+
+// setHeader replaces the headers named name with a single one, in the position of the first.
+func (m *scriptMessage) setHeader(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, value string
+	if err := starlark.UnpackArgs("set_header", args, kwargs, "name", &name, "value", &value); err != nil {
+		return nil, err
+	}
+
+	return starlark.None, m.editHeaders(func(headers []HeaderField) []HeaderField {
+		index := -1
+		var kept []HeaderField
+		for _, header := range headers {
+			if !strings.EqualFold(header.Name, name) {
+				kept = append(kept, header)
+			} else if index == -1 {
+				index = len(kept)
+			}
+		}
+		if index == -1 {
+			return append(kept, HeaderField{Name: name, Value: value})
+		}
+		return append(kept[:index], append([]HeaderField{{Name: name, Value: value}}, kept[index:]...)...)
+	})
+}
+
+// addHeader adds a header after the existing ones.
+func (m *scriptMessage) addHeader(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, value string
+	if err := starlark.UnpackArgs("add_header", args, kwargs, "name", &name, "value", &value); err != nil {
+		return nil, err
+	}
+
+	return starlark.None, m.editHeaders(func(headers []HeaderField) []HeaderField {
+		return append(headers, HeaderField{Name: name, Value: value})
+	})
+}
+
+// removeHeader removes the headers named name.
+func (m *scriptMessage) removeHeader(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs("remove_header", args, kwargs, "name", &name); err != nil {
+		return nil, err
+	}
+
+	return starlark.None, m.editHeaders(func(headers []HeaderField) []HeaderField {
+		var kept []HeaderField
+		for _, header := range headers {
+			if !strings.EqualFold(header.Name, name) {
+				kept = append(kept, header)
+			}
+		}
+		return kept
+	})
+}
+
+func (m *scriptMessage) editHeaders(edit func([]HeaderField) []HeaderField) error {
+	if m.frozen {
+		return fmt.Errorf("cannot change %s.headers after on_request", m.kind)
+	}
+
+	headers, err := m.headers()
+	if err != nil {
+		return err
+	}
+	m.fields["headers"] = scriptHeaders(edit(headers))
+	return nil
+}
+
+// headers returns the headers of the message, checking that they're (name, value) pairs of strings.
+func (m *scriptMessage) headers() ([]HeaderField, error) {
+	// The script may have replaced the list with any other list.
+	list := m.fields["headers"].(*starlark.List)
+	headers := make([]HeaderField, 0, list.Len())
+	for i := range list.Len() {
+		pair, ok := list.Index(i).(starlark.Indexable)
+		if !ok || pair.Len() != 2 {
+			return nil, fmt.Errorf("script: %s.headers[%d] must be a (name, value) pair, not %s", m.kind, i, list.Index(i))
+		}
+		name, nameOk := starlark.AsString(pair.Index(0))
+		value, valueOk := starlark.AsString(pair.Index(1))
+		if !nameOk || !valueOk || name == "" {
+			return nil, fmt.Errorf("script: %s.headers[%d] must be a pair of a name and a value string, not %s", m.kind, i, list.Index(i))
+		}
+		headers = append(headers, HeaderField{Name: name, Value: value})
+	}
+	return headers, nil
+}
+
+// string and bytes return the field name, whose type SetField keeps.
+func (m *scriptMessage) string(name string) string {
+	return string(m.fields[name].(starlark.String))
+}
+
+func (m *scriptMessage) bytes(name string) []byte {
+	return []byte(m.fields[name].(starlark.Bytes))
+}
+
+func (m *scriptMessage) int(name string) (int, error) {
+	value, err := starlark.AsInt32(m.fields[name])
+	if err != nil {
+		return 0, fmt.Errorf("script: %s.%s: %w", m.kind, name, err)
+	}
+	return value, nil
+}
@@ -1,13 +1,30 @@
 package server
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/http2"
+	tls_client "github.com/bogdanfinn/tls-client"
 	utls "github.com/bogdanfinn/utls"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ConfigurationHeaderKey is the name of the header field that contains the RoundTripper configuration.
@@ -15,157 +32,954 @@ import (
 // Unfortunately, this seems to be a limitation of Burp's Extender API.
 const ConfigurationHeaderKey = "Awesometlsconfig"
 
-var (
-	s         *fhttp.Server
-	proxy     *interceptProxy
-	isProxyOn bool
-)
+// TruncatedHeaderKey is the name of the header field that's added to responses whose body was cut off at MaxResponseBytes.
+const TruncatedHeaderKey = "X-Awesometls-Truncated"
+
+// internalHeaderPrefixes are the (canonical) prefixes of headers that are only meaningful between Burp and the spoof server,
+// such as ConfigurationHeaderKey. They're never sent to the destination.
+var internalHeaderPrefixes = []string{"Awesometls", "X-Awesometls"}
+
+// requestIds numbers the requests of the spoof server, for the requestId field of their log records.
+var requestIds atomic.Uint64
+
+// spoof is the spoof server that Burp sends its requests to.
+var spoof = &spoofServer{}
+
+type spoofServer struct {
+	// name is the name of the listener in Settings.Listeners, or empty for the spoof server itself.
+	name string
+
+	mutex     sync.Mutex
+	server    *fhttp.Server
+	addr      string
+	tlsConfig *utls.Config
+	stopped   chan struct{}
+
+	// boundAddr is the address the server actually listens on, which differs from addr if that has port 0.
+	boundAddr net.Addr
+
+	// retiring is the server that rebind moved away from, which keeps serving until the move is committed.
+	retiring *fhttp.Server
+
+	// started is when start was called, or zero if the server isn't running.
+	started time.Time
 
-func init() {
-	s = &fhttp.Server{}
+	// clientCert is the client certificate required when RequireClientCertificate is enabled.
+	clientCert atomic.Pointer[clientCertificate]
+
+	// http2Config is tlsConfig offering HTTP/2, used when SpoofHttp2 is enabled.
+	http2Config atomic.Pointer[utls.Config]
 }
 
+// StartServer starts the spoof server on addr and blocks until StopServer is called.
+// Changing the address with SaveSettings moves the server without returning from StartServer.
+//
+// Settings are first read from the AWESOME_TLS_* environment variables, see settingsEnvironmentVariables.
+// They take precedence over the defaults, but not over the fields passed to SaveSettings.
+// If addr is empty, the SpoofProxyAddress setting is used instead.
 func StartServer(addr string) error {
+	if err := applyEnvironment(); err != nil {
+		return err
+	}
+
+	if addr == "" {
+		addr = state.Load().settings.SpoofProxyAddress
+	}
+
 	if addr == "" {
 		return fmt.Errorf("address must be provided")
 	}
 
-	s = &fhttp.Server{}
+	stopped, err := spoof.start(addr)
+	if err != nil {
+		return err
+	}
+
+	go watchForResume(stopped)
+	go prewarmer.run(stopped)
+	go watchCertificateExpiry(stopped)
+
+	if err := listeners.start(""); err != nil {
+		listenerLog.Error("starting the listeners failed", "error", err)
+	}
+
+	if err := forward.start(); err != nil {
+		forwardLog.Error("start failed", "error", err)
+	}
+
+	if err := socks.start(); err != nil {
+		socksLog.Error("start failed", "error", err)
+	}
+
+	<-stopped
+
+	return nil
+}
+
+func StopServer() error {
+	return errors.Join(listeners.stop(""), forward.stop(), socks.stop(), spoof.stop(), proxies.stop())
+}
+
+// start creates a new certificate authority and starts listening on addr.
+// It returns a channel that's closed once the server is stopped.
+func (s *spoofServer) start(addr string) (chan struct{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server != nil {
+		return nil, fmt.Errorf("spoof server is already running on %s", s.addr)
+	}
 
 	ca, private, err := NewCertificateAuthority()
 	if err != nil {
-		return fmt.Errorf("NewCertificateAuthority, err: %w", err)
+		return nil, fmt.Errorf("NewCertificateAuthority, err: %w", err)
+	}
+
+	s.tlsConfig = &utls.Config{
+		Certificates: []utls.Certificate{
+			{
+				Certificate: [][]byte{ca.Raw},
+				PrivateKey:  private,
+				Leaf:        ca,
+			},
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+
+	clientCert, err := newClientCertificate(s.tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("newClientCertificate, err: %w", err)
+	}
+	s.clientCert.Store(clientCert)
+	s.http2Config.Store(offerHTTP2(s.tlsConfig))
+	s.tlsConfig.GetConfigForClient = s.configForClient
+
+	if err = s.listen(addr); err != nil {
+		return nil, err
+	}
+
+	s.stopped = make(chan struct{})
+	s.started = time.Now()
+
+	return s.stopped, nil
+}
+
+// startListener starts a listener of Settings.Listeners on addr, sharing the TLS configuration of the spoof server.
+func (s *spoofServer) startListener(addr string) error {
+	spoof.mutex.Lock()
+	tlsConfig := spoof.tlsConfig
+	running := spoof.server != nil
+	spoof.mutex.Unlock()
+
+	if !running {
+		return errors.New("spoof server isn't running")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server != nil {
+		return fmt.Errorf("already running on %s", s.addr)
+	}
+
+	s.tlsConfig = tlsConfig
+
+	return s.listen(addr)
+}
+
+// running reports whether the server is listening.
+func (s *spoofServer) running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.server != nil
+}
+
+// startTime returns when the server started, or zero if it isn't running.
+func (s *spoofServer) startTime() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.started
+}
+
+// rebind moves the server to addr, if it's running on a different address. The new listener is started, and the old
+// one keeps serving until commit is called, so rollback can go back to it instead of binding its address again, which
+// another process may have taken meanwhile. Requests in flight on the listener that's closed are allowed to finish.
+func (s *spoofServer) rebind(addr string) (commit, rollback func(), err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server == nil || s.addr == addr {
+		return func() {}, func() {}, nil
+	}
+
+	previous, previousAddr, previousBoundAddr := s.server, s.addr, s.boundAddr
+	if err := s.listen(addr); err != nil {
+		return nil, nil, err
+	}
+	next := s.server
+	s.retiring = previous
+
+	// Once the server was stopped, or moved again, neither has anything left to do.
+	commit = func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.retiring == previous {
+			s.retiring = nil
+			shutdownInBackground(previous)
+		}
+	}
+	rollback = func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.retiring == previous && s.server == next {
+			s.retiring = nil
+			s.server, s.addr, s.boundAddr = previous, previousAddr, previousBoundAddr
+			shutdownInBackground(next)
+		}
+	}
+	return commit, rollback, nil
+}
+
+// shutdownInBackground closes the listener of server, and lets its requests in flight finish.
+func shutdownInBackground(server *fhttp.Server) {
+	go func() {
+		defer recoverPanic(spoofLog, "shutdown")
+
+		if err := server.Shutdown(context.Background()); err != nil {
+			spoofLog.Warn("shutdown of the previous listener failed", "error", err)
+		}
+	}()
+}
+
+// listen starts serving on addr. The caller must hold the mutex.
+// Pipe addresses (see pipeAddressPrefix) are served without TLS, since they never leave the machine.
+func (s *spoofServer) listen(addr string) error {
+	listener, err := listenAddress(addr)
+	if err != nil {
+		return fmt.Errorf("listen, err: %w", err)
+	}
+
+	name := "spoof server"
+	if s.name != "" {
+		name = "listener " + s.name
+	}
+	listener = limitConnections(supervise(name, addr, listener))
+
+	server := &fhttp.Server{
+		Addr:      addr,
+		Handler:   fhttp.HandlerFunc(s.handle),
+		ConnState: trackConnState,
+	}
+
+	if _, ok := pipeName(addr); !ok {
+		listener = utls.NewListener(listener, s.tlsConfig)
+
+		// The server speaks HTTP/2 on connections that negotiated it, which they only can if SpoofHttp2 is enabled
+		// (see configForClient). It doesn't report their state, so they're never closed for being idle.
+		if err := http2.ConfigureServer(server, nil); err != nil {
+			listener.Close()
+			return fmt.Errorf("configure HTTP/2, err: %w", err)
+		}
+		serveHTTP2 := server.TLSNextProto[http2.NextProtoTLS]
+		server.TLSNextProto[http2.NextProtoTLS] = func(server *fhttp.Server, conn *utls.Conn, handler fhttp.Handler) {
+			clientConnections.connState(conn, fhttp.StateActive)
+			serveHTTP2(server, conn, handler)
+		}
+	}
+
+	go func() {
+		defer recoverPanic(spoofLog, "serve")
+
+		if err := server.Serve(listener); err != nil && !errors.Is(err, fhttp.ErrServerClosed) {
+			spoofLog.Error("serve failed", "error", err)
+		}
+	}()
+
+	s.server = server
+	s.addr = addr
+	s.boundAddr = listener.Addr()
+
+	return nil
+}
+
+// GetListenAddress returns the address the spoof server listens on, or an empty string if it isn't running.
+// If SpoofProxyAddress has port 0, this is the port that was chosen when the server started.
+// Unspecified IPs (e.g. when listening on ":0") are replaced with the loopback address, so the result can be dialed.
+// Pipe addresses are returned as configured.
+func GetListenAddress() string {
+	return spoof.listenAddr()
+}
+
+// listenAddr returns the dialable address the server listens on, or an empty string if it isn't running.
+func (s *spoofServer) listenAddr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server == nil {
+		return ""
+	}
+
+	if _, ok := pipeName(s.addr); ok {
+		return s.addr
+	}
+
+	return dialableAddr(s.boundAddr)
+}
+
+// dialableAddr returns addr, with an unspecified IP replaced by the loopback address.
+func dialableAddr(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(tcpAddr.Port))
+	}
+
+	return tcpAddr.String()
+}
+
+func (s *spoofServer) stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+
+	err := s.server.Shutdown(context.Background())
+	if s.retiring != nil {
+		err = errors.Join(err, s.retiring.Shutdown(context.Background()))
+		s.retiring = nil
+	}
+
+	s.server = nil
+	s.addr = ""
+	s.boundAddr = nil
+	s.started = time.Time{}
+	s.clientCert.Store(nil)
+	s.http2Config.Store(nil)
+	if s.stopped != nil {
+		close(s.stopped)
+		s.stopped = nil
 	}
 
-	m := fhttp.NewServeMux()
-	m.HandleFunc("/", func(w fhttp.ResponseWriter, req *fhttp.Request) {
-		configHeader := req.Header.Get(ConfigurationHeaderKey)
-		req.Header.Del(ConfigurationHeaderKey)
+	return err
+}
+
+// handle sends a request from Burp to its destination, using the state that's current when the request arrives.
+// Requests to a listener of Settings.Listeners start from that listener's configuration instead of the saved settings.
+func (s *spoofServer) handle(w fhttp.ResponseWriter, req *fhttp.Request) {
+	defer recoverHandler(w, spoofLog)
 
-		config, err := ParseTransportConfig(configHeader)
+	current := state.Load()
+	defaults := current.defaultsFor(s.name)
+
+	// The header is removed in every mode, along with any other internal header, so it's never sent to the destination.
+	configHeader := req.Header.Get(ConfigurationHeaderKey)
+	removeInternalHeaders(req.Header)
+	removeInternalTrailers(req)
+
+	if configHeader == "" && current.settings.ConfigurationMode != ConfigurationModeHeader {
+		var err error
+		var spooled *replayableBody
+		configHeader, spooled, err = takeRegisteredConfig(req)
+		defer spooled.release()
 		if err != nil {
-			writeError(w, err)
+			writeError(w, spoofLog, nil, withCode(ErrorConfigInvalid, err))
 			return
 		}
+	}
 
-		if !isProxyOn && config.UseInterceptedFingerprint {
-			if err = StartProxy(config.InterceptProxyAddr, config.BurpAddr); err != nil {
-				writeError(w, err)
-				return
-			}
-			isProxyOn = true
-		} else if isProxyOn && !config.UseInterceptedFingerprint {
-			if err = StopProxy(); err != nil {
-				writeError(w, err)
+	var config *TransportConfig
+	if configHeader == "" {
+		config = fallbackTransportConfig(defaults, req)
+		if localAddr, ok := req.Context().Value(fhttp.LocalAddrContextKey).(net.Addr); config.Host == "" || ok && loopsBack(req.Context(), config, req, localAddr) {
+			writeError(w, spoofLog, nil, withCode(ErrorConfigInvalid, errors.New("missing transport configuration and no destination to fall back to")))
+			return
+		}
+		spoofLog.Debug("request has no transport configuration, using the saved settings", "host", config.Host)
+	} else {
+		var err error
+		if config, err = current.configs.parse(s.name, configHeader, defaults); err != nil {
+			writeConfigurationError(w, err)
+			return
+		}
+	}
+
+	current.send(w, req, defaults, config)
+}
+
+// send sends req to the destination of config and writes the response to w.
+// defaults is the configuration config started from, before the request's own configuration was applied.
+func (current *transportState) send(w fhttp.ResponseWriter, req *fhttp.Request, defaults TransportConfig, config *TransportConfig) {
+	name, port := destination(config, req)
+	requestId := requestIds.Add(1)
+	config.TraceId = cmp.Or(config.TraceId, newTraceId())
+	requestLog := spoofLog.With("requestId", requestId, "traceId", config.TraceId, "host", captureKey(name, port))
+	w.Header().Set(TraceIdHeaderKey, config.TraceId)
+
+	outcome := outcomeError
+	started := time.Now()
+	done := startRequestMetrics(name, current.settings.MetricsHostBuckets, config.TraceId)
+	defer func() {
+		done(outcome)
+		requestLog.Debug("request done", "outcome", outcome, "durationMs", time.Since(started).Milliseconds())
+	}()
+
+	// capture records the connection of the request if it set TransportConfig.Capture. It's kept with the protocol of
+	// the response and the error the request failed with.
+	var capture *wireCapture
+	var protocol string
+	var requestErr error
+
+	// fail responds with err, which is reported along with the request's destination and how long it took.
+	fail := func(err error) {
+		requestErr = err
+		fields := map[string]string{"requestId": strconv.FormatUint(requestId, 10), "traceId": config.TraceId, "host": captureKey(name, port)}
+		writeError(w, requestLog.With("durationMs", time.Since(started).Milliseconds()), fields, err)
+	}
+
+	// A panic while handling the request fails it with ErrorInternal, rather than taking down the process Burp runs
+	// the server in. Once the response is being written, it can only be cut short.
+	writing := false
+	defer func() {
+		if r := recover(); r != nil {
+			err := recovered(requestLog, "request", r)
+			outcome = outcomeError
+			if writing {
+				recentErrors.addRequest(err, ErrorInternal, captureKey(name, port), config.TraceId)
 				return
 			}
-			isProxyOn = false
+			fail(err)
+		}
+	}()
+
+	if err := current.settings.applyProfile(config, name); err != nil {
+		fail(withCode(ErrorConfigInvalid, err))
+		return
+	}
+
+	// The script can change the destination, so it's only known once the script returns.
+	var scripted *scriptMessage
+	if current.script != nil {
+		var err error
+		if scripted, err = current.script.applyToRequest(req, config, current.settings.profileFor(config, name)); err != nil {
+			fail(withCode(ErrorHookFailed, err))
+			return
+		}
+		if scriptedName, scriptedPort := destination(config, req); scriptedName != name || scriptedPort != port {
+			name, port = scriptedName, scriptedPort
+			requestLog = spoofLog.With("requestId", requestId, "traceId", config.TraceId, "host", captureKey(name, port))
 		}
+	}
 
-		if proxy != nil {
-			if interceptedFingerprint := proxy.getTLSFingerprint(); interceptedFingerprint != "" && config.UseInterceptedFingerprint {
-				config.HexClientHello = HexClientHello(interceptedFingerprint)
+	intercepted := false
+	bypass := matchBypassHost(current.settings.BypassHosts, name)
+	if bypass {
+		requestLog.Debug("host matches BypassHosts, sending the request without a spoofed fingerprint")
+	} else if config.useInterceptedFingerprint(name) {
+		if captured, key, stale := captures.lookup(name, port, config.InterceptedFingerprintDefault); captured != nil {
+			if stale {
+				requestLog.Warn("intercepted fingerprint may be outdated, consider capturing it again", "fingerprint", key, "capturedAt", captured.CapturedAt)
 			}
+			requestLog.Debug("using intercepted fingerprint", "fingerprint", key)
+			// The captured ClientHello is replayed as-is, including its ALPN list, and the request is sent with the
+			// protocol the destination picks from it: HTTP/1.1 if the list doesn't offer h2 (or offers no protocol).
+			// So is the one captured after a HelloRetryRequest, if the destination sends one too.
+			config.useCapture(captured)
+			captured.uses.Add(1)
+			intercepted = true
+		} else {
+			requestLog.Debug("no intercepted fingerprint matched, using the configured fingerprint")
 		}
+	}
 
-		client, err := NewClient(config)
-		if err != nil {
-			writeError(w, err)
-			return
+	if config.ExternalProxyUrl != defaults.ExternalProxyUrl && logEnabled(slog.LevelDebug) {
+		if proxyURL, err := parseUpstreamProxyUrl(config.ExternalProxyUrl); err == nil {
+			requestLog.Debug("using upstream proxy", "proxy", proxyURL.Redacted())
+		}
+	}
+
+	var client requestDoer
+	var err error
+	switch {
+	case bypass:
+		if config.Capture {
+			requestLog.Debug("requests to BypassHosts aren't captured")
 		}
+		client, err = current.bypassClientFor(config)
+	case config.Capture:
+		// The request gets a client of its own, so that its connection isn't shared with (or reused from) others.
+		capture = newWireCapture(requestId, captureKey(name, port), config, current.settings.WireCapture)
+		var captured tls_client.HttpClient
+		if captured, err = newClient(config, capture); err == nil {
+			client = captured
+			w.Header().Set(RequestIdHeaderKey, strconv.FormatUint(requestId, 10))
+			defer func() {
+				captured.CloseIdleConnections()
+				capture.finish(protocol, requestErr)
+			}()
+		}
+	default:
+		client, err = current.clientFor(config)
+	}
+	if err != nil {
+		fail(withCode(ErrorConfigInvalid, err))
+		return
+	}
+	fingerprintRequests.WithLabelValues(fingerprintLabel(config, bypass, intercepted)).Inc()
 
-		req.URL.Host = config.Host
-		req.URL.Scheme = config.Scheme
-		req.RequestURI = ""
-		req.Header[fhttp.HeaderOrderKey] = config.HeaderOrder
-		// The content-length header is already set by the client (internally).
-		// Leaving it here causes strange '400 bad request' errors from the destination, so we remove it.
-		req.Header.Del("Content-Length")
+	req.URL.Host = config.Host
+	req.URL.Scheme = config.Scheme
+	req.RequestURI = ""
+	// Like the Connection header, a client closing its connection to us (e.g. Intruder with "Connection: close")
+	// is hop-by-hop. Passing it on would make the client close the connection to the destination after each
+	// request, instead of reusing it (or multiplexing the requests on it with HTTP/2).
+	req.Close = false
+	headerOrder, pseudoHeaderOrder := splitPseudoHeaders(config.HeaderOrder)
+	req.Header[fhttp.HeaderOrderKey] = headerOrder
+	// Pseudo-headers in the order (like in the one of a captured client) replace the order of the HTTP/2 fingerprint.
+	if len(pseudoHeaderOrder) > 0 {
+		req.Header[fhttp.PHeaderOrderKey] = pseudoHeaderOrder
+	}
+	// The content-length header is already set by the client (internally).
+	// Leaving it here causes strange '400 bad request' errors from the destination, so we remove it.
+	req.Header.Del("Content-Length")
+	// The negotiated protocol depends on the fingerprint's ALPN list, so hop-by-hop headers
+	// (which HTTP/2 doesn't allow) are never forwarded.
+	removeHopByHopHeaders(req.Header)
 
-		res, err := client.Do(req)
-		if err != nil {
-			writeError(w, err)
+	// Nothing above adds internal headers. If one shows up anyway, it's a bug that would leak it to the destination.
+	if leaked := append(removeInternalHeaders(req.Header), removeInternalHeaders(req.Trailer)...); len(leaked) > 0 {
+		requestLog.Error("BUG: internal headers were about to be sent and have been removed, please report this", "headers", leaked)
+	}
+
+	// The body is streamed to the destination, except for hooked requests: hooks get the whole body and can replace
+	// it, so it's buffered. Recorded and mirrored requests keep the start of their body as it's streamed.
+	recording := recorder.recording(name)
+	mirroring := mirror.mirroring(name)
+	hooks := current.settings.Hooks
+	hooked := hooks.hookFor(hooks.RequestUrl, name) != "" || hooks.hookFor(hooks.ResponseUrl, name) != ""
+	var reqBody []byte
+	var tap *bodyTap
+	trace := &harTrace{}
+	if hooked && hasBody(req) {
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			fail(err)
 			return
 		}
+		req.Body.Close()
+		setBody(req, reqBody)
+	} else if (recording != nil || mirroring != nil) && hasBody(req) {
+		tap = tapBody(req, tapLimit(recording, mirroring))
+	}
 
-		defer res.Body.Close()
+	hookedRequest, err := hooks.applyRequestHook(req, &reqBody, current.settings.profileFor(config, name), name, captureKey(name, port))
+	if err != nil {
+		fail(withCode(ErrorHookFailed, err))
+		return
+	}
 
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			writeError(w, err)
+	if recording != nil || mirroring != nil {
+		req = req.WithContext(withHarTrace(req.Context(), trace))
+	}
+
+	// The host's slot is held until the response is written, so MaxConcurrentRequestsPerHost also caps the connections
+	// to a destination busy with response bodies. The total slot is released once the response headers arrived.
+	slots, err := limiter.acquire(req.Context(), name)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer slots.release()
+
+	res, timer, err := doWithRetries(client, req, config, current.settings.RetryPolicy.effective(), requestLog)
+	slots.releaseTotal()
+	if err != nil {
+		outcome = requestOutcome(err)
+		fail(err)
+		return
+	}
+	responded := time.Now()
+	prewarmer.touch(current, config, name, port, bypass, req.Header.Get("User-Agent"))
+
+	if duration, ok := timer.handshakeDuration(); ok {
+		handshakeDuration.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": config.TraceId})
+		requestLog.Log(req.Context(), levelTrace, "TLS handshake done", "durationMs", duration.Milliseconds())
+	}
+
+	defer timer.cancel()
+
+	defer res.Body.Close()
+
+	var negotiated NegotiatedTLS
+	if config.ReportTls || logEnabled(slog.LevelDebug) {
+		negotiated = timer.negotiated()
+	}
+	requestLog.Debug("negotiated protocol", "protocol", res.Proto, "tls", negotiated)
+	protocol = res.Proto
+
+	limit := config.maxResponseBytes()
+	var reader io.Reader = &idleReader{Reader: res.Body, timer: timer}
+	if limit > 0 {
+		reader = io.LimitReader(reader, limit+1)
+	}
+
+	// The body is read into a pooled buffer, which is reused once the response is written. Mirrored records refer
+	// to the body until they're written in the background, so their buffers aren't reused.
+	buf := getBodyBuffer()
+	defer func() {
+		if mirroring == nil {
+			putBodyBuffer(buf)
+		}
+	}()
+	_, err = buf.ReadFrom(reader)
+	body := buf.Bytes()
+	received := time.Now()
+	timer.stop()
+	if err != nil {
+		err = timer.wrap(err)
+		outcome = requestOutcome(err)
+		fail(withCode(stageErrorCode(err, timer.current()), err))
+		return
+	}
+
+	truncated := limit > 0 && int64(len(body)) > limit
+	if truncated {
+		body = body[:limit]
+		// Canceling the request stops the transfer, and the connection is closed instead of being reused.
+		timer.cancel()
+		requestLog.Warn("response exceeded MaxResponseBytes and was truncated", "maxResponseBytes", limit)
+	}
+
+	reqBodySize := int64(len(reqBody))
+	if tap != nil {
+		reqBody, reqBodySize = tap.body()
+	}
+	if recording != nil {
+		recorder.add(newHarEntry(recording, trace, timer, req, reqBody, reqBodySize, res, body, responded, received))
+	}
+	if mirroring != nil {
+		mirror.add(newMirrorRecord(mirroring, trace, req, reqBody, res, body))
+	}
+	timings := requestTimingsOf(timer, responded, received)
+	timings.observe(config.TraceId)
+
+	if err = hooks.applyResponseHook(hookedRequest, res, &body, name, captureKey(name, port)); err != nil {
+		fail(withCode(ErrorHookFailed, err))
+		return
+	}
+	if scripted != nil {
+		if err = current.script.applyToResponse(scripted, res, &body); err != nil {
+			fail(withCode(ErrorHookFailed, err))
 			return
 		}
+	}
+
+	// Write the response (back to burp).
+	removeHopByHopHeaders(res.Header)
+	for k := range res.Header {
+		vv := res.Header.Values(k)
+		for _, v := range vv {
+			// The response body is already automatically decompressed, so we need to update the Content-Length header accordingly.
+			// Not doing so will cause the response writer to return an error.
+			if k == "Content-Length" {
+				w.Header().Add(k, strconv.Itoa(len(body)))
+			} else {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	outcome = outcomeSuccess
+	if truncated {
+		outcome = outcomeTruncated
+		w.Header().Set(TruncatedHeaderKey, "true")
+		w.Header().Set(ErrorCodeHeaderKey, ErrorBodyTooLarge)
+	}
+	if config.ReportTimings {
+		w.Header().Set(TimingsHeaderKey, timings.header())
+	}
+	if config.ReportTls {
+		w.Header().Set(TlsHeaderKey, negotiated.header())
+	}
+	writing = true
+	w.WriteHeader(res.StatusCode)
+	w.Write(body)
+}
+
+// takeRegisteredConfig returns the configuration registered for req with RegisterTransportConfig, if any.
+// The body of req is read to identify it into a replayableBody, whose spool keeps no more than maxSpooledMemoryBytes
+// of it in memory, and replaced with a reader of the spool. The caller must release the spool once the request is done.
+func takeRegisteredConfig(req *fhttp.Request) (string, *replayableBody, error) {
+	hash := requestHash(req.Method, req.RequestURI)
+	var spooled *replayableBody
+	if hasBody(req) {
+		spooled = newReplayableBody(req.Body)
+		body, _ := spooled.reader(false)
+		if _, err := io.Copy(hash, body); err != nil {
+			return "", spooled, err
+		}
+		if !spooled.replayable() {
+			return "", spooled, errors.New("spooling the request body failed")
+		}
+		req.Body.Close()
+		req.Body, _ = spooled.reader(false)
+	}
+
+	// Requests the extension registered arrive the way it saw them, so one that doesn't match was changed on the way
+	// (e.g. by another extension) or arrived too late. It falls back to the saved settings, which it may not be meant
+	// to be sent with.
+	config, ok := registeredConfigs.take(hex.EncodeToString(hash.Sum(nil)))
+	if !ok {
+		spoofLog.Error("no transport configuration was registered for the request, it was changed after it was registered or arrived too late",
+			"method", req.Method, "host", req.Host, "waiting", registeredConfigs.len())
+	}
 
-		// Write the response (back to burp).
-		for k := range res.Header {
-			vv := res.Header.Values(k)
-			for _, v := range vv {
-				// The response body is already automatically decompressed, so we need to update the Content-Length header accordingly.
-				// Not doing so will cause the response writer to return an error.
-				if k == "Content-Length" {
-					w.Header().Add(k, fmt.Sprintf("%d", len(body)))
-				} else {
-					w.Header().Add(k, v)
+	return config, spooled, nil
+}
+
+// fallbackTransportConfig is the configuration of requests that reach the spoof server without a ConfigurationHeaderKey header
+// or a registered configuration (e.g. because another extension removed the header or changed the request). They use the saved settings and are sent to the host from their Host header,
+// or the server name they connected with if that's missing. The scheme is always HTTPS, because that's what Burp uses
+// to reach the spoof server.
+func fallbackTransportConfig(defaults TransportConfig, req *fhttp.Request) *TransportConfig {
+	config := &defaults
+	config.Scheme = "https"
+	config.Host = req.Host
+
+	if config.Host == "" && req.TLS != nil {
+		config.Host = req.TLS.ServerName
+	}
+
+	return config
+}
+
+// loopsBack reports whether the destination of config is the listener at localAddr that req arrived on, whatever
+// name or address the destination is given by, so sending req there would make it arrive again. Any address of this
+// machine on the listener's port counts, since the listener may be bound to all of them.
+func loopsBack(ctx context.Context, config *TransportConfig, req *fhttp.Request, localAddr net.Addr) bool {
+	tcpAddr, ok := localAddr.(*net.TCPAddr)
+	if !ok {
+		return config.Host == localAddr.String()
+	}
+
+	host, port := destination(config, req)
+	if port != strconv.Itoa(tcpAddr.Port) {
+		return false
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = dnsCache.lookup(ctx, "ip", host); err != nil {
+		// The destination can't be dialed either, which the request reports.
+		return false
+	}
+
+	local, _ := netip.AddrFromSlice(tcpAddr.IP)
+	var machine []net.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr == local.Unmap() || addr.IsLoopback() || addr.IsUnspecified() {
+			return true
+		}
+		if machine == nil {
+			machine, _ = net.InterfaceAddrs()
+		}
+		for _, machineAddr := range machine {
+			if ipNet, ok := machineAddr.(*net.IPNet); ok {
+				if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+					return true
 				}
 			}
 		}
-		w.WriteHeader(res.StatusCode)
-		w.Write(body)
-	})
+	}
 
-	s.Addr = addr
-	s.Handler = m
-	s.TLSConfig = &utls.Config{
-		Certificates: []utls.Certificate{
-			{
-				Certificate: [][]byte{ca.Raw},
-				PrivateKey:  private,
-				Leaf:        ca,
-			},
-		},
-		NextProtos: []string{"http/1.1"},
+	return false
+}
+
+// splitPseudoHeaders splits the HTTP/2 pseudo-headers (like ":method") from the other headers of a header order.
+func splitPseudoHeaders(order []string) (headers, pseudoHeaders []string) {
+	if !slices.ContainsFunc(order, isPseudoHeader) {
+		return order, nil
 	}
 
-	listener, err := net.Listen("tcp", s.Addr)
-	if err != nil {
-		return fmt.Errorf("listen, err: %w", err)
+	for _, name := range order {
+		if isPseudoHeader(name) {
+			pseudoHeaders = append(pseudoHeaders, name)
+		} else {
+			headers = append(headers, name)
+		}
 	}
+	return headers, pseudoHeaders
+}
 
-	tlsListener := utls.NewListener(listener, s.TLSConfig)
+func isPseudoHeader(name string) bool {
+	return strings.HasPrefix(name, ":")
+}
 
-	if err := s.Serve(tlsListener); err != nil {
-		return fmt.Errorf("serve, err: %w", err)
+// destination returns the hostname and port of the destination server.
+// Burp usually only sends the hostname in the configuration,
+// so we check the Host header for a port before falling back to the scheme's default port.
+func destination(config *TransportConfig, req *fhttp.Request) (string, string) {
+	if host, port, err := net.SplitHostPort(config.Host); err == nil {
+		return host, port
 	}
 
-	return nil
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		return config.Host, port
+	}
+
+	if config.Scheme == "http" {
+		return config.Host, "80"
+	}
+
+	return config.Host, "443"
 }
 
-func StartProxy(interceptAddr, burpAddr string) (err error) {
-	p, err := newInterceptProxy(interceptAddr, burpAddr)
-	if err != nil {
-		return err
+// setBody replaces the body of req with body. The transport can send it again (see fhttp.Request.GetBody),
+// e.g. when an HTTP/2 connection is shut down with GOAWAY before the destination processed the request.
+func setBody(req *fhttp.Request, body []byte) {
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = fhttp.NoBody
+		req.GetBody = func() (io.ReadCloser, error) { return fhttp.NoBody, nil }
+		return
 	}
 
-	proxy = p
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
 
-	go proxy.Start()
+// hopByHopHeaders are only meaningful for a single HTTP/1.1 connection, see RFC 9110, Section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	return nil
+// removeHopByHopHeaders removes the hop-by-hop headers from h, including the ones listed in its Connection header.
+func removeHopByHopHeaders(h fhttp.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
 }
 
-func StopProxy() (err error) {
-	if proxy == nil {
-		return nil
+// removeInternalHeaders removes the headers starting with one of internalHeaderPrefixes from h, and returns their names.
+func removeInternalHeaders(h fhttp.Header) []string {
+	var removed []string
+
+	for name := range h {
+		for _, prefix := range internalHeaderPrefixes {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				removed = append(removed, name)
+				delete(h, name)
+				break
+			}
+		}
 	}
-	return proxy.Stop()
+
+	return removed
 }
 
-func StopServer() error {
-	return s.Shutdown(context.Background())
+// removeInternalTrailers removes the internal trailers of req (see removeInternalHeaders), those it declared and those
+// that arrive after its body. The trailers are only read along with the end of the body, into the map the destination
+// is sent them from, so they're removed again once the body has been read.
+func removeInternalTrailers(req *fhttp.Request) {
+	removeInternalHeaders(req.Trailer)
+	if hasBody(req) {
+		req.Body = &trailerFilter{ReadCloser: req.Body, req: req}
+	}
 }
 
-func writeError(w fhttp.ResponseWriter, err error) {
+// trailerFilter removes the internal trailers of req once its body, which it reads, ends.
+type trailerFilter struct {
+	io.ReadCloser
+	req *fhttp.Request
+}
+
+func (f *trailerFilter) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if err == io.EOF {
+		removeInternalHeaders(f.req.Trailer)
+	}
+	return n, err
+}
+
+// writeConfigurationError responds to a request whose ConfigurationHeaderKey header can't be parsed.
+// The response body is a JSON object naming the problem, and the offset in the header at which it was found if known.
+func writeConfigurationError(w fhttp.ResponseWriter, err error) {
+	response := struct {
+		Error  string
+		Code   string
+		Header string
+		Offset int64 `json:",omitempty"`
+	}{
+		Error:  fmt.Sprintf("Awesome TLS error: invalid %s header: %s", ConfigurationHeaderKey, err),
+		Code:   ErrorConfigInvalid,
+		Header: ConfigurationHeaderKey,
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		response.Offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		response.Offset = typeErr.Offset
+	}
+
+	body, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ErrorCodeHeaderKey, ErrorConfigInvalid)
+	w.WriteHeader(fhttp.StatusBadRequest)
+	w.Write(body)
+	reportFailure(spoofLog, nil, ErrorConfigInvalid, fmt.Errorf("invalid %s header: %w", ConfigurationHeaderKey, err))
+}
+
+// writeError responds to a request that failed with err, naming the code of the error in the ErrorCodeHeaderKey
+// header, and reports it with reportFailure.
+func writeError(w fhttp.ResponseWriter, requestLog *slog.Logger, fields map[string]string, err error) {
+	code := errorCode(err)
+	recentErrors.addRequest(err, code, fields["host"], fields["traceId"])
+	w.Header().Set(ErrorCodeHeaderKey, code)
 	w.WriteHeader(500)
 	fmt.Fprint(w, fmt.Errorf("Awesome TLS error: %s", err))
-	fmt.Println(err)
+	reportFailure(requestLog, fields, code, err)
+}
+
+// reportFailure logs the failure of a request with requestLog, and publishes it as an EventRequestFailed event along
+// with fields identifying the request, if any.
+func reportFailure(requestLog *slog.Logger, fields map[string]string, code string, err error) {
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		requestLog = requestLog.With("handshake", handshakeErr.Diagnostics)
+	}
+	requestLog.Warn("request failed", "code", code, "error", err)
+
+	event := map[string]string{"code": code, "error": currentRedactor().text(err.Error())}
+	if handshakeErr != nil {
+		event["handshake"] = handshakeErr.Diagnostics.String()
+	}
+	maps.Copy(event, fields)
+	publishEvent(EventRequestFailed, event)
 }
@@ -0,0 +1,739 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	utls "github.com/bogdanfinn/utls"
+)
+
+// countingClient returns a client of the spoof server, with at most conns connections, that counts its dials in
+// dials. h2 makes it negotiate HTTP/2.
+func countingClient(conns int, h2 bool, dials *atomic.Int64) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		MaxConnsPerHost:     conns,
+		MaxIdleConnsPerHost: conns,
+		ForceAttemptHTTP2:   h2,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	if !h2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+// countConnections samples the client connections of the spoof server until the returned function is called, which
+// returns the most that were open above the ones open before.
+func countConnections() func() int64 {
+	baseline := activeConnections.Load()
+	var peak atomic.Int64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			if open := activeConnections.Load() - baseline; open > peak.Load() {
+				peak.Store(open)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	return func() int64 {
+		close(done)
+		<-stopped
+		return peak.Load()
+	}
+}
+
+// mixedOrigin replies to the requests of mixedRequest.
+func mixedOrigin(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/no-content":
+		w.WriteHeader(http.StatusNoContent)
+	case "/not-modified":
+		w.WriteHeader(http.StatusNotModified)
+	case "/chunked":
+		for i := range 3 {
+			fmt.Fprintf(w, "chunk %d.", i)
+			w.(http.Flusher).Flush()
+		}
+	case "/close":
+		w.Header().Set("Connection", "close")
+		fmt.Fprint(w, "closed")
+	case "/large":
+		w.Write([]byte(strings.Repeat("x", 256<<10)))
+	default:
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s %s", req.Method, body)
+	}
+}
+
+// mixedRequest is the i-th request of TestKeepAlive to one of origins, along with the status and body it's answered
+// with. The origins alternate, except that connections are closed by the last one, which mustn't speak HTTP/2: it
+// would send GOAWAY to the streams of other requests instead.
+func mixedRequest(t *testing.T, spoofAddr string, origins []*httptest.Server, i int) (*http.Request, int, string) {
+	origin := origins[i%len(origins)]
+	if i%8 == 6 {
+		origin = origins[len(origins)-1]
+	}
+	config := testConfig(origin, nil)
+	method, path, body := http.MethodGet, "/", ""
+	status, want := http.StatusOK, "GET "
+
+	switch i % 8 {
+	case 1:
+		method, want = http.MethodHead, ""
+	case 2:
+		method, body, want = http.MethodPost, fmt.Sprintf("body %d", i), fmt.Sprintf("POST body %d", i)
+	case 3:
+		path, status, want = "/no-content", http.StatusNoContent, ""
+	case 4:
+		path, status, want = "/not-modified", http.StatusNotModified, ""
+	case 5:
+		path, want = "/chunked", "chunk 0.chunk 1.chunk 2."
+	case 6:
+		path, want = "/close", "closed"
+	case 7:
+		if i%16 == 7 {
+			config, status, want = "{not json", http.StatusBadRequest, ""
+		} else {
+			path, want = "/large", strings.Repeat("x", 256<<10)
+		}
+	}
+
+	req, err := http.NewRequest(method, "https://"+spoofAddr+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = strings.TrimPrefix(origin.URL, "https://")
+	req.Header.Set(ConfigurationHeaderKey, config)
+	return req, status, want
+}
+
+func TestKeepAlive(t *testing.T) {
+	spoofAddr := startSpoofServer(t)
+	origins := []*httptest.Server{newTestOrigin(t, mixedOrigin), httptest.NewTLSServer(http.HandlerFunc(mixedOrigin))}
+	t.Cleanup(origins[1].Close)
+
+	const requests, conns = 1000, 4
+	var dials atomic.Int64
+	client := countingClient(conns, false, &dials)
+	defer client.CloseIdleConnections()
+	peak := countConnections()
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range conns {
+		wg.Go(func() {
+			for i := int(next.Add(1)) - 1; i < requests; i = int(next.Add(1)) - 1 {
+				req, status, want := mixedRequest(t, spoofAddr, origins, i)
+				res, err := client.Do(req)
+				if err != nil {
+					t.Errorf("request %d: %s", i, err)
+					return
+				}
+				body, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				if err != nil {
+					t.Errorf("request %d: %s", i, err)
+					return
+				}
+				if res.StatusCode != status || status != http.StatusBadRequest && string(body) != want {
+					t.Errorf("request %d %s %s: got %d %.200q, want %d %.40q", i, req.Method, req.URL.Path, res.StatusCode, body, status, want)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := dials.Load(); got != conns {
+		t.Errorf("%d requests dialed the spoof server %d times, want %d", requests, got, conns)
+	}
+	if got := peak(); got > conns {
+		t.Errorf("the spoof server had %d more connections open, want at most %d", got, conns)
+	}
+}
+
+func TestKeepAlivePipelinedConfigurations(t *testing.T) {
+	spoofAddr := startSpoofServer(t)
+	origins := make([]*httptest.Server, 3)
+	for i := range origins {
+		origins[i] = newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "origin %d %s", i, req.URL.Path)
+		})
+	}
+
+	conn, err := tls.Dial("tcp", spoofAddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The requests are written at once, before any response is read.
+	var pipelined strings.Builder
+	for i := range 9 {
+		origin := origins[i%len(origins)]
+		fmt.Fprintf(&pipelined, "GET /%d HTTP/1.1\r\nHost: %s\r\n%s: %s\r\n\r\n",
+			i, strings.TrimPrefix(origin.URL, "https://"), ConfigurationHeaderKey, testConfig(origin, nil))
+	}
+	if _, err := io.WriteString(conn, pipelined.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for i := range 9 {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err)
+		}
+		if want := fmt.Sprintf("origin %d /%d", i%len(origins), i); string(body) != want {
+			t.Errorf("response %d: got %q, want %q", i, body, want)
+		}
+	}
+}
+
+func TestKeepAliveHTTP2(t *testing.T) {
+	saveTestSettings(t, `{"SpoofHttp2":true}`)
+	spoofAddr := startSpoofServer(t)
+	origins := []*httptest.Server{newTestOrigin(t, mixedOrigin), newTestOrigin(t, mixedOrigin)}
+
+	const requests = 500
+	var dials atomic.Int64
+	client := countingClient(1, true, &dials)
+	defer client.CloseIdleConnections()
+
+	// The requests are sent once the connection negotiated HTTP/2, by fewer goroutines than the streams the server
+	// allows at a time, so the client has no reason to open another connection.
+	if res, err := client.Head("https://" + spoofAddr + "/"); err != nil {
+		t.Fatal(err)
+	} else {
+		res.Body.Close()
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Go(func() {
+			for i := int(next.Add(1)) - 1; i < requests; i = int(next.Add(1)) - 1 {
+				req, err := http.NewRequest(http.MethodPost, "https://"+spoofAddr+"/", strings.NewReader(fmt.Sprint(i)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				origin := origins[i%len(origins)]
+				req.Host = strings.TrimPrefix(origin.URL, "https://")
+				req.Header.Set(ConfigurationHeaderKey, testConfig(origin, nil))
+
+				res, err := client.Do(req)
+				if err != nil {
+					t.Errorf("request %d: %s", i, err)
+					return
+				}
+				body, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				if res.ProtoMajor != 2 || string(body) != fmt.Sprintf("POST %d", i) {
+					t.Errorf("request %d: got %s %q, want HTTP/2.0 %q", i, res.Proto, body, fmt.Sprintf("POST %d", i))
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := dials.Load(); got != 1 {
+		t.Errorf("%d concurrent requests dialed the spoof server %d times, want 1", requests, got)
+	}
+}
+
+// TestInternalHeadersNeverReachTheDestination sends requests with internal headers along each path to the
+// destination: spoofed, bypassed, through an upstream proxy or the forward proxy, retried, upgraded, failing, or
+// changed by a hook or a script. Neither the destination nor the upstream proxy may receive any of them.
+func TestInternalHeadersNeverReachTheDestination(t *testing.T) {
+	const marker = "leaked-internal-header"
+	resetOnce := make(chan struct{}, 1)
+	resetOnce <- struct{}{}
+	origin := newRecordingOrigin(t, false, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/reset":
+			select {
+			case <-resetOnce:
+				if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			default:
+			}
+		case "/error":
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	host := strings.TrimPrefix(origin.URL, "https://")
+
+	// The upstream proxy keeps the CONNECT requests it receives and tunnels them to their target.
+	var connectsMutex sync.Mutex
+	var connects []string
+	proxy := newTestListener(t, func(conn net.Conn, done <-chan struct{}) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		dump, _ := httputil.DumpRequest(req, false)
+		connectsMutex.Lock()
+		connects = append(connects, string(dump))
+		connectsMutex.Unlock()
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer target.Close()
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(target, reader)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+	})
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"AddHeaders":[{"Name":%q,"Value":%q},{"Name":"X-Awesometls-Hooked","Value":%q}]}`, ConfigurationHeaderKey, marker, marker)
+	}))
+	t.Cleanup(hook.Close)
+	// Hooks don't apply to requests to their own host, which is the one of the destination.
+	hookURL := strings.Replace(hook.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name     string
+		settings string
+		path     string
+		more     map[string]any
+		mutate   func(*http.Request)
+		// forward sends the request through the forward proxy instead of the spoof server.
+		forward    bool
+		wantStatus int
+	}{
+		{name: "spoofed", path: "/", wantStatus: http.StatusOK},
+		{name: "destination error", path: "/error", wantStatus: http.StatusInternalServerError},
+		{
+			name: "retried after a reset", settings: `{"RetryPolicy":{"RetryCount":2,"InitialBackoffMs":1,"RetryOn":["reset"]}}`,
+			path: "/reset", wantStatus: http.StatusOK,
+		},
+		{name: "through an upstream proxy", path: "/", more: map[string]any{"ExternalProxyUrl": "http://" + proxy}, wantStatus: http.StatusOK},
+		{name: "bypassed", settings: `{"BypassHosts":["127.0.0.1"]}`, path: "/", wantStatus: http.StatusOK},
+		{name: "through the forward proxy", settings: `{"ForwardProxyAddress":"127.0.0.1:0"}`, path: "/", forward: true, wantStatus: http.StatusOK},
+		{
+			name: "WebSocket upgrade", path: "/", wantStatus: http.StatusOK,
+			mutate: func(req *http.Request) {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+				req.Header.Set("Sec-WebSocket-Version", "13")
+				req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			},
+		},
+		{
+			name: "in trailers", path: "/", wantStatus: http.StatusOK,
+			mutate: func(req *http.Request) {
+				// The body has no length, so it's chunked and the trailers can follow it.
+				req.Body, req.ContentLength = io.NopCloser(strings.NewReader("trailed")), -1
+				req.Trailer = http.Header{TraceIdHeaderKey: {marker}, "X-Awesometls-Other": {marker}}
+			},
+		},
+		{name: "added by a request hook", settings: fmt.Sprintf(`{"Hooks":{"RequestUrl":%q}}`, hookURL), path: "/", wantStatus: http.StatusOK},
+		{
+			// The hook fails, which is logged, and the response is passed on unchanged.
+			name: "response hook fails", settings: `{"Hooks":{"ResponseUrl":"http://localhost:1/response"}}`,
+			path: "/", wantStatus: http.StatusOK,
+		},
+		{
+			name: "added by a script", path: "/", wantStatus: http.StatusOK,
+			settings: fmt.Sprintf(`{"Script":{"Source":%q}}`, "def on_request(req):\n    req.add_header(\"X-Awesometls-Scripted\", \""+marker+"\")\n"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.settings != "" {
+				saveTestSettings(t, test.settings)
+			}
+			received := origin.requests()
+			var after uint64
+			if logs := GetLogs(0); len(logs) > 0 {
+				after = logs[len(logs)-1].Sequence
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "https://"+host+test.path, strings.NewReader(test.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(TraceIdHeaderKey, marker)
+			req.Header.Set("X-Awesometls-Other", marker)
+			// Clients don't have to send canonical names.
+			req.Header["awesometls-lowercase"] = []string{marker}
+			if test.mutate != nil {
+				test.mutate(req)
+			}
+
+			var res *http.Response
+			if test.forward {
+				req.Header.Set(ConfigurationHeaderKey, testConfig(origin.Server, test.more))
+				transport := &http.Transport{
+					Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: GetForwardProxyAddress()}),
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}
+				defer transport.CloseIdleConnections()
+				if res, err = (&http.Client{Transport: transport, Timeout: 30 * time.Second}).Do(req); err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+			} else {
+				res, _ = spoofRequest(t, req, origin.Server, test.more)
+			}
+
+			if res.StatusCode != test.wantStatus {
+				t.Errorf("got %d, want %d", res.StatusCode, test.wantStatus)
+			}
+			if origin.requests() == received {
+				t.Error("the request didn't reach the destination")
+			}
+			// The last check before sending strips internal headers too, but logs them as a bug of the path.
+			for _, record := range GetLogs(after) {
+				if strings.HasPrefix(record.Message, "BUG:") {
+					t.Errorf("logged %q with %v", record.Message, record.Fields)
+				}
+			}
+		})
+	}
+
+	origin.assertNotReceived(t, marker, `"Fingerprint"`)
+	connectsMutex.Lock()
+	defer connectsMutex.Unlock()
+	if len(connects) == 0 {
+		t.Error("no request went through the upstream proxy")
+	}
+	assertNotLeaked(t, connects, marker)
+}
+
+// clientHelloWithALPN returns the ClientHello record of Chrome 131 to serverName, offering the application protocols
+// alpn instead of its own, or none at all (without the extension) if alpn is empty.
+func clientHelloWithALPN(t *testing.T, serverName string, alpn []string) []byte {
+	t.Helper()
+
+	spec, err := utls.UTLSIdToSpec(utls.HelloChrome_131)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Extensions = slices.DeleteFunc(spec.Extensions, func(extension utls.TLSExtension) bool {
+		_, ok := extension.(*utls.ALPNExtension)
+		return ok && len(alpn) == 0
+	})
+	for _, extension := range spec.Extensions {
+		if extension, ok := extension.(*utls.ALPNExtension); ok {
+			extension.AlpnProtocols = alpn
+		}
+	}
+	return clientHelloOfSpec(t, serverName, spec)
+}
+
+// clientHelloOfSpec returns the ClientHello record that spec makes to serverName.
+func clientHelloOfSpec(t *testing.T, serverName string, spec utls.ClientHelloSpec) []byte {
+	t.Helper()
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	uconn := utls.UClient(conn, &utls.Config{ServerName: serverName, InsecureSkipVerify: true}, utls.HelloCustom, false, false, false)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello := uconn.HandshakeState.Hello.Raw
+	return append([]byte{0x16, 0x03, 0x01, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+}
+
+// TestReplaysTheInterceptedALPN sends requests with intercepted fingerprints that offer different application
+// protocols, to a destination that speaks HTTP/2 and HTTP/1.1 and to one that only speaks HTTP/1.1. The destination
+// must be offered exactly the captured list, and the request must be sent with the protocol it picks from it.
+func TestReplaysTheInterceptedALPN(t *testing.T) {
+	offered := make(chan []string, 1)
+	newOrigin := func(h2 bool) *httptest.Server {
+		origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, req.Proto)
+		}))
+		origin.EnableHTTP2 = h2
+		origin.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case offered <- hello.SupportedProtos:
+			default:
+			}
+			return nil, nil
+		}}
+		origin.StartTLS()
+		t.Cleanup(origin.Close)
+		return origin
+	}
+	both, http1 := newOrigin(true), newOrigin(false)
+
+	tests := []struct {
+		name      string
+		origin    *httptest.Server
+		alpn      []string
+		wantProto string
+	}{
+		{name: "HTTP2 and HTTP1", origin: both, alpn: []string{"h2", "http/1.1"}, wantProto: "HTTP/2.0"},
+		{name: "HTTP1 before HTTP2", origin: both, alpn: []string{"http/1.1", "h2"}, wantProto: "HTTP/2.0"},
+		{name: "HTTP2 only", origin: both, alpn: []string{"h2"}, wantProto: "HTTP/2.0"},
+		{name: "HTTP1 only", origin: both, alpn: []string{"http/1.1"}, wantProto: "HTTP/1.1"},
+		{name: "none", origin: both, wantProto: "HTTP/1.1"},
+		{name: "HTTP2 and HTTP1 to an HTTP1 destination", origin: http1, alpn: []string{"h2", "http/1.1"}, wantProto: "HTTP/1.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, port, _ := net.SplitHostPort(strings.TrimPrefix(test.origin.URL, "https://"))
+			raw := clientHelloWithALPN(t, host, test.alpn)
+			info, err := parseClientHello(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			captures.put(newCapturedFingerprint(host, port, info, raw))
+			t.Cleanup(func() { DeleteCapturedFingerprint(captureKey(host, port)) })
+			select {
+			case <-offered:
+			default:
+			}
+
+			// Each capture is a fingerprint of its own, so the request opens a connection whose handshake offers it.
+			res, body := spoofGet(t, test.origin, "/", map[string]any{"Fingerprint": "", "UseInterceptedFingerprint": true})
+			if res.StatusCode != http.StatusOK || body != test.wantProto {
+				t.Errorf("got %d %q, want the request sent with %s", res.StatusCode, body, test.wantProto)
+			}
+			select {
+			case protos := <-offered:
+				if !slices.Equal(protos, test.alpn) {
+					t.Errorf("the destination was offered %q, want the captured %q", protos, test.alpn)
+				}
+			default:
+				t.Error("the request didn't open a connection of its own")
+			}
+		})
+	}
+}
+
+// recordingListener keeps the bytes its connections read from the client.
+type recordingListener struct {
+	net.Listener
+
+	mutex    sync.Mutex
+	received []*bytes.Buffer
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	received := &bytes.Buffer{}
+	l.received = append(l.received, received)
+	return &recordingConn{Conn: conn, listener: l, received: received}, nil
+}
+
+// clientData returns what the client sent on the connection with the given index.
+func (l *recordingListener) clientData(index int) []byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if index >= len(l.received) {
+		return nil
+	}
+	return bytes.Clone(l.received[index].Bytes())
+}
+
+type recordingConn struct {
+	net.Conn
+	listener *recordingListener
+	received *bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.listener.mutex.Lock()
+	c.received.Write(p[:n])
+	c.listener.mutex.Unlock()
+	return n, err
+}
+
+// TestReplaysTheClientHelloCapturedAfterAHelloRetryRequest sends a request with an intercepted fingerprint whose client
+// sent another ClientHello after a HelloRetryRequest, to a destination that asks for a retry too. Each ClientHello the
+// destination gets must have the extensions of its captured counterpart.
+func TestReplaysTheClientHelloCapturedAfterAHelloRetryRequest(t *testing.T) {
+	listener := &recordingListener{}
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	listener.Listener = origin.Listener
+	origin.Listener = listener
+	// The captured ClientHello has no key share for P-256, so the destination asks for one.
+	origin.TLS = &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256}}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "https://"))
+
+	// The second ClientHello drops application_settings and adds record_size_limit, and has a share of P-256 only. The
+	// destination checks that the extensions it knows of don't change otherwise.
+	base, err := utls.UTLSIdToSpec(utls.HelloChrome_131)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSpec, err := cloneClientHelloSpec(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retrySpec, err := cloneClientHelloSpec(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var extensions []utls.TLSExtension
+	for _, extension := range retrySpec.Extensions {
+		switch extension := extension.(type) {
+		case *utls.ApplicationSettingsExtension, *utls.ApplicationSettingsExtensionNew:
+			continue
+		case *utls.KeyShareExtension:
+			extension.KeyShares = []utls.KeyShare{{Group: utls.CurveP256}}
+			extensions = append(extensions, &utls.FakeRecordSizeLimitExtension{Limit: 0x4001})
+		}
+		extensions = append(extensions, extension)
+	}
+	retrySpec.Extensions = extensions
+	first, retry := clientHelloOfSpec(t, host, firstSpec), clientHelloOfSpec(t, host, retrySpec)
+
+	firstInfo, err := parseClientHello(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryInfo, err := parseClientHello(retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := newCapturedFingerprint(host, port, firstInfo, first)
+	captured.setRetry(retryInfo, retry)
+	captures.put(captured)
+	t.Cleanup(func() { DeleteCapturedFingerprint(captureKey(host, port)) })
+
+	if res, body := spoofGet(t, origin, "/", map[string]any{"Fingerprint": "", "UseInterceptedFingerprint": true}); res.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("got %d %q", res.StatusCode, body)
+	}
+
+	// The client may send a ChangeCipherSpec record between its ClientHellos.
+	r := bufio.NewReader(bytes.NewReader(listener.clientData(0)))
+	var sent []*clientHelloInfo
+	for len(sent) < 2 {
+		if contentType, err := r.Peek(1); err == nil && contentType[0] == recordTypeChangeCipherSpec {
+			if _, err := readRecord(r); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		_, hello, err := readClientHello(r)
+		if err != nil || hello == nil {
+			t.Fatalf("the destination got %d ClientHellos (%v), want 2", len(sent), err)
+		}
+		info, err := parseClientHello(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, info)
+	}
+
+	// The padding depends on the length of each ClientHello, which the key shares change.
+	extensionsOf := func(info *clientHelloInfo) []uint16 {
+		return slices.DeleteFunc(withoutGrease(info.Extensions), func(id uint16) bool { return id == utls.ExtensionPadding })
+	}
+	for i, want := range []*clientHelloInfo{firstInfo, retryInfo} {
+		if got := extensionsOf(sent[i]); !slices.Equal(got, extensionsOf(want)) {
+			t.Errorf("ClientHello %d has the extensions %v, want the captured %v", i+1, got, extensionsOf(want))
+		}
+	}
+}
+
+// TestRejectsFallbackDestinationsThatLoopBack sends requests without a configuration whose Host names the spoof
+// server by another name or address than it's bound to. Each is rejected rather than sent back to the spoof server.
+func TestRejectsFallbackDestinationsThatLoopBack(t *testing.T) {
+	spoofAddr := startSpoofServer(t)
+	_, port, _ := net.SplitHostPort(spoofAddr)
+
+	for _, host := range []string{spoofAddr, "localhost:" + port, "[::1]:" + port, "0.0.0.0:" + port} {
+		t.Run(host, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://"+spoofAddr+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = host
+			res, err := spoofClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if got := res.Header.Get(ErrorCodeHeaderKey); got != ErrorConfigInvalid || !strings.Contains(string(body), "no destination to fall back to") {
+				t.Errorf("got %d (%s) %.200q, want the request rejected as looping back", res.StatusCode, got, body)
+			}
+		})
+	}
+}
+
+func TestLoopsBack(t *testing.T) {
+	localAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8886}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"127.0.0.1:8886", true},
+		{"localhost:8886", true},
+		{"[::1]:8886", true},
+		{"127.0.0.2:8886", true},
+		{"localhost:8887", false},
+		{"localhost", false},
+		{"192.0.2.1:8886", false},
+	}
+
+	for _, test := range tests {
+		config := &TransportConfig{Scheme: "https", Host: test.host}
+		if got := loopsBack(context.Background(), config, &fhttp.Request{Host: test.host}, localAddr); got != test.want {
+			t.Errorf("loopsBack(%q) = %t, want %t", test.host, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestToggleFingerprintUnderLoad switches the default fingerprint back and forth while requests that use it are in
+// flight. None of them may fail, and each is sent with one of the fingerprints, until the last one applies to all.
+func TestToggleFingerprintUnderLoad(t *testing.T) {
+	spoofAddr := startSpoofServer(t)
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		fmt.Fprint(w, "toggled")
+	})
+	host := strings.TrimPrefix(origin.URL, "https://")
+	fingerprints := []string{"chrome_131", "firefox_120"}
+	t.Cleanup(func() {
+		if err := SaveSettings(testSettings); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// The configuration has no fingerprint, so requests use the one of the settings in effect when they arrive.
+	send := func() (string, error) {
+		req, err := http.NewRequest(http.MethodGet, "https://"+spoofAddr+"/", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Host = host
+		req.Header.Set(ConfigurationHeaderKey, fmt.Sprintf(`{"Host":%q,"Scheme":"https","ReportTls":true}`, host))
+		res, err := spoofClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if res.StatusCode != http.StatusOK || string(body) != "toggled" {
+			return "", fmt.Errorf("got %d %q", res.StatusCode, body)
+		}
+		var negotiated NegotiatedTLS
+		if err := json.Unmarshal([]byte(res.Header.Get(TlsHeaderKey)), &negotiated); err != nil {
+			return "", fmt.Errorf("%s header %q: %w", TlsHeaderKey, res.Header.Get(TlsHeaderKey), err)
+		}
+		return negotiated.Fingerprint, nil
+	}
+
+	stop := make(chan struct{})
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fingerprint, err := send()
+				if err != nil {
+					t.Errorf("request %d: %s", sent.Load(), err)
+					return
+				}
+				if fingerprint != fingerprints[0] && fingerprint != fingerprints[1] {
+					t.Errorf("request sent with the fingerprint %q, want one of %v", fingerprint, fingerprints)
+				}
+				sent.Add(1)
+			}
+		})
+	}
+
+	const toggles = 20
+	for i := range toggles {
+		if err := SaveSettings(fmt.Sprintf(`{"ConfigurationMode":"header","LogLevel":"error","Fingerprint":%q}`, fingerprints[i%2])); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	t.Logf("%d requests were sent during %d toggles", sent.Load(), toggles)
+
+	last := fingerprints[(toggles-1)%2]
+	for i := range 3 {
+		if fingerprint, err := send(); err != nil || fingerprint != last {
+			t.Errorf("request %d after the toggles: sent with %q (%v), want %q", i, fingerprint, err, last)
+		}
+	}
+}
+
+// TestRejectedSettingsKeepTheSpoofListener moves the spoof server to another address in settings that are rejected
+// because a later listener can't bind. The spoof server must stay on its listener, which never stopped serving, so
+// its connections are kept.
+func TestRejectedSettingsKeepTheSpoofListener(t *testing.T) {
+	spoofAddr := startSpoofServer(t)
+	origin := newTestOrigin(t, func(w http.ResponseWriter, req *http.Request) {})
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	var dials atomic.Int64
+	client := countingClient(1, false, &dials)
+	defer client.CloseIdleConnections()
+	get := func() error {
+		req, err := http.NewRequest(http.MethodGet, "https://"+spoofAddr+"/", nil)
+		if err != nil {
+			return err
+		}
+		req.Host = strings.TrimPrefix(origin.URL, "https://")
+		req.Header.Set(ConfigurationHeaderKey, testConfig(origin, nil))
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("got %d", res.StatusCode)
+		}
+		return nil
+	}
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = SaveSettings(fmt.Sprintf(`{"ConfigurationMode":"header","LogLevel":"error","SpoofProxyAddress":"localhost:0","ForwardProxyAddress":%q}`, taken.Addr()))
+	var errs SettingsErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "ForwardProxyAddress" || errs[0].Code != SettingsErrorBindFailed {
+		t.Fatalf("got %v, want the forward proxy address rejected", err)
+	}
+
+	if got := GetListenAddress(); got != spoofAddr {
+		t.Errorf("the spoof server listens on %s after the rejected settings, want %s", got, spoofAddr)
+	}
+	for i := range 3 {
+		if err := get(); err != nil {
+			t.Fatalf("request %d after the rejected settings: %s", i, err)
+		}
+	}
+	if got := dials.Load(); got != 1 {
+		t.Errorf("the client dialed the spoof server %d times, want its connection kept", got)
+	}
+}
+
+func TestAppliedSettingsMoveTheSpoofListener(t *testing.T) {
+	spoofAddr := startSpoofServer(t)
+	t.Cleanup(func() {
+		if err := SaveSettings(`{"ConfigurationMode":"header","LogLevel":"error","SpoofProxyAddress":"127.0.0.1:0"}`); err != nil {
+			t.Error(err)
+		}
+		if err := SaveSettings(testSettings); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := SaveSettings(`{"ConfigurationMode":"header","LogLevel":"error","SpoofProxyAddress":"localhost:0"}`); err != nil {
+		t.Fatal(err)
+	}
+	moved := GetListenAddress()
+	if moved == spoofAddr || moved == "" {
+		t.Fatalf("the spoof server listens on %q, want another address than %s", moved, spoofAddr)
+	}
+	if conn, err := net.Dial("tcp", moved); err != nil {
+		t.Errorf("the spoof server doesn't accept connections on %s: %s", moved, err)
+	} else {
+		conn.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", spoofAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("the previous address %s still accepts connections", spoofAddr)
+		}
+	}
+}
+
+// TestRejectedSettingsRestoreThePprofEndpoint starts the pprof endpoint in settings that are rejected because the
+// log file, which is applied after it, can't be opened. The endpoint must be stopped again.
+func TestRejectedSettingsRestoreThePprofEndpoint(t *testing.T) {
+	startSpoofServer(t)
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pprofAddr := free.Addr().String()
+	free.Close()
+	// A file can't have a log file under it.
+	notADirectory := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADirectory, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = SaveSettings(fmt.Sprintf(`{"ConfigurationMode":"header","LogLevel":"error","PprofAddress":%q,"LogFile":%q}`, pprofAddr, filepath.Join(notADirectory, "log")))
+	var errs SettingsErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "LogFile" {
+		t.Fatalf("got %v, want the log file rejected", err)
+	}
+
+	// The endpoint is shut down in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", pprofAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("the pprof endpoint still listens on %s after the rejected settings", pprofAddr)
+		}
+	}
+}
+
+// TestPipeAddressesCantRequireAClientCertificate checks that settings requiring the client certificate reject pipe
+// addresses, which would accept clients without it since they don't speak TLS.
+func TestPipeAddressesCantRequireAClientCertificate(t *testing.T) {
+	settings := Settings{
+		ConfigurationMode:        ConfigurationModeHeader,
+		SpoofProxyAddress:        "pipe://spoof",
+		RequireClientCertificate: true,
+		Listeners:                []ListenerSettings{{Name: "tcp", Address: "127.0.0.1:0"}, {Name: "piped", Address: "pipe://piped"}},
+	}
+	var errs SettingsErrors
+	if err := settings.validate(); !errors.As(err, &errs) {
+		t.Fatalf("got %v, want the pipe addresses rejected", err)
+	}
+	var fields []string
+	for _, err := range errs {
+		if err.Code == SettingsErrorInvalidAddress {
+			fields = append(fields, err.Field)
+		}
+	}
+	if want := []string{"SpoofProxyAddress", "Listeners[1].Address"}; !slices.Equal(fields, want) {
+		t.Errorf("rejected the addresses of %v, want %v", fields, want)
+	}
+
+	settings.RequireClientCertificate = false
+	if err := settings.validate(); err != nil {
+		t.Errorf("pipe addresses are rejected without RequireClientCertificate: %s", err)
+	}
+}
+
+// TestInterceptProxyRetriesFailedAddresses binds the intercept proxy to two addresses, one of which is taken. Only
+// the taken one is rejected, and syncing the same addresses again binds it once it's free.
+func TestInterceptProxyRetriesFailedAddresses(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	addrs := []string{"127.0.0.1:0", taken.Addr().String()}
+
+	err = SaveSettings(fmt.Sprintf(`{"ConfigurationMode":"header","LogLevel":"error","UseInterceptedFingerprint":true,"InterceptProxyAddress":%q,"BurpProxyAddress":"127.0.0.1:1"}`, strings.Join(addrs, ",")))
+	var errs SettingsErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "InterceptProxyAddress" || errs[0].Value != addrs[1] || errs[0].Code != SettingsErrorBindFailed {
+		t.Fatalf("got %v, want only %s rejected", err, addrs[1])
+	}
+
+	group := &proxyGroup{listeners: make(map[string]*interceptProxy)}
+	defer group.stop()
+	if err := group.sync(addrs, "127.0.0.1:1", InterceptOptions{}); err == nil {
+		t.Fatalf("bound %s, which is taken", addrs[1])
+	}
+	if got := group.listenAddrs(); len(got) != 1 {
+		t.Fatalf("listening on %v, want only the address that's free", got)
+	}
+	taken.Close()
+	if err := group.sync(addrs, "127.0.0.1:1", InterceptOptions{}); err != nil {
+		t.Fatalf("syncing again once %s is free: %s", addrs[1], err)
+	}
+	if got := group.listenAddrs(); len(got) != 2 {
+		t.Errorf("listening on %v, want both addresses", got)
+	}
+}
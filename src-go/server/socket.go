@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// minDialShare is the minimum time to connect to each of the addresses of a host, see socketDialer.dialResolved.
+const minDialShare = 2 * time.Second
+
+// maxSocketBufferBytes caps SocketOptions.SendBufferBytes and SocketOptions.ReceiveBufferBytes.
+const maxSocketBufferBytes = 64 << 20
+
+// SocketOptions tune the TCP connections to destinations and upstream proxies, and the connections clients make to
+// the spoof server, its listeners and the proxies. Options the platform doesn't support are skipped.
+type SocketOptions struct {
+	// NoDelay sends small writes, like TLS records and HTTP/2 frames, right away instead of coalescing them
+	// (TCP_NODELAY, which disables Nagle's algorithm). Defaults to true.
+	NoDelay *bool
+
+	// KeepAliveIntervalSeconds is the number of seconds between TCP keep-alive probes, and before the first one.
+	// Zero keeps Go's default of 15 seconds, and -1 disables keep-alive probes.
+	KeepAliveIntervalSeconds int
+
+	// SendBufferBytes and ReceiveBufferBytes are the sizes of the sockets' buffers (SO_SNDBUF and SO_RCVBUF),
+	// e.g. to fill the bandwidth of high-latency destinations. Zero keeps the OS's defaults.
+	SendBufferBytes    int
+	ReceiveBufferBytes int
+}
+
+// clone returns a copy of the options that doesn't share their pointer.
+func (options SocketOptions) clone() SocketOptions {
+	if options.NoDelay != nil {
+		noDelay := *options.NoDelay
+		options.NoDelay = &noDelay
+	}
+	return options
+}
+
+// socketOptions are the SocketOptions of the settings in effect.
+var socketOptions atomic.Pointer[SocketOptions]
+
+// currentSocketOptions returns the SocketOptions in effect.
+func currentSocketOptions() *SocketOptions {
+	if options := socketOptions.Load(); options != nil {
+		return options
+	}
+	return &SocketOptions{}
+}
+
+// socketDialer is a net.Dialer that applies SocketOptions to the connections it makes. The socket buffers are set
+// before connecting, so the TCP window scale takes them into account.
+type socketDialer struct {
+	net.Dialer
+	options *SocketOptions
+}
+
+// newSocketDialer returns a dialer for the SocketOptions in effect, which connects from localAddr if it's set.
+func newSocketDialer(localAddr net.Addr) *socketDialer {
+	options := currentSocketOptions()
+	dialer := &socketDialer{Dialer: net.Dialer{LocalAddr: localAddr}, options: options}
+	if options.SendBufferBytes > 0 || options.ReceiveBufferBytes > 0 {
+		dialer.Control = options.control
+	}
+	// Keep-alives are configured once connected instead, to report the options the platform doesn't support.
+	if options.KeepAliveIntervalSeconds != 0 {
+		dialer.KeepAlive = -1
+	}
+	return dialer
+}
+
+func (d *socketDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *socketDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialResolved(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.options.apply(conn, false)
+	return conn, nil
+}
+
+// dialResolved connects to addr, resolving its host with dnsCache. The addresses are tried in turn, each getting an
+// equal share of the time left (but at least minDialShare), like net.Dialer does.
+func (d *socketDialer) dialResolved(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !dnsCache.enabled() {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+
+	family := "ip"
+	if tcpAddr, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		family = "ip6"
+		if tcpAddr.IP.To4() != nil {
+			family = "ip4"
+		}
+	}
+
+	addrs, err := dnsCache.lookup(ctx, family, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var firstErr error
+	for i, ip := range addrs {
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(addrs)-1 {
+			share := max(time.Until(deadline)/time.Duration(len(addrs)-i), minDialShare)
+			dialCtx, cancel = context.WithTimeout(ctx, share)
+		}
+		conn, err := d.Dialer.DialContext(dialCtx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		cancel()
+		if err == nil {
+			dnsCache.dialed(family, host, true)
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no addresses", Name: host}}
+	}
+
+	dnsCache.dialed(family, host, false)
+	return nil, firstErr
+}
+
+// control sets the socket buffers of a connection before it's made, see net.Dialer.Control.
+func (options *SocketOptions) control(network, addr string, conn syscall.RawConn) error {
+	err := conn.Control(func(fd uintptr) {
+		for _, buffer := range []struct {
+			name   string
+			option int
+			bytes  int
+		}{
+			{"SO_SNDBUF", soSndbuf, options.SendBufferBytes},
+			{"SO_RCVBUF", soRcvbuf, options.ReceiveBufferBytes},
+		} {
+			if buffer.bytes == 0 {
+				continue
+			}
+			if err := setSocketBuffer(fd, buffer.option, buffer.bytes); err != nil {
+				connectionLog.Debug("setting a socket buffer isn't supported, skipping it", "option", buffer.name, "address", addr, "error", err)
+			}
+		}
+	})
+	if err != nil {
+		connectionLog.Debug("setting the socket buffers isn't supported, skipping them", "address", addr, "error", err)
+	}
+
+	// Failing to set an option never fails the dial.
+	return nil
+}
+
+// apply applies the options to conn once it's connected, along with the socket buffers if buffers is true (they're
+// set before connecting for dialed connections). Connections that aren't TCP, like unix sockets, are left alone.
+func (options *SocketOptions) apply(conn net.Conn, buffers bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	// Go enables TCP_NODELAY by default.
+	if options.NoDelay != nil && !*options.NoDelay {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			connectionLog.Debug("disabling TCP_NODELAY isn't supported, skipping it", "address", conn.RemoteAddr(), "error", err)
+		}
+	}
+
+	switch {
+	case options.KeepAliveIntervalSeconds < 0:
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			connectionLog.Debug("disabling keep-alives isn't supported, skipping it", "address", conn.RemoteAddr(), "error", err)
+		}
+	case options.KeepAliveIntervalSeconds > 0:
+		interval := time.Duration(options.KeepAliveIntervalSeconds) * time.Second
+		if err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval}); err != nil {
+			connectionLog.Debug("setting the keep-alive interval isn't supported, skipping it", "address", conn.RemoteAddr(), "error", err)
+		}
+	}
+
+	if !buffers {
+		return
+	}
+	if options.SendBufferBytes > 0 {
+		if err := tcpConn.SetWriteBuffer(options.SendBufferBytes); err != nil {
+			connectionLog.Debug("setting SO_SNDBUF isn't supported, skipping it", "address", conn.RemoteAddr(), "error", err)
+		}
+	}
+	if options.ReceiveBufferBytes > 0 {
+		if err := tcpConn.SetReadBuffer(options.ReceiveBufferBytes); err != nil {
+			connectionLog.Debug("setting SO_RCVBUF isn't supported, skipping it", "address", conn.RemoteAddr(), "error", err)
+		}
+	}
+}
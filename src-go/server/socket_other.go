@@ -0,0 +1,15 @@
+//go:build !windows
+
+package server
+
+import "syscall"
+
+const (
+	soSndbuf = syscall.SO_SNDBUF
+	soRcvbuf = syscall.SO_RCVBUF
+)
+
+// setSocketBuffer sets the size of the buffer option (soSndbuf or soRcvbuf) of the socket fd.
+func setSocketBuffer(fd uintptr, option, bytes int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, option, bytes)
+}
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+// SocksProxySettings configures the inbound SOCKS5 proxy, for clients that don't support HTTP proxies.
+// TLS connections to port 443 that carry HTTP are intercepted like by the forward proxy (see ForwardProxyAddress),
+// all other connections are tunneled to their destination as-is.
+type SocksProxySettings struct {
+	Enabled bool
+
+	// Address to listen on ([ip:]port).
+	Address string
+
+	// Username and Password are required from clients if Username is set (RFC 1929).
+	// Otherwise, clients don't need to authenticate.
+	Username string
+	Password string
+}
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion          = 5
+	socksAuthVersion      = 1
+	socksMethodNoAuth     = 0x00
+	socksMethodUserPass   = 0x02
+	socksMethodNoneFound  = 0xff
+	socksCommandConnect   = 0x01
+	socksAddressIPv4      = 0x01
+	socksAddressDomain    = 0x03
+	socksAddressIPv6      = 0x04
+	socksReplySucceeded   = 0x00
+	socksReplyFailure     = 0x01
+	socksReplyUnreachable = 0x04
+	socksReplyRefused     = 0x05
+	socksReplyCommand     = 0x07
+	socksReplyAddressType = 0x08
+)
+
+const (
+	// socksHandshakeTimeout is how long a client has to complete the SOCKS handshake.
+	socksHandshakeTimeout = 10 * time.Second
+
+	// socksPeekTimeout is how long to wait for the client to start a TLS handshake on port 443, before the connection
+	// is tunneled as-is (e.g. for protocols where the server speaks first).
+	socksPeekTimeout = 2 * time.Second
+
+	// socksInterceptPort is the port whose TLS connections are intercepted.
+	socksInterceptPort = "443"
+)
+
+// socks is the SOCKS5 proxy of Settings.SocksProxy.
+// Like the forward proxy, it runs along with the spoof server and issues its certificates with the same CA.
+var socks = &socksProxy{}
+
+type socksProxy struct {
+	mutex    sync.Mutex
+	addr     string
+	listener *socksListener
+}
+
+// socksListener serves the SOCKS5 proxy on one address.
+type socksListener struct {
+	addr     string
+	listener net.Listener
+	mitm     *mitmServer
+}
+
+// address returns the address the proxy listens on with these settings, or an empty string if it's disabled.
+func (settings *SocksProxySettings) address() string {
+	if !settings.Enabled {
+		return ""
+	}
+	return settings.Address
+}
+
+// sync applies SocksProxy: the proxy moves to the configured address, or stops if it's disabled.
+// Credentials are checked against the settings in effect when a client connects, so changing them doesn't rebind.
+// If the spoof server isn't running, the proxy starts along with it instead (see start).
+func (p *socksProxy) sync(settings SocksProxySettings) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	addr := settings.address()
+	p.addr = addr
+
+	if p.listener != nil && p.listener.addr == addr {
+		return nil
+	}
+	if p.listener == nil && (addr == "" || !spoof.running()) {
+		return nil
+	}
+
+	previous := p.listener
+
+	p.listener = nil
+	if addr != "" {
+		listener, err := newSocksListener(addr)
+		if err != nil {
+			p.listener = previous
+			return err
+		}
+		p.listener = listener
+	}
+
+	if previous != nil {
+		go func() {
+			defer recoverPanic(socksLog, "shutdown")
+
+			if err := previous.shutdown(); err != nil {
+				socksLog.Warn("shutdown of the previous listener failed", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// start starts the proxy on the configured address, if it's enabled and the proxy isn't running yet.
+func (p *socksProxy) start() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener != nil || p.addr == "" {
+		return nil
+	}
+
+	listener, err := newSocksListener(p.addr)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+
+	return nil
+}
+
+func (p *socksProxy) stop() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener == nil {
+		return nil
+	}
+
+	err := p.listener.shutdown()
+	p.listener = nil
+
+	return err
+}
+
+// listenAddr returns the dialable address the proxy listens on, or an empty string if it isn't running.
+func (p *socksProxy) listenAddr() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener == nil {
+		return ""
+	}
+
+	return dialableAddr(p.listener.listener.Addr())
+}
+
+// GetSocksProxyAddress returns the address the SOCKS5 proxy listens on, or an empty string if it isn't running.
+// Like GetListenAddress, a port 0 in the address is replaced with the port that was chosen.
+func GetSocksProxyAddress() string {
+	return socks.listenAddr()
+}
+
+func newSocksListener(addr string) (*socksListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen, err: %w", err)
+	}
+	listener = limitConnections(supervise("SOCKS proxy", addr, listener))
+
+	mitm, err := newMITMServer(listener.Addr())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	l := &socksListener{
+		addr:     addr,
+		listener: listener,
+		mitm:     mitm,
+	}
+
+	go l.serve()
+
+	return l, nil
+}
+
+func (l *socksListener) serve() {
+	defer recoverPanic(socksLog, "accept")
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				socksLog.Error("accept failed", "error", err)
+			}
+			return
+		}
+
+		go l.handleConn(conn)
+	}
+}
+
+// shutdown stops accepting connections and waits for the requests in flight on intercepted connections to finish.
+// Connections that are tunneled as-is are left open until either side closes them.
+func (l *socksListener) shutdown() error {
+	err := l.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return errors.Join(err, l.mitm.shutdown())
+}
+
+func (l *socksListener) handleConn(conn net.Conn) {
+	defer recoverPanic(socksLog, "connection")
+
+	// Intercepted connections are counted by the MITM server once they're handed to it.
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+
+	reader := bufio.NewReaderSize(conn, 5+maxRecordLength)
+
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	authority, err := socksHandshake(conn, reader, state.Load().settings.SocksProxy)
+	if err != nil {
+		socksLog.Debug("client failed", "address", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	if _, port, _ := net.SplitHostPort(authority); port == socksInterceptPort {
+		// Intercepted connections are answered before connecting to the destination, because the client only reveals
+		// whether it speaks TLS once it got the reply.
+		if err = writeSocksReply(conn, socksReplySucceeded); err != nil {
+			conn.Close()
+			return
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(socksPeekTimeout))
+		intercept := interceptsSocksConn(reader)
+		_ = conn.SetDeadline(time.Time{})
+
+		if intercept {
+			l.mitm.serve(&tunnelConn{Conn: conn, reader: reader, authority: authority})
+			return
+		}
+
+		upstream, err := dialTunnel(authority)
+		if err != nil {
+			socksLog.Debug("connect failed", "host", authority, "error", err)
+			conn.Close()
+			return
+		}
+
+		pipeConns(conn, reader, upstream)
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	upstream, err := dialTunnel(authority)
+	if err != nil {
+		socksLog.Debug("connect failed", "host", authority, "error", err)
+		_ = writeSocksReply(conn, socksDialReply(err))
+		conn.Close()
+		return
+	}
+
+	if err = writeSocksReply(conn, socksReplySucceeded); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+
+	pipeConns(conn, reader, upstream)
+}
+
+// interceptsSocksConn reports whether the client starts a TLS handshake whose ALPN indicates HTTP.
+// Nothing is consumed from r.
+func interceptsSocksConn(r *bufio.Reader) bool {
+	header, err := r.Peek(5)
+	if err != nil || header[0] != recordTypeHandshake {
+		return false
+	}
+
+	record, err := r.Peek(5 + int(binary.BigEndian.Uint16(header[3:])))
+	if err != nil {
+		return false
+	}
+
+	// A ClientHello that's fragmented across several records can't be inspected here. Clients that split it usually
+	// do so because it's large, which is typical for browsers, so it's assumed to carry HTTP.
+	info, err := parseClientHello(record)
+	if err != nil {
+		return true
+	}
+
+	return !isOpaqueALPN(info.ALPN)
+}
+
+// socksHandshake negotiates authentication with a SOCKS5 client according to settings and reads its request.
+// It returns the destination (host:port) of a CONNECT request. Other requests are rejected.
+// The caller replies to the request with writeSocksReply.
+func socksHandshake(conn net.Conn, r *bufio.Reader, settings SocksProxySettings) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksMethodNoAuth)
+	if settings.Username != "" {
+		method = socksMethodUserPass
+	}
+
+	if !slices.Contains(methods, method) {
+		_, _ = conn.Write([]byte{socksVersion, socksMethodNoneFound})
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+
+	if method == socksMethodUserPass {
+		if err := socksAuthenticate(conn, r, settings); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddressDomain:
+		length, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err = io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = writeSocksReply(conn, socksReplyAddressType)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	if request[1] != socksCommandConnect {
+		// BIND and UDP ASSOCIATE aren't supported.
+		_ = writeSocksReply(conn, socksReplyCommand)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksAuthenticate checks the username and password a client sends, see RFC 1929.
+func socksAuthenticate(conn net.Conn, r *bufio.Reader, settings SocksProxySettings) error {
+	readField := func() ([]byte, error) {
+		length, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		field := make([]byte, length)
+		_, err = io.ReadFull(r, field)
+		return field, err
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != socksAuthVersion {
+		return fmt.Errorf("unsupported authentication version %d", version)
+	}
+
+	username, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+
+	usernameOk := subtle.ConstantTimeCompare(username, []byte(settings.Username)) == 1
+	passwordOk := subtle.ConstantTimeCompare(password, []byte(settings.Password)) == 1
+	if !usernameOk || !passwordOk {
+		_, _ = conn.Write([]byte{socksAuthVersion, 1})
+		return fmt.Errorf("invalid credentials for user '%s'", username)
+	}
+
+	_, err = conn.Write([]byte{socksAuthVersion, 0})
+	return err
+}
+
+// writeSocksReply answers a SOCKS5 request. The bound address is always reported as unspecified.
+func writeSocksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksDialReply returns the reply to a request whose destination couldn't be reached because of err.
+func socksDialReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyUnreachable
+	default:
+		return socksReplyFailure
+	}
+}
+
+// dialTunnel connects to authority (host:port) for a connection that is tunneled as-is, with the upstream proxy,
+// local address and dial timeout of the saved settings (or the profile for the host).
+func dialTunnel(authority string) (net.Conn, error) {
+	current := state.Load()
+	config := current.defaultsFor("")
+	config.Host = authority
+
+	host, _, _ := net.SplitHostPort(authority)
+	if err := current.settings.applyProfile(&config, host); err != nil {
+		return nil, err
+	}
+
+	var proxyURL *url.URL
+	if config.ExternalProxyUrl != "" {
+		var err error
+		if proxyURL, err = parseUpstreamProxyUrl(config.ExternalProxyUrl); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := time.Duration(cmp.Or(config.DialTimeout, config.HttpTimeout, tls_client.DefaultTimeoutSeconds)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return dialFrom(ctx, config.LocalAddress, func(ctx context.Context, localAddr net.Addr) (net.Conn, error) {
+		return dialUpstream(ctx, proxyURL, authority, localAddr)
+	})
+}
+
+// pipeConns copies data between the client and the destination until either side is done, then closes both.
+// clientReader may contain data that was already buffered from client.
+func pipeConns(client net.Conn, clientReader io.Reader, upstream net.Conn) {
+	defer client.Close()
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer recoverPanic(socksLog, "pipe")
+		_, _ = copyBuffered(upstream, clientReader)
+		closeWrite(upstream)
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer recoverPanic(socksLog, "pipe")
+		_, _ = copyBuffered(client, upstream)
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+}
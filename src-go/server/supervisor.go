@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRebindAttempts is the number of times a supervised listener tries to rebind before giving up.
+	maxRebindAttempts = 10
+
+	// initialRebindBackoff is the delay before the first attempt to rebind, doubled after each failed attempt
+	// up to maxRebindBackoff.
+	initialRebindBackoff = 100 * time.Millisecond
+	maxRebindBackoff     = 30 * time.Second
+
+	// resumeCheckInterval is how often the clock is checked for a gap, see watchForResume.
+	resumeCheckInterval = 5 * time.Second
+
+	// resumeThreshold is how far past resumeCheckInterval a check has to be for the machine to have slept.
+	resumeThreshold = 30 * time.Second
+)
+
+// supervisedListener is a listener that rebinds its address if accepting fails for any reason other than it being
+// closed, e.g. after the OS dropped the socket on resume, so the server using it keeps serving instead of stopping.
+// It retries with exponential backoff, publishing EventListenerDown, EventListenerRestarted and EventListenerGaveUp.
+type supervisedListener struct {
+	// name describes the listener in logs and events, e.g. "forward proxy".
+	name string
+
+	// addr is the address to rebind, which is the address the listener was bound to if it was configured with port 0.
+	addr string
+
+	mutex    sync.Mutex
+	listener net.Listener
+	closed   bool
+	done     chan struct{}
+}
+
+// supervise returns listener, which listens on the configured address addr, supervised under name.
+func supervise(name, addr string, listener net.Listener) net.Listener {
+	if _, ok := pipeName(addr); !ok {
+		addr = listener.Addr().String()
+	}
+
+	return &supervisedListener{name: name, addr: addr, listener: listener, done: make(chan struct{})}
+}
+
+func (l *supervisedListener) Accept() (net.Conn, error) {
+	for {
+		l.mutex.Lock()
+		listener := l.listener
+		l.mutex.Unlock()
+
+		conn, err := listener.Accept()
+		if err == nil {
+			currentSocketOptions().apply(conn, true)
+			return conn, nil
+		}
+
+		// Timeouts are temporary, and the servers using the listener already retry them.
+		var netErr net.Error
+		if l.isClosed() || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, err
+		}
+
+		if err = l.rebind(listener, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rebind replaces listener, whose Accept failed with err, with a new listener on the same address.
+func (l *supervisedListener) rebind(listener net.Listener, err error) error {
+	listenerLog.Warn("accept failed, rebinding", "listener", l.name, "address", l.addr, "error", err)
+	recentErrors.add(err)
+	publishEvent(EventListenerDown, map[string]string{"listener": l.name, "address": l.addr, "error": err.Error()})
+
+	listener.Close()
+
+	backoff := initialRebindBackoff
+	for attempt := 1; attempt <= maxRebindAttempts; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-l.done:
+			return net.ErrClosed
+		}
+
+		next, listenErr := listenAddress(l.addr)
+		if listenErr != nil {
+			listenerLog.Warn("rebinding failed", "listener", l.name, "address", l.addr, "attempt", attempt, "maxAttempts", maxRebindAttempts, "error", listenErr)
+			err = listenErr
+			backoff = min(backoff*2, maxRebindBackoff)
+			continue
+		}
+
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			next.Close()
+			return net.ErrClosed
+		}
+		l.listener = next
+		l.mutex.Unlock()
+
+		listenerLog.Info("rebound", "listener", l.name, "address", l.addr)
+		publishEvent(EventListenerRestarted, map[string]string{"listener": l.name, "address": l.addr, "attempts": strconv.Itoa(attempt)})
+		return nil
+	}
+
+	listenerLog.Error("gave up rebinding", "listener", l.name, "address", l.addr, "error", err)
+	publishEvent(EventListenerGaveUp, map[string]string{"listener": l.name, "address": l.addr, "error": err.Error()})
+	return err
+}
+
+func (l *supervisedListener) isClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.closed
+}
+
+func (l *supervisedListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+
+	return l.listener.Close()
+}
+
+func (l *supervisedListener) Addr() net.Addr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.listener.Addr()
+}
+
+// watchForResume resets the connection pools when the machine resumes from sleep, until stopped is closed.
+// Connections that were open before sleeping are usually dead by then, and requests reusing them would hang
+// until they time out. Sleeping shows as a check that comes much later than resumeCheckInterval: the wall clock
+// keeps running while the machine sleeps, and on most platforms the monotonic clock doesn't.
+func watchForResume(stopped <-chan struct{}) {
+	defer recoverPanic(connectionLog, "resume watcher")
+
+	ticker := time.NewTicker(resumeCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-stopped:
+			return
+		case now := <-ticker.C:
+			elapsed := max(now.Round(0).Sub(last.Round(0)), now.Sub(last))
+			if gap := elapsed - resumeCheckInterval; gap > resumeThreshold {
+				connectionLog.Info("resumed, resetting connection pools", "gap", gap.Round(time.Second))
+				state.Load().clearClients()
+				sourceAddresses.clear()
+				publishEvent(EventResumed, map[string]string{"gap": gap.Round(time.Second).String()})
+			}
+			last = now
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	nethttptrace "net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+	tls_client "github.com/bogdanfinn/tls-client"
+	"golang.org/x/net/proxy"
+)
+
+// The stages of a request that have their own timeout, see TransportConfig.DialTimeout and friends.
+const (
+	stageDial           = "dial"
+	stageTLSHandshake   = "TLS handshake"
+	stageWriteRequest   = "write request"
+	stageResponseHeader = "response header"
+	stageIdleRead       = "idle read"
+)
+
+// stageTimer cancels a request when the stage it's in takes longer than the stage's timeout.
+// Stages without a timeout are only bounded by TransportConfig.HttpTimeout.
+type stageTimer struct {
+	cancel   context.CancelFunc
+	timeouts map[string]time.Duration
+
+	mutex   sync.Mutex
+	stage   string
+	timer   *time.Timer
+	expired string
+
+	// entered is when each stage was first entered. Along with the trace events below,
+	// it's the timing breakdown of the request reported by the HAR recorder, see harTimingsOf.
+	entered      map[string]time.Time
+	tls          bool
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	firstByte    time.Time
+	reused       bool
+
+	// handshake records the TLS handshake of the connection dialed for the request, until the request is written.
+	handshake *handshakeRecorder
+	// use is the request's use of its connection, until it's canceled.
+	use *connectionUse
+	// conn is the connection the request got, see negotiated.
+	conn net.Conn
+}
+
+type stageTimerKey struct{}
+
+// withStageTimer returns a copy of ctx that's canceled when a stage of the request times out,
+// and the stageTimer that tracks the request's stages.
+func withStageTimer(ctx context.Context, config *TransportConfig) (context.Context, *stageTimer) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t := &stageTimer{
+		timeouts: map[string]time.Duration{
+			stageDial:           time.Duration(config.DialTimeout) * time.Second,
+			stageTLSHandshake:   time.Duration(config.TlsHandshakeTimeout) * time.Second,
+			stageResponseHeader: time.Duration(config.ResponseHeaderTimeout) * time.Second,
+			stageIdleRead:       time.Duration(config.IdleReadTimeout) * time.Second,
+		},
+		entered: make(map[string]time.Time),
+		tls:     config.Scheme == "https",
+	}
+	// The request is done with its connection once it's canceled.
+	t.cancel = func() {
+		cancel()
+		t.mutex.Lock()
+		use := t.use
+		t.mutex.Unlock()
+		use.release()
+	}
+
+	ctx = context.WithValue(ctx, stageTimerKey{}, t)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		// The connection is dialed (and the handshake done) before it's handed to the transport, or it's reused.
+		// Writing the request has no timeout of its own.
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.gotConn(info.Conn, info.Reused)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				t.enter(stageResponseHeader)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+		},
+	})
+	// Connections are dialed with the net package, which only reports name resolution to its own trace.
+	ctx = nethttptrace.WithClientTrace(ctx, &nethttptrace.ClientTrace{
+		DNSStart: func(nethttptrace.DNSStartInfo) {
+			t.mark(&t.dnsStart)
+		},
+		DNSDone: func(nethttptrace.DNSDoneInfo) {
+			t.mark(&t.dnsDone)
+		},
+		ConnectStart: func(string, string) {
+			t.mark(&t.connectStart)
+		},
+	})
+
+	return ctx, t
+}
+
+// gotConn moves the request on to writing it once it got conn, which is new unless reused.
+func (t *stageTimer) gotConn(conn net.Conn, reused bool) {
+	t.enter(stageWriteRequest)
+	use := acquireConnection(conn, reused)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.reused = reused
+	t.conn = conn
+	// A request that's retried by the transport gets another connection.
+	t.use.release()
+	t.use = use
+}
+
+// negotiated returns what the connection the request got negotiated with the destination.
+func (t *stageTimer) negotiated() NegotiatedTLS {
+	t.mutex.Lock()
+	conn, reused := t.conn, t.reused
+	t.mutex.Unlock()
+
+	return negotiatedTLS(conn, reused)
+}
+
+// stageTimerFrom returns the stageTimer of the request ctx belongs to, if any.
+func stageTimerFrom(ctx context.Context) *stageTimer {
+	t, _ := ctx.Value(stageTimerKey{}).(*stageTimer)
+	return t
+}
+
+// enter starts stage, replacing the timeout of the previous one.
+func (t *stageTimer) enter(stage string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.expired != "" {
+		return
+	}
+
+	if _, ok := t.entered[stage]; !ok {
+		t.entered[stage] = time.Now()
+	}
+	t.stage = stage
+	if stage == stageWriteRequest && t.handshake != nil {
+		t.handshake.stop()
+	}
+
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	if timeout := t.timeouts[stage]; timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			t.expire(stage)
+		})
+	}
+}
+
+// mark sets event to the current time, unless it happened already.
+func (t *stageTimer) mark(event *time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if event.IsZero() {
+		*event = time.Now()
+	}
+}
+
+func (t *stageTimer) expire(stage string) {
+	t.mutex.Lock()
+	if t.expired == "" {
+		t.expired = stage
+	}
+	t.mutex.Unlock()
+
+	t.cancel()
+}
+
+// current returns the stage the request is in, or the one that timed out.
+func (t *stageTimer) current() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.stage
+}
+
+// stop stops the timeout of the current stage.
+func (t *stageTimer) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// wrap names the stage that timed out in err, if any.
+func (t *stageTimer) wrap(err error) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.expired == "" {
+		return err
+	}
+
+	return &stageTimeoutError{stage: t.expired, timeout: t.timeouts[t.expired], err: err}
+}
+
+// stageTimeoutError is the error of a request whose stage timed out, see stageTimer.wrap.
+type stageTimeoutError struct {
+	stage   string
+	timeout time.Duration
+	err     error
+}
+
+func (err *stageTimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %s expired: %s", err.stage, err.timeout, err.err)
+}
+
+func (err *stageTimeoutError) Unwrap() error {
+	return err.err
+}
+
+// recordHandshake records the TLS handshake of conn, the connection dialed for the request, to diagnose it if it fails.
+func (t *stageTimer) recordHandshake(conn net.Conn) net.Conn {
+	if !t.tls {
+		return conn
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.handshake = &handshakeRecorder{Conn: conn}
+	return t.handshake
+}
+
+// diagnoseHandshake adds what the TLS handshake got to to err, if the request failed during it.
+func (t *stageTimer) diagnoseHandshake(err error, stage string) error {
+	t.mutex.Lock()
+	recorder := t.handshake
+	t.mutex.Unlock()
+
+	if stage != stageTLSHandshake || recorder == nil {
+		return err
+	}
+	return &HandshakeError{Err: err, Diagnostics: recorder.diagnostics(err)}
+}
+
+// handshakeDuration returns how long the TLS handshake of the request took, if it dialed a new connection to an
+// HTTPS destination.
+func (t *stageTimer) handshakeDuration() (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	start, started := t.entered[stageTLSHandshake]
+	end, ended := t.entered[stageWriteRequest]
+	if !t.tls || !started || !ended || t.reused {
+		return 0, false
+	}
+
+	return end.Sub(start), true
+}
+
+// idleReader is a response body that times out when no data arrives for the stage's timeout.
+type idleReader struct {
+	io.Reader
+	timer *stageTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.enter(stageIdleRead)
+	return r.Reader.Read(p)
+}
+
+// stageDialer dials destinations directly or through the upstream proxy at proxyURL, from localAddress if set
+// (see TransportConfig.LocalAddress), and moves the request it dials for on to the TLS handshake stage once connected.
+type stageDialer struct {
+	proxyURL     *url.URL
+	localAddress string
+	// timeout and localAddr are the client's dial timeout and local address (see tls_client.WithLocalAddr), which
+	// apply to connections the transport dials without a request's context too, e.g. for HTTP/2. localAddress takes
+	// precedence over localAddr.
+	timeout   time.Duration
+	localAddr *net.TCPAddr
+	// fingerprint is the UpstreamConnection.Fingerprint of the connections.
+	fingerprint string
+	// capture, if set, records the connections.
+	capture *wireCapture
+}
+
+// newStageDialerFactory returns a factory for the dialer of clients with fingerprint (see connectionFingerprint) that
+// send their requests through proxyURL from localAddress, and record their connections for capture if it's set.
+func newStageDialerFactory(proxyURL *url.URL, localAddress, fingerprint string, capture *wireCapture) tls_client.ProxyDialerFactory {
+	return func(_ string, timeout time.Duration, localAddr *net.TCPAddr, _ fhttp.Header, _ tls_client.Logger) (proxy.ContextDialer, error) {
+		return &stageDialer{proxyURL: proxyURL, localAddress: localAddress, timeout: timeout, localAddr: localAddr, fingerprint: fingerprint, capture: capture}, nil
+	}
+}
+
+func (d *stageDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext runs on a goroutine of the transport, so it recovers from its panics itself.
+func (d *stageDialer) DialContext(ctx context.Context, _, addr string) (_ net.Conn, err error) {
+	defer recoverPanicAsError(connectionLog, "dial", &err)
+
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	conn, err := dialFrom(ctx, d.localAddress, func(ctx context.Context, localAddr net.Addr) (net.Conn, error) {
+		if localAddr == nil && d.localAddr != nil {
+			localAddr = d.localAddr
+		}
+		return dialUpstream(ctx, d.proxyURL, addr, localAddr)
+	})
+	if err != nil {
+		upstreamConns.failed.Add(1)
+		return nil, err
+	}
+
+	dialDuration.Observe(time.Since(start).Seconds())
+	connectionLog.Log(ctx, levelTrace, "connected", "address", addr, "localAddress", conn.LocalAddr(), "durationMs", time.Since(start).Milliseconds())
+
+	if t := stageTimerFrom(ctx); t != nil {
+		t.enter(stageTLSHandshake)
+		conn = t.recordHandshake(conn)
+	}
+	if d.capture != nil {
+		conn = d.capture.tap(conn)
+	}
+
+	// The metered connection is the one the TLS connection wraps, so acquireConnection finds it.
+	var proxy string
+	if d.proxyURL != nil {
+		proxy = d.proxyURL.Redacted()
+	}
+	return newMeteredConn(conn, addr, d.fingerprint, proxy), nil
+}
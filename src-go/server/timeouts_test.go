@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestStageDialerUsesTheClientsDialOptions dials without a request's context, as the HTTP/2 transport does, through an
+// upstream proxy that never answers, and from the client's local address. The dial must end at the client's timeout,
+// and connect from its local address unless LocalAddress is set.
+func TestStageDialerUsesTheClientsDialOptions(t *testing.T) {
+	silent := newTestListener(t, func(conn net.Conn, done <-chan struct{}) { <-done })
+	proxyURL, _ := url.Parse("http://" + silent)
+
+	const timeout = 200 * time.Millisecond
+	dialer, err := newStageDialerFactory(proxyURL, "", "test", nil)("", timeout, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if conn, err := dialer.DialContext(context.Background(), "tcp", "destination.test:443"); err == nil {
+		conn.Close()
+		t.Fatal("connected through a proxy that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Errorf("the dial took %s, the client's timeout is %s", elapsed, timeout)
+	}
+
+	remote := make(chan net.Addr, 2)
+	destination := newTestListener(t, func(conn net.Conn, done <-chan struct{}) { remote <- conn.RemoteAddr() })
+	for _, test := range []struct {
+		name         string
+		localAddress string
+		want         string
+	}{
+		{name: "client's local address", want: "127.0.0.2"},
+		{name: "LocalAddress", localAddress: "127.0.0.3", want: "127.0.0.3"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dialer, err := newStageDialerFactory(nil, test.localAddress, "test", nil)("", timeout, &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.DialContext(context.Background(), "tcp", destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if addr := (<-remote).(*net.TCPAddr); addr.IP.String() != test.want {
+				t.Errorf("connected from %s, want %s", addr.IP, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TimingsHeaderKey is the response header with the RequestTimings of a request that set TransportConfig.ReportTimings,
+// e.g. "dns=1.2, connect=8.1, tls=20.4, write=0.1, ttfb=35.9, body=3.0, reused=false", in milliseconds.
+const TimingsHeaderKey = "X-Awesometls-Timings"
+
+// RequestTimings are the phases of the attempt of a request that got the response, in milliseconds, as measured by the
+// spoof server's connection to the destination rather than Burp's to the spoof server.
+type RequestTimings struct {
+	// DNS, Connect and TLS are the host name lookup, the TCP connection (including the upstream proxy's) and the TLS
+	// handshake, which are zero on a Reused connection.
+	DNS     float64
+	Connect float64
+	TLS     float64
+
+	// Write is the time to send the request, FirstByte the time from then to the first byte of the response, and
+	// Body the time to receive the rest of the response.
+	Write     float64
+	FirstByte float64
+	Body      float64
+
+	// Reused reports whether the request was sent on a connection that was open already.
+	Reused bool
+}
+
+// requestTimingsOf returns the phases of the attempt of timer, which returned at responded, and whose body was read
+// until done.
+func requestTimingsOf(timer *stageTimer, responded, done time.Time) RequestTimings {
+	_, har := harTimingsOf(timer, responded, done)
+
+	timer.mutex.Lock()
+	reused := timer.reused
+	timer.mutex.Unlock()
+
+	timings := RequestTimings{Write: har.Send, FirstByte: har.Wait, Body: har.Receive, Reused: reused}
+	if !reused {
+		timings.DNS = max(har.DNS, 0)
+		timings.TLS = max(har.SSL, 0)
+		// As defined by HAR, the connect time includes the TLS handshake.
+		timings.Connect = max(har.Connect-timings.TLS, 0)
+	}
+	return timings
+}
+
+// header formats the timings for TimingsHeaderKey.
+func (t RequestTimings) header() string {
+	var b strings.Builder
+	for _, phase := range t.phases() {
+		fmt.Fprintf(&b, "%s=%.1f, ", phase.name, phase.milliseconds)
+	}
+	fmt.Fprintf(&b, "reused=%t", t.Reused)
+	return b.String()
+}
+
+type requestPhase struct {
+	name         string
+	milliseconds float64
+}
+
+func (t RequestTimings) phases() []requestPhase {
+	return []requestPhase{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLS},
+		{"write", t.Write},
+		{"ttfb", t.FirstByte},
+		{"body", t.Body},
+	}
+}
+
+// observe records the timings in the request_phase_duration_seconds metric, leaving out the phases of connecting on
+// a reused connection.
+func (t RequestTimings) observe(traceId string) {
+	for _, phase := range t.phases() {
+		if t.Reused && (phase.name == "dns" || phase.name == "connect" || phase.name == "tls") {
+			continue
+		}
+		requestPhaseDuration.WithLabelValues(phase.name).(prometheus.ExemplarObserver).ObserveWithExemplar(phase.milliseconds/1000, prometheus.Labels{"trace_id": traceId})
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+
+	utls "github.com/bogdanfinn/utls"
+)
+
+// TlsHeaderKey is the response header with what a request that set TransportConfig.ReportTls negotiated with its
+// destination, as a JSON encoded NegotiatedTLS.
+const TlsHeaderKey = "X-Awesometls-Tls"
+
+// NegotiatedTLS is what the connection a request was sent on negotiated with the destination, e.g. to check that a
+// spoofed fingerprint ends up with the parameters the browser would. The TLS fields are empty for plain HTTP.
+type NegotiatedTLS struct {
+	// Fingerprint is the fingerprint the ClientHello was built from, see UpstreamConnection.Fingerprint.
+	Fingerprint string `json:",omitempty"`
+	// Reused reports whether the connection was open already. Its parameters are the ones of its handshake.
+	Reused bool
+
+	Version     string `json:",omitempty"`
+	CipherSuite string `json:",omitempty"`
+	ALPN        string `json:",omitempty"`
+	// Resumed reports whether the handshake resumed a previous session, ECHAccepted whether the destination accepted
+	// Encrypted Client Hello.
+	Resumed     bool `json:",omitempty"`
+	ECHAccepted bool `json:",omitempty"`
+
+	// The subject, issuer and SHA-256 fingerprint (in hex) of the destination's certificate.
+	CertificateSubject string `json:",omitempty"`
+	CertificateIssuer  string `json:",omitempty"`
+	CertificateSha256  string `json:",omitempty"`
+}
+
+// negotiatedTLS returns what conn, the connection a GotConn trace reported, negotiated.
+func negotiatedTLS(conn net.Conn, reused bool) NegotiatedTLS {
+	negotiated := NegotiatedTLS{Reused: reused}
+
+	var certificates []*x509.Certificate
+	switch c := conn.(type) {
+	case *utls.UConn:
+		state := c.ConnectionState()
+		conn = c.NetConn()
+		negotiated.Version, negotiated.CipherSuite, negotiated.ALPN = tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol
+		negotiated.Resumed, negotiated.ECHAccepted = state.DidResume, state.ECHAccepted
+		certificates = state.PeerCertificates
+	case *tls.Conn:
+		state := c.ConnectionState()
+		conn = c.NetConn()
+		negotiated.Version, negotiated.CipherSuite, negotiated.ALPN = tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol
+		negotiated.Resumed, negotiated.ECHAccepted = state.DidResume, state.ECHAccepted
+		certificates = state.PeerCertificates
+	}
+	if metered, ok := conn.(*meteredConn); ok {
+		negotiated.Fingerprint = metered.fingerprint
+	}
+	if len(certificates) > 0 {
+		leaf := certificates[0]
+		sum := sha256.Sum256(leaf.Raw)
+		negotiated.CertificateSubject, negotiated.CertificateIssuer, negotiated.CertificateSha256 = leaf.Subject.String(), leaf.Issuer.String(), hex.EncodeToString(sum[:])
+	}
+	return negotiated
+}
+
+// header formats the parameters for TlsHeaderKey.
+func (n NegotiatedTLS) header() string {
+	data, _ := json.Marshal(n)
+	return string(data)
+}
+
+func (n NegotiatedTLS) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("fingerprint", n.Fingerprint), slog.Bool("reused", n.Reused)}
+	if n.Version == "" {
+		return slog.GroupValue(attrs...)
+	}
+	attrs = append(attrs,
+		slog.String("version", n.Version),
+		slog.String("cipherSuite", n.CipherSuite),
+		slog.String("alpn", n.ALPN),
+		slog.Bool("resumed", n.Resumed),
+		slog.Bool("echAccepted", n.ECHAccepted),
+	)
+	if n.CertificateSha256 != "" {
+		attrs = append(attrs, slog.String("certificateSubject", n.CertificateSubject), slog.String("certificateIssuer", n.CertificateIssuer), slog.String("certificateSha256", n.CertificateSha256))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// TraceIdHeaderKey is the response header with the trace ID of a request, see TransportConfig.TraceId.
+const TraceIdHeaderKey = "X-Awesometls-Trace-Id"
+
+// maxTraceIdLength is the length of TransportConfig.TraceId at most. Prometheus caps the labels of an exemplar at
+// 128 characters, which leaves room for the trace_id name.
+const maxTraceIdLength = 64
+
+// newTraceId returns a random trace ID for a request that didn't send one, 32 hex digits like the trace IDs of W3C
+// trace contexts.
+func newTraceId() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validateTraceId returns an error unless id can be logged and sent back in a header as-is: at most maxTraceIdLength
+// printable ASCII characters, without spaces.
+func validateTraceId(id string) error {
+	if len(id) > maxTraceIdLength {
+		return fmt.Errorf("TraceId must not be longer than %d characters", maxTraceIdLength)
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return fmt.Errorf("TraceId must only contain printable ASCII characters without spaces, not %q", id[i])
+		}
+	}
+	return nil
+}
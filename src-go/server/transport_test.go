@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bogdanfinn/tls-client/profiles"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// connKey is the context key of the in-flight counter of the connection a request arrived on.
+type connKey struct{}
+
+// TestMultiplexesUpToMaxConcurrentStreams sends more concurrent requests than an HTTP/2 destination allows streams on
+// one connection. Each connection carries at most MAX_CONCURRENT_STREAMS of them, and another is only dialed when the
+// open ones are saturated. Requests with another fingerprint don't share the connections.
+func TestMultiplexesUpToMaxConcurrentStreams(t *testing.T) {
+	const maxConcurrentStreams, requests = 2, 6
+
+	var conns atomic.Int64
+	var inFlight, mostPerConn atomic.Int64
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		perConn := req.Context().Value(connKey{}).(*atomic.Int64)
+		if n := perConn.Add(1); n > mostPerConn.Load() {
+			mostPerConn.Store(n)
+		}
+		defer perConn.Add(-1)
+		if req.URL.Path == "/wait" && inFlight.Add(1) == requests {
+			releaseOnce.Do(func() { close(release) })
+		}
+		if req.URL.Path == "/wait" {
+			select {
+			case <-release:
+			case <-time.After(10 * time.Second):
+			}
+		}
+		fmt.Fprint(w, req.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.Config.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: maxConcurrentStreams}
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.Config.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, &atomic.Int64{})
+	}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Go(func() {
+			if res, body := spoofGet(t, origin, "/wait", nil); res.StatusCode != http.StatusOK || body != "HTTP/2.0" {
+				t.Errorf("request %d: got %d %q", i, res.StatusCode, body)
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := mostPerConn.Load(); got > maxConcurrentStreams {
+		t.Errorf("a connection carried %d concurrent streams, the destination allows %d", got, maxConcurrentStreams)
+	}
+	if want := int64(requests / maxConcurrentStreams); conns.Load() != want {
+		t.Errorf("%d connections were dialed for %d concurrent requests, want %d", conns.Load(), requests, want)
+	}
+
+	dialed := conns.Load()
+	for i := range 3 {
+		if res, _ := spoofGet(t, origin, "/", nil); res.StatusCode != http.StatusOK {
+			t.Fatalf("request %d after the concurrent ones: got %d", i, res.StatusCode)
+		}
+	}
+	if conns.Load() != dialed {
+		t.Errorf("%d connections were dialed for requests the open ones could carry", conns.Load()-dialed)
+	}
+
+	if res, _ := spoofGet(t, origin, "/", map[string]any{"Fingerprint": "firefox_120"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("request with another fingerprint: got %d", res.StatusCode)
+	}
+	if conns.Load() != dialed+1 {
+		t.Error("a request with another fingerprint was sent on a connection of the first one")
+	}
+}
+
+// TestRetriesStreamsRefusedWithGoAway sends a request to an HTTP/2 destination whose first connection answers it
+// with GOAWAY before processing it, as a server shutting down does. The request is sent again on a new connection.
+func TestRetriesStreamsRefusedWithGoAway(t *testing.T) {
+	var conns atomic.Int64
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	origin.EnableHTTP2 = true
+	origin.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		http2.NextProtoTLS: func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+			if conns.Add(1) > 1 {
+				(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{BaseConfig: server, Handler: handler})
+				return
+			}
+			goAwayFirstStream(t, conn)
+		},
+	}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	if res, body := spoofGet(t, origin, "/", nil); res.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("got %d %q, want the request sent again on another connection", res.StatusCode, body)
+	}
+	if got := conns.Load(); got != 2 {
+		t.Errorf("%d connections were dialed, want 2", got)
+	}
+}
+
+// clientPreface is what the client of an HTTP/2 connection sent before its first request: its SETTINGS, in order, and
+// the names of the header fields of the request, in order.
+type clientPreface struct {
+	settings []http2.Setting
+	headers  []string
+}
+
+// recordingTLSConn records what the client sent on a TLS connection, decrypted.
+type recordingTLSConn struct {
+	*tls.Conn
+	mutex sync.Mutex
+	read  bytes.Buffer
+}
+
+func (c *recordingTLSConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mutex.Lock()
+	c.read.Write(b[:n])
+	c.mutex.Unlock()
+	return n, err
+}
+
+// newClientPrefaceOrigin returns an HTTP/2 destination that answers "ok", and a function returning the preface of the
+// first connection to it.
+func newClientPrefaceOrigin(t *testing.T) (*httptest.Server, func() clientPreface) {
+	var first atomic.Pointer[recordingTLSConn]
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	origin.EnableHTTP2 = true
+	origin.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		http2.NextProtoTLS: func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+			recording := &recordingTLSConn{Conn: conn}
+			first.CompareAndSwap(nil, recording)
+			(&http2.Server{}).ServeConn(recording, &http2.ServeConnOpts{BaseConfig: server, Handler: handler})
+		},
+	}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	return origin, func() clientPreface {
+		conn := first.Load()
+		if conn == nil {
+			t.Fatal("no HTTP/2 connection was made")
+		}
+		conn.mutex.Lock()
+		data := bytes.Clone(conn.read.Bytes())
+		conn.mutex.Unlock()
+
+		var preface clientPreface
+		framer := http2.NewFramer(io.Discard, bytes.NewReader(data[len(http2.ClientPreface):]))
+		framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatalf("the connection has no request: %s", err)
+			}
+			switch frame := frame.(type) {
+			case *http2.SettingsFrame:
+				if !frame.IsAck() && preface.settings == nil {
+					frame.ForeachSetting(func(setting http2.Setting) error {
+						preface.settings = append(preface.settings, setting)
+						return nil
+					})
+				}
+			case *http2.MetaHeadersFrame:
+				for _, field := range frame.Fields {
+					preface.headers = append(preface.headers, field.Name)
+				}
+				return preface
+			}
+		}
+	}
+}
+
+// TestProfileWithAnotherHttp2Fingerprint sends requests with profiles of the same TLS fingerprint, one of which takes
+// the HTTP/2 fingerprint of another. Its connection sends the SETTINGS of that other fingerprint.
+func TestProfileWithAnotherHttp2Fingerprint(t *testing.T) {
+	saveTestSettings(t, `{"Profiles":{"chrome":{"Fingerprint":"chrome_131"},"mixed":{"Fingerprint":"chrome_131","Http2Fingerprint":"firefox_120"}}}`)
+
+	for profile, fingerprint := range map[string]string{"chrome": "chrome_131", "mixed": "firefox_120"} {
+		t.Run(profile, func(t *testing.T) {
+			origin, preface := newClientPrefaceOrigin(t)
+			if res, body := spoofGet(t, origin, "/", map[string]any{"Profile": profile}); res.StatusCode != http.StatusOK || body != "ok" {
+				t.Fatalf("got %d %q", res.StatusCode, body)
+			}
+
+			if got, want := preface().settings, http2SettingsOf(fingerprint); !slices.Equal(got, want) {
+				t.Errorf("the connection sent the SETTINGS %v, want the ones of %s %v", got, fingerprint, want)
+			}
+		})
+	}
+}
+
+// TestReplaysTheHttp2FingerprintOfAnImportedCapture imports a captured fingerprint with the HTTP/2 SETTINGS and
+// header order of its client. Requests replaying it send both, rather than the ones of the default fingerprint.
+func TestReplaysTheHttp2FingerprintOfAnImportedCapture(t *testing.T) {
+	origin, preface := newClientPrefaceOrigin(t)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "https://"))
+	raw := clientHelloWithALPN(t, host, []string{"h2", "http/1.1"})
+	info, err := parseClientHello(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := newCapturedFingerprintDocument(newCapturedFingerprint(host, port, info, raw))
+	doc.H2Settings = []H2Setting{{ID: 1, Value: 4096}, {ID: 4, Value: 1 << 20}, {ID: 3, Value: 100}}
+	doc.HeaderOrder = []string{":method", ":path", ":authority", ":scheme", "User-Agent", "Accept-Encoding"}
+	data, _ := json.Marshal(doc)
+	if err := ImportCapturedFingerprint(string(data)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeleteCapturedFingerprint(captureKey(host, port)) })
+
+	if res, body := spoofGet(t, origin, "/", map[string]any{"Fingerprint": "", "UseInterceptedFingerprint": true}); res.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("got %d %q", res.StatusCode, body)
+	}
+
+	sent := preface()
+	want := []http2.Setting{{ID: 1, Val: 4096}, {ID: 4, Val: 1 << 20}, {ID: 3, Val: 100}}
+	if !slices.Equal(sent.settings, want) {
+		t.Errorf("the connection sent the SETTINGS %v, want the captured %v", sent.settings, want)
+	}
+	ordered := slices.DeleteFunc(sent.headers, func(name string) bool {
+		return !slices.Contains([]string{":method", ":path", ":authority", ":scheme", "user-agent", "accept-encoding"}, name)
+	})
+	if want := []string{":method", ":path", ":authority", ":scheme", "user-agent", "accept-encoding"}; !slices.Equal(ordered, want) {
+		t.Errorf("the request sent its headers in the order %v, want the captured %v", sent.headers, want)
+	}
+}
+
+// http2SettingsOf returns the SETTINGS the client profile of fingerprint sends, in order.
+func http2SettingsOf(fingerprint string) []http2.Setting {
+	profile := profiles.MappedTLSClients[fingerprint]
+	var settings []http2.Setting
+	for _, id := range profile.GetSettingsOrder() {
+		settings = append(settings, http2.Setting{ID: http2.SettingID(id), Val: profile.GetSettings()[id]})
+	}
+	return settings
+}
+
+// goAwayFirstStream speaks HTTP/2 on conn until the client opens a stream, which it refuses with a GOAWAY frame that
+// reports no stream as processed.
+func goAwayFirstStream(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+		t.Errorf("reading the client preface: %s", err)
+		return
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Error(err)
+		return
+	}
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Errorf("the client didn't open a stream: %s", err)
+			return
+		}
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			framer.WriteGoAway(0, http2.ErrCodeNo, nil)
+			// The client closes the connection once it moved its streams elsewhere.
+			io.Copy(io.Discard, conn)
+			return
+		}
+	}
+}
@@ -0,0 +1,689 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bogdanfinn/tls-client/profiles"
+)
+
+// Codes of a SettingsError, so the settings tab can react to them without parsing the reason.
+const (
+	SettingsErrorInvalidJSON        = "invalid_json"
+	SettingsErrorInvalidType        = "invalid_type"
+	SettingsErrorInvalidAddress     = "invalid_address"
+	SettingsErrorInvalidValue       = "invalid_value"
+	SettingsErrorInvalidProxyUrl    = "invalid_proxy_url"
+	SettingsErrorInvalidClientHello = "invalid_client_hello"
+	SettingsErrorUnknownFingerprint = "unknown_fingerprint"
+	SettingsErrorOutOfRange         = "out_of_range"
+	SettingsErrorBindFailed         = "bind_failed"
+	SettingsErrorUnsupportedVersion = "unsupported_schema_version"
+	SettingsErrorInvalidScript      = "invalid_script"
+)
+
+// SettingsError describes why a single field of the settings passed to SaveSettings was rejected.
+type SettingsError struct {
+	// Field is the name of the rejected field, or empty if the error isn't specific to one.
+	Field string
+	Value string
+	// Reason is a human-readable explanation.
+	Reason string
+	// Code is one of the SettingsError* constants.
+	Code string
+}
+
+// SettingsErrors is returned by SaveSettings when settings are rejected. None of the settings are applied in that case.
+type SettingsErrors []SettingsError
+
+func (errs SettingsErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		if err.Field == "" {
+			messages[i] = err.Reason
+		} else {
+			messages[i] = fmt.Sprintf("%s: %s", err.Field, err.Reason)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// JSON returns the errors as a JSON array, for the settings tab to highlight the offending fields.
+func (errs SettingsErrors) JSON() string {
+	data, err := json.Marshal(errs)
+	if err != nil {
+		return errs.Error()
+	}
+	return string(data)
+}
+
+func (errs *SettingsErrors) add(field, value, code, format string, v ...any) {
+	*errs = append(*errs, SettingsError{Field: field, Value: value, Reason: fmt.Sprintf(format, v...), Code: code})
+}
+
+// decodeSettings parses the settings passed to SaveSettings after migrating them to the current schema version,
+// turning JSON errors into SettingsErrors.
+func decodeSettings(data string, settings *Settings) error {
+	if strings.TrimSpace(data) == "" {
+		return SettingsErrors{{Reason: "missing settings", Code: SettingsErrorInvalidJSON}}
+	}
+
+	migrated, err := migrateSettings([]byte(data))
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(migrated, settings)
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		return SettingsErrors{{Field: typeErr.Field, Value: typeErr.Value, Reason: fmt.Sprintf("must be of type %s", typeErr.Type), Code: SettingsErrorInvalidType}}
+	default:
+		return SettingsErrors{{Reason: err.Error(), Code: SettingsErrorInvalidJSON}}
+	}
+}
+
+// validate checks every field that would otherwise only fail once a request uses it.
+func (settings *Settings) validate() error {
+	var errs SettingsErrors
+
+	if err := validateProjectId(settings.ProjectId); err != nil {
+		errs.add("ProjectId", settings.ProjectId, SettingsErrorInvalidValue, "%s", err)
+	}
+
+	validateSpoofAddress(&errs, "SpoofProxyAddress", settings.SpoofProxyAddress, settings.RequireClientCertificate)
+	for _, addr := range splitAddrs(settings.InterceptProxyAddress) {
+		validateAddress(&errs, "InterceptProxyAddress", addr)
+	}
+	validateAddress(&errs, "BurpProxyAddress", settings.BurpProxyAddress)
+
+	if settings.UseInterceptedFingerprint && len(splitAddrs(settings.InterceptProxyAddress)) == 0 {
+		errs.add("InterceptProxyAddress", settings.InterceptProxyAddress, SettingsErrorInvalidAddress, "required when UseInterceptedFingerprint is enabled")
+	}
+
+	switch settings.ConfigurationMode {
+	case "", ConfigurationModeChannel, ConfigurationModeHeader:
+	default:
+		errs.add("ConfigurationMode", settings.ConfigurationMode, SettingsErrorInvalidValue, "must be '%s' or '%s'", ConfigurationModeChannel, ConfigurationModeHeader)
+	}
+
+	if _, ok := logLevels[settings.LogLevel]; !ok && settings.LogLevel != "" {
+		errs.add("LogLevel", settings.LogLevel, SettingsErrorInvalidValue, "must be '%s', '%s', '%s', '%s' or '%s'", LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelDebug, LogLevelTrace)
+	}
+
+	switch settings.LogFormat {
+	case "", LogFormatConsole, LogFormatJson:
+	default:
+		errs.add("LogFormat", settings.LogFormat, SettingsErrorInvalidValue, "must be '%s' or '%s'", LogFormatConsole, LogFormatJson)
+	}
+	if settings.LogMaxSizeMB < 0 {
+		errs.add("LogMaxSizeMB", strconv.Itoa(settings.LogMaxSizeMB), SettingsErrorOutOfRange, "must not be negative")
+	}
+	if settings.LogMaxBackups < 0 {
+		errs.add("LogMaxBackups", strconv.Itoa(settings.LogMaxBackups), SettingsErrorOutOfRange, "must not be negative")
+	}
+
+	switch settings.InterceptOpaqueTraffic {
+	case "", OpaqueTrafficTunnel, OpaqueTrafficReject:
+	default:
+		errs.add("InterceptOpaqueTraffic", settings.InterceptOpaqueTraffic, SettingsErrorInvalidValue, "must be '%s' or '%s'", OpaqueTrafficTunnel, OpaqueTrafficReject)
+	}
+
+	validateProxyUrl(&errs, "InterceptUpstreamProxyUrl", settings.InterceptUpstreamProxyUrl)
+	validateProxyUrl(&errs, "ExternalProxyUrl", settings.ExternalProxyUrl)
+	validateFingerprint(&errs, "Fingerprint", settings.Fingerprint, settings.HexClientHello)
+	validateTimeouts(&errs, "", settings.HttpTimeout, settings.DialTimeout, settings.TlsHandshakeTimeout, settings.ResponseHeaderTimeout, settings.IdleReadTimeout)
+	validateMaxResponseBytes(&errs, "MaxResponseBytes", settings.MaxResponseBytes)
+
+	if settings.InterceptedFingerprintMaxEntries < 0 {
+		errs.add("InterceptedFingerprintMaxEntries", strconv.Itoa(settings.InterceptedFingerprintMaxEntries), SettingsErrorOutOfRange, "must not be negative")
+	}
+
+	validateRetryPolicy(&errs, &settings.RetryPolicy)
+
+	validateSocketOptions(&errs, &settings.SocketOptions)
+	validateDnsCache(&errs, &settings.DnsCache)
+	validateCaches(&errs, &settings.Caches)
+	validatePrewarm(&errs, &settings.Prewarm)
+	validateWireCapture(&errs, &settings.WireCapture)
+	validateRecentErrors(&errs, &settings.RecentErrors)
+	validateRedaction(&errs, &settings.Redaction)
+
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"MaxConcurrentRequests", settings.MaxConcurrentRequests},
+		{"MaxConcurrentRequestsPerHost", settings.MaxConcurrentRequestsPerHost},
+	} {
+		if limit.value < 0 {
+			errs.add(limit.field, strconv.Itoa(limit.value), SettingsErrorOutOfRange, "must not be negative")
+		}
+	}
+
+	for _, pattern := range settings.BypassHosts {
+		switch {
+		case strings.TrimSpace(pattern) == "":
+			errs.add("BypassHosts", pattern, SettingsErrorInvalidValue, "host patterns must not be empty")
+		case strings.Contains(pattern, "/"):
+			if _, _, err := net.ParseCIDR(strings.TrimSpace(pattern)); err != nil {
+				errs.add("BypassHosts", pattern, SettingsErrorInvalidValue, "invalid CIDR range")
+			}
+		}
+	}
+
+	validateHooks(&errs, &settings.Hooks)
+	validateScript(&errs, &settings.Script)
+	validateMirror(&errs, &settings.Mirror)
+
+	for _, name := range slices.Sorted(maps.Keys(settings.Profiles)) {
+		profile := settings.Profiles[name]
+		prefix := fmt.Sprintf("Profiles[%s].", name)
+
+		if strings.TrimSpace(name) == "" {
+			errs.add("Profiles", name, SettingsErrorInvalidValue, "profile names must not be empty")
+		}
+
+		validateProxyUrl(&errs, prefix+"ExternalProxyUrl", profile.ExternalProxyUrl)
+		validateFingerprint(&errs, prefix+"Fingerprint", profile.Fingerprint, profile.HexClientHello)
+		validateFingerprint(&errs, prefix+"Http2Fingerprint", profile.Http2Fingerprint, "")
+		validateTimeouts(&errs, prefix, profile.HttpTimeout, profile.DialTimeout, profile.TlsHandshakeTimeout, profile.ResponseHeaderTimeout, profile.IdleReadTimeout)
+		validateMaxResponseBytes(&errs, prefix+"MaxResponseBytes", profile.MaxResponseBytes)
+	}
+
+	if _, ok := settings.Profiles[settings.DefaultProfile]; settings.DefaultProfile != "" && !ok {
+		errs.add("DefaultProfile", settings.DefaultProfile, SettingsErrorInvalidValue, "no profile named '%s'", settings.DefaultProfile)
+	}
+
+	for i, mapping := range settings.ProfileHosts {
+		prefix := fmt.Sprintf("ProfileHosts[%d].", i)
+
+		if strings.TrimSpace(mapping.Host) == "" {
+			errs.add(prefix+"Host", mapping.Host, SettingsErrorInvalidValue, "host patterns must not be empty")
+		}
+		if _, ok := settings.Profiles[mapping.Profile]; !ok {
+			errs.add(prefix+"Profile", mapping.Profile, SettingsErrorInvalidValue, "no profile named '%s'", mapping.Profile)
+		}
+	}
+
+	names := make(map[string]bool, len(settings.Listeners))
+	for i, listener := range settings.Listeners {
+		prefix := fmt.Sprintf("Listeners[%d].", i)
+
+		switch {
+		case listener.Name == "":
+			errs.add(prefix+"Name", listener.Name, SettingsErrorInvalidValue, "must not be empty")
+		case names[listener.Name]:
+			errs.add(prefix+"Name", listener.Name, SettingsErrorInvalidValue, "duplicate listener name")
+		}
+		names[listener.Name] = true
+
+		if listener.Address == "" {
+			errs.add(prefix+"Address", listener.Address, SettingsErrorInvalidAddress, "must not be empty")
+		}
+		validateSpoofAddress(&errs, prefix+"Address", listener.Address, settings.RequireClientCertificate)
+
+		validateProxyUrl(&errs, prefix+"ExternalProxyUrl", listener.ExternalProxyUrl)
+		validateFingerprint(&errs, prefix+"Fingerprint", listener.Fingerprint, listener.HexClientHello)
+		validateTimeouts(&errs, prefix, listener.HttpTimeout, listener.DialTimeout, listener.TlsHandshakeTimeout, listener.ResponseHeaderTimeout, listener.IdleReadTimeout)
+	}
+
+	validateAddress(&errs, "ForwardProxyAddress", settings.ForwardProxyAddress)
+	validateSocksProxy(&errs, &settings.SocksProxy)
+	validateControlAddress(&errs, settings.ControlAddress)
+	validateLoopbackAddress(&errs, settings, "AdminAddress", settings.AdminAddress)
+	validateLoopbackAddress(&errs, settings, "MetricsAddress", settings.MetricsAddress)
+	validateLoopbackAddress(&errs, settings, "PprofAddress", settings.PprofAddress)
+
+	if settings.MetricsHostBuckets < 0 || settings.MetricsHostBuckets > maxMetricsHostBuckets {
+		errs.add("MetricsHostBuckets", strconv.Itoa(settings.MetricsHostBuckets), SettingsErrorOutOfRange, "must be between 0 and %d", maxMetricsHostBuckets)
+	}
+
+	for _, pattern := range settings.InterceptedFingerprintHosts {
+		if strings.TrimSpace(pattern) == "" {
+			errs.add("InterceptedFingerprintHosts", pattern, SettingsErrorInvalidValue, "host patterns must not be empty")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// validateProxyUrl checks that rawURL is a supported upstream proxy URL. Empty URLs are allowed.
+func validateProxyUrl(errs *SettingsErrors, field, rawURL string) {
+	if rawURL == "" {
+		return
+	}
+
+	if _, err := parseUpstreamProxyUrl(rawURL); err != nil {
+		errs.add(field, rawURL, SettingsErrorInvalidProxyUrl, "%s", err)
+	}
+}
+
+// validateFingerprint checks that fingerprint is a known fingerprint and that hexClientHello can be parsed.
+// The latter's errors are reported for the HexClientHello field next to field.
+func validateFingerprint(errs *SettingsErrors, field, fingerprint string, hexClientHello HexClientHello) {
+	if fingerprint != "" && strings.ToLower(fingerprint) != "default" {
+		if _, ok := profiles.MappedTLSClients[fingerprint]; !ok {
+			errs.add(field, fingerprint, SettingsErrorUnknownFingerprint, "unrecognized fingerprint")
+		}
+	}
+
+	if hexClientHello != "" {
+		if _, err := hexClientHello.ToClientHelloSpec(); err != nil {
+			errs.add(strings.TrimSuffix(field, "Fingerprint")+"HexClientHello", string(hexClientHello), SettingsErrorInvalidClientHello, "%s", err)
+		}
+	}
+}
+
+// validateTimeouts checks that none of the timeouts (in the order of the TransportConfig fields) is negative.
+func validateTimeouts(errs *SettingsErrors, prefix string, httpTimeout, dialTimeout, tlsHandshakeTimeout, responseHeaderTimeout, idleReadTimeout int) {
+	for _, timeout := range []struct {
+		field string
+		value int
+	}{
+		{"HttpTimeout", httpTimeout},
+		{"DialTimeout", dialTimeout},
+		{"TlsHandshakeTimeout", tlsHandshakeTimeout},
+		{"ResponseHeaderTimeout", responseHeaderTimeout},
+		{"IdleReadTimeout", idleReadTimeout},
+	} {
+		if timeout.value < 0 {
+			errs.add(prefix+timeout.field, strconv.Itoa(timeout.value), SettingsErrorOutOfRange, "must not be negative")
+		}
+	}
+}
+
+func validateMaxResponseBytes(errs *SettingsErrors, field string, maxResponseBytes *int64) {
+	if maxResponseBytes != nil && *maxResponseBytes < 0 {
+		errs.add(field, strconv.FormatInt(*maxResponseBytes, 10), SettingsErrorOutOfRange, "must not be negative")
+	}
+}
+
+func validateDnsCache(errs *SettingsErrors, cache *DnsCacheSettings) {
+	for _, count := range []struct {
+		field string
+		value int
+		min   int
+	}{
+		{"DnsCache.MinTtlSeconds", cache.MinTtlSeconds, 0},
+		{"DnsCache.MaxTtlSeconds", cache.MaxTtlSeconds, 0},
+		{"DnsCache.NegativeTtlSeconds", cache.NegativeTtlSeconds, -1},
+		{"DnsCache.MaxDialFailures", cache.MaxDialFailures, 0},
+		{"DnsCache.MaxEntries", cache.MaxEntries, 0},
+	} {
+		if count.value < count.min {
+			errs.add(count.field, strconv.Itoa(count.value), SettingsErrorOutOfRange, "must not be less than %d", count.min)
+		}
+	}
+
+	if cache.MaxTtlSeconds > 0 && cache.MinTtlSeconds > cache.MaxTtlSeconds {
+		errs.add("DnsCache.MaxTtlSeconds", strconv.Itoa(cache.MaxTtlSeconds), SettingsErrorOutOfRange, "must not be less than MinTtlSeconds (%d)", cache.MinTtlSeconds)
+	}
+}
+
+func validateWireCapture(errs *SettingsErrors, capture *WireCaptureSettings) {
+	for _, count := range []struct {
+		field string
+		value int
+	}{
+		{"WireCapture.MaxBytes", capture.MaxBytes},
+		{"WireCapture.TtlSeconds", capture.TtlSeconds},
+		{"WireCapture.MaxEntries", capture.MaxEntries},
+	} {
+		if count.value < 0 {
+			errs.add(count.field, strconv.Itoa(count.value), SettingsErrorOutOfRange, "must not be negative")
+		}
+	}
+}
+
+func validateRecentErrors(errs *SettingsErrors, recent *RecentErrorSettings) {
+	for _, count := range []struct {
+		field string
+		value int
+	}{
+		{"RecentErrors.MaxEntries", recent.MaxEntries},
+		{"RecentErrors.CoalesceSeconds", recent.CoalesceSeconds},
+	} {
+		if count.value < 0 {
+			errs.add(count.field, strconv.Itoa(count.value), SettingsErrorOutOfRange, "must not be negative")
+		}
+	}
+}
+
+func validateRedaction(errs *SettingsErrors, redaction *RedactionSettings) {
+	for i, name := range redaction.Headers {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, ": \t\r\n") {
+			errs.add(fmt.Sprintf("Redaction.Headers[%d]", i), name, SettingsErrorInvalidValue, "must be a header name")
+		}
+	}
+	for i, pattern := range redaction.BodyPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs.add(fmt.Sprintf("Redaction.BodyPatterns[%d]", i), pattern, SettingsErrorInvalidValue, "%s", err)
+		}
+	}
+}
+
+func validateCaches(errs *SettingsErrors, caches *CacheSettings) {
+	for _, count := range []struct {
+		field string
+		value int
+	}{
+		{"Caches.LeafCertificates", caches.LeafCertificates},
+		{"Caches.RequestConfigurations", caches.RequestConfigurations},
+		{"Caches.ClientHellos", caches.ClientHellos},
+	} {
+		if count.value < 0 {
+			errs.add(count.field, strconv.Itoa(count.value), SettingsErrorOutOfRange, "must not be negative")
+		}
+	}
+}
+
+func validatePrewarm(errs *SettingsErrors, prewarm *PrewarmSettings) {
+	if prewarm.Connections < 0 || prewarm.Connections > maxPrewarmConnections {
+		errs.add("Prewarm.Connections", strconv.Itoa(prewarm.Connections), SettingsErrorOutOfRange, "must be between 0 and %d", maxPrewarmConnections)
+	}
+
+	for _, count := range []struct {
+		field string
+		value int
+		min   int
+	}{
+		{"Prewarm.RecentHosts", prewarm.RecentHosts, -1},
+		{"Prewarm.IdleSeconds", prewarm.IdleSeconds, 0},
+		{"Prewarm.IntervalSeconds", prewarm.IntervalSeconds, 0},
+	} {
+		if count.value < count.min {
+			errs.add(count.field, strconv.Itoa(count.value), SettingsErrorOutOfRange, "must not be less than %d", count.min)
+		}
+	}
+
+	for i, host := range prewarm.Hosts {
+		if _, _, _, _, err := parsePrewarmHost(host); err != nil {
+			errs.add(fmt.Sprintf("Prewarm.Hosts[%d]", i), host, SettingsErrorInvalidValue, "%s", err)
+		}
+	}
+}
+
+func validateSocketOptions(errs *SettingsErrors, options *SocketOptions) {
+	if options.KeepAliveIntervalSeconds < -1 {
+		errs.add("SocketOptions.KeepAliveIntervalSeconds", strconv.Itoa(options.KeepAliveIntervalSeconds), SettingsErrorOutOfRange, "must be -1 (to disable keep-alives) or more")
+	}
+
+	for _, buffer := range []struct {
+		field string
+		value int
+	}{
+		{"SocketOptions.SendBufferBytes", options.SendBufferBytes},
+		{"SocketOptions.ReceiveBufferBytes", options.ReceiveBufferBytes},
+	} {
+		if buffer.value < 0 || buffer.value > maxSocketBufferBytes {
+			errs.add(buffer.field, strconv.Itoa(buffer.value), SettingsErrorOutOfRange, "must be between 0 and %d", maxSocketBufferBytes)
+		}
+	}
+}
+
+func validateRetryPolicy(errs *SettingsErrors, policy *RetryPolicy) {
+	for _, count := range []struct {
+		field string
+		value int
+	}{
+		{"RetryPolicy.RetryCount", policy.RetryCount},
+		{"RetryPolicy.InitialBackoffMs", policy.InitialBackoffMs},
+		{"RetryPolicy.MaxBackoffMs", policy.MaxBackoffMs},
+	} {
+		if count.value < 0 {
+			errs.add(count.field, strconv.Itoa(count.value), SettingsErrorOutOfRange, "must not be negative")
+		}
+	}
+
+	if effective := policy.effective(); policy.MaxBackoffMs > 0 && effective.InitialBackoffMs > policy.MaxBackoffMs {
+		errs.add("RetryPolicy.MaxBackoffMs", strconv.Itoa(policy.MaxBackoffMs), SettingsErrorOutOfRange, "must not be less than InitialBackoffMs (%d)", effective.InitialBackoffMs)
+	}
+
+	for _, class := range policy.RetryOn {
+		if !slices.Contains(retryClasses, class) {
+			errs.add("RetryPolicy.RetryOn", class, SettingsErrorInvalidValue, "must be one of %s", strings.Join(retryClasses, ", "))
+		}
+	}
+}
+
+func validateHooks(errs *SettingsErrors, hooks *HookSettings) {
+	for _, hook := range []struct {
+		field string
+		url   string
+	}{
+		{"Hooks.RequestUrl", hooks.RequestUrl},
+		{"Hooks.ResponseUrl", hooks.ResponseUrl},
+	} {
+		if hook.url == "" {
+			continue
+		}
+		if parsed, err := url.Parse(hook.url); err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs.add(hook.field, hook.url, SettingsErrorInvalidValue, "must be an absolute http or https URL")
+		}
+	}
+
+	if hooks.TimeoutMs < 0 {
+		errs.add("Hooks.TimeoutMs", strconv.Itoa(hooks.TimeoutMs), SettingsErrorOutOfRange, "must not be negative")
+	}
+}
+
+func validateScript(errs *SettingsErrors, script *ScriptSettings) {
+	if script.TimeoutMs < 0 {
+		errs.add("Script.TimeoutMs", strconv.Itoa(script.TimeoutMs), SettingsErrorOutOfRange, "must not be negative")
+	}
+	if script.MaxSteps < 0 {
+		errs.add("Script.MaxSteps", strconv.Itoa(script.MaxSteps), SettingsErrorOutOfRange, "must not be negative")
+	}
+
+	// Compiling runs the top level of the script, so it's only done with valid limits.
+	if script.TimeoutMs >= 0 && script.MaxSteps >= 0 {
+		if _, err := compileScript(*script); err != nil {
+			errs.add("Script.Source", "", SettingsErrorInvalidScript, "%s", err)
+		}
+	}
+}
+
+func validateMirror(errs *SettingsErrors, mirror *MirrorSettings) {
+	switch mirror.Sink {
+	case "":
+	case MirrorSinkDirectory, MirrorSinkUnix:
+		if mirror.Address == "" {
+			errs.add("Mirror.Address", mirror.Address, SettingsErrorInvalidValue, "must not be empty")
+		}
+	case MirrorSinkHttp:
+		if parsed, err := url.Parse(mirror.Address); err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs.add("Mirror.Address", mirror.Address, SettingsErrorInvalidValue, "must be an absolute http or https URL")
+		}
+	default:
+		errs.add("Mirror.Sink", mirror.Sink, SettingsErrorInvalidValue, "must be one of %s", strings.Join(mirrorSinks, ", "))
+	}
+
+	for _, hosts := range []struct {
+		field    string
+		patterns []string
+	}{
+		{"Mirror.IncludeHosts", mirror.IncludeHosts},
+		{"Mirror.ExcludeHosts", mirror.ExcludeHosts},
+	} {
+		for _, pattern := range hosts.patterns {
+			if strings.TrimSpace(pattern) == "" {
+				errs.add(hosts.field, pattern, SettingsErrorInvalidValue, "host patterns must not be empty")
+			}
+		}
+	}
+
+	if mirror.QueueSize < 0 || mirror.QueueSize > maxMirrorQueueSize {
+		errs.add("Mirror.QueueSize", strconv.Itoa(mirror.QueueSize), SettingsErrorOutOfRange, "must be between 0 and %d", maxMirrorQueueSize)
+	}
+}
+
+// warnLocalAddresses logs a warning for each local address of the settings that isn't assigned to the host right now.
+// They're accepted anyway, since the interface may belong to a VPN that isn't up yet.
+func (settings *Settings) warnLocalAddresses() {
+	check := func(field, localAddress string) {
+		if localAddress == "" {
+			return
+		}
+		if err := checkLocalAddress(localAddress); err != nil {
+			settingsLog.Warn("connections from the local address will fail until it's available", "field", field, "error", err)
+		}
+	}
+
+	check("LocalAddress", settings.LocalAddress)
+	for _, name := range slices.Sorted(maps.Keys(settings.Profiles)) {
+		check(fmt.Sprintf("Profiles[%s].LocalAddress", name), settings.Profiles[name].LocalAddress)
+	}
+}
+
+// validateSocksProxy checks the settings of the SOCKS5 proxy. Its credentials are limited to 255 bytes by RFC 1929.
+func validateSocksProxy(errs *SettingsErrors, socks *SocksProxySettings) {
+	if socks.Enabled && socks.Address == "" {
+		errs.add("SocksProxy.Address", socks.Address, SettingsErrorInvalidAddress, "must not be empty")
+	}
+	validateAddress(errs, "SocksProxy.Address", socks.Address)
+
+	if len(socks.Username) > 255 {
+		errs.add("SocksProxy.Username", socks.Username, SettingsErrorOutOfRange, "must not be longer than 255 bytes")
+	}
+	if len(socks.Password) > 255 {
+		errs.add("SocksProxy.Password", "", SettingsErrorOutOfRange, "must not be longer than 255 bytes")
+	}
+	if socks.Password != "" && socks.Username == "" {
+		errs.add("SocksProxy.Password", "", SettingsErrorInvalidValue, "requires a Username")
+	}
+}
+
+// validateControlAddress checks that addr is a unix socket or a loopback address, so the control plane isn't reachable
+// from other machines.
+func validateControlAddress(errs *SettingsErrors, addr string) {
+	if addr == "" {
+		return
+	}
+
+	if socket, ok := strings.CutPrefix(addr, controlSocketPrefix); ok {
+		if socket == "" {
+			errs.add("ControlAddress", addr, SettingsErrorInvalidAddress, "missing unix socket path")
+		}
+		return
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.add("ControlAddress", addr, SettingsErrorInvalidAddress, "must be of the form ip:port or %s/path", controlSocketPrefix)
+		return
+	}
+
+	if !isLoopbackHost(host) {
+		errs.add("ControlAddress", addr, SettingsErrorInvalidAddress, "must be a loopback address")
+		return
+	}
+
+	validateAddress(errs, "ControlAddress", addr)
+}
+
+// validateLoopbackAddress checks that the admin API, metrics or pprof endpoint (field) listens on a loopback address,
+// on a port no other listener uses.
+func validateLoopbackAddress(errs *SettingsErrors, settings *Settings, field, addr string) {
+	if addr == "" {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.add(field, addr, SettingsErrorInvalidAddress, "must be of the form ip:port")
+		return
+	}
+
+	if !isLoopbackHost(host) {
+		errs.add(field, addr, SettingsErrorInvalidAddress, "must be a loopback address")
+		return
+	}
+
+	validateAddress(errs, field, addr)
+
+	// Port 0 picks a free port, so it can't collide.
+	if n, err := strconv.Atoi(port); err != nil || n == 0 {
+		return
+	}
+
+	others := map[string]string{
+		"SpoofProxyAddress":   settings.SpoofProxyAddress,
+		"ForwardProxyAddress": settings.ForwardProxyAddress,
+		"SocksProxy.Address":  settings.SocksProxy.Address,
+		"ControlAddress":      settings.ControlAddress,
+		"AdminAddress":        settings.AdminAddress,
+		"MetricsAddress":      settings.MetricsAddress,
+		"PprofAddress":        settings.PprofAddress,
+	}
+	delete(others, field)
+	for i, intercept := range splitAddrs(settings.InterceptProxyAddress) {
+		others[fmt.Sprintf("InterceptProxyAddress[%d]", i)] = intercept
+	}
+	for i, listener := range settings.Listeners {
+		others[fmt.Sprintf("Listeners[%d].Address", i)] = listener.Address
+	}
+
+	for _, other := range slices.Sorted(maps.Keys(others)) {
+		if _, otherPort, err := net.SplitHostPort(others[other]); err == nil && otherPort == port {
+			errs.add(field, addr, SettingsErrorInvalidAddress, "must not use the port of %s", other)
+		}
+	}
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback IP.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateAddress checks that addr is a valid listen or dial address ([ip:]port). Empty addresses are allowed.
+// validateSpoofAddress checks the address of the spoof server or a listener, which may also be a pipe address. Pipes
+// don't speak TLS, so they can't ask for the client certificate if requireClientCertificate is set.
+func validateSpoofAddress(errs *SettingsErrors, field, addr string, requireClientCertificate bool) {
+	if name, ok := pipeName(addr); ok {
+		if !pipeNamePattern.MatchString(name) {
+			errs.add(field, addr, SettingsErrorInvalidAddress, "pipe names must be 1 to 64 letters, digits, '.', '_' or '-'")
+		}
+		if requireClientCertificate {
+			errs.add(field, addr, SettingsErrorInvalidAddress, "pipe addresses can't require a client certificate, which RequireClientCertificate does")
+		}
+		return
+	}
+
+	validateAddress(errs, field, addr)
+}
+
+func validateAddress(errs *SettingsErrors, field, addr string) {
+	if addr == "" {
+		return
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.add(field, addr, SettingsErrorInvalidAddress, "must be of the form [ip:]port")
+		return
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs.add(field, addr, SettingsErrorInvalidAddress, "invalid port '%s'", port)
+	}
+}
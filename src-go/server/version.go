@@ -0,0 +1,88 @@
+package server
+
+import (
+	"cmp"
+	"runtime"
+	buildinfo "runtime/debug"
+)
+
+// version, commit and buildDate are set by release builds with
+// `-ldflags "-X server.version=v1.2.3 -X server.commit=<sha> -X server.buildDate=<RFC 3339 time>"`.
+// Builds without them fall back to the build information Go embeds, see GetVersion.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// VersionInfo describes the build of the Go library, as returned by GetVersion.
+type VersionInfo struct {
+	// Version is the release version, or "(devel)" for builds that aren't releases.
+	Version string
+
+	// Commit is the git commit the library was built from, if known.
+	Commit string
+
+	// Modified reports whether the working tree had uncommitted changes when the library was built.
+	Modified bool
+
+	// BuildDate is the time the library was built (RFC 3339), or the time of Commit if the build didn't set it.
+	BuildDate string
+
+	// UtlsVersion and TlsClientVersion are the versions of the bundled uTLS and tls-client modules,
+	// which determine the fingerprints that can be spoofed.
+	UtlsVersion      string
+	TlsClientVersion string
+
+	// GoVersion is the version of the Go runtime.
+	GoVersion string
+}
+
+// GetVersion returns the version and build information of the Go library, so bug reports can tell which build
+// Burp loaded.
+func GetVersion() VersionInfo {
+	result := VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := buildinfo.ReadBuildInfo()
+	if !ok {
+		result.Version = cmp.Or(result.Version, "(devel)")
+		return result
+	}
+
+	result.Version = cmp.Or(result.Version, info.Main.Version, "(devel)")
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if result.Commit == "" {
+				result.Commit = setting.Value
+			}
+		case "vcs.time":
+			if result.BuildDate == "" {
+				result.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			result.Modified = setting.Value == "true"
+		}
+	}
+
+	for _, dep := range info.Deps {
+		depVersion := dep.Version
+		if dep.Replace != nil {
+			depVersion = dep.Replace.Version
+		}
+		switch dep.Path {
+		case "github.com/bogdanfinn/utls":
+			result.UtlsVersion = depVersion
+		case "github.com/bogdanfinn/tls-client":
+			result.TlsClientVersion = depVersion
+		}
+	}
+
+	return result
+}
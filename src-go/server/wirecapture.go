@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bogdanfinn/fhttp/http2"
+	"github.com/bogdanfinn/fhttp/http2/hpack"
+)
+
+// RequestIdHeaderKey is the response header with the number of a request that set TransportConfig.Capture, to export
+// its capture with ExportWireCapture.
+const RequestIdHeaderKey = "X-Awesometls-Request-Id"
+
+// Defaults of WireCaptureSettings.
+const (
+	DefaultWireCaptureMaxBytes   = 1 << 20
+	DefaultWireCaptureTtlSeconds = 600
+	DefaultMaxWireCaptures       = 50
+)
+
+// WireCaptureSettings bound the captures of the requests that set TransportConfig.Capture, which are only kept in
+// memory. Zero keeps the defaults.
+type WireCaptureSettings struct {
+	// MaxBytes is the number of bytes kept of what a captured request sent, and of what it received.
+	// Defaults to [DefaultWireCaptureMaxBytes].
+	MaxBytes int
+
+	// TtlSeconds is the number of seconds captures are kept for. Defaults to [DefaultWireCaptureTtlSeconds].
+	TtlSeconds int
+
+	// MaxEntries is the number of captures kept, forgetting the oldest ones first. Defaults to [DefaultMaxWireCaptures].
+	MaxEntries int
+}
+
+// effective returns the settings with their defaults filled in.
+func (settings WireCaptureSettings) effective() WireCaptureSettings {
+	settings.MaxBytes = cmp.Or(settings.MaxBytes, DefaultWireCaptureMaxBytes)
+	settings.TtlSeconds = cmp.Or(settings.TtlSeconds, DefaultWireCaptureTtlSeconds)
+	settings.MaxEntries = cmp.Or(settings.MaxEntries, DefaultMaxWireCaptures)
+	return settings
+}
+
+// WireCapture is what a request that set TransportConfig.Capture sent and received on its connection to the
+// destination, decrypted, see ExportWireCapture.
+type WireCapture struct {
+	RequestId  uint64
+	TraceId    string
+	Host       string
+	CapturedAt time.Time
+
+	// Protocol is the protocol of the connection, HTTP/1.1 or HTTP/2.0.
+	Protocol string
+
+	// TLSVersion and CipherSuite are the ones negotiated with the destination, empty for plain HTTP.
+	TLSVersion  string
+	CipherSuite string
+
+	// Request is what was sent, and Response what was received.
+	Request  WireCaptureStream
+	Response WireCaptureStream
+
+	// Error is the error the request failed with, if it did.
+	Error string `json:",omitempty"`
+
+	// Note explains why the capture is incomplete, e.g. because the cipher suite can't be decrypted.
+	Note string `json:",omitempty"`
+}
+
+// WireCaptureStream is what was sent in one direction of a connection.
+type WireCaptureStream struct {
+	// Bytes are the plaintext bytes in the order they were sent: the HTTP/1.1 messages as they were serialized,
+	// chunked bodies included, or the HTTP/2 frames (after the client's connection preface). Secrets are redacted
+	// (see RedactionSettings), which HTTP/2 frames can only be in Frames, so Bytes is left out if they had any.
+	Bytes []byte
+
+	// Truncated is set if more than WireCaptureSettings.MaxBytes were sent.
+	Truncated bool
+
+	// Frames summarize the HTTP/2 frames of Bytes.
+	Frames []WireFrame `json:",omitempty"`
+}
+
+// WireFrame is the summary of an HTTP/2 frame.
+type WireFrame struct {
+	Type   string
+	Stream uint32
+	Flags  string `json:",omitempty"`
+	Length uint32
+
+	// Headers are the fields of HEADERS and PUSH_PROMISE frames (and their CONTINUATION frames), in their order on
+	// the wire and including the pseudo headers.
+	Headers []WireHeader `json:",omitempty"`
+
+	// Settings are the settings of SETTINGS frames, in their order on the wire.
+	Settings []H2Setting `json:",omitempty"`
+
+	// WindowIncrement is the increment of WINDOW_UPDATE frames.
+	WindowIncrement uint32 `json:",omitempty"`
+
+	// ErrorCode is the error code of RST_STREAM and GOAWAY frames.
+	ErrorCode string `json:",omitempty"`
+}
+
+// WireHeader is a header field of a WireFrame.
+type WireHeader struct {
+	Name  string
+	Value string
+}
+
+// wireCaptures keeps the captures of the latest requests that set TransportConfig.Capture.
+var wireCaptures = &wireCaptureStore{entries: newBoundedCache[uint64, *wireCapture](cacheWireCaptures, DefaultMaxWireCaptures, 0)}
+
+type wireCaptureStore struct {
+	entries *boundedCache[uint64, *wireCapture]
+	ttl     atomic.Int64
+}
+
+func (s *wireCaptureStore) configure(settings WireCaptureSettings) {
+	settings = settings.effective()
+	s.entries.resize(settings.MaxEntries)
+	s.ttl.Store(int64(time.Duration(settings.TtlSeconds) * time.Second))
+}
+
+func (s *wireCaptureStore) put(capture *wireCapture) {
+	ttl := cmp.Or(time.Duration(s.ttl.Load()), DefaultWireCaptureTtlSeconds*time.Second)
+	s.entries.putExpiring(capture.requestId, capture, time.Now().Add(ttl))
+}
+
+// wireCapture captures the connection of a request to its destination. The client of the request (see newClient)
+// records the bytes of each connection it dials, and logs the secrets of their TLS handshakes to keys. Decrypting
+// them waits until the capture is exported.
+type wireCapture struct {
+	requestId uint64
+	traceId   string
+	host      string
+	started   time.Time
+	tls       bool
+	maxBytes  int
+
+	keys wireKeys
+
+	mutex sync.Mutex
+	// conn is the connection dialed last, which is the one of the last attempt of the request.
+	conn     *wireTap
+	protocol string
+	err      error
+}
+
+func newWireCapture(requestId uint64, host string, config *TransportConfig, settings WireCaptureSettings) *wireCapture {
+	return &wireCapture{
+		requestId: requestId,
+		traceId:   config.TraceId,
+		host:      host,
+		started:   time.Now(),
+		tls:       config.Scheme == "https",
+		maxBytes:  settings.effective().MaxBytes,
+	}
+}
+
+// tap returns conn, recording the bytes written to it and read from it for the capture.
+func (c *wireCapture) tap(conn net.Conn) net.Conn {
+	// The TLS handshake and the framing of the records come on top of the plaintext.
+	limit := c.maxBytes + c.maxBytes/16 + 64<<10
+	tapped := &wireTap{Conn: conn, limit: limit}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn = tapped
+	return tapped
+}
+
+// finish records the protocol of the response and the error the request failed with, if any, and keeps the capture.
+func (c *wireCapture) finish(protocol string, err error) {
+	c.mutex.Lock()
+	c.protocol, c.err = protocol, err
+	c.mutex.Unlock()
+
+	wireCaptures.put(c)
+}
+
+// export decrypts the capture, and redacts its secrets.
+func (c *wireCapture) export() *WireCapture {
+	redactor := currentRedactor()
+
+	c.mutex.Lock()
+	conn, protocol, requestErr := c.conn, c.protocol, c.err
+	c.mutex.Unlock()
+
+	capture := &WireCapture{RequestId: c.requestId, TraceId: c.traceId, Host: c.host, CapturedAt: c.started, Protocol: protocol}
+	if requestErr != nil {
+		capture.Error = redactor.text(requestErr.Error())
+	}
+	if conn == nil {
+		capture.Note = "no connection was made"
+		return capture
+	}
+
+	sent, received, sentCut, receivedCut := conn.recorded()
+	if c.tls {
+		plaintext, err := decryptWire(sent, received, &c.keys)
+		if err != nil {
+			capture.Note = err.Error()
+		}
+		if plaintext == nil {
+			return capture
+		}
+		capture.TLSVersion, capture.CipherSuite = tls.VersionName(plaintext.version), tls.CipherSuiteName(plaintext.cipherSuite)
+		sent, received = plaintext.sent, plaintext.received
+	}
+
+	capture.Request = c.stream(sent, sentCut)
+	capture.Response = c.stream(received, receivedCut)
+
+	if preface, ok := bytes.CutPrefix(capture.Request.Bytes, []byte(http2.ClientPreface)); ok {
+		capture.Protocol = cmp.Or(capture.Protocol, "HTTP/2.0")
+		var sentErr, receivedErr error
+		capture.Request.Frames, sentErr = wireFrames(preface)
+		capture.Response.Frames, receivedErr = wireFrames(capture.Response.Bytes)
+		if err := errors.Join(sentErr, receivedErr); err != nil && capture.Note == "" {
+			capture.Note = fmt.Sprintf("the HTTP/2 frames can't be summarized: %s", err)
+		}
+		sentRedacted := capture.Request.redactFrames(redactor)
+		receivedRedacted := capture.Response.redactFrames(redactor)
+		if (sentRedacted || receivedRedacted) && capture.Note == "" {
+			capture.Note = "the bytes of the HTTP/2 frames are left out since they had secrets, see Settings.Redaction"
+		}
+	} else if len(capture.Request.Bytes) > 0 {
+		capture.Protocol = cmp.Or(capture.Protocol, "HTTP/1.1")
+		capture.Request.Bytes = redactor.http1(capture.Request.Bytes)
+		capture.Response.Bytes = redactor.http1(capture.Response.Bytes)
+	}
+
+	return capture
+}
+
+// redactFrames redacts the values of redacted headers from the Frames of an HTTP/2 stream. The headers of Bytes are
+// compressed, so it can't be redacted: it's left out if any header was redacted, or if its DATA frames have secrets.
+// It returns whether Bytes was left out.
+func (s *WireCaptureStream) redactFrames(redactor *redactor) bool {
+	if redactor.disabled {
+		return false
+	}
+
+	secrets := false
+	data := false
+	for i := range s.Frames {
+		frame := &s.Frames[i]
+		for j, header := range frame.Headers {
+			if redactor.redactsHeader(header.Name) {
+				frame.Headers[j].Value = redactor.token(len(header.Value))
+				secrets = true
+			}
+		}
+		data = data || frame.Type == http2.FrameData.String() && frame.Length > 0
+	}
+	if data && !bytes.Equal(redactor.body(s.Bytes), s.Bytes) {
+		secrets = true
+	}
+	if secrets {
+		s.Bytes = nil
+	}
+	return secrets
+}
+
+// stream returns data as the bytes of one direction of the capture, truncated to maxBytes. cut is whether the
+// connection already sent more than it recorded.
+func (c *wireCapture) stream(data []byte, cut bool) WireCaptureStream {
+	if len(data) > c.maxBytes {
+		return WireCaptureStream{Bytes: data[:c.maxBytes], Truncated: true}
+	}
+	return WireCaptureStream{Bytes: data, Truncated: cut}
+}
+
+// wireTap records the first limit bytes written to and read from a connection.
+type wireTap struct {
+	net.Conn
+	limit int
+
+	mutex       sync.Mutex
+	sent        []byte
+	received    []byte
+	sentCut     bool
+	receivedCut bool
+}
+
+func (t *wireTap) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.record(&t.received, &t.receivedCut, p[:n])
+	return n, err
+}
+
+func (t *wireTap) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	t.record(&t.sent, &t.sentCut, p[:n])
+	return n, err
+}
+
+func (t *wireTap) record(data *[]byte, cut *bool, p []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	room := t.limit - len(*data)
+	if len(p) > room {
+		p = p[:max(room, 0)]
+		*cut = true
+	}
+	*data = append(*data, p...)
+}
+
+// recorded returns copies of the bytes recorded so far, and whether either direction was cut off at the limit.
+func (t *wireTap) recorded() (sent, received []byte, sentCut, receivedCut bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return bytes.Clone(t.sent), bytes.Clone(t.received), t.sentCut, t.receivedCut
+}
+
+// wireFrames summarizes the HTTP/2 frames of data, one direction of a connection. An incomplete last frame is left out.
+func wireFrames(data []byte) ([]WireFrame, error) {
+	framer := http2.NewFramer(io.Discard, bytes.NewReader(data))
+	framer.SetMaxReadFrameSize(1<<24 - 1)
+	// The peer's SETTINGS_HEADER_TABLE_SIZE bounds the dynamic table, which is announced when it grows, so any size
+	// a peer may choose is allowed.
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	framer.ReadMetaHeaders.SetAllowedMaxDynamicTableSize(1 << 24)
+
+	var frames []WireFrame
+	for {
+		f, err := framer.ReadFrame()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+
+		header := f.Header()
+		frame := WireFrame{Type: header.Type.String(), Stream: header.StreamID, Flags: wireFrameFlags(header), Length: header.Length}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			for _, field := range f.Fields {
+				frame.Headers = append(frame.Headers, WireHeader{Name: field.Name, Value: field.Value})
+			}
+		case *http2.SettingsFrame:
+			f.ForeachSetting(func(setting http2.Setting) error {
+				frame.Settings = append(frame.Settings, H2Setting{ID: uint16(setting.ID), Value: setting.Val})
+				return nil
+			})
+		case *http2.WindowUpdateFrame:
+			frame.WindowIncrement = f.Increment
+		case *http2.RSTStreamFrame:
+			frame.ErrorCode = f.ErrCode.String()
+		case *http2.GoAwayFrame:
+			frame.ErrorCode = f.ErrCode.String()
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// wireFrameFlagNames are the names of the flags of each frame type, by bit.
+var wireFrameFlagNames = map[http2.FrameType]map[http2.Flags]string{
+	http2.FrameData:         {http2.FlagDataEndStream: "END_STREAM", http2.FlagDataPadded: "PADDED"},
+	http2.FrameHeaders:      {http2.FlagHeadersEndStream: "END_STREAM", http2.FlagHeadersEndHeaders: "END_HEADERS", http2.FlagHeadersPadded: "PADDED", http2.FlagHeadersPriority: "PRIORITY"},
+	http2.FrameSettings:     {http2.FlagSettingsAck: "ACK"},
+	http2.FramePing:         {http2.FlagPingAck: "ACK"},
+	http2.FrameContinuation: {http2.FlagContinuationEndHeaders: "END_HEADERS"},
+	http2.FramePushPromise:  {http2.FlagPushPromiseEndHeaders: "END_HEADERS", http2.FlagPushPromisePadded: "PADDED"},
+}
+
+// wireFrameFlags returns the names of the flags of a frame, separated by |.
+func wireFrameFlags(header http2.FrameHeader) string {
+	var names []string
+	for bit := http2.Flags(1); bit != 0; bit <<= 1 {
+		if !header.Flags.Has(bit) {
+			continue
+		}
+		name, ok := wireFrameFlagNames[header.Type][bit]
+		if !ok {
+			name = fmt.Sprintf("0x%x", uint8(bit))
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "|")
+}
+
+// GetWireCapture returns the capture of the request numbered requestId, see RequestIdHeaderKey.
+func GetWireCapture(requestId uint64) (*WireCapture, error) {
+	capture, ok := wireCaptures.entries.get(requestId)
+	if !ok {
+		return nil, fmt.Errorf("no capture of request %d, it wasn't captured or expired", requestId)
+	}
+	return capture.export(), nil
+}
+
+// ExportWireCapture returns the capture of the request numbered requestId as a JSON encoded WireCapture, whose bytes
+// are base64 encoded. Captures are only kept in memory, so exporting them is the only way they're written anywhere.
+func ExportWireCapture(requestId uint64) (string, error) {
+	capture, err := GetWireCapture(requestId)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(capture)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// handshakeTypeKeyUpdate is the TLS 1.3 message that switches the sender to its next traffic secret.
+const handshakeTypeKeyUpdate = 0x18
+
+// Labels of the secrets in the key log, see tls.Config.KeyLogWriter.
+const (
+	keyLogLabelTLS12         = "CLIENT_RANDOM"
+	keyLogLabelClientTraffic = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogLabelServerTraffic = "SERVER_TRAFFIC_SECRET_0"
+)
+
+const (
+	recordHeaderLength = 5
+	aeadNonceLength    = 12
+	// tls12ExplicitNonceLength is the length of the part of the AES-GCM nonce that TLS 1.2 sends with each record.
+	tls12ExplicitNonceLength = 8
+)
+
+// wireKeys keeps the secrets the client logs for the connections of a capture, in the NSS key log format the
+// KeyLogWriter of its TLS config writes. It's safe for concurrent use.
+type wireKeys struct {
+	mutex   sync.Mutex
+	secrets map[string][]byte
+}
+
+func (k *wireKeys) Write(p []byte) (int, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for _, line := range strings.Split(string(p), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		if k.secrets == nil {
+			k.secrets = make(map[string][]byte)
+		}
+		k.secrets[fields[0]+" "+strings.ToLower(fields[1])] = secret
+	}
+	return len(p), nil
+}
+
+// secret returns the secret of label for the connection whose ClientHello had clientRandom, or nil.
+func (k *wireKeys) secret(label string, clientRandom []byte) []byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.secrets[label+" "+hex.EncodeToString(clientRandom)]
+}
+
+// wirePlaintext is what the client sent and received over a TLS connection, decrypted.
+type wirePlaintext struct {
+	version     uint16
+	cipherSuite uint16
+	sent        []byte
+	received    []byte
+}
+
+// decryptWire decrypts the records the client sent and received over a TLS connection with the secrets of keys.
+// Both streams may be cut off anywhere, as the capture's size cap requires: an incomplete last record is left out.
+// Only the AEAD cipher suites can be decrypted, which are the ones the fingerprints offer first. Since the records are
+// authenticated, the plaintext returned so far is returned along with an error if decrypting fails along the way.
+func decryptWire(sent, received []byte, keys *wireKeys) (*wirePlaintext, error) {
+	sentRecords, receivedRecords := splitRecords(sent), splitRecords(received)
+
+	clientRandom, err := clientHelloRandom(sentRecords)
+	if err != nil {
+		return nil, err
+	}
+	serverRandom, version, cipherSuite, err := serverHelloOf(receivedRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := &wirePlaintext{version: version, cipherSuite: cipherSuite}
+	suite, ok := wireCipherSuites[cipherSuite]
+	if !ok {
+		return plaintext, fmt.Errorf("cipher suite %s can't be decrypted", tls.CipherSuiteName(cipherSuite))
+	}
+
+	var client, server *recordDecrypter
+	if version == tls.VersionTLS13 {
+		clientSecret, serverSecret := keys.secret(keyLogLabelClientTraffic, clientRandom), keys.secret(keyLogLabelServerTraffic, clientRandom)
+		if clientSecret == nil || serverSecret == nil {
+			return plaintext, errors.New("the TLS handshake didn't complete")
+		}
+		if client, err = suite.tls13Decrypter(clientSecret); err == nil {
+			server, err = suite.tls13Decrypter(serverSecret)
+		}
+	} else {
+		masterSecret := keys.secret(keyLogLabelTLS12, clientRandom)
+		if masterSecret == nil {
+			return plaintext, errors.New("the TLS handshake didn't complete")
+		}
+		client, server, err = suite.tls12Decrypters(masterSecret, clientRandom, serverRandom)
+	}
+	if err != nil {
+		return plaintext, err
+	}
+
+	plaintext.sent, err = client.decrypt(sentRecords)
+	if err != nil {
+		return plaintext, fmt.Errorf("decrypting the records sent: %w", err)
+	}
+	plaintext.received, err = server.decrypt(receivedRecords)
+	if err != nil {
+		return plaintext, fmt.Errorf("decrypting the records received: %w", err)
+	}
+	return plaintext, nil
+}
+
+// splitRecords splits data into its TLS records, including their headers, leaving out an incomplete last one.
+func splitRecords(data []byte) [][]byte {
+	var records [][]byte
+	for len(data) >= recordHeaderLength {
+		length := recordHeaderLength + int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < length {
+			break
+		}
+		records = append(records, data[:length:length])
+		data = data[length:]
+	}
+	return records
+}
+
+// handshakeMessages calls f with the plaintext handshake messages at the start of records, in order, until it returns false.
+// Change cipher spec records, which TLS 1.3 sends for compatibility, are skipped.
+func handshakeMessages(records [][]byte, f func(messageType uint8, body []byte) bool) {
+	var buffered []byte
+	for _, record := range records {
+		switch record[0] {
+		case recordTypeChangeCipherSpec:
+			continue
+		case recordTypeHandshake:
+		default:
+			return
+		}
+
+		buffered = append(buffered, record[recordHeaderLength:]...)
+		for len(buffered) >= 4 {
+			length := 4 + (int(buffered[1])<<16 | int(buffered[2])<<8 | int(buffered[3]))
+			if len(buffered) < length {
+				break
+			}
+			if !f(buffered[0], buffered[4:length]) {
+				return
+			}
+			buffered = buffered[length:]
+		}
+	}
+}
+
+// clientHelloRandom returns the Random value of the ClientHello the client started the connection with.
+func clientHelloRandom(records [][]byte) ([]byte, error) {
+	var random []byte
+	handshakeMessages(records, func(messageType uint8, body []byte) bool {
+		// Version (2) + random (32).
+		if messageType == handshakeTypeClientHello && len(body) >= 34 {
+			random = body[2:34]
+		}
+		return false
+	})
+	if random == nil {
+		return nil, errors.New("no ClientHello was sent")
+	}
+	return random, nil
+}
+
+// serverHelloOf returns the Random value, the version and the cipher suite of the ServerHello the server answered with.
+// A HelloRetryRequest is skipped, since the handshake goes on with the ServerHello that follows it.
+func serverHelloOf(records [][]byte) (random []byte, version, cipherSuite uint16, err error) {
+	err = errors.New("no ServerHello was received")
+	handshakeMessages(records, func(messageType uint8, body []byte) bool {
+		if messageType != handshakeTypeServerHello {
+			return true
+		}
+
+		s := cryptobyte.String(body)
+		var sessionId, extensions cryptobyte.String
+		var compression uint8
+		if !s.ReadUint16(&version) || !s.ReadBytes(&random, 32) || !s.ReadUint8LengthPrefixed(&sessionId) ||
+			!s.ReadUint16(&cipherSuite) || !s.ReadUint8(&compression) {
+			err = errors.New("malformed ServerHello")
+			return false
+		}
+		if bytes.Equal(random, helloRetryRequestRandom) {
+			return true
+		}
+
+		if s.ReadUint16LengthPrefixed(&extensions) {
+			for !extensions.Empty() {
+				var extension uint16
+				var data cryptobyte.String
+				if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+					break
+				}
+				if extension == extensionSupportedVersions {
+					data.ReadUint16(&version)
+				}
+			}
+		}
+		err = nil
+		return false
+	})
+	return random, version, cipherSuite, err
+}
+
+// wireCipherSuite is an AEAD cipher suite that captures can be decrypted with.
+type wireCipherSuite struct {
+	keyLength int
+	hash      func() hash.Hash
+	aead      func(key []byte) (cipher.AEAD, error)
+	// fixedNonceLength is the length of the part of the nonce that's derived from the keys in TLS 1.2.
+	// The rest of the AES-GCM nonce is sent with each record.
+	fixedNonceLength int
+}
+
+var (
+	aes128Gcm = wireCipherSuite{keyLength: 16, hash: sha256.New, aead: newAesGcm, fixedNonceLength: 4}
+	aes256Gcm = wireCipherSuite{keyLength: 32, hash: sha512.New384, aead: newAesGcm, fixedNonceLength: 4}
+	chacha20  = wireCipherSuite{keyLength: 32, hash: sha256.New, aead: chacha20poly1305.New, fixedNonceLength: aeadNonceLength}
+)
+
+var wireCipherSuites = map[uint16]wireCipherSuite{
+	tls.TLS_AES_128_GCM_SHA256:                        aes128Gcm,
+	tls.TLS_AES_256_GCM_SHA384:                        aes256Gcm,
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  chacha20,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       aes128Gcm,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         aes128Gcm,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               aes128Gcm,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       aes256Gcm,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         aes256Gcm,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               aes256Gcm,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: chacha20,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   chacha20,
+}
+
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tls13Decrypter returns the decrypter of the records protected with the traffic secret, see RFC 8446, Section 7.3.
+func (suite wireCipherSuite) tls13Decrypter(secret []byte) (*recordDecrypter, error) {
+	d := &recordDecrypter{suite: suite, tls13: true}
+	return d, d.useSecret(secret)
+}
+
+// tls12Decrypters returns the decrypters of the records the client and the server protect with the keys derived from
+// masterSecret, see RFC 5246, Section 6.3.
+func (suite wireCipherSuite) tls12Decrypters(masterSecret, clientRandom, serverRandom []byte) (*recordDecrypter, *recordDecrypter, error) {
+	keyBlock := tls12Prf(suite.hash, masterSecret, "key expansion", append(bytes.Clone(serverRandom), clientRandom...), 2*suite.keyLength+2*suite.fixedNonceLength)
+	clientKey, keyBlock := keyBlock[:suite.keyLength], keyBlock[suite.keyLength:]
+	serverKey, keyBlock := keyBlock[:suite.keyLength], keyBlock[suite.keyLength:]
+	clientIv, serverIv := keyBlock[:suite.fixedNonceLength], keyBlock[suite.fixedNonceLength:]
+
+	client := &recordDecrypter{suite: suite, iv: clientIv}
+	server := &recordDecrypter{suite: suite, iv: serverIv}
+	var err error
+	if client.aead, err = suite.aead(clientKey); err != nil {
+		return nil, nil, err
+	}
+	if server.aead, err = suite.aead(serverKey); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// tls12Prf is the pseudorandom function of TLS 1.2, P_hash of RFC 5246, Section 5.
+func tls12Prf(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+
+	var out []byte
+	a := seed
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of RFC 8446, Section 7.1, with an empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) ([]byte, error) {
+	var info cryptobyte.Builder
+	info.AddUint16(uint16(length))
+	info.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	info.AddUint8LengthPrefixed(func(*cryptobyte.Builder) {})
+	return hkdf.Expand(h, secret, string(info.BytesOrPanic()), length)
+}
+
+// recordDecrypter decrypts the records one side of a connection sent, in order.
+type recordDecrypter struct {
+	suite wireCipherSuite
+	tls13 bool
+
+	secret []byte
+	aead   cipher.AEAD
+	iv     []byte
+	seq    uint64
+}
+
+// useSecret switches to the keys of the TLS 1.3 traffic secret, starting the sequence numbers over.
+func (d *recordDecrypter) useSecret(secret []byte) error {
+	key, err := hkdfExpandLabel(d.suite.hash, secret, "key", d.suite.keyLength)
+	if err != nil {
+		return err
+	}
+	if d.iv, err = hkdfExpandLabel(d.suite.hash, secret, "iv", aeadNonceLength); err != nil {
+		return err
+	}
+	if d.aead, err = d.suite.aead(key); err != nil {
+		return err
+	}
+	d.secret, d.seq = secret, 0
+	return nil
+}
+
+// decrypt returns the application data of records. The records before the traffic keys are in use, which are either
+// plaintext or protected with the keys of the handshake, are skipped, and so is everything after an alert.
+func (d *recordDecrypter) decrypt(records [][]byte) ([]byte, error) {
+	var data []byte
+	started := false
+	for _, record := range records {
+		var contentType uint8
+		var plaintext []byte
+		var err error
+		if d.tls13 {
+			if record[0] != recordTypeApplicationData {
+				continue
+			}
+			// The records protected with the handshake keys look just like the others, but don't decrypt with these.
+			contentType, plaintext, err = d.open(record)
+			if err != nil && !started {
+				continue
+			}
+		} else {
+			if !started {
+				started = record[0] == recordTypeChangeCipherSpec
+				continue
+			}
+			contentType, plaintext, err = d.open(record)
+		}
+		if err != nil {
+			return data, err
+		}
+		started = true
+
+		switch contentType {
+		case recordTypeApplicationData:
+			data = append(data, plaintext...)
+		case recordTypeAlert:
+			return data, nil
+		case recordTypeHandshake:
+			if d.tls13 && len(plaintext) > 0 && plaintext[0] == handshakeTypeKeyUpdate {
+				next, err := hkdfExpandLabel(d.suite.hash, d.secret, "traffic upd", len(d.secret))
+				if err == nil {
+					err = d.useSecret(next)
+				}
+				if err != nil {
+					return data, err
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+// open decrypts record, returning its content type and plaintext.
+func (d *recordDecrypter) open(record []byte) (uint8, []byte, error) {
+	payload := record[recordHeaderLength:]
+	nonce := make([]byte, aeadNonceLength)
+	var additionalData []byte
+
+	if d.tls13 {
+		copy(nonce, d.iv)
+		xorSequenceNumber(nonce, d.seq)
+		additionalData = record[:recordHeaderLength]
+	} else {
+		if d.suite.fixedNonceLength < aeadNonceLength {
+			if len(payload) < tls12ExplicitNonceLength {
+				return 0, nil, errors.New("record too short")
+			}
+			copy(nonce, d.iv)
+			copy(nonce[d.suite.fixedNonceLength:], payload[:tls12ExplicitNonceLength])
+			payload = payload[tls12ExplicitNonceLength:]
+		} else {
+			copy(nonce, d.iv)
+			xorSequenceNumber(nonce, d.seq)
+		}
+		if len(payload) < d.aead.Overhead() {
+			return 0, nil, errors.New("record too short")
+		}
+		additionalData = binary.BigEndian.AppendUint64(nil, d.seq)
+		additionalData = append(additionalData, record[:3]...)
+		additionalData = binary.BigEndian.AppendUint16(additionalData, uint16(len(payload)-d.aead.Overhead()))
+	}
+
+	plaintext, err := d.aead.Open(nil, nonce, payload, additionalData)
+	if err != nil {
+		return 0, nil, fmt.Errorf("record %d doesn't decrypt: %w", d.seq, err)
+	}
+	d.seq++
+
+	if !d.tls13 {
+		return record[0], plaintext, nil
+	}
+
+	// The inner plaintext of TLS 1.3 ends with its content type, followed by zero padding.
+	end := len(plaintext) - 1
+	for end >= 0 && plaintext[end] == 0 {
+		end--
+	}
+	if end < 0 {
+		return 0, nil, fmt.Errorf("record %d has no content type", d.seq-1)
+	}
+	return plaintext[end], plaintext[:end], nil
+}
+
+// xorSequenceNumber XORs the sequence number into the end of nonce, which is how both TLS 1.3 and ChaCha20-Poly1305
+// in TLS 1.2 derive the nonce of each record.
+func xorSequenceNumber(nonce []byte, seq uint64) {
+	offset := len(nonce) - 8
+	for i := range 8 {
+		nonce[offset+i] ^= byte(seq >> (56 - 8*i))
+	}
+}
@@ -0,0 +1,94 @@
+package burp;
+
+import burp.api.montoya.MontoyaApi;
+import com.google.gson.Gson;
+import com.google.gson.JsonArray;
+import com.google.gson.JsonObject;
+import com.google.gson.JsonParser;
+
+import java.io.ByteArrayInputStream;
+import java.io.File;
+import java.io.FileOutputStream;
+import java.security.KeyFactory;
+import java.security.KeyStore;
+import java.security.SecureRandom;
+import java.security.cert.Certificate;
+import java.security.cert.CertificateFactory;
+import java.security.spec.PKCS8EncodedKeySpec;
+import java.util.Base64;
+
+/**
+ * Installs the one-time client certificate of the Go server in Burp's "Client TLS certificates" settings,
+ * so Burp presents it to the spoof server when RequireClientCertificate is enabled.
+ */
+public class ClientCertificate {
+    private static final String ALIAS = "awesome-tls";
+
+    /**
+     * The certificate as returned by GetClientCertificate.
+     */
+    private static class Document {
+        String Certificate;
+        String PrivateKey;
+    }
+
+    private final MontoyaApi api;
+
+    public ClientCertificate(MontoyaApi api) {
+        this.api = api;
+    }
+
+    /**
+     * Installs the client certificate for connections to host, replacing any that was installed before.
+     */
+    public void install(String host) throws Exception {
+        var json = ServerLibrary.INSTANCE.GetClientCertificate();
+        if (!json.startsWith("{")) {
+            throw new Exception(json);
+        }
+
+        var document = new Gson().fromJson(json, Document.class);
+        var certificate = CertificateFactory.getInstance("X.509").generateCertificate(new ByteArrayInputStream(Base64.getDecoder().decode(document.Certificate)));
+        var privateKey = KeyFactory.getInstance("EC").generatePrivate(new PKCS8EncodedKeySpec(Base64.getDecoder().decode(document.PrivateKey)));
+
+        var passwordBytes = new byte[24];
+        new SecureRandom().nextBytes(passwordBytes);
+        var password = Base64.getEncoder().encodeToString(passwordBytes);
+
+        var keyStore = KeyStore.getInstance("PKCS12");
+        keyStore.load(null, null);
+        keyStore.setKeyEntry(ALIAS, privateKey, password.toCharArray(), new Certificate[]{certificate});
+
+        var file = File.createTempFile("awesome-tls-client", ".p12");
+        file.deleteOnExit();
+        try (var out = new FileOutputStream(file)) {
+            keyStore.store(out, password.toCharArray());
+        }
+
+        var options = JsonParser.parseString(this.api.burpSuite().exportProjectOptionsAsJson("project_options.ssl.client_certificates")).getAsJsonObject();
+        var clientCertificates = options.getAsJsonObject("project_options").getAsJsonObject("ssl").getAsJsonObject("client_certificates");
+        var certificates = clientCertificates.has("certificates") ? clientCertificates.getAsJsonArray("certificates") : new JsonArray();
+
+        // Certificates installed for the spoof server before are replaced, the user's own certificates are kept.
+        var next = new JsonArray();
+        for (var element : certificates) {
+            var entry = element.getAsJsonObject();
+            if (!entry.has("file") || !new File(entry.get("file").getAsString()).getName().startsWith("awesome-tls-client")) {
+                next.add(entry);
+            }
+        }
+
+        var entry = new JsonObject();
+        entry.addProperty("destination_host", host);
+        entry.addProperty("enabled", true);
+        entry.addProperty("file", file.getAbsolutePath());
+        entry.addProperty("password", password);
+        entry.addProperty("type", "pkcs12");
+        next.add(entry);
+
+        clientCertificates.add("certificates", next);
+        clientCertificates.addProperty("use_user_options", false);
+
+        this.api.burpSuite().importProjectOptionsFromJson(options.toString());
+    }
+}
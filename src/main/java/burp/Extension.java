@@ -8,32 +8,58 @@ import burp.api.montoya.proxy.http.ProxyRequestHandler;
 import burp.api.montoya.proxy.http.ProxyRequestReceivedAction;
 import burp.api.montoya.proxy.http.ProxyRequestToBeSentAction;
 import com.google.gson.Gson;
+import com.google.gson.JsonObject;
 
 import java.net.URI;
 import java.net.URL;
 import java.nio.charset.StandardCharsets;
+import java.util.Base64;
 import java.util.Objects;
+import java.util.UUID;
 
 public class Extension implements BurpExtension {
     private MontoyaApi api;
     private Gson gson;
     private Settings settings;
+    private UpstreamProxyRules upstreamProxyRules;
+    private Thread logForwarder;
 
     private static final String HEADER_KEY = "Awesometlsconfig";
 
+    private static final long LOG_POLL_INTERVAL_MS = 1000;
+
+    private static final long LISTEN_POLL_INTERVAL_MS = 100;
+
+    private static final long LISTEN_TIMEOUT_MS = 10_000;
+
+    /**
+     * A log record of the Go server, as returned by GetLogs.
+     */
+    private static class LogRecord {
+        long Sequence;
+        String Level;
+        String Message;
+        JsonObject Fields;
+    }
+
     @Override
     public void initialize(MontoyaApi api) {
         this.api = api;
         this.gson = new Gson();
         this.settings = new Settings(api);
+        this.upstreamProxyRules = new UpstreamProxyRules(api);
 
         api.extension().setName("Awesome TLS");
         api.extension().registerUnloadingHandler(() -> {
+            logForwarder.interrupt();
             var err = ServerLibrary.INSTANCE.StopServer();
             if (!err.isEmpty()) {
                 api.logging().logToError(err);
             }
         });
+        logForwarder = new Thread(this::forwardServerLogs);
+        logForwarder.setDaemon(true);
+        logForwarder.start();
         api.userInterface().registerSuiteTab("Awesome TLS", new SettingsTab(settings).getUI());
         api.proxy().registerRequestHandler(new ProxyRequestHandler() {
             @Override
@@ -47,6 +73,16 @@ public class Extension implements BurpExtension {
             }
         });
 
+        var restoreErr = settings.restorePersisted();
+        if (!restoreErr.isEmpty()) {
+            api.logging().logToError("Failed to restore persisted settings: " + restoreErr);
+        }
+
+        var err = settings.apply();
+        if (!err.isEmpty()) {
+            api.logging().logToError(err);
+        }
+
         new Thread(() -> {
             var err = ServerLibrary.INSTANCE.StartServer(settings.getSpoofProxyAddress());
             if (!err.isEmpty()) {
@@ -57,6 +93,78 @@ public class Extension implements BurpExtension {
                 }
             }
         }).start();
+
+        if (settings.getRequireClientCertificate()) {
+            new Thread(this::installClientCertificate).start();
+        }
+    }
+
+    /**
+     * Waits for the spoof server to start, and installs its client certificate in Burp.
+     */
+    private void installClientCertificate() {
+        try {
+            new ClientCertificate(api).install(new URI("https://" + spoofAddress()).getHost());
+        } catch (Exception e) {
+            api.logging().logToError("Failed to install the client certificate of the spoof server: " + e);
+        }
+    }
+
+    /**
+     * Copies the Go server's log records to the extension's output, and its errors to the extension's errors, since
+     * Burp doesn't show the Go server's stderr. Runs until the thread is interrupted.
+     */
+    private void forwardServerLogs() {
+        var after = 0L;
+        while (!Thread.currentThread().isInterrupted()) {
+            try {
+                for (var record : gson.fromJson(ServerLibrary.INSTANCE.GetLogs(after), LogRecord[].class)) {
+                    after = record.Sequence;
+                    var line = new StringBuilder(record.Level.toUpperCase()).append(' ');
+                    if (record.Fields != null && record.Fields.has("component")) {
+                        line.append(record.Fields.get("component").getAsString()).append(": ");
+                    }
+                    line.append(record.Message);
+                    if (record.Fields != null) {
+                        for (var field : record.Fields.entrySet()) {
+                            if (!field.getKey().equals("component")) {
+                                var value = field.getValue();
+                                line.append(' ').append(field.getKey()).append('=').append(value.isJsonPrimitive() ? value.getAsString() : value.toString());
+                            }
+                        }
+                    }
+                    if (record.Level.equals("error")) {
+                        api.logging().logToError(line.toString());
+                    } else {
+                        api.logging().logToOutput(line.toString());
+                    }
+                }
+                Thread.sleep(LOG_POLL_INTERVAL_MS);
+            } catch (InterruptedException e) {
+                return;
+            } catch (Exception e) {
+                api.logging().logToError("Failed to read the Go server's log: " + e);
+                return;
+            }
+        }
+    }
+
+    /**
+     * Returns the address the spoof server listens on, which has the port the Go server chose if the setting has port 0.
+     * Until the server listens there's no address to send requests to (the setting may be ":0"), so this waits for it,
+     * and throws if it doesn't listen within LISTEN_TIMEOUT_MS.
+     */
+    private String spoofAddress() throws InterruptedException {
+        var deadline = System.currentTimeMillis() + LISTEN_TIMEOUT_MS;
+        var address = ServerLibrary.INSTANCE.GetListenAddress();
+        while (address.isEmpty()) {
+            if (System.currentTimeMillis() >= deadline) {
+                throw new IllegalStateException("the spoof server isn't listening on " + settings.getSpoofProxyAddress());
+            }
+            Thread.sleep(LISTEN_POLL_INTERVAL_MS);
+            address = ServerLibrary.INSTANCE.GetListenAddress();
+        }
+        return address;
     }
 
     private ProxyRequestToBeSentAction processHttpRequest(InterceptedRequest request) {
@@ -72,15 +180,27 @@ public class Extension implements BurpExtension {
                 headerOrder[i] = request.headers().get(i).name();
             }
 
-            var transportConfig = settings.toTransportConfig();
+            var transportConfig = new TransportConfig();
             transportConfig.Host = requestURL.getHost();
             transportConfig.Scheme = requestURL.getProtocol();
             transportConfig.HeaderOrder = headerOrder;
+            transportConfig.ExternalProxyUrl = upstreamProxyRules.proxyFor(requestURL.getHost());
+            transportConfig.TraceId = UUID.randomUUID().toString();
 
             var goConfigJSON = gson.toJson(transportConfig);
-            var url = new URI("https://" + settings.getSpoofProxyAddress()).toURL();
+            var url = new URI("https://" + spoofAddress()).toURL();
             var httpService = HttpService.httpService(url.getHost(), url.getPort(), Objects.equals(url.getProtocol(), "https"));
-            var nextRequest = request.withService(httpService).withAddedHeader(HEADER_KEY, goConfigJSON);
+            var nextRequest = request.withService(httpService);
+            if (settings.getConfigurationMode().equals(Settings.CONFIGURATION_MODE_HEADER)) {
+                nextRequest = nextRequest.withAddedHeader(HEADER_KEY, goConfigJSON);
+            } else {
+                // The request is sent as-is, the Go server matches it to its configuration by its request line and body.
+                var rawRequest = Base64.getEncoder().encodeToString(nextRequest.toByteArray().getBytes());
+                var err = ServerLibrary.INSTANCE.RegisterTransportConfig(rawRequest, goConfigJSON);
+                if (!err.isEmpty()) {
+                    api.logging().logToError(err);
+                }
+            }
 
             return ProxyRequestToBeSentAction.continueWith(nextRequest);
         } catch (Exception e) {
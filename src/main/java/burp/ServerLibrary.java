@@ -11,7 +11,73 @@ public interface ServerLibrary extends Library {
 
     String StopServer();
 
+    String StartListener(String name);
+
+    String StopListener(String name);
+
+    String GetListeners();
+
+    String GetListenAddress();
+
+    String GetForwardProxyAddress();
+
+    String GetSocksProxyAddress();
+
+    String GetAdminToken();
+
+    String GetInterceptListenAddresses();
+
+    String GetClientCertificate();
+
+    String LoadPersistedSettings(String projectId);
+
+    String SaveSettings(String settings);
+
+    String RegisterTransportConfig(String request, String config);
+
+    String ExportConfiguration(boolean includeSecrets);
+
+    String ImportConfiguration(String document);
+
     String GetFingerprints();
 
+    String GetRetryPolicy();
+
+    String ListProfiles();
+
+    String GetCapturedFingerprints();
+
+    String DeleteCapturedFingerprint(String key);
+
+    String ExportCapturedFingerprint(String host);
+
+    String ImportCapturedFingerprint(String document);
+
+    void ClearCapturedFingerprints();
+
+    void ClearDnsCache();
+
+    String StartRecording(String options);
+
+    void StopRecording();
+
+    String ExportHar();
+
+    String ExportWireCapture(long requestId);
+
+    String GetLogs(long after);
+
+    String BuildCurlCommand(String request);
+
+    String GetVersion();
+
+    String Healthcheck();
+
+    String GetConnectionStats();
+
+    String GetRecentErrors();
+
+    void ClearRecentErrors();
+
     void SmokeTest();
 }
@@ -2,9 +2,11 @@ package burp;
 
 import burp.api.montoya.MontoyaApi;
 import burp.api.montoya.persistence.Preferences;
+import com.google.gson.Gson;
 
 public class Settings {
     private final Preferences storage;
+    private final String projectId;
 
     private final String spoofProxyAddress = "SpoofProxyAddress";
     private final String interceptProxyAddress = "InterceptProxyAddress";
@@ -14,6 +16,8 @@ public class Settings {
     private final String useInterceptedFingerprint = "UseInterceptedFingerprint";
     private final String httpTimeout = "HttpTimeout";
     private final String externalProxyUrl = "ExternalProxyUrl";
+    private final String configurationMode = "ConfigurationMode";
+    private final String requireClientCertificate = "RequireClientCertificate";
 
     public static final String DEFAULT_SPOOF_PROXY_ADDRESS = "127.0.0.1:8887";
     public static final String DEFAULT_INTERCEPT_PROXY_ADDRESS = "127.0.0.1:8886";
@@ -22,36 +26,58 @@ public class Settings {
     public static final String DEFAULT_TLS_FINGERPRINT = "default";
     public static final Boolean USE_INTERCEPTED_FINGERPRINT = false;
     public static final String DEFAULT_EXTERNAL_PROXY_URL = "";
+    public static final String CONFIGURATION_MODE_CHANNEL = "channel";
+    public static final String CONFIGURATION_MODE_HEADER = "header";
+    public static final Boolean DEFAULT_REQUIRE_CLIENT_CERTIFICATE = false;
+
+    /**
+     * Prefix of the spoof proxy addresses that name a local pipe. Burp only sends requests to TCP addresses, so the
+     * extension doesn't take them: they're for the command-line server.
+     */
+    public static final String PIPE_ADDRESS_PREFIX = "pipe://";
 
     public Settings(MontoyaApi api) {
         this.storage = api.persistence().preferences();
+        // The Go server keeps the state of each project in a directory named after it.
+        this.projectId = api.project().id().replaceAll("[^A-Za-z0-9._-]", "_");
     }
 
+    // Defaults aren't stored, so the settings the user never set can be left out of toServerSettings.
+
     public String read(String key, String defaultValue) {
         var value = this.storage.getString(key);
-        if (value == null || value.isEmpty()) {
-            this.write(key, defaultValue);
-            return defaultValue;
-        }
-        return value;
+        return value == null || value.isEmpty() ? defaultValue : value;
     }
 
     public Boolean read(String key, Boolean defaultValue) {
         var value = this.storage.getBoolean(key);
-        if (value == null) {
-            this.storage.setBoolean(key, defaultValue);
-            return defaultValue;
-        }
-        return value;
+        return value == null ? defaultValue : value;
     }
 
     public Integer read(String key, Integer defaultValue) {
         var value = this.storage.getInteger(key);
-        if (value == null) {
-            this.storage.setInteger(key, defaultValue);
-            return defaultValue;
+        return value == null ? defaultValue : value;
+    }
+
+    /**
+     * Returns the setting key like read, or null if the user never set it.
+     */
+    private String readSet(String key, String defaultValue) {
+        return this.storage.getString(key) == null ? null : this.read(key, defaultValue);
+    }
+
+    /**
+     * Reports whether the user set any of the settings.
+     */
+    private boolean isAnySet() {
+        for (var key : new String[]{spoofProxyAddress, interceptProxyAddress, burpProxyAddress, fingerprint, hexClientHello, externalProxyUrl, configurationMode}) {
+            if (this.storage.getString(key) != null) {
+                return true;
+            }
         }
-        return value;
+        return this.storage.getBoolean(useInterceptedFingerprint) != null
+                || this.storage.getBoolean(requireClientCertificate) != null
+                || this.storage.getInteger(httpTimeout) != null;
     }
 
     public void write(String key, String value) {
@@ -66,8 +92,13 @@ public class Settings {
         this.storage.setInteger(key, value);
     }
 
+    /**
+     * Returns the address to start the spoof server on. If the user never set it, that's the one of the
+     * AWESOME_TLS_SPOOF_ADDRESS environment variable, which the Go server would otherwise use, or the default.
+     */
     public String getSpoofProxyAddress() {
-        return this.read(this.spoofProxyAddress, DEFAULT_SPOOF_PROXY_ADDRESS);
+        var environment = System.getenv("AWESOME_TLS_SPOOF_ADDRESS");
+        return this.read(this.spoofProxyAddress, environment == null || environment.isEmpty() ? DEFAULT_SPOOF_PROXY_ADDRESS : environment);
     }
 
     public void setSpoofProxyAddress(String spoofProxyAddress) {
@@ -130,19 +161,112 @@ public class Settings {
         this.write(this.externalProxyUrl, externalProxyUrl);
     }
 
+    /**
+     * How the configuration of each request is passed to the Go server.
+     * Set it to CONFIGURATION_MODE_HEADER to fall back to the configuration header.
+     */
+    public String getConfigurationMode() {
+        return this.read(this.configurationMode, CONFIGURATION_MODE_CHANNEL);
+    }
+
+    public void setConfigurationMode(String configurationMode) {
+        this.write(this.configurationMode, configurationMode);
+    }
+
+    public Boolean getRequireClientCertificate() {
+        return this.read(this.requireClientCertificate, DEFAULT_REQUIRE_CLIENT_CERTIFICATE);
+    }
+
+    public void setRequireClientCertificate(Boolean requireClientCertificate) {
+        this.write(this.requireClientCertificate, requireClientCertificate);
+    }
+
+    /**
+     * Restores the settings the Go server persisted the last time they were applied, if Burp's own copy is gone
+     * (e.g. after reinstalling Burp). Does nothing if Burp has settings already.
+     *
+     * @return an error message, or an empty string on success.
+     */
+    public String restorePersisted() {
+        if (this.isAnySet()) {
+            return "";
+        }
+
+        var json = ServerLibrary.INSTANCE.LoadPersistedSettings(this.projectId);
+        if (json.isEmpty()) {
+            return "";
+        }
+        if (!json.startsWith("{")) {
+            return json;
+        }
+
+        var persisted = new Gson().fromJson(json, ServerSettings.class);
+        // The command-line server may have persisted a pipe address, which Burp can't send requests to.
+        if (persisted.SpoofProxyAddress != null && !persisted.SpoofProxyAddress.isEmpty() && !persisted.SpoofProxyAddress.startsWith(PIPE_ADDRESS_PREFIX)) {
+            this.setSpoofProxyAddress(persisted.SpoofProxyAddress);
+        }
+        if (persisted.InterceptProxyAddress != null) {
+            this.setInterceptProxyAddress(persisted.InterceptProxyAddress);
+        }
+        if (persisted.BurpProxyAddress != null) {
+            this.setBurpProxyAddress(persisted.BurpProxyAddress);
+        }
+        if (persisted.Fingerprint != null) {
+            this.setFingerprint(persisted.Fingerprint);
+        }
+        if (persisted.HexClientHello != null) {
+            this.setHexClientHello(persisted.HexClientHello);
+        }
+        if (persisted.HttpTimeout != null && persisted.HttpTimeout != 0) {
+            this.setHttpTimeout(persisted.HttpTimeout);
+        }
+        if (persisted.UseInterceptedFingerprint != null) {
+            this.setUseInterceptedFingerprint(persisted.UseInterceptedFingerprint);
+        }
+        if (persisted.ExternalProxyUrl != null) {
+            this.setExternalProxyUrl(persisted.ExternalProxyUrl);
+        }
+        if (persisted.ConfigurationMode != null && !persisted.ConfigurationMode.isEmpty()) {
+            this.setConfigurationMode(persisted.ConfigurationMode);
+        }
+        if (persisted.RequireClientCertificate != null) {
+            this.setRequireClientCertificate(persisted.RequireClientCertificate);
+        }
+
+        return "";
+    }
+
     public String[] getFingerprints() {
         return ServerLibrary.INSTANCE.GetFingerprints().split("\n");
     }
 
-    public TransportConfig toTransportConfig() {
-        var transportConfig = new TransportConfig();
-        transportConfig.Fingerprint = this.getFingerprint();
-        transportConfig.HexClientHello = this.getHexClientHello();
-        transportConfig.HttpTimeout = this.getHttpTimeout();
-        transportConfig.UseInterceptedFingerprint = this.getUseInterceptedFingerprint();
-        transportConfig.BurpAddr = this.getBurpProxyAddress();
-        transportConfig.InterceptProxyAddr = this.getInterceptProxyAddress();
-        transportConfig.ExternalProxyUrl = this.getExternalProxyUrl();
-        return transportConfig;
+    /**
+     * Returns the settings to apply to the Go server. The ones the user never set are left out (null), so the Go server
+     * keeps the values of its AWESOME_TLS_* environment variables for them. The extension itself depends on the
+     * project, the configuration mode and whether a client certificate is required, so those are always included.
+     */
+    public ServerSettings toServerSettings() {
+        var serverSettings = new ServerSettings();
+        serverSettings.ProjectId = this.projectId;
+        serverSettings.SpoofProxyAddress = this.readSet(this.spoofProxyAddress, DEFAULT_SPOOF_PROXY_ADDRESS);
+        serverSettings.InterceptProxyAddress = this.readSet(this.interceptProxyAddress, DEFAULT_INTERCEPT_PROXY_ADDRESS);
+        serverSettings.BurpProxyAddress = this.readSet(this.burpProxyAddress, DEFAULT_BURP_PROXY_ADDRESS);
+        serverSettings.Fingerprint = this.readSet(this.fingerprint, DEFAULT_TLS_FINGERPRINT);
+        serverSettings.HexClientHello = this.readSet(this.hexClientHello, "");
+        serverSettings.HttpTimeout = this.storage.getInteger(this.httpTimeout);
+        serverSettings.UseInterceptedFingerprint = this.storage.getBoolean(this.useInterceptedFingerprint);
+        serverSettings.ExternalProxyUrl = this.readSet(this.externalProxyUrl, DEFAULT_EXTERNAL_PROXY_URL);
+        serverSettings.ConfigurationMode = this.getConfigurationMode();
+        serverSettings.RequireClientCertificate = this.getRequireClientCertificate();
+        return serverSettings;
+    }
+
+    /**
+     * Applies the settings to the Go server without restarting it.
+     *
+     * @return an error message, or an empty string on success.
+     */
+    public String apply() {
+        return ServerLibrary.INSTANCE.SaveSettings(new Gson().toJson(this.toServerSettings()));
     }
 }
@@ -0,0 +1,26 @@
+package burp;
+
+/**
+ * Describes why a single field was rejected by SaveSettings.
+ */
+public class SettingsError {
+    /**
+     * Name of the rejected field (see ServerSettings), or empty if the error isn't specific to one.
+     */
+    public String Field;
+
+    /**
+     * The rejected value.
+     */
+    public String Value;
+
+    /**
+     * Human-readable explanation.
+     */
+    public String Reason;
+
+    /**
+     * Machine-readable error code (e.g. `invalid_address`).
+     */
+    public String Code;
+}
@@ -1,11 +1,15 @@
 package burp;
 
+import com.google.gson.Gson;
 import com.intellij.uiDesigner.core.GridConstraints;
 import com.intellij.uiDesigner.core.GridLayoutManager;
 import com.intellij.uiDesigner.core.Spacer;
 
 import javax.swing.*;
+import javax.swing.border.Border;
 import java.awt.*;
+import java.util.HashMap;
+import java.util.Map;
 
 public class SettingsTab {
     private JComboBox comboBoxFingerprint;
@@ -29,6 +33,7 @@ public class SettingsTab {
     private JTextField textFieldHexClientHello;
     private JLabel labelExternalProxyUrl;
     private JTextField textFieldExternalProxyUrl;
+    private final Map<JComponent, Border> defaultBorders = new HashMap<>();
 
     public SettingsTab(Settings settings) {
         textFieldInterceptProxyAddress.setText(settings.getInterceptProxyAddress());
@@ -44,20 +49,86 @@ public class SettingsTab {
         comboBoxFingerprint.setSelectedItem(settings.getFingerprint());
 
         buttonSave.addActionListener(e -> {
-            settings.setSpoofProxyAddress(textFieldSpoofProxyAddress.getText());
+            var spoofProxyAddress = textFieldSpoofProxyAddress.getText();
+            if (spoofProxyAddress.startsWith(Settings.PIPE_ADDRESS_PREFIX)) {
+                // Burp only sends requests to TCP addresses, pipes are for the command-line server.
+                var settingsError = new SettingsError();
+                settingsError.Field = "SpoofProxyAddress";
+                settingsError.Value = spoofProxyAddress;
+                settingsError.Reason = "Burp can't send requests over a pipe, use a TCP address ([ip:]port)";
+                settingsError.Code = "invalid_address";
+                showSettingsErrors(new SettingsError[]{settingsError});
+                return;
+            }
+
+            settings.setSpoofProxyAddress(spoofProxyAddress);
             settings.setFingerprint((String) comboBoxFingerprint.getSelectedItem());
             settings.setHexClientHello(textFieldHexClientHello.getText());
             settings.setExternalProxyUrl(textFieldExternalProxyUrl.getText());
             settings.setHttpTimeout((int) spinnerHttpTimout.getValue());
+            applySettings(settings);
         });
 
         buttonSaveAdvanced.addActionListener(e -> {
             settings.setInterceptProxyAddress(textFieldInterceptProxyAddress.getText());
             settings.setBurpProxyAddress(textFieldBurpProxyAddress.getText());
             settings.setUseInterceptedFingerprint(checkBoxButtonUseInterceptedFingerprint.isSelected());
+            applySettings(settings);
         });
     }
 
+    private Map<String, JComponent> fields() {
+        return Map.of(
+                "SpoofProxyAddress", textFieldSpoofProxyAddress,
+                "InterceptProxyAddress", textFieldInterceptProxyAddress,
+                "BurpProxyAddress", textFieldBurpProxyAddress,
+                "Fingerprint", comboBoxFingerprint,
+                "HexClientHello", textFieldHexClientHello,
+                "HttpTimeout", spinnerHttpTimout,
+                "ExternalProxyUrl", textFieldExternalProxyUrl
+        );
+    }
+
+    private void resetBorders() {
+        for (var field : fields().values()) {
+            field.setBorder(defaultBorders.computeIfAbsent(field, JComponent::getBorder));
+        }
+    }
+
+    private void applySettings(Settings settings) {
+        resetBorders();
+
+        var err = settings.apply();
+        if (err.isEmpty()) {
+            return;
+        }
+
+        if (!err.startsWith("[")) {
+            JOptionPane.showMessageDialog(panelMain, err, "Awesome TLS", JOptionPane.ERROR_MESSAGE);
+            return;
+        }
+
+        showSettingsErrors(new Gson().fromJson(err, SettingsError[].class));
+    }
+
+    /**
+     * Outlines the fields of settingsErrors in red and shows why they were rejected.
+     */
+    private void showSettingsErrors(SettingsError[] settingsErrors) {
+        resetBorders();
+
+        var fields = fields();
+        var message = new StringBuilder("Settings were not applied:\n");
+        for (var settingsError : settingsErrors) {
+            var field = fields.get(settingsError.Field);
+            if (field != null) {
+                field.setBorder(BorderFactory.createLineBorder(Color.RED));
+            }
+            message.append("\n").append(settingsError.Field.isEmpty() ? "" : settingsError.Field + ": ").append(settingsError.Reason);
+        }
+        JOptionPane.showMessageDialog(panelMain, message.toString(), "Awesome TLS", JOptionPane.ERROR_MESSAGE);
+    }
+
     public JPanel getUI() {
         return this.panelMain;
     }
@@ -137,7 +208,7 @@ public class SettingsTab {
         labelInterceptProxyAddress.setText("Intercept proxy address:");
         panelAdvanced.add(labelInterceptProxyAddress, new GridConstraints(1, 0, 1, 1, GridConstraints.ANCHOR_WEST, GridConstraints.FILL_NONE, GridConstraints.SIZEPOLICY_FIXED, GridConstraints.SIZEPOLICY_FIXED, null, null, null, 0, false));
         textFieldInterceptProxyAddress = new JTextField();
-        textFieldInterceptProxyAddress.setToolTipText("Local address the intercept proxy server should listen on. Use it to configure proxy on your client. Requires extension reload.");
+        textFieldInterceptProxyAddress.setToolTipText("Local address(es) the intercept proxy server should listen on, separated by commas. Use it to configure proxy on your client.");
         panelAdvanced.add(textFieldInterceptProxyAddress, new GridConstraints(2, 0, 1, 1, GridConstraints.ANCHOR_WEST, GridConstraints.FILL_HORIZONTAL, GridConstraints.SIZEPOLICY_WANT_GROW, GridConstraints.SIZEPOLICY_FIXED, null, null, null, 0, false));
         labelBurpProxyAddress = new JLabel();
         labelBurpProxyAddress.setText("Burp proxy address:");
@@ -0,0 +1,139 @@
+package burp;
+
+import burp.api.montoya.MontoyaApi;
+import com.google.gson.JsonElement;
+import com.google.gson.JsonObject;
+import com.google.gson.JsonParser;
+
+import java.net.URLEncoder;
+import java.nio.charset.StandardCharsets;
+import java.util.regex.Pattern;
+
+/**
+ * Selects the upstream proxy Burp would have used for a destination, from its "Upstream proxy servers" and "SOCKS proxy"
+ * settings, so the Go server can send the request through it.
+ */
+public class UpstreamProxyRules {
+    private static final long REFRESH_INTERVAL_MILLIS = 5000;
+
+    private final MontoyaApi api;
+
+    private JsonObject upstreamProxy;
+    private JsonObject socksProxy;
+    private long refreshedAt;
+
+    public UpstreamProxyRules(MontoyaApi api) {
+        this.api = api;
+    }
+
+    /**
+     * Returns the URL of the upstream proxy for host, including its credentials.
+     *
+     * @return the proxy URL, an empty string if Burp would connect directly, or null if no rule applies.
+     */
+    public synchronized String proxyFor(String host) {
+        this.refresh();
+
+        if (this.upstreamProxy != null && this.upstreamProxy.has("servers")) {
+            for (var element : this.upstreamProxy.getAsJsonArray("servers")) {
+                var server = element.getAsJsonObject();
+                if (!getBoolean(server, "enabled") || !matches(getString(server, "destination_host"), host)) {
+                    continue;
+                }
+
+                var proxyHost = getString(server, "proxy_host");
+                if (proxyHost.isEmpty()) {
+                    return "";
+                }
+
+                var authenticationType = getString(server, "authentication_type");
+                if (!authenticationType.isEmpty() && !authenticationType.equals("none") && !authenticationType.equals("basic")) {
+                    this.api.logging().logToError("Upstream proxy " + proxyHost + " uses unsupported authentication type " + authenticationType + ", ignoring it");
+                    continue;
+                }
+
+                var credentials = authenticationType.equals("basic") ? userInfo(getString(server, "username"), getString(server, "password")) : "";
+                return "http://" + credentials + proxyHost + ":" + server.get("proxy_port").getAsInt();
+            }
+        }
+
+        if (this.socksProxy != null && getBoolean(this.socksProxy, "use_proxy")) {
+            var scheme = getBoolean(this.socksProxy, "dns_over_socks") ? "socks5h" : "socks5";
+            var credentials = getString(this.socksProxy, "username").isEmpty() ? "" : userInfo(getString(this.socksProxy, "username"), getString(this.socksProxy, "password"));
+            return scheme + "://" + credentials + getString(this.socksProxy, "host") + ":" + this.socksProxy.get("port").getAsInt();
+        }
+
+        return null;
+    }
+
+    private void refresh() {
+        var now = System.currentTimeMillis();
+        if (now - this.refreshedAt < REFRESH_INTERVAL_MILLIS) {
+            return;
+        }
+        this.refreshedAt = now;
+
+        try {
+            var project = connections(this.api.burpSuite().exportProjectOptionsAsJson("project_options.connections"), "project_options");
+            var user = connections(this.api.burpSuite().exportUserOptionsAsJson("user_options.connections"), "user_options");
+
+            this.upstreamProxy = select(project, user, "upstream_proxy");
+            this.socksProxy = select(project, user, "socks_proxy");
+        } catch (Exception e) {
+            this.api.logging().logToError("Failed to read Burp's upstream proxy settings: " + e);
+        }
+    }
+
+    private static JsonObject connections(String json, String root) {
+        var options = JsonParser.parseString(json).getAsJsonObject();
+        if (!options.has(root)) {
+            return null;
+        }
+        var connections = options.getAsJsonObject(root).get("connections");
+        return connections == null ? null : connections.getAsJsonObject();
+    }
+
+    /**
+     * Returns the project's setting, unless it defers to the user's setting.
+     */
+    private static JsonObject select(JsonObject project, JsonObject user, String name) {
+        var projectSetting = project != null && project.has(name) ? project.getAsJsonObject(name) : null;
+        if (projectSetting != null && !getBoolean(projectSetting, "use_user_options")) {
+            return projectSetting;
+        }
+        return user != null && user.has(name) ? user.getAsJsonObject(name) : projectSetting;
+    }
+
+    /**
+     * Matches host against a destination host pattern, which may contain the wildcards * and ?.
+     */
+    private static boolean matches(String pattern, String host) {
+        var regex = new StringBuilder();
+        for (var c : pattern.toCharArray()) {
+            switch (c) {
+                case '*' -> regex.append(".*");
+                case '?' -> regex.append('.');
+                default -> regex.append(Pattern.quote(String.valueOf(c)));
+            }
+        }
+        return Pattern.compile(regex.toString(), Pattern.CASE_INSENSITIVE).matcher(host).matches();
+    }
+
+    private static String userInfo(String username, String password) {
+        return encode(username) + ":" + encode(password) + "@";
+    }
+
+    private static String encode(String value) {
+        return URLEncoder.encode(value, StandardCharsets.UTF_8).replace("+", "%20");
+    }
+
+    private static String getString(JsonObject object, String name) {
+        JsonElement element = object.get(name);
+        return element == null || element.isJsonNull() ? "" : element.getAsString();
+    }
+
+    private static boolean getBoolean(JsonObject object, String name) {
+        JsonElement element = object.get(name);
+        return element != null && !element.isJsonNull() && element.getAsBoolean();
+    }
+}